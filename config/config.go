@@ -1,13 +1,17 @@
 package config
 
 import (
+	"crypto/sha256"
 	"fmt"
+	"io"
 	"log"
 	"math"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/joho/godotenv"
+	"golang.org/x/crypto/hkdf"
 )
 
 func LoadConfig(path string) IConfig {
@@ -55,6 +59,82 @@ func LoadConfig(path string) IConfig {
 			}
 			return f
 		}(),
+		fileOrphanAge: func() time.Duration {
+			if envMap["APP_FILE_ORPHAN_AGE"] == "" {
+				return 24 * time.Hour
+			}
+			t, err := strconv.Atoi(envMap["APP_FILE_ORPHAN_AGE"])
+			if err != nil {
+				log.Fatalf("load file orphan age failed: %v", err)
+			}
+			return time.Duration(int64(t) * int64(math.Pow10(9)))
+		}(),
+		fileSweepInterval: func() time.Duration {
+			if envMap["APP_FILE_SWEEP_INTERVAL"] == "" {
+				return time.Hour
+			}
+			t, err := strconv.Atoi(envMap["APP_FILE_SWEEP_INTERVAL"])
+			if err != nil {
+				log.Fatalf("load file sweep interval failed: %v", err)
+			}
+			return time.Duration(int64(t) * int64(math.Pow10(9)))
+		}(),
+		fileSignKey: func() string {
+			if envMap["APP_FILE_SIGN_KEY"] != "" {
+				return envMap["APP_FILE_SIGN_KEY"]
+			}
+			// Existing env files keep working with a key derived from the jwt
+			// secret, the session key itself never signs a file url
+			if envMap["JWT_SECRET_KEY"] == "" {
+				log.Fatalf("load file sign key failed: APP_FILE_SIGN_KEY is required")
+			}
+			key := make([]byte, 32)
+			if _, err := io.ReadFull(hkdf.New(sha256.New, []byte(envMap["JWT_SECRET_KEY"]), nil, []byte("file-url")), key); err != nil {
+				log.Fatalf("derive file sign key failed: %v", err)
+			}
+			return string(key)
+		}(),
+		fileSignExpires: func() time.Duration {
+			if envMap["APP_FILE_SIGN_EXPIRES"] == "" {
+				return 15 * time.Minute
+			}
+			t, err := strconv.Atoi(envMap["APP_FILE_SIGN_EXPIRES"])
+			if err != nil {
+				log.Fatalf("load file sign expires failed: %v", err)
+			}
+			return time.Duration(int64(t) * int64(math.Pow10(9)))
+		}(),
+		uploadPartSize: func() int {
+			if envMap["APP_UPLOAD_PART_SIZE"] == "" {
+				return 5 * 1024 * 1024
+			}
+			b, err := strconv.Atoi(envMap["APP_UPLOAD_PART_SIZE"])
+			if err != nil {
+				log.Fatalf("load upload part size failed: %v", err)
+			}
+			return b
+		}(),
+		uploadMaxSize: func() int64 {
+			if envMap["APP_UPLOAD_MAX_SIZE"] == "" {
+				return 2 * 1024 * 1024 * 1024
+			}
+			b, err := strconv.ParseInt(envMap["APP_UPLOAD_MAX_SIZE"], 10, 64)
+			if err != nil {
+				log.Fatalf("load upload max size failed: %v", err)
+			}
+			return b
+		}(),
+		guestTokenExpires: envDuration(envMap, "APP_GUEST_TOKEN_EXPIRES", 30*24*time.Hour),
+		fileWorkers: func() int {
+			if envMap["APP_FILE_WORKERS"] == "" {
+				return 5
+			}
+			w, err := strconv.Atoi(envMap["APP_FILE_WORKERS"])
+			if err != nil {
+				log.Fatalf("load file workers failed: %v", err)
+			}
+			return w
+		}(),
 	}
 
 	dbConfig := &db{
@@ -98,12 +178,141 @@ func LoadConfig(path string) IConfig {
 			}
 			return t
 		}(),
+		signingMethod: func() string {
+			if envMap["JWT_SIGNING_METHOD"] == "" {
+				return "HS256"
+			}
+			return envMap["JWT_SIGNING_METHOD"]
+		}(),
+		keysDir: func() string {
+			if envMap["JWT_KEYS_DIR"] == "" {
+				return "./assets/keys"
+			}
+			return envMap["JWT_KEYS_DIR"]
+		}(),
+		keyRotation:          envDuration(envMap, "JWT_KEY_ROTATION", 30*24*time.Hour),
+		impersonationExpires: envDuration(envMap, "JWT_IMPERSONATION_EXPIRES", 15*time.Minute),
+	}
+	// Retired keys must outlive every token they signed
+	jwtConfig.keyGrace = envDuration(envMap, "JWT_KEY_GRACE", time.Duration(jwtConfig.refreshExpiresAt)*time.Second)
+
+	mailConfig := &mail{
+		driver: func() string {
+			if envMap["MAIL_DRIVER"] == "" {
+				return "log"
+			}
+			return envMap["MAIL_DRIVER"]
+		}(),
+		from:     envMap["MAIL_FROM"],
+		filePath: envMap["MAIL_FILE_PATH"],
+		smtpHost: envMap["MAIL_SMTP_HOST"],
+		smtpPort: func() int {
+			if envMap["MAIL_SMTP_PORT"] == "" {
+				return 587
+			}
+			p, err := strconv.Atoi(envMap["MAIL_SMTP_PORT"])
+			if err != nil {
+				log.Fatalf("load mail smtp port failed: %v", err)
+			}
+			return p
+		}(),
+		smtpUsername: envMap["MAIL_SMTP_USERNAME"],
+		smtpPassword: envMap["MAIL_SMTP_PASSWORD"],
+	}
+
+	authConfig := &auth{
+		resetTokenExpires: func() time.Duration {
+			if envMap["AUTH_RESET_TOKEN_EXPIRES"] == "" {
+				return 30 * time.Minute
+			}
+			t, err := strconv.Atoi(envMap["AUTH_RESET_TOKEN_EXPIRES"])
+			if err != nil {
+				log.Fatalf("load reset token expires failed: %v", err)
+			}
+			return time.Duration(int64(t) * int64(math.Pow10(9)))
+		}(),
+		verifyTokenExpires: func() time.Duration {
+			if envMap["AUTH_VERIFY_TOKEN_EXPIRES"] == "" {
+				return 24 * time.Hour
+			}
+			t, err := strconv.Atoi(envMap["AUTH_VERIFY_TOKEN_EXPIRES"])
+			if err != nil {
+				log.Fatalf("load verify token expires failed: %v", err)
+			}
+			return time.Duration(int64(t) * int64(math.Pow10(9)))
+		}(),
+		passwordMinLength: func() int {
+			if envMap["AUTH_PASSWORD_MIN_LENGTH"] == "" {
+				return 8
+			}
+			l, err := strconv.Atoi(envMap["AUTH_PASSWORD_MIN_LENGTH"])
+			if err != nil {
+				log.Fatalf("load password min length failed: %v", err)
+			}
+			return l
+		}(),
+		passwordRequireUpper:  envBool(envMap, "AUTH_PASSWORD_REQUIRE_UPPER", true),
+		passwordRequireLower:  envBool(envMap, "AUTH_PASSWORD_REQUIRE_LOWER", true),
+		passwordRequireDigit:  envBool(envMap, "AUTH_PASSWORD_REQUIRE_DIGIT", true),
+		passwordRequireSymbol: envBool(envMap, "AUTH_PASSWORD_REQUIRE_SYMBOL", false),
+		passwordBreachedList:  envMap["AUTH_PASSWORD_BREACHED_LIST"],
+		loginMaxAttempts:      envInt(envMap, "AUTH_LOGIN_MAX_ATTEMPTS", 5),
+		loginIpMaxAttempts:    envInt(envMap, "AUTH_LOGIN_IP_MAX_ATTEMPTS", 20),
+		loginWindow:           envDuration(envMap, "AUTH_LOGIN_WINDOW", 15*time.Minute),
+		loginDelay:            envDuration(envMap, "AUTH_LOGIN_DELAY", time.Second),
+		lockoutDuration:       envDuration(envMap, "AUTH_LOCKOUT_DURATION", 15*time.Minute),
+		totpRequiredAdmin:     envBool(envMap, "AUTH_TOTP_REQUIRED_ADMIN", false),
+		legacyApiKeys:         envBool(envMap, "AUTH_LEGACY_API_KEYS", false),
+		inviteTokenExpires:    envDuration(envMap, "AUTH_INVITE_TOKEN_EXPIRES", 72*time.Hour),
+		deleteTokenExpires:    envDuration(envMap, "AUTH_DELETE_TOKEN_EXPIRES", time.Hour),
+		totpIssuer: func() string {
+			if envMap["AUTH_TOTP_ISSUER"] == "" {
+				return envMap["APP_NAME"]
+			}
+			return envMap["AUTH_TOTP_ISSUER"]
+		}(),
+	}
+
+	cacheConfig := &cache{
+		tokenTTL: envDuration(envMap, "CACHE_TOKEN_TTL", 30*time.Second),
+		roleTTL:  envDuration(envMap, "CACHE_ROLE_TTL", 5*time.Minute),
+	}
+
+	oidcConfig := &oidc{
+		stateExpires: envDuration(envMap, "OIDC_STATE_EXPIRES", 10*time.Minute),
+		providers:    make(map[string]*oidcProvider),
+	}
+	for _, name := range strings.Split(envMap["OIDC_PROVIDERS"], ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		prefix := "OIDC_" + strings.ToUpper(name) + "_"
+		provider := &oidcProvider{
+			name:         name,
+			issuer:       strings.TrimSuffix(envMap[prefix+"ISSUER"], "/"),
+			clientId:     envMap[prefix+"CLIENT_ID"],
+			clientSecret: envMap[prefix+"CLIENT_SECRET"],
+			redirectUrl:  envMap[prefix+"REDIRECT_URL"],
+			scopes:       strings.Fields(envMap[prefix+"SCOPES"]),
+		}
+		if provider.issuer == "" || provider.clientId == "" || provider.redirectUrl == "" {
+			log.Fatalf("load oidc provider %s failed: issuer, client id and redirect url are required", name)
+		}
+		if len(provider.scopes) == 0 {
+			provider.scopes = []string{"openid", "email", "profile"}
+		}
+		oidcConfig.providers[name] = provider
 	}
 
 	return &config{
-		app: appConfig,
-		db:  dbConfig,
-		jwt: jwtConfig,
+		app:   appConfig,
+		db:    dbConfig,
+		jwt:   jwtConfig,
+		mail:  mailConfig,
+		auth:  authConfig,
+		cache: cacheConfig,
+		oidc:  oidcConfig,
 	}
 }
 
@@ -111,12 +320,20 @@ type IConfig interface {
 	App() IAppConfig
 	Db() IDbConfig
 	Jwt() IJwtConfig
+	Mail() IMailConfig
+	Auth() IAuthConfig
+	Cache() ICacheConfig
+	Oidc() IOidcConfig
 }
 
 type config struct {
-	app *app
-	db  *db
-	jwt *jwt
+	app   *app
+	db    *db
+	jwt   *jwt
+	mail  *mail
+	auth  *auth
+	cache *cache
+	oidc  *oidc
 }
 
 type IAppConfig interface {
@@ -127,6 +344,14 @@ type IAppConfig interface {
 	WriteTimeout() time.Duration
 	BodyLimit() int
 	FileLimit() int
+	FileOrphanAge() time.Duration
+	FileSweepInterval() time.Duration
+	FileSignKey() []byte
+	FileSignExpires() time.Duration
+	UploadPartSize() int
+	UploadMaxSize() int64
+	FileWorkers() int
+	GuestTokenExpires() time.Duration
 	Host() string
 	Port() int
 }
@@ -141,21 +366,38 @@ type app struct {
 	bodyLimit    int // bytes
 	fileLimit    int // bytes
 	gcpBucket    string
+
+	fileOrphanAge     time.Duration
+	fileSweepInterval time.Duration
+	fileSignKey       string
+	fileSignExpires   time.Duration
+	uploadPartSize    int   // bytes
+	uploadMaxSize     int64 // bytes
+	fileWorkers       int
+	guestTokenExpires time.Duration
 }
 
 func (c *config) App() IAppConfig {
 	return c.app
 }
 
-func (a *app) Url() string                 { return fmt.Sprintf("%s:%d", a.host, a.port) }
-func (a *app) Name() string                { return a.name }
-func (a *app) Version() string             { return a.version }
-func (a *app) ReadTimeout() time.Duration  { return a.readTimeout }
-func (a *app) WriteTimeout() time.Duration { return a.writeTimeout }
-func (a *app) BodyLimit() int              { return a.bodyLimit }
-func (a *app) FileLimit() int              { return a.fileLimit }
-func (a *app) Host() string                { return a.host }
-func (a *app) Port() int                   { return a.port }
+func (a *app) Url() string                      { return fmt.Sprintf("%s:%d", a.host, a.port) }
+func (a *app) Name() string                     { return a.name }
+func (a *app) Version() string                  { return a.version }
+func (a *app) ReadTimeout() time.Duration       { return a.readTimeout }
+func (a *app) WriteTimeout() time.Duration      { return a.writeTimeout }
+func (a *app) BodyLimit() int                   { return a.bodyLimit }
+func (a *app) FileLimit() int                   { return a.fileLimit }
+func (a *app) FileOrphanAge() time.Duration     { return a.fileOrphanAge }
+func (a *app) FileSweepInterval() time.Duration { return a.fileSweepInterval }
+func (a *app) FileSignKey() []byte              { return []byte(a.fileSignKey) }
+func (a *app) FileSignExpires() time.Duration   { return a.fileSignExpires }
+func (a *app) UploadPartSize() int              { return a.uploadPartSize }
+func (a *app) UploadMaxSize() int64             { return a.uploadMaxSize }
+func (a *app) FileWorkers() int                 { return a.fileWorkers }
+func (a *app) GuestTokenExpires() time.Duration { return a.guestTokenExpires }
+func (a *app) Host() string                     { return a.host }
+func (a *app) Port() int                        { return a.port }
 
 type IDbConfig interface {
 	Url() string
@@ -199,6 +441,11 @@ type IJwtConfig interface {
 	RefreshExpiresAt() int
 	SetJwtAccessExpires(t int)
 	SetJwtRefreshExpires(t int)
+	SigningMethod() string
+	KeysDir() string
+	KeyRotation() time.Duration
+	KeyGrace() time.Duration
+	ImpersonationExpires() time.Duration
 }
 
 type jwt struct {
@@ -207,16 +454,230 @@ type jwt struct {
 	apiKey           string
 	accessExpiresAt  int // sec
 	refreshExpiresAt int // sec
+	signingMethod    string
+	keysDir          string
+	keyRotation      time.Duration
+	keyGrace         time.Duration
+	// Support staff acting as a user get a short token that is never refreshed
+	impersonationExpires time.Duration
 }
 
 func (c *config) Jwt() IJwtConfig {
 	return c.jwt
 }
 
-func (j *jwt) SecretKey() []byte          { return []byte(j.secretKey) }
-func (j *jwt) AdminKey() []byte           { return []byte(j.adminKey) }
-func (j *jwt) ApiKey() []byte             { return []byte(j.apiKey) }
-func (j *jwt) AccessExpiresAt() int       { return j.accessExpiresAt }
-func (j *jwt) RefreshExpiresAt() int      { return j.refreshExpiresAt }
-func (j *jwt) SetJwtAccessExpires(t int)  { j.accessExpiresAt = t }
-func (j *jwt) SetJwtRefreshExpires(t int) { j.refreshExpiresAt = t }
+func (j *jwt) SecretKey() []byte                   { return []byte(j.secretKey) }
+func (j *jwt) AdminKey() []byte                    { return []byte(j.adminKey) }
+func (j *jwt) ApiKey() []byte                      { return []byte(j.apiKey) }
+func (j *jwt) AccessExpiresAt() int                { return j.accessExpiresAt }
+func (j *jwt) RefreshExpiresAt() int               { return j.refreshExpiresAt }
+func (j *jwt) SetJwtAccessExpires(t int)           { j.accessExpiresAt = t }
+func (j *jwt) SetJwtRefreshExpires(t int)          { j.refreshExpiresAt = t }
+func (j *jwt) SigningMethod() string               { return j.signingMethod }
+func (j *jwt) KeysDir() string                     { return j.keysDir }
+func (j *jwt) KeyRotation() time.Duration          { return j.keyRotation }
+func (j *jwt) KeyGrace() time.Duration             { return j.keyGrace }
+func (j *jwt) ImpersonationExpires() time.Duration { return j.impersonationExpires }
+
+type IMailConfig interface {
+	Driver() string
+	From() string
+	FilePath() string
+	SmtpHost() string
+	SmtpPort() int
+	SmtpUsername() string
+	SmtpPassword() string
+}
+
+type mail struct {
+	driver       string // log | file | smtp
+	from         string
+	filePath     string
+	smtpHost     string
+	smtpPort     int
+	smtpUsername string
+	smtpPassword string
+}
+
+func (c *config) Mail() IMailConfig {
+	return c.mail
+}
+
+func (m *mail) Driver() string       { return m.driver }
+func (m *mail) From() string         { return m.from }
+func (m *mail) FilePath() string     { return m.filePath }
+func (m *mail) SmtpHost() string     { return m.smtpHost }
+func (m *mail) SmtpPort() int        { return m.smtpPort }
+func (m *mail) SmtpUsername() string { return m.smtpUsername }
+func (m *mail) SmtpPassword() string { return m.smtpPassword }
+
+type IAuthConfig interface {
+	ResetTokenExpires() time.Duration
+	VerifyTokenExpires() time.Duration
+	PasswordMinLength() int
+	PasswordRequireUpper() bool
+	PasswordRequireLower() bool
+	PasswordRequireDigit() bool
+	PasswordRequireSymbol() bool
+	PasswordBreachedList() string
+	LoginMaxAttempts() int
+	LoginIpMaxAttempts() int
+	LoginWindow() time.Duration
+	LoginDelay() time.Duration
+	LockoutDuration() time.Duration
+	TotpRequiredAdmin() bool
+	TotpIssuer() string
+	LegacyApiKeys() bool
+	InviteTokenExpires() time.Duration
+	DeleteTokenExpires() time.Duration
+}
+
+type auth struct {
+	resetTokenExpires     time.Duration
+	verifyTokenExpires    time.Duration
+	passwordMinLength     int
+	passwordRequireUpper  bool
+	passwordRequireLower  bool
+	passwordRequireDigit  bool
+	passwordRequireSymbol bool
+	passwordBreachedList  string
+	loginMaxAttempts      int
+	loginIpMaxAttempts    int
+	loginWindow           time.Duration
+	loginDelay            time.Duration
+	lockoutDuration       time.Duration
+	totpRequiredAdmin     bool
+	totpIssuer            string
+	legacyApiKeys         bool
+	inviteTokenExpires    time.Duration
+	deleteTokenExpires    time.Duration
+}
+
+func (c *config) Auth() IAuthConfig {
+	return c.auth
+}
+
+func (a *auth) ResetTokenExpires() time.Duration  { return a.resetTokenExpires }
+func (a *auth) VerifyTokenExpires() time.Duration { return a.verifyTokenExpires }
+func (a *auth) PasswordMinLength() int            { return a.passwordMinLength }
+func (a *auth) PasswordRequireUpper() bool        { return a.passwordRequireUpper }
+func (a *auth) PasswordRequireLower() bool        { return a.passwordRequireLower }
+func (a *auth) PasswordRequireDigit() bool        { return a.passwordRequireDigit }
+func (a *auth) PasswordRequireSymbol() bool       { return a.passwordRequireSymbol }
+func (a *auth) PasswordBreachedList() string      { return a.passwordBreachedList }
+func (a *auth) LoginMaxAttempts() int             { return a.loginMaxAttempts }
+func (a *auth) LoginIpMaxAttempts() int           { return a.loginIpMaxAttempts }
+func (a *auth) LoginWindow() time.Duration        { return a.loginWindow }
+func (a *auth) LoginDelay() time.Duration         { return a.loginDelay }
+func (a *auth) LockoutDuration() time.Duration    { return a.lockoutDuration }
+func (a *auth) TotpRequiredAdmin() bool           { return a.totpRequiredAdmin }
+func (a *auth) TotpIssuer() string                { return a.totpIssuer }
+func (a *auth) LegacyApiKeys() bool               { return a.legacyApiKeys }
+func (a *auth) InviteTokenExpires() time.Duration { return a.inviteTokenExpires }
+func (a *auth) DeleteTokenExpires() time.Duration { return a.deleteTokenExpires }
+
+type ICacheConfig interface {
+	TokenTTL() time.Duration
+	RoleTTL() time.Duration
+}
+
+// A ttl of 0 turns the cache off.
+type cache struct {
+	tokenTTL time.Duration
+	roleTTL  time.Duration
+}
+
+func (c *config) Cache() ICacheConfig {
+	return c.cache
+}
+
+func (c *cache) TokenTTL() time.Duration { return c.tokenTTL }
+func (c *cache) RoleTTL() time.Duration  { return c.roleTTL }
+
+type IOidcConfig interface {
+	StateExpires() time.Duration
+	Provider(name string) (IOidcProviderConfig, bool)
+}
+
+type IOidcProviderConfig interface {
+	Name() string
+	Issuer() string
+	ClientId() string
+	ClientSecret() string
+	RedirectUrl() string
+	Scopes() []string
+}
+
+// oidc holds the providers listed in OIDC_PROVIDERS, each one is configured
+// with OIDC_<NAME>_ISSUER, _CLIENT_ID, _CLIENT_SECRET, _REDIRECT_URL and
+// _SCOPES.
+type oidc struct {
+	stateExpires time.Duration
+	providers    map[string]*oidcProvider
+}
+
+type oidcProvider struct {
+	name         string
+	issuer       string
+	clientId     string
+	clientSecret string
+	redirectUrl  string
+	scopes       []string
+}
+
+func (c *config) Oidc() IOidcConfig {
+	return c.oidc
+}
+
+func (o *oidc) StateExpires() time.Duration { return o.stateExpires }
+func (o *oidc) Provider(name string) (IOidcProviderConfig, bool) {
+	p, ok := o.providers[name]
+	if !ok {
+		return nil, false
+	}
+	return p, true
+}
+
+func (p *oidcProvider) Name() string         { return p.name }
+func (p *oidcProvider) Issuer() string       { return p.issuer }
+func (p *oidcProvider) ClientId() string     { return p.clientId }
+func (p *oidcProvider) ClientSecret() string { return p.clientSecret }
+func (p *oidcProvider) RedirectUrl() string  { return p.redirectUrl }
+func (p *oidcProvider) Scopes() []string     { return p.scopes }
+
+// envBool reads an optional boolean, an empty value falls back to def.
+func envBool(envMap map[string]string, key string, def bool) bool {
+	if envMap[key] == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(envMap[key])
+	if err != nil {
+		log.Fatalf("load %s failed: %v", strings.ToLower(key), err)
+	}
+	return b
+}
+
+// envInt reads an optional integer, an empty value falls back to def.
+func envInt(envMap map[string]string, key string, def int) int {
+	if envMap[key] == "" {
+		return def
+	}
+	i, err := strconv.Atoi(envMap[key])
+	if err != nil {
+		log.Fatalf("load %s failed: %v", strings.ToLower(key), err)
+	}
+	return i
+}
+
+// envDuration reads an optional duration in seconds, an empty value falls
+// back to def.
+func envDuration(envMap map[string]string, key string, def time.Duration) time.Duration {
+	if envMap[key] == "" {
+		return def
+	}
+	t, err := strconv.Atoi(envMap[key])
+	if err != nil {
+		log.Fatalf("load %s failed: %v", strings.ToLower(key), err)
+	}
+	return time.Duration(int64(t) * int64(math.Pow10(9)))
+}
@@ -0,0 +1,89 @@
+package addresses
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+type Address struct {
+	Id         string `db:"id" json:"id"`
+	UserId     string `db:"user_id" json:"user_id"`
+	Name       string `db:"name" json:"name"`
+	Phone      string `db:"phone" json:"phone"`
+	Line1      string `db:"line1" json:"line1"`
+	Line2      string `db:"line2" json:"line2"`
+	District   string `db:"district" json:"district"`
+	Province   string `db:"province" json:"province"`
+	PostalCode string `db:"postal_code" json:"postal_code"`
+	Country    string `db:"country" json:"country"`
+	IsDefault  bool   `db:"is_default" json:"is_default"`
+	CreatedAt  string `db:"created_at" json:"created_at"`
+	UpdatedAt  string `db:"updated_at" json:"updated_at"`
+}
+
+// AddressReq is used for both insert and update, on update only the fields
+// that are given change.
+type AddressReq struct {
+	Id         string `json:"-"`
+	UserId     string `json:"-"`
+	Name       string `json:"name" form:"name"`
+	Phone      string `json:"phone" form:"phone"`
+	Line1      string `json:"line1" form:"line1"`
+	Line2      string `json:"line2" form:"line2"`
+	District   string `json:"district" form:"district"`
+	Province   string `json:"province" form:"province"`
+	PostalCode string `json:"postal_code" form:"postal_code"`
+	Country    string `json:"country" form:"country"`
+	IsDefault  *bool  `json:"is_default" form:"is_default"`
+}
+
+func (obj *AddressReq) Trim() {
+	obj.Name = strings.TrimSpace(obj.Name)
+	obj.Phone = strings.TrimSpace(obj.Phone)
+	obj.Line1 = strings.TrimSpace(obj.Line1)
+	obj.Line2 = strings.TrimSpace(obj.Line2)
+	obj.District = strings.TrimSpace(obj.District)
+	obj.Province = strings.TrimSpace(obj.Province)
+	obj.PostalCode = strings.TrimSpace(obj.PostalCode)
+	obj.Country = strings.ToUpper(strings.TrimSpace(obj.Country))
+}
+
+var (
+	phonePattern      = regexp.MustCompile(`^\+?[0-9 -]{6,20}$`)
+	postalCodePattern = regexp.MustCompile(`^[A-Za-z0-9 -]{3,10}$`)
+	countryPattern    = regexp.MustCompile(`^[A-Z]{2}$`)
+)
+
+// Validate checks the fields that are set, required says every field but
+// line2 must be set as well.
+func (obj *AddressReq) Validate(required bool) error {
+	if required {
+		switch {
+		case obj.Name == "":
+			return fmt.Errorf("name is required")
+		case obj.Phone == "":
+			return fmt.Errorf("phone is required")
+		case obj.Line1 == "":
+			return fmt.Errorf("line1 is required")
+		case obj.District == "":
+			return fmt.Errorf("district is required")
+		case obj.Province == "":
+			return fmt.Errorf("province is required")
+		case obj.PostalCode == "":
+			return fmt.Errorf("postal code is required")
+		case obj.Country == "":
+			return fmt.Errorf("country is required")
+		}
+	}
+	if obj.Phone != "" && !phonePattern.MatchString(obj.Phone) {
+		return fmt.Errorf("phone pattern is invalid")
+	}
+	if obj.PostalCode != "" && !postalCodePattern.MatchString(obj.PostalCode) {
+		return fmt.Errorf("postal code pattern is invalid")
+	}
+	if obj.Country != "" && !countryPattern.MatchString(obj.Country) {
+		return fmt.Errorf("country must be an ISO 3166-1 alpha-2 code")
+	}
+	return nil
+}
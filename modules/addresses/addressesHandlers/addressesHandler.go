@@ -0,0 +1,199 @@
+package addressesHandlers
+
+import (
+	"strings"
+
+	"github.com/codepnw/ecommerce/config"
+	"github.com/codepnw/ecommerce/modules/addresses"
+	"github.com/codepnw/ecommerce/modules/addresses/addressesUsecases"
+	"github.com/codepnw/ecommerce/modules/entities"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+type addressesHandlersErrCode string
+
+const (
+	findAddressesErr  addressesHandlersErrCode = "addresses-001"
+	findOneAddressErr addressesHandlersErrCode = "addresses-002"
+	insertAddressErr  addressesHandlersErrCode = "addresses-003"
+	updateAddressErr  addressesHandlersErrCode = "addresses-004"
+	deleteAddressErr  addressesHandlersErrCode = "addresses-005"
+)
+
+type IAddressesHandler interface {
+	FindAddresses(c *fiber.Ctx) error
+	FindOneAddress(c *fiber.Ctx) error
+	InsertAddress(c *fiber.Ctx) error
+	UpdateAddress(c *fiber.Ctx) error
+	DeleteAddress(c *fiber.Ctx) error
+}
+
+type addressesHandler struct {
+	cfg     config.IConfig
+	usecase addressesUsecases.IAddressesUsecase
+}
+
+func AddressesHandler(cfg config.IConfig, usecase addressesUsecases.IAddressesUsecase) IAddressesHandler {
+	return &addressesHandler{
+		cfg:     cfg,
+		usecase: usecase,
+	}
+}
+
+// badRequest lists the errors caused by the request rather than the server.
+func badRequest(err error) bool {
+	msg := err.Error()
+	return msg == "address not found" ||
+		strings.HasSuffix(msg, " is required") ||
+		strings.HasSuffix(msg, " pattern is invalid") ||
+		strings.HasPrefix(msg, "country must be")
+}
+
+func (h *addressesHandler) FindAddresses(c *fiber.Ctx) error {
+	userId := strings.Trim(c.Params("user_id"), " ")
+
+	result, err := h.usecase.FindAddresses(userId)
+	if err != nil {
+		return entities.NewResponse(c).Error(
+			fiber.ErrInternalServerError.Code,
+			string(findAddressesErr),
+			err.Error(),
+		).Res()
+	}
+
+	return entities.NewResponse(c).Success(fiber.StatusOK, result).Res()
+}
+
+func (h *addressesHandler) FindOneAddress(c *fiber.Ctx) error {
+	userId := strings.Trim(c.Params("user_id"), " ")
+	addressId := strings.Trim(c.Params("address_id"), " ")
+
+	if _, err := uuid.Parse(addressId); err != nil {
+		return entities.NewResponse(c).Error(
+			fiber.ErrBadRequest.Code,
+			string(findOneAddressErr),
+			"id type is invalid",
+		).Res()
+	}
+
+	address, err := h.usecase.FindOneAddress(userId, addressId)
+	if err != nil {
+		if badRequest(err) {
+			return entities.NewResponse(c).Error(
+				fiber.ErrBadRequest.Code,
+				string(findOneAddressErr),
+				err.Error(),
+			).Res()
+		}
+		return entities.NewResponse(c).Error(
+			fiber.ErrInternalServerError.Code,
+			string(findOneAddressErr),
+			err.Error(),
+		).Res()
+	}
+
+	return entities.NewResponse(c).Success(fiber.StatusOK, address).Res()
+}
+
+func (h *addressesHandler) InsertAddress(c *fiber.Ctx) error {
+	req := new(addresses.AddressReq)
+	if err := c.BodyParser(req); err != nil {
+		return entities.NewResponse(c).Error(
+			fiber.ErrBadRequest.Code,
+			string(insertAddressErr),
+			err.Error(),
+		).Res()
+	}
+	req.UserId = strings.Trim(c.Params("user_id"), " ")
+	req.Trim()
+
+	address, err := h.usecase.InsertAddress(req)
+	if err != nil {
+		if badRequest(err) {
+			return entities.NewResponse(c).Error(
+				fiber.ErrBadRequest.Code,
+				string(insertAddressErr),
+				err.Error(),
+			).Res()
+		}
+		return entities.NewResponse(c).Error(
+			fiber.ErrInternalServerError.Code,
+			string(insertAddressErr),
+			err.Error(),
+		).Res()
+	}
+
+	return entities.NewResponse(c).Success(fiber.StatusCreated, address).Res()
+}
+
+func (h *addressesHandler) UpdateAddress(c *fiber.Ctx) error {
+	addressId := strings.Trim(c.Params("address_id"), " ")
+	if _, err := uuid.Parse(addressId); err != nil {
+		return entities.NewResponse(c).Error(
+			fiber.ErrBadRequest.Code,
+			string(updateAddressErr),
+			"id type is invalid",
+		).Res()
+	}
+
+	req := new(addresses.AddressReq)
+	if err := c.BodyParser(req); err != nil {
+		return entities.NewResponse(c).Error(
+			fiber.ErrBadRequest.Code,
+			string(updateAddressErr),
+			err.Error(),
+		).Res()
+	}
+	req.Id = addressId
+	req.UserId = strings.Trim(c.Params("user_id"), " ")
+	req.Trim()
+
+	address, err := h.usecase.UpdateAddress(req)
+	if err != nil {
+		if badRequest(err) {
+			return entities.NewResponse(c).Error(
+				fiber.ErrBadRequest.Code,
+				string(updateAddressErr),
+				err.Error(),
+			).Res()
+		}
+		return entities.NewResponse(c).Error(
+			fiber.ErrInternalServerError.Code,
+			string(updateAddressErr),
+			err.Error(),
+		).Res()
+	}
+
+	return entities.NewResponse(c).Success(fiber.StatusOK, address).Res()
+}
+
+func (h *addressesHandler) DeleteAddress(c *fiber.Ctx) error {
+	userId := strings.Trim(c.Params("user_id"), " ")
+	addressId := strings.Trim(c.Params("address_id"), " ")
+
+	if _, err := uuid.Parse(addressId); err != nil {
+		return entities.NewResponse(c).Error(
+			fiber.ErrBadRequest.Code,
+			string(deleteAddressErr),
+			"id type is invalid",
+		).Res()
+	}
+
+	if err := h.usecase.DeleteAddress(userId, addressId); err != nil {
+		if badRequest(err) {
+			return entities.NewResponse(c).Error(
+				fiber.ErrBadRequest.Code,
+				string(deleteAddressErr),
+				err.Error(),
+			).Res()
+		}
+		return entities.NewResponse(c).Error(
+			fiber.ErrInternalServerError.Code,
+			string(deleteAddressErr),
+			err.Error(),
+		).Res()
+	}
+
+	return entities.NewResponse(c).Success(fiber.StatusOK, nil).Res()
+}
@@ -0,0 +1,291 @@
+package addressesRepositories
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/codepnw/ecommerce/modules/addresses"
+	"github.com/jmoiron/sqlx"
+)
+
+type IAddressesRepository interface {
+	FindAddresses(userId string) ([]*addresses.Address, error)
+	FindOneAddress(userId, addressId string) (*addresses.Address, error)
+	FindDefaultAddress(userId string) (*addresses.Address, error)
+	InsertAddress(req *addresses.AddressReq) (string, error)
+	UpdateAddress(req *addresses.AddressReq) error
+	DeleteAddress(userId, addressId string) error
+}
+
+type addressesRepository struct {
+	db *sqlx.DB
+}
+
+func AddressesRepository(db *sqlx.DB) IAddressesRepository {
+	return &addressesRepository{db: db}
+}
+
+const selectAddresses = `
+	SELECT
+		"id",
+		"user_id",
+		"name",
+		"phone",
+		"line1",
+		"line2",
+		"district",
+		"province",
+		"postal_code",
+		"country",
+		"is_default",
+		"created_at",
+		"updated_at"
+	FROM "addresses"`
+
+func (r *addressesRepository) FindAddresses(userId string) ([]*addresses.Address, error) {
+	query := selectAddresses + `
+		WHERE "user_id" = $1
+		ORDER BY "is_default" DESC, "created_at" DESC;`
+
+	result := make([]*addresses.Address, 0)
+	if err := r.db.Select(&result, query, userId); err != nil {
+		return nil, fmt.Errorf("select addresses failed: %v", err)
+	}
+	return result, nil
+}
+
+func (r *addressesRepository) FindOneAddress(userId, addressId string) (*addresses.Address, error) {
+	query := selectAddresses + `
+		WHERE "id" = $1
+		AND "user_id" = $2;`
+
+	address := new(addresses.Address)
+	if err := r.db.Get(address, query, addressId, userId); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("address not found")
+		}
+		return nil, fmt.Errorf("get address failed: %v", err)
+	}
+	return address, nil
+}
+
+func (r *addressesRepository) FindDefaultAddress(userId string) (*addresses.Address, error) {
+	query := selectAddresses + `
+		WHERE "user_id" = $1
+		AND "is_default";`
+
+	address := new(addresses.Address)
+	if err := r.db.Get(address, query, userId); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("address not found")
+		}
+		return nil, fmt.Errorf("get default address failed: %v", err)
+	}
+	return address, nil
+}
+
+// InsertAddress makes the first address of a user the default one whatever
+// the request says.
+func (r *addressesRepository) InsertAddress(req *addresses.AddressReq) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+
+	// Rows are locked so two inserts for the same user can't both decide
+	// they are the first
+	var count int
+	if err := tx.GetContext(ctx, &count, `
+		SELECT
+			COUNT(*)
+		FROM (
+			SELECT
+				"id"
+			FROM "addresses"
+			WHERE "user_id" = $1
+			FOR UPDATE
+		) AS "a";`, req.UserId); err != nil {
+		tx.Rollback()
+		return "", fmt.Errorf("count addresses failed: %v", err)
+	}
+
+	isDefault := count == 0 || (req.IsDefault != nil && *req.IsDefault)
+	if isDefault {
+		if err := clearDefault(ctx, tx, req.UserId); err != nil {
+			tx.Rollback()
+			return "", err
+		}
+	}
+
+	query := `
+		INSERT INTO "addresses" (
+			"user_id",
+			"name",
+			"phone",
+			"line1",
+			"line2",
+			"district",
+			"province",
+			"postal_code",
+			"country",
+			"is_default"
+		)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		RETURNING "id";`
+
+	var addressId string
+	if err := tx.QueryRowxContext(
+		ctx,
+		query,
+		req.UserId,
+		req.Name,
+		req.Phone,
+		req.Line1,
+		req.Line2,
+		req.District,
+		req.Province,
+		req.PostalCode,
+		req.Country,
+		isDefault,
+	).Scan(&addressId); err != nil {
+		tx.Rollback()
+		return "", fmt.Errorf("insert address failed: %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return "", err
+	}
+	return addressId, nil
+}
+
+// UpdateAddress changes the fields that are given, line2 can't be cleared
+// through here since an empty value means unchanged.
+func (r *addressesRepository) UpdateAddress(req *addresses.AddressReq) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	if req.IsDefault != nil && *req.IsDefault {
+		if err := clearDefault(ctx, tx, req.UserId); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	query := `
+		UPDATE "addresses" SET
+			"name" = COALESCE(NULLIF($1, ''), "name"),
+			"phone" = COALESCE(NULLIF($2, ''), "phone"),
+			"line1" = COALESCE(NULLIF($3, ''), "line1"),
+			"line2" = COALESCE(NULLIF($4, ''), "line2"),
+			"district" = COALESCE(NULLIF($5, ''), "district"),
+			"province" = COALESCE(NULLIF($6, ''), "province"),
+			"postal_code" = COALESCE(NULLIF($7, ''), "postal_code"),
+			"country" = COALESCE(NULLIF($8, ''), "country"),
+			"is_default" = COALESCE($9, "is_default")
+		WHERE "id" = $10
+		AND "user_id" = $11;`
+
+	result, err := tx.ExecContext(
+		ctx,
+		query,
+		req.Name,
+		req.Phone,
+		req.Line1,
+		req.Line2,
+		req.District,
+		req.Province,
+		req.PostalCode,
+		req.Country,
+		req.IsDefault,
+		req.Id,
+		req.UserId,
+	)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("update address failed: %v", err)
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		tx.Rollback()
+		return fmt.Errorf("address not found")
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// DeleteAddress hands the default flag to the newest address left when the
+// default one is deleted. Orders keep their snapshot, only the link is lost.
+func (r *addressesRepository) DeleteAddress(userId, addressId string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		DELETE FROM "addresses"
+		WHERE "id" = $1
+		AND "user_id" = $2
+		RETURNING "is_default";`
+
+	var wasDefault bool
+	if err := tx.QueryRowxContext(ctx, query, addressId, userId).Scan(&wasDefault); err != nil {
+		tx.Rollback()
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("address not found")
+		}
+		return fmt.Errorf("delete address failed: %v", err)
+	}
+
+	if wasDefault {
+		query := `
+			UPDATE "addresses" SET
+				"is_default" = TRUE
+			WHERE "id" = (
+				SELECT
+					"id"
+				FROM "addresses"
+				WHERE "user_id" = $1
+				ORDER BY "created_at" DESC
+				LIMIT 1
+			);`
+
+		if _, err := tx.ExecContext(ctx, query, userId); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("update default address failed: %v", err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	return nil
+}
+
+func clearDefault(ctx context.Context, tx *sqlx.Tx, userId string) error {
+	query := `
+		UPDATE "addresses" SET
+			"is_default" = FALSE
+		WHERE "user_id" = $1
+		AND "is_default";`
+
+	if _, err := tx.ExecContext(ctx, query, userId); err != nil {
+		return fmt.Errorf("clear default address failed: %v", err)
+	}
+	return nil
+}
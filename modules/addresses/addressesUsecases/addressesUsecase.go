@@ -0,0 +1,70 @@
+package addressesUsecases
+
+import (
+	"github.com/codepnw/ecommerce/modules/addresses"
+	"github.com/codepnw/ecommerce/modules/addresses/addressesRepositories"
+)
+
+type IAddressesUsecase interface {
+	FindAddresses(userId string) ([]*addresses.Address, error)
+	FindOneAddress(userId, addressId string) (*addresses.Address, error)
+	InsertAddress(req *addresses.AddressReq) (*addresses.Address, error)
+	UpdateAddress(req *addresses.AddressReq) (*addresses.Address, error)
+	DeleteAddress(userId, addressId string) error
+}
+
+type addressesUsecase struct {
+	repository addressesRepositories.IAddressesRepository
+}
+
+func AddressesUsecase(repository addressesRepositories.IAddressesRepository) IAddressesUsecase {
+	return &addressesUsecase{
+		repository: repository,
+	}
+}
+
+func (u *addressesUsecase) FindAddresses(userId string) ([]*addresses.Address, error) {
+	result, err := u.repository.FindAddresses(userId)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (u *addressesUsecase) FindOneAddress(userId, addressId string) (*addresses.Address, error) {
+	address, err := u.repository.FindOneAddress(userId, addressId)
+	if err != nil {
+		return nil, err
+	}
+	return address, nil
+}
+
+func (u *addressesUsecase) InsertAddress(req *addresses.AddressReq) (*addresses.Address, error) {
+	if err := req.Validate(true); err != nil {
+		return nil, err
+	}
+
+	addressId, err := u.repository.InsertAddress(req)
+	if err != nil {
+		return nil, err
+	}
+	return u.repository.FindOneAddress(req.UserId, addressId)
+}
+
+func (u *addressesUsecase) UpdateAddress(req *addresses.AddressReq) (*addresses.Address, error) {
+	if err := req.Validate(false); err != nil {
+		return nil, err
+	}
+
+	if err := u.repository.UpdateAddress(req); err != nil {
+		return nil, err
+	}
+	return u.repository.FindOneAddress(req.UserId, req.Id)
+}
+
+func (u *addressesUsecase) DeleteAddress(userId, addressId string) error {
+	if err := u.repository.DeleteAddress(userId, addressId); err != nil {
+		return err
+	}
+	return nil
+}
@@ -8,3 +8,49 @@ type Category struct {
 type CategoryFilter struct {
 	Title string `query:"title"`
 }
+
+const (
+	ScopeAll         = "*"
+	ScopeUsersAuth   = "users:auth"
+	ScopeCatalogRead = "catalog:read"
+	ScopeOrdersGuest = "orders:guest"
+	// ScopeMetricsRead is not covered by ScopeAll, a scraper key has to be
+	// created with it by name
+	ScopeMetricsRead = "metrics:read"
+)
+
+var ApiKeyScopes = []string{ScopeAll, ScopeUsersAuth, ScopeCatalogRead, ScopeOrdersGuest, ScopeMetricsRead}
+
+// LegacyApiKeyScopes are granted to keys signed with the shared secret, the
+// routes they could reach before managed keys. AUTH_LEGACY_API_KEYS is only
+// meant to bridge clients onto managed keys and will be removed.
+var LegacyApiKeyScopes = []string{ScopeUsersAuth, ScopeCatalogRead}
+
+// ApiKey is a managed client key, only a sha256 digest of the key is stored
+// and the key itself is shown once when it is created.
+type ApiKey struct {
+	Id         string   `db:"id" json:"id"`
+	Name       string   `db:"name" json:"name"`
+	OwnerId    *string  `db:"owner_id" json:"owner_id"`
+	Prefix     string   `db:"prefix" json:"prefix"`
+	Scopes     []string `db:"-" json:"scopes"`
+	ScopesJson string   `db:"scopes" json:"-"`
+	CreatedAt  string   `db:"created_at" json:"created_at"`
+	LastUsedAt *string  `db:"last_used_at" json:"last_used_at"`
+	ExpiresAt  *string  `db:"expires_at" json:"expires_at"`
+	RevokedAt  *string  `db:"revoked_at" json:"revoked_at"`
+}
+
+type ApiKeyReq struct {
+	Name      string   `json:"name"`
+	Scopes    []string `json:"scopes"`
+	ExpiresIn int      `json:"expires_in"` // days, 0 never expires
+	OwnerId   string   `json:"-"`
+	Prefix    string   `json:"-"`
+	KeyHash   string   `json:"-"`
+}
+
+type ApiKeyRes struct {
+	*ApiKey
+	Key string `json:"key"`
+}
@@ -8,24 +8,27 @@ import (
 	"github.com/codepnw/ecommerce/modules/appinfo"
 	"github.com/codepnw/ecommerce/modules/appinfo/appinfoUsecases"
 	"github.com/codepnw/ecommerce/modules/entities"
-	"github.com/codepnw/ecommerce/pkg/auth"
 	"github.com/gofiber/fiber/v2"
 )
 
 type appinfoHandlerErrCode string
 
 const (
-	generateApiKeyErr appinfoHandlerErrCode = "appinfo-001"
 	findCategoryErr   appinfoHandlerErrCode = "appinfo-002"
 	insertCategoryErr appinfoHandlerErrCode = "appinfo-003"
 	deleteCategoryErr appinfoHandlerErrCode = "appinfo-004"
+	insertApiKeyErr   appinfoHandlerErrCode = "appinfo-005"
+	findApiKeysErr    appinfoHandlerErrCode = "appinfo-006"
+	revokeApiKeyErr   appinfoHandlerErrCode = "appinfo-007"
 )
 
 type IAppinfoHandler interface {
-	GenerateApiKey(c *fiber.Ctx) error
 	FindCategory(c *fiber.Ctx) error
 	InsertCategory(c *fiber.Ctx) error
-	DeleteCategory(c *fiber.Ctx) error 
+	DeleteCategory(c *fiber.Ctx) error
+	InsertApiKey(c *fiber.Ctx) error
+	FindApiKeys(c *fiber.Ctx) error
+	RevokeApiKey(c *fiber.Ctx) error
 }
 
 type appinfoHandler struct {
@@ -40,31 +43,6 @@ func AppinfoHandler(cfg config.IConfig, usecase appinfoUsecases.IAppinfoUsecase)
 	}
 }
 
-func (h *appinfoHandler) GenerateApiKey(c *fiber.Ctx) error {
-	apiKey, err := auth.NewEcomAuth(
-		auth.ApiKey,
-		h.cfg.Jwt(),
-		nil,
-	)
-
-	if err != nil {
-		return entities.NewResponse(c).Error(
-			fiber.ErrInternalServerError.Code,
-			string(generateApiKeyErr),
-			err.Error(),
-		).Res()
-	}
-
-	return entities.NewResponse(c).Success(
-		fiber.StatusOK,
-		&struct {
-			Key string `json:"key"`
-		}{
-			Key: apiKey.SignToken(),
-		},
-	).Res()
-}
-
 func (h *appinfoHandler) FindCategory(c *fiber.Ctx) error {
 	req := new(appinfo.CategoryFilter)
 	if err := c.QueryParser(req); err != nil {
@@ -119,7 +97,7 @@ func (h *appinfoHandler) InsertCategory(c *fiber.Ctx) error {
 func (h *appinfoHandler) DeleteCategory(c *fiber.Ctx) error {
 	categoryId := strings.Trim(c.Params("category_id"), " ")
 	categoryIdInt, err := strconv.Atoi(categoryId)
-	
+
 	if err != nil {
 		return entities.NewResponse(c).Error(
 			fiber.ErrBadRequest.Code,
@@ -145,11 +123,86 @@ func (h *appinfoHandler) DeleteCategory(c *fiber.Ctx) error {
 	}
 
 	return entities.NewResponse(c).Success(
-		fiber.StatusOK, 
+		fiber.StatusOK,
 		&struct {
 			CategoryId int `json:"category_id"`
-		} {
+		}{
 			CategoryId: categoryIdInt,
 		},
 	).Res()
-}
\ No newline at end of file
+}
+
+func (h *appinfoHandler) InsertApiKey(c *fiber.Ctx) error {
+	req := new(appinfo.ApiKeyReq)
+	if err := c.BodyParser(req); err != nil {
+		return entities.NewResponse(c).Error(
+			fiber.ErrBadRequest.Code,
+			string(insertApiKeyErr),
+			err.Error(),
+		).Res()
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	req.OwnerId, _ = c.Locals("userId").(string)
+
+	if req.Name == "" || req.ExpiresIn < 0 {
+		return entities.NewResponse(c).Error(
+			fiber.ErrBadRequest.Code,
+			string(insertApiKeyErr),
+			"name is required and expires_in must not be negative",
+		).Res()
+	}
+
+	result, err := h.usecase.InsertApiKey(req)
+	if err != nil {
+		if strings.HasPrefix(err.Error(), "scope ") {
+			return entities.NewResponse(c).Error(
+				fiber.ErrBadRequest.Code,
+				string(insertApiKeyErr),
+				err.Error(),
+			).Res()
+		}
+		return entities.NewResponse(c).Error(
+			fiber.ErrInternalServerError.Code,
+			string(insertApiKeyErr),
+			err.Error(),
+		).Res()
+	}
+
+	return entities.NewResponse(c).Success(fiber.StatusCreated, result).Res()
+}
+
+func (h *appinfoHandler) FindApiKeys(c *fiber.Ctx) error {
+	result, err := h.usecase.FindApiKeys()
+	if err != nil {
+		return entities.NewResponse(c).Error(
+			fiber.ErrInternalServerError.Code,
+			string(findApiKeysErr),
+			err.Error(),
+		).Res()
+	}
+
+	return entities.NewResponse(c).Success(fiber.StatusOK, result).Res()
+}
+
+func (h *appinfoHandler) RevokeApiKey(c *fiber.Ctx) error {
+	apiKeyId := strings.Trim(c.Params("apikey_id"), " ")
+
+	if err := h.usecase.RevokeApiKey(apiKeyId); err != nil {
+		switch err.Error() {
+		case "api key not found":
+			return entities.NewResponse(c).Error(
+				fiber.ErrBadRequest.Code,
+				string(revokeApiKeyErr),
+				err.Error(),
+			).Res()
+		default:
+			return entities.NewResponse(c).Error(
+				fiber.ErrInternalServerError.Code,
+				string(revokeApiKeyErr),
+				err.Error(),
+			).Res()
+		}
+	}
+
+	return entities.NewResponse(c).Success(fiber.StatusOK, nil).Res()
+}
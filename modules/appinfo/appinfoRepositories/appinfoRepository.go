@@ -2,6 +2,7 @@ package appinfoRepositories
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"strings"
 
@@ -13,6 +14,9 @@ type IAppinfoRepository interface {
 	FindCategory(req *appinfo.CategoryFilter) ([]*appinfo.Category, error)
 	InsertCategory(req []*appinfo.Category) error
 	DeleteCategory(categoryId int) error
+	InsertApiKey(req *appinfo.ApiKeyReq) (*appinfo.ApiKey, error)
+	FindApiKeys() ([]*appinfo.ApiKey, error)
+	RevokeApiKey(apiKeyId string) error
 }
 
 type appinfoRepository struct {
@@ -54,7 +58,7 @@ func (r *appinfoRepository) InsertCategory(req []*appinfo.Category) error {
 			"title"
 		)
 		VALUES`
-	
+
 	tx, err := r.db.BeginTxx(ctx, nil)
 	if err != nil {
 		return err
@@ -64,7 +68,7 @@ func (r *appinfoRepository) InsertCategory(req []*appinfo.Category) error {
 	for i, cat := range req {
 		vlStack = append(vlStack, cat.Title)
 
-		if i != len(req) - 1 {
+		if i != len(req)-1 {
 			query += fmt.Sprintf(`($%d),`, i+1)
 		} else {
 			query += fmt.Sprintf(`($%d)`, i+1)
@@ -101,4 +105,115 @@ func (r *appinfoRepository) DeleteCategory(categoryId int) error {
 		return fmt.Errorf("delete category failed: %v", err)
 	}
 	return nil
-}
\ No newline at end of file
+}
+
+func (r *appinfoRepository) InsertApiKey(req *appinfo.ApiKeyReq) (*appinfo.ApiKey, error) {
+	scopes, err := json.Marshal(req.Scopes)
+	if err != nil {
+		return nil, fmt.Errorf("marshal scopes failed: %v", err)
+	}
+
+	query := `
+		INSERT INTO "api_keys" (
+			"name",
+			"owner_id",
+			"prefix",
+			"key_hash",
+			"scopes",
+			"expires_at"
+		)
+		VALUES (
+			$1,
+			NULLIF($2, ''),
+			$3,
+			$4,
+			$5,
+			(CASE WHEN $6::INT > 0 THEN NOW() + ($6::INT * INTERVAL '1 day') ELSE NULL END)
+		)
+		RETURNING "id";`
+
+	var id string
+	if err := r.db.QueryRowxContext(
+		context.Background(),
+		query,
+		req.Name,
+		req.OwnerId,
+		req.Prefix,
+		req.KeyHash,
+		string(scopes),
+		req.ExpiresIn,
+	).Scan(&id); err != nil {
+		return nil, fmt.Errorf("insert api key failed: %v", err)
+	}
+
+	return r.findOneApiKey(id)
+}
+
+func (r *appinfoRepository) findOneApiKey(apiKeyId string) (*appinfo.ApiKey, error) {
+	query := `
+		SELECT
+			"id",
+			"name",
+			"owner_id",
+			"prefix",
+			"scopes"::TEXT AS "scopes",
+			"created_at",
+			"last_used_at",
+			"expires_at",
+			"revoked_at"
+		FROM "api_keys"
+		WHERE "id" = $1;`
+
+	key := new(appinfo.ApiKey)
+	if err := r.db.Get(key, query, apiKeyId); err != nil {
+		return nil, fmt.Errorf("api key not found")
+	}
+	if err := json.Unmarshal([]byte(key.ScopesJson), &key.Scopes); err != nil {
+		return nil, fmt.Errorf("unmarshal scopes failed: %v", err)
+	}
+	return key, nil
+}
+
+func (r *appinfoRepository) FindApiKeys() ([]*appinfo.ApiKey, error) {
+	query := `
+		SELECT
+			"id",
+			"name",
+			"owner_id",
+			"prefix",
+			"scopes"::TEXT AS "scopes",
+			"created_at",
+			"last_used_at",
+			"expires_at",
+			"revoked_at"
+		FROM "api_keys"
+		ORDER BY "created_at" DESC;`
+
+	keys := make([]*appinfo.ApiKey, 0)
+	if err := r.db.Select(&keys, query); err != nil {
+		return nil, fmt.Errorf("select api keys failed: %v", err)
+	}
+	for _, key := range keys {
+		if err := json.Unmarshal([]byte(key.ScopesJson), &key.Scopes); err != nil {
+			return nil, fmt.Errorf("unmarshal scopes failed: %v", err)
+		}
+	}
+	return keys, nil
+}
+
+func (r *appinfoRepository) RevokeApiKey(apiKeyId string) error {
+	query := `
+		UPDATE "api_keys" SET
+			"revoked_at" = NOW()
+		WHERE "id" = $1
+		AND "revoked_at" IS NULL;`
+
+	result, err := r.db.ExecContext(context.Background(), query, apiKeyId)
+	if err != nil {
+		return fmt.Errorf("revoke api key failed: %v", err)
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return fmt.Errorf("api key not found")
+	}
+	return nil
+}
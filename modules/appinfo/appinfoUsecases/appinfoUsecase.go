@@ -1,14 +1,20 @@
 package appinfoUsecases
 
 import (
+	"fmt"
+
 	"github.com/codepnw/ecommerce/modules/appinfo"
 	"github.com/codepnw/ecommerce/modules/appinfo/appinfoRepositories"
+	"github.com/codepnw/ecommerce/pkg/utils"
 )
 
 type IAppinfoUsecase interface {
 	FindCategory(req *appinfo.CategoryFilter) ([]*appinfo.Category, error)
 	InsertCategory(req []*appinfo.Category) error
 	DeleteCategory(categoryId int) error
+	InsertApiKey(req *appinfo.ApiKeyReq) (*appinfo.ApiKeyRes, error)
+	FindApiKeys() ([]*appinfo.ApiKey, error)
+	RevokeApiKey(apiKeyId string) error
 }
 
 type appinfoUsecase struct {
@@ -36,7 +42,63 @@ func (u *appinfoUsecase) InsertCategory(req []*appinfo.Category) error {
 
 func (u *appinfoUsecase) DeleteCategory(categoryId int) error {
 	if err := u.repository.DeleteCategory(categoryId); err != nil {
-		return err 
+		return err
 	}
 	return nil
-}
\ No newline at end of file
+}
+
+func (u *appinfoUsecase) InsertApiKey(req *appinfo.ApiKeyReq) (*appinfo.ApiKeyRes, error) {
+	if len(req.Scopes) == 0 {
+		req.Scopes = []string{appinfo.ScopeAll}
+	}
+	for _, scope := range req.Scopes {
+		valid := false
+		for _, s := range appinfo.ApiKeyScopes {
+			if scope == s {
+				valid = true
+				break
+			}
+		}
+		if !valid {
+			return nil, fmt.Errorf("scope %s is invalid", scope)
+		}
+	}
+
+	prefix, err := utils.RandToken(4)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := utils.RandToken(24)
+	if err != nil {
+		return nil, err
+	}
+
+	// The prefix lets people tell their keys apart without the secret
+	key := "ek_" + prefix + "_" + secret
+	req.Prefix = "ek_" + prefix
+	req.KeyHash = utils.HashToken(key)
+
+	apiKey, err := u.repository.InsertApiKey(req)
+	if err != nil {
+		return nil, err
+	}
+	return &appinfo.ApiKeyRes{
+		ApiKey: apiKey,
+		Key:    key,
+	}, nil
+}
+
+func (u *appinfoUsecase) FindApiKeys() ([]*appinfo.ApiKey, error) {
+	keys, err := u.repository.FindApiKeys()
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+func (u *appinfoUsecase) RevokeApiKey(apiKeyId string) error {
+	if err := u.repository.RevokeApiKey(apiKeyId); err != nil {
+		return err
+	}
+	return nil
+}
@@ -1,19 +1,160 @@
 package files
 
-import "mime/multipart"
+import (
+	"fmt"
+	"io"
+	"mime/multipart"
+	"path"
+	"regexp"
+	"strings"
+)
 
 type FileReq struct {
 	File        *multipart.FileHeader `form:"file"`
 	Destination string                `form:"destination"`
 	Extension   string
 	FileName    string
+	OwnerId     string
+	Purpose     string
+	Private     bool
 }
 
 type FileRes struct {
+	Id       string `json:"id"`
 	FileName string `json:"filename"`
 	Url      string `json:"url"`
 }
 
 type DeleteFileReq struct {
 	Destination string `json:"destination"`
+	Private     bool   `json:"private"`
+}
+
+type FileFailure struct {
+	Destination string `json:"destination"`
+	Error       string `json:"error"`
+}
+
+// StorageError lists the files of a batch that failed, the rest of the batch
+// has been processed.
+type StorageError struct {
+	Failed []*FileFailure
+}
+
+func (e *StorageError) Error() string {
+	msg := make([]string, 0, len(e.Failed))
+	for _, f := range e.Failed {
+		msg = append(msg, fmt.Sprintf("%s: %s", f.Destination, f.Error))
+	}
+	return strings.Join(msg, "; ")
+}
+
+type FileBatchRes struct {
+	Succeeded any            `json:"succeeded"`
+	Failed    []*FileFailure `json:"failed"`
+}
+
+// File is a row of the "files" registry, one per uploaded object.
+type File struct {
+	Id          string  `db:"id" json:"id"`
+	FileName    string  `db:"filename" json:"filename"`
+	Destination string  `db:"destination" json:"destination"`
+	Url         string  `db:"url" json:"url"`
+	OwnerId     *string `db:"owner_id" json:"owner_id"`
+	Purpose     string  `db:"purpose" json:"purpose"`
+	RefCount    int     `db:"ref_count" json:"ref_count"`
+	IsPrivate   bool    `db:"is_private" json:"is_private"`
+	CreatedAt   string  `db:"created_at" json:"created_at"`
+}
+
+type FilePurpose string
+
+const (
+	PurposeGeneral      FilePurpose = "general"
+	PurposeProduct      FilePurpose = "product"
+	PurposeTransferSlip FilePurpose = "transfer_slip"
+)
+
+type UploadStatus string
+
+const (
+	UploadPending   UploadStatus = "pending"
+	UploadCompleted UploadStatus = "completed"
+	UploadAborted   UploadStatus = "aborted"
+)
+
+type UploadInitReq struct {
+	FileName    string `json:"filename"`
+	Destination string `json:"destination"`
+	Purpose     string `json:"purpose"`
+	TotalSize   int64  `json:"total_size"`
+	Checksum    string `json:"checksum"` // sha256 hex of the whole file, optional
+}
+
+// Upload is a chunked upload session, parts are kept under the uploads root
+// until the session is completed or aborted.
+type Upload struct {
+	Id          string        `db:"id" json:"id"`
+	OwnerId     string        `db:"owner_id" json:"owner_id"`
+	FileName    string        `db:"filename" json:"filename"`
+	Destination string        `db:"destination" json:"destination"`
+	Purpose     string        `db:"purpose" json:"purpose"`
+	TotalSize   int64         `db:"total_size" json:"total_size"`
+	PartSize    int64         `db:"part_size" json:"part_size"`
+	TotalParts  int           `db:"-" json:"total_parts"`
+	Checksum    string        `db:"checksum" json:"checksum"`
+	Status      string        `db:"status" json:"status"`
+	Parts       []*UploadPart `db:"-" json:"parts"`
+	CreatedAt   string        `db:"created_at" json:"created_at"`
+}
+
+type UploadPart struct {
+	PartNumber int    `db:"part_number" json:"part_number"`
+	Size       int64  `db:"size" json:"size"`
+	Checksum   string `db:"checksum" json:"checksum"`
+}
+
+type UploadPartReq struct {
+	UploadId   string
+	OwnerId    string
+	PartNumber int
+	Checksum   string // sha256 hex of the part
+	Body       io.Reader
+}
+
+// Private files are kept outside the public images root and are only
+// reachable through signed urls.
+func StorageRoot(private bool) string {
+	if private {
+		return "./assets/private/"
+	}
+	return "./assets/images/"
+}
+
+var destinationPattern = regexp.MustCompile(`^[a-zA-Z0-9_-]+(/[a-zA-Z0-9_-]+)*$`)
+
+// CleanDestination checks a folder sent by a client, it has to stay under the
+// storage root so absolute paths, ".." and anything but plain names are
+// refused. An empty destination is the root itself.
+func CleanDestination(destination string) (string, error) {
+	if destination == "" {
+		return "", nil
+	}
+	if path.IsAbs(destination) {
+		return "", fmt.Errorf("destination is invalid")
+	}
+	cleaned := path.Clean(destination)
+	for _, segment := range strings.Split(cleaned, "/") {
+		if segment == ".." {
+			return "", fmt.Errorf("destination is invalid")
+		}
+	}
+	if !destinationPattern.MatchString(cleaned) {
+		return "", fmt.Errorf("destination is invalid")
+	}
+	return cleaned, nil
+}
+
+func UploadPartPath(uploadId string, partNumber int) string {
+	return fmt.Sprintf("./assets/uploads/%s/%d.part", uploadId, partNumber)
 }
@@ -1,9 +1,13 @@
 package filesHandlers
 
 import (
+	"bytes"
+	"context"
+	"encoding/hex"
 	"fmt"
 	"math"
 	"path/filepath"
+	"strconv"
 	"strings"
 
 	"github.com/codepnw/ecommerce/config"
@@ -19,11 +23,21 @@ type filesHanldersErr string
 const (
 	uploadFilesErr filesHanldersErr = "files-001"
 	deleteErr      filesHanldersErr = "files-002"
+	initUploadErr  filesHanldersErr = "files-003"
+	findUploadErr  filesHanldersErr = "files-004"
+	uploadPartErr  filesHanldersErr = "files-005"
+	completeErr    filesHanldersErr = "files-006"
+	abortErr       filesHanldersErr = "files-007"
 )
 
 type IFilesHandler interface {
 	UploadFiles(c *fiber.Ctx) error
 	DeleteFile(c *fiber.Ctx) error
+	InitUpload(c *fiber.Ctx) error
+	FindOneUpload(c *fiber.Ctx) error
+	UploadPart(c *fiber.Ctx) error
+	CompleteUpload(c *fiber.Ctx) error
+	AbortUpload(c *fiber.Ctx) error
 }
 
 type filesHandler struct {
@@ -53,6 +67,17 @@ func (h *filesHandler) UploadFiles(c *fiber.Ctx) error {
 	filesReq := form.File["files"]
 	destination := c.FormValue("destination")
 
+	purposeMap := map[string]files.FilePurpose{
+		"general":       files.PurposeGeneral,
+		"product":       files.PurposeProduct,
+		"transfer_slip": files.PurposeTransferSlip,
+	}
+	purpose := purposeMap[strings.ToLower(c.FormValue("purpose"))]
+	if purpose == "" {
+		purpose = files.PurposeGeneral
+	}
+	ownerId, _ := c.Locals("userId").(string)
+
 	extMap := map[string]string{
 		"png":  "png",
 		"jpg":  "jpg",
@@ -83,11 +108,27 @@ func (h *filesHandler) UploadFiles(c *fiber.Ctx) error {
 			Destination: destination + "/" + filename,
 			FileName:    filename,
 			Extension:   ext,
+			OwnerId:     ownerId,
+			Purpose:     string(purpose),
+			Private:     purpose == files.PurposeTransferSlip,
 		})
 	}
 
-	res, err := h.usecase.UploadToStorage(req)
+	// Storage work stops once the response could no longer be written
+	ctx, cancel := context.WithTimeout(c.Context(), h.cfg.App().WriteTimeout())
+	defer cancel()
+
+	res, err := h.usecase.UploadToStorage(ctx, req)
 	if err != nil {
+		if storageErr, ok := err.(*files.StorageError); ok && len(res) > 0 {
+			return entities.NewResponse(c).Success(
+				fiber.StatusMultiStatus,
+				&files.FileBatchRes{
+					Succeeded: res,
+					Failed:    storageErr.Failed,
+				},
+			).Res()
+		}
 		return entities.NewResponse(c).Error(
 			fiber.ErrInternalServerError.Code,
 			string(uploadFilesErr),
@@ -108,7 +149,30 @@ func (h *filesHandler) DeleteFile(c *fiber.Ctx) error {
 		).Res()
 	}
 
-	if err := h.usecase.DeleteFileOnStorage(req); err != nil {
+	ctx, cancel := context.WithTimeout(c.Context(), h.cfg.App().WriteTimeout())
+	defer cancel()
+
+	if err := h.usecase.DeleteFileOnStorage(ctx, req); err != nil {
+		if storageErr, ok := err.(*files.StorageError); ok && len(storageErr.Failed) < len(req) {
+			failedMap := make(map[string]bool)
+			for _, f := range storageErr.Failed {
+				failedMap[f.Destination] = true
+			}
+
+			succeeded := make([]string, 0)
+			for _, r := range req {
+				if !failedMap[r.Destination] {
+					succeeded = append(succeeded, r.Destination)
+				}
+			}
+			return entities.NewResponse(c).Success(
+				fiber.StatusMultiStatus,
+				&files.FileBatchRes{
+					Succeeded: succeeded,
+					Failed:    storageErr.Failed,
+				},
+			).Res()
+		}
 		return entities.NewResponse(c).Error(
 			fiber.ErrInternalServerError.Code,
 			string(deleteErr),
@@ -117,3 +181,203 @@ func (h *filesHandler) DeleteFile(c *fiber.Ctx) error {
 	}
 	return entities.NewResponse(c).Success(fiber.StatusOK, nil).Res()
 }
+
+func (h *filesHandler) InitUpload(c *fiber.Ctx) error {
+	req := new(files.UploadInitReq)
+	if err := c.BodyParser(req); err != nil {
+		return entities.NewResponse(c).Error(
+			fiber.ErrBadRequest.Code,
+			string(initUploadErr),
+			err.Error(),
+		).Res()
+	}
+
+	extMap := map[string]string{
+		"png":  "png",
+		"jpg":  "jpg",
+		"jpeg": "jpeg",
+		"pdf":  "pdf",
+		"mp4":  "mp4",
+		"mov":  "mov",
+		"webm": "webm",
+	}
+
+	ext := strings.ToLower(strings.TrimPrefix(filepath.Ext(req.FileName), "."))
+	if extMap[ext] == "" {
+		return entities.NewResponse(c).Error(
+			fiber.ErrBadRequest.Code,
+			string(initUploadErr),
+			"extension is not acceptable",
+		).Res()
+	}
+
+	if req.TotalSize <= 0 || req.TotalSize > h.cfg.App().UploadMaxSize() {
+		return entities.NewResponse(c).Error(
+			fiber.ErrBadRequest.Code,
+			string(initUploadErr),
+			fmt.Sprintf("file size must between 1 byte and %d MiB", int(math.Ceil(float64(h.cfg.App().UploadMaxSize())/math.Pow(1024, 2)))),
+		).Res()
+	}
+
+	if req.Checksum != "" {
+		if b, err := hex.DecodeString(req.Checksum); err != nil || len(b) != 32 {
+			return entities.NewResponse(c).Error(
+				fiber.ErrBadRequest.Code,
+				string(initUploadErr),
+				"checksum must be a sha256 hex digest",
+			).Res()
+		}
+	}
+
+	destination, err := files.CleanDestination(req.Destination)
+	if err != nil {
+		return entities.NewResponse(c).Error(
+			fiber.ErrBadRequest.Code,
+			string(initUploadErr),
+			err.Error(),
+		).Res()
+	}
+	req.Destination = destination
+
+	purposeMap := map[string]files.FilePurpose{
+		"general":       files.PurposeGeneral,
+		"product":       files.PurposeProduct,
+		"transfer_slip": files.PurposeTransferSlip,
+	}
+	req.Purpose = string(purposeMap[strings.ToLower(req.Purpose)])
+
+	upload, err := h.usecase.InitUpload(c.Locals("userId").(string), req)
+	if err != nil {
+		return entities.NewResponse(c).Error(
+			fiber.ErrInternalServerError.Code,
+			string(initUploadErr),
+			err.Error(),
+		).Res()
+	}
+	return entities.NewResponse(c).Success(fiber.StatusCreated, upload).Res()
+}
+
+func (h *filesHandler) FindOneUpload(c *fiber.Ctx) error {
+	uploadId := strings.Trim(c.Params("upload_id"), " ")
+
+	upload, err := h.usecase.FindOneUpload(c.Locals("userId").(string), uploadId)
+	if err != nil {
+		return entities.NewResponse(c).Error(
+			fiber.ErrNotFound.Code,
+			string(findUploadErr),
+			err.Error(),
+		).Res()
+	}
+	return entities.NewResponse(c).Success(fiber.StatusOK, upload).Res()
+}
+
+// UploadPart reads the part from the buffered request body, BodyLimit caps
+// how much that holds so InitUpload never hands out a part size above it.
+func (h *filesHandler) UploadPart(c *fiber.Ctx) error {
+	uploadId := strings.Trim(c.Params("upload_id"), " ")
+	partNumber, err := strconv.Atoi(c.Params("part_number"))
+	if err != nil {
+		return entities.NewResponse(c).Error(
+			fiber.ErrBadRequest.Code,
+			string(uploadPartErr),
+			"part number is invalid",
+		).Res()
+	}
+
+	checksum := c.Get("X-Part-Checksum")
+	if checksum == "" {
+		return entities.NewResponse(c).Error(
+			fiber.ErrBadRequest.Code,
+			string(uploadPartErr),
+			"X-Part-Checksum header is required",
+		).Res()
+	}
+
+	part, err := h.usecase.UploadPart(&files.UploadPartReq{
+		UploadId:   uploadId,
+		OwnerId:    c.Locals("userId").(string),
+		PartNumber: partNumber,
+		Checksum:   checksum,
+		Body:       bytes.NewReader(c.Body()),
+	})
+	if err != nil {
+		switch err.Error() {
+		case "upload not found":
+			return entities.NewResponse(c).Error(
+				fiber.ErrNotFound.Code,
+				string(uploadPartErr),
+				err.Error(),
+			).Res()
+		case "upload is not pending", "part number is out of range", "part size is invalid", "part checksum mismatch":
+			return entities.NewResponse(c).Error(
+				fiber.ErrBadRequest.Code,
+				string(uploadPartErr),
+				err.Error(),
+			).Res()
+		default:
+			return entities.NewResponse(c).Error(
+				fiber.ErrInternalServerError.Code,
+				string(uploadPartErr),
+				err.Error(),
+			).Res()
+		}
+	}
+	return entities.NewResponse(c).Success(fiber.StatusOK, part).Res()
+}
+
+func (h *filesHandler) CompleteUpload(c *fiber.Ctx) error {
+	uploadId := strings.Trim(c.Params("upload_id"), " ")
+
+	res, err := h.usecase.CompleteUpload(c.Locals("userId").(string), uploadId)
+	if err != nil {
+		switch err.Error() {
+		case "upload not found":
+			return entities.NewResponse(c).Error(
+				fiber.ErrNotFound.Code,
+				string(completeErr),
+				err.Error(),
+			).Res()
+		case "upload is not pending", "upload has already been completed", "upload parts are incomplete", "file size is invalid", "file checksum mismatch":
+			return entities.NewResponse(c).Error(
+				fiber.ErrBadRequest.Code,
+				string(completeErr),
+				err.Error(),
+			).Res()
+		default:
+			return entities.NewResponse(c).Error(
+				fiber.ErrInternalServerError.Code,
+				string(completeErr),
+				err.Error(),
+			).Res()
+		}
+	}
+	return entities.NewResponse(c).Success(fiber.StatusCreated, res).Res()
+}
+
+func (h *filesHandler) AbortUpload(c *fiber.Ctx) error {
+	uploadId := strings.Trim(c.Params("upload_id"), " ")
+
+	if err := h.usecase.AbortUpload(c.Locals("userId").(string), uploadId); err != nil {
+		switch err.Error() {
+		case "upload not found":
+			return entities.NewResponse(c).Error(
+				fiber.ErrNotFound.Code,
+				string(abortErr),
+				err.Error(),
+			).Res()
+		case "upload has already been completed":
+			return entities.NewResponse(c).Error(
+				fiber.ErrBadRequest.Code,
+				string(abortErr),
+				err.Error(),
+			).Res()
+		default:
+			return entities.NewResponse(c).Error(
+				fiber.ErrInternalServerError.Code,
+				string(abortErr),
+				err.Error(),
+			).Res()
+		}
+	}
+	return entities.NewResponse(c).Success(fiber.StatusOK, nil).Res()
+}
@@ -0,0 +1,284 @@
+package filesRepositories
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/codepnw/ecommerce/modules/files"
+	"github.com/jmoiron/sqlx"
+)
+
+type IFilesRepository interface {
+	InsertFile(req *files.File) error
+	DeleteFileByDestination(destination string) error
+	RecountReferences() error
+	FindOrphanFiles(age time.Duration) ([]*files.File, error)
+	InsertUpload(req *files.Upload) error
+	FindOneUpload(uploadId string) (*files.Upload, error)
+	UpsertUploadPart(uploadId string, req *files.UploadPart) error
+	UpdateUploadStatus(uploadId string, status files.UploadStatus) error
+	FindStaleUploads(age time.Duration) ([]*files.Upload, error)
+	DeleteUpload(uploadId string) error
+}
+
+type filesRepository struct {
+	db *sqlx.DB
+}
+
+func FilesRepository(db *sqlx.DB) IFilesRepository {
+	return &filesRepository{db: db}
+}
+
+func (r *filesRepository) InsertFile(req *files.File) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	query := `
+		INSERT INTO "files" (
+			"filename",
+			"destination",
+			"url",
+			"owner_id",
+			"purpose",
+			"is_private"
+		)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		ON CONFLICT ("destination") DO UPDATE SET
+			"url" = EXCLUDED."url",
+			"owner_id" = EXCLUDED."owner_id",
+			"purpose" = EXCLUDED."purpose",
+			"is_private" = EXCLUDED."is_private"
+		RETURNING "id";`
+
+	if err := r.db.QueryRowContext(
+		ctx,
+		query,
+		req.FileName,
+		req.Destination,
+		req.Url,
+		req.OwnerId,
+		req.Purpose,
+		req.IsPrivate,
+	).Scan(&req.Id); err != nil {
+		return fmt.Errorf("insert file failed: %v", err)
+	}
+	return nil
+}
+
+func (r *filesRepository) DeleteFileByDestination(destination string) error {
+	query := `DELETE FROM "files" WHERE "destination" = $1;`
+
+	if _, err := r.db.ExecContext(context.Background(), query, destination); err != nil {
+		return fmt.Errorf("delete file failed: %v", err)
+	}
+	return nil
+}
+
+// RecountReferences syncs "ref_count" with the rows that point at each file,
+// which also catches references dropped by cascading deletes.
+func (r *filesRepository) RecountReferences() error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+
+	query := `
+		WITH "rc" AS (
+			SELECT
+				"f"."id",
+				(
+					SELECT
+						COUNT(*)
+					FROM "images" "i"
+					WHERE "i"."url" = "f"."url"
+				) + (
+					SELECT
+						COUNT(*)
+					FROM "orders" "o"
+					WHERE "o"."transfer_slip"->>'url' = "f"."url"
+				) AS "count"
+			FROM "files" "f"
+		)
+		UPDATE "files" SET
+			"ref_count" = "rc"."count"
+		FROM "rc"
+		WHERE "files"."id" = "rc"."id"
+		AND "files"."ref_count" <> "rc"."count";`
+
+	if _, err := r.db.ExecContext(ctx, query); err != nil {
+		return fmt.Errorf("recount file references failed: %v", err)
+	}
+	return nil
+}
+
+func (r *filesRepository) FindOrphanFiles(age time.Duration) ([]*files.File, error) {
+	query := `
+		SELECT
+			"id",
+			"filename",
+			"destination",
+			"url",
+			"owner_id",
+			"purpose",
+			"ref_count",
+			"is_private",
+			"created_at"
+		FROM "files"
+		WHERE "ref_count" = 0
+		AND "created_at" < NOW() - ($1 * INTERVAL '1 second');`
+
+	orphans := make([]*files.File, 0)
+	if err := r.db.Select(&orphans, query, int64(age.Seconds())); err != nil {
+		return nil, fmt.Errorf("find orphan files failed: %v", err)
+	}
+	return orphans, nil
+}
+
+func (r *filesRepository) InsertUpload(req *files.Upload) error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	query := `
+		INSERT INTO "uploads" (
+			"owner_id",
+			"filename",
+			"destination",
+			"purpose",
+			"total_size",
+			"part_size",
+			"checksum"
+		)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING "id", "status", "created_at";`
+
+	if err := r.db.QueryRowxContext(
+		ctx,
+		query,
+		req.OwnerId,
+		req.FileName,
+		req.Destination,
+		req.Purpose,
+		req.TotalSize,
+		req.PartSize,
+		req.Checksum,
+	).Scan(&req.Id, &req.Status, &req.CreatedAt); err != nil {
+		return fmt.Errorf("insert upload failed: %v", err)
+	}
+	return nil
+}
+
+func (r *filesRepository) FindOneUpload(uploadId string) (*files.Upload, error) {
+	query := `
+		SELECT
+			"id",
+			"owner_id",
+			"filename",
+			"destination",
+			"purpose",
+			"total_size",
+			"part_size",
+			"checksum",
+			"status",
+			"created_at"
+		FROM "uploads"
+		WHERE "id" = $1;`
+
+	upload := &files.Upload{
+		Parts: make([]*files.UploadPart, 0),
+	}
+	if err := r.db.Get(upload, query, uploadId); err != nil {
+		return nil, fmt.Errorf("upload not found")
+	}
+
+	partsQuery := `
+		SELECT
+			"part_number",
+			"size",
+			"checksum"
+		FROM "upload_parts"
+		WHERE "upload_id" = $1
+		ORDER BY "part_number" ASC;`
+
+	if err := r.db.Select(&upload.Parts, partsQuery, uploadId); err != nil {
+		return nil, fmt.Errorf("get upload parts failed: %v", err)
+	}
+	return upload, nil
+}
+
+// UpsertUploadPart also touches the upload, the stale sweep goes by its
+// updated_at and must not take an upload that is still receiving parts.
+func (r *filesRepository) UpsertUploadPart(uploadId string, req *files.UploadPart) error {
+	query := `
+		WITH "part" AS (
+			INSERT INTO "upload_parts" (
+				"upload_id",
+				"part_number",
+				"size",
+				"checksum"
+			)
+			VALUES ($1, $2, $3, $4)
+			ON CONFLICT ("upload_id", "part_number") DO UPDATE SET
+				"size" = EXCLUDED."size",
+				"checksum" = EXCLUDED."checksum"
+			RETURNING "upload_id"
+		)
+		UPDATE "uploads" SET
+			"updated_at" = NOW()
+		WHERE "id" = (SELECT "upload_id" FROM "part");`
+
+	if _, err := r.db.ExecContext(
+		context.Background(),
+		query,
+		uploadId,
+		req.PartNumber,
+		req.Size,
+		req.Checksum,
+	); err != nil {
+		return fmt.Errorf("insert upload part failed: %v", err)
+	}
+	return nil
+}
+
+func (r *filesRepository) UpdateUploadStatus(uploadId string, status files.UploadStatus) error {
+	query := `
+		UPDATE "uploads" SET
+			"status" = $1
+		WHERE "id" = $2;`
+
+	if _, err := r.db.ExecContext(context.Background(), query, string(status), uploadId); err != nil {
+		return fmt.Errorf("update upload status failed: %v", err)
+	}
+	return nil
+}
+
+func (r *filesRepository) FindStaleUploads(age time.Duration) ([]*files.Upload, error) {
+	query := `
+		SELECT
+			"id",
+			"owner_id",
+			"filename",
+			"destination",
+			"purpose",
+			"total_size",
+			"part_size",
+			"checksum",
+			"status",
+			"created_at"
+		FROM "uploads"
+		WHERE "status" <> 'completed'
+		AND "updated_at" < NOW() - ($1 * INTERVAL '1 second');`
+
+	uploads := make([]*files.Upload, 0)
+	if err := r.db.Select(&uploads, query, int64(age.Seconds())); err != nil {
+		return nil, fmt.Errorf("find stale uploads failed: %v", err)
+	}
+	return uploads, nil
+}
+
+func (r *filesRepository) DeleteUpload(uploadId string) error {
+	query := `DELETE FROM "uploads" WHERE "id" = $1;`
+
+	if _, err := r.db.ExecContext(context.Background(), query, uploadId); err != nil {
+		return fmt.Errorf("delete upload failed: %v", err)
+	}
+	return nil
+}
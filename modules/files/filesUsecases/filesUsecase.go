@@ -2,136 +2,501 @@ package filesUsecases
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
+	"log"
+	"net/url"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/codepnw/ecommerce/config"
 	"github.com/codepnw/ecommerce/modules/files"
+	"github.com/codepnw/ecommerce/modules/files/filesRepositories"
+	"github.com/codepnw/ecommerce/pkg/utils"
+	"github.com/codepnw/ecommerce/pkg/workers"
 )
 
 type IFilesUsecase interface {
-	UploadToStorage(req []*files.FileReq) ([]*files.FileRes, error)
-	DeleteFileOnStorage(req []*files.DeleteFileReq) error
+	UploadToStorage(ctx context.Context, req []*files.FileReq) ([]*files.FileRes, error)
+	DeleteFileOnStorage(ctx context.Context, req []*files.DeleteFileReq) error
+	DeleteOrphanFiles() (int, error)
+	SweepOrphanFiles(ctx context.Context)
+	SignUrl(rawUrl string) string
+	UnsignUrl(rawUrl string) string
+	InitUpload(ownerId string, req *files.UploadInitReq) (*files.Upload, error)
+	FindOneUpload(ownerId, uploadId string) (*files.Upload, error)
+	UploadPart(req *files.UploadPartReq) (*files.UploadPart, error)
+	CompleteUpload(ownerId, uploadId string) (*files.FileRes, error)
+	AbortUpload(ownerId, uploadId string) error
+	DeleteStaleUploads() (int, error)
 }
 
 type filesUsecase struct {
-	cfg config.IConfig
+	cfg        config.IConfig
+	repository filesRepositories.IFilesRepository
+	pool       workers.IPool
 }
 
-func FilesUsecase(cfg config.IConfig) IFilesUsecase {
-	return &filesUsecase{cfg: cfg}
+func FilesUsecase(cfg config.IConfig, repository filesRepositories.IFilesRepository, pool workers.IPool) IFilesUsecase {
+	return &filesUsecase{
+		cfg:        cfg,
+		repository: repository,
+		pool:       pool,
+	}
 }
 
-type filesPub struct {
-	destination string
-	file        *files.FileRes
+func (u *filesUsecase) uploadToStorage(ctx context.Context, job *files.FileReq) (*files.FileRes, error) {
+	container, err := job.File.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer container.Close()
+
+	// Upload an object to storage
+	root := files.StorageRoot(job.Private)
+	dest := root + job.Destination
+	if err := os.MkdirAll(root+strings.Replace(job.Destination, job.FileName, "", 1), 0777); err != nil {
+		return nil, fmt.Errorf("mkdir \"%s%s\" failed: %v", root, job.Destination, err)
+	}
+
+	out, err := os.Create(dest)
+	if err != nil {
+		return nil, fmt.Errorf("write file failed: %v", err)
+	}
+	if _, err := io.Copy(out, container); err != nil {
+		out.Close()
+		os.Remove(dest)
+		return nil, fmt.Errorf("write file failed: %v", err)
+	}
+	out.Close()
+
+	// The caller may have given up while the file was being written
+	if err := ctx.Err(); err != nil {
+		os.Remove(dest)
+		return nil, err
+	}
+
+	fileUrl := fmt.Sprintf("http://%s:%d/%s", u.cfg.App().Host(), u.cfg.App().Port(), job.Destination)
+	if job.Private {
+		fileUrl = fmt.Sprintf("http://%s:%d/private/%s", u.cfg.App().Host(), u.cfg.App().Port(), job.Destination)
+	}
+
+	// Register the object so it can be swept if it is never referenced
+	record := &files.File{
+		FileName:    job.FileName,
+		Destination: job.Destination,
+		Url:         fileUrl,
+		Purpose:     job.Purpose,
+		IsPrivate:   job.Private,
+	}
+	if job.OwnerId != "" {
+		record.OwnerId = &job.OwnerId
+	}
+	if record.Purpose == "" {
+		record.Purpose = string(files.PurposeGeneral)
+	}
+	if err := u.repository.InsertFile(record); err != nil {
+		os.Remove(dest)
+		return nil, err
+	}
+
+	return &files.FileRes{
+		Id:       record.Id,
+		FileName: job.FileName,
+		Url:      u.SignUrl(fileUrl),
+	}, nil
 }
 
-func (u *filesUsecase) uploadToStorageWorker(ctx context.Context, jobs <-chan *files.FileReq, results chan<- *files.FileRes, errs chan<- error) {
-	for job := range jobs {
-		cotainer, err := job.File.Open()
+func (u *filesUsecase) UploadToStorage(ctx context.Context, req []*files.FileReq) ([]*files.FileRes, error) {
+	ctx, cancel := context.WithTimeout(ctx, time.Second*60)
+	defer cancel()
+
+	results := make([]*files.FileRes, len(req))
+	jobs := make([]workers.Job, 0, len(req))
+	for i := range req {
+		i := i
+		jobs = append(jobs, func(ctx context.Context) error {
+			result, err := u.uploadToStorage(ctx, req[i])
+			if err != nil {
+				return err
+			}
+			results[i] = result
+			return nil
+		})
+	}
+
+	res := make([]*files.FileRes, 0)
+	failed := make([]*files.FileFailure, 0)
+	for i, err := range u.pool.Run(ctx, jobs) {
 		if err != nil {
-			errs <- err
-			return
+			failed = append(failed, &files.FileFailure{
+				Destination: req[i].Destination,
+				Error:       err.Error(),
+			})
+			continue
 		}
+		res = append(res, results[i])
+	}
+
+	if len(failed) > 0 {
+		return res, &files.StorageError{Failed: failed}
+	}
+	return res, nil
+}
+
+func (u *filesUsecase) deleteFromStorage(ctx context.Context, job *files.DeleteFileReq) error {
+	if err := os.Remove(files.StorageRoot(job.Private) + job.Destination); err != nil {
+		return fmt.Errorf("remove file: %s failed: %v", job.Destination, err)
+	}
+	if err := u.repository.DeleteFileByDestination(job.Destination); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (u *filesUsecase) DeleteFileOnStorage(ctx context.Context, req []*files.DeleteFileReq) error {
+	ctx, cancel := context.WithTimeout(ctx, time.Second*60)
+	defer cancel()
+
+	jobs := make([]workers.Job, 0, len(req))
+	for i := range req {
+		i := i
+		jobs = append(jobs, func(ctx context.Context) error {
+			return u.deleteFromStorage(ctx, req[i])
+		})
+	}
 
-		b, err := io.ReadAll(cotainer)
+	failed := make([]*files.FileFailure, 0)
+	for i, err := range u.pool.Run(ctx, jobs) {
 		if err != nil {
-			errs <- err
-			return
+			failed = append(failed, &files.FileFailure{
+				Destination: req[i].Destination,
+				Error:       err.Error(),
+			})
+		}
+	}
+
+	if len(failed) > 0 {
+		return &files.StorageError{Failed: failed}
+	}
+	return nil
+}
+
+func (u *filesUsecase) DeleteOrphanFiles() (int, error) {
+	if err := u.repository.RecountReferences(); err != nil {
+		return 0, err
+	}
+
+	orphans, err := u.repository.FindOrphanFiles(u.cfg.App().FileOrphanAge())
+	if err != nil {
+		return 0, err
+	}
+
+	var deleted int
+	for _, f := range orphans {
+		if err := os.Remove(files.StorageRoot(f.IsPrivate) + f.Destination); err != nil && !os.IsNotExist(err) {
+			log.Printf("remove orphan file: %s failed: %v\n", f.Destination, err)
+			continue
+		}
+		if err := u.repository.DeleteFileByDestination(f.Destination); err != nil {
+			log.Printf("delete orphan file: %s failed: %v\n", f.Destination, err)
+			continue
 		}
+		deleted++
+	}
+	return deleted, nil
+}
 
-		// Upload an object to storage
-		dest := fmt.Sprintf("./assets/images/%s", job.Destination)
-		if err := os.WriteFile(dest, b, 0777); err != nil {
-			if err := os.MkdirAll("./assets/images/"+strings.Replace(job.Destination, job.FileName, "", 1), 0777); err != nil {
-				errs <- fmt.Errorf("mkdir \"./assets/images/%s\" failed: %v", err, job.Destination)
-				return
+func (u *filesUsecase) SweepOrphanFiles(ctx context.Context) {
+	ticker := time.NewTicker(u.cfg.App().FileSweepInterval())
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			deleted, err := u.DeleteOrphanFiles()
+			if err != nil {
+				log.Printf("sweep orphan files failed: %v\n", err)
+			} else if deleted > 0 {
+				log.Printf("swept %d orphan files\n", deleted)
 			}
-			if err := os.WriteFile(dest, b, 0777); err != nil {
-				errs <- fmt.Errorf("write file failed: %v", err)
-				return
+
+			stale, err := u.DeleteStaleUploads()
+			if err != nil {
+				log.Printf("sweep stale uploads failed: %v\n", err)
+			} else if stale > 0 {
+				log.Printf("swept %d stale uploads\n", stale)
 			}
 		}
+	}
+}
 
-		newFile := &filesPub{
-			file: &files.FileRes{
-				FileName: job.FileName,
-				Url:      fmt.Sprintf("http://%s:%d/%s", u.cfg.App().Host(), u.cfg.App().Port(), job.Destination),
-			},
-			destination: job.Destination,
-		}
+// SignUrl returns a fresh time-limited link for private file urls, public
+// urls are returned untouched.
+func (u *filesUsecase) SignUrl(rawUrl string) string {
+	parsed, err := url.Parse(rawUrl)
+	if err != nil || !strings.HasPrefix(parsed.Path, "/private/") {
+		return rawUrl
+	}
+
+	expires := time.Now().Add(u.cfg.App().FileSignExpires()).Unix()
+	query := url.Values{}
+	query.Set("expires", strconv.FormatInt(expires, 10))
+	query.Set("signature", utils.SignPath(u.cfg.App().FileSignKey(), parsed.Path, expires))
+	parsed.RawQuery = query.Encode()
+
+	return parsed.String()
+}
 
-		errs <- nil
-		results <- newFile.file
+// UnsignUrl strips the signature from a private file url so the stored value
+// does not expire.
+func (u *filesUsecase) UnsignUrl(rawUrl string) string {
+	parsed, err := url.Parse(rawUrl)
+	if err != nil || !strings.HasPrefix(parsed.Path, "/private/") {
+		return rawUrl
 	}
+	parsed.RawQuery = ""
+	return parsed.String()
 }
 
-func (u *filesUsecase) UploadToStorage(req []*files.FileReq) ([]*files.FileRes, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*60)
-	defer cancel()
+func totalParts(upload *files.Upload) int {
+	return int((upload.TotalSize + upload.PartSize - 1) / upload.PartSize)
+}
+
+func (u *filesUsecase) findOwnUpload(ownerId, uploadId string) (*files.Upload, error) {
+	upload, err := u.repository.FindOneUpload(uploadId)
+	if err != nil {
+		return nil, err
+	}
+	if upload.OwnerId != ownerId {
+		return nil, fmt.Errorf("upload not found")
+	}
+	upload.TotalParts = totalParts(upload)
+	return upload, nil
+}
 
-	jobsCh := make(chan *files.FileReq, len(req))
-	resultsCh := make(chan *files.FileRes, len(req))
-	errsCh := make(chan error, len(req))
+func (u *filesUsecase) InitUpload(ownerId string, req *files.UploadInitReq) (*files.Upload, error) {
+	partSize := int64(u.cfg.App().UploadPartSize())
+	if limit := int64(u.cfg.App().BodyLimit()); limit > 0 && partSize > limit {
+		partSize = limit
+	}
 
-	res := make([]*files.FileRes, 0)
+	ext := strings.ToLower(strings.TrimPrefix(filepath.Ext(req.FileName), "."))
+	filename := utils.RandFileName(ext)
 
-	for _, r := range req {
-		jobsCh <- r
+	upload := &files.Upload{
+		OwnerId:     ownerId,
+		FileName:    filename,
+		Destination: strings.Trim(req.Destination, "/") + "/" + filename,
+		Purpose:     req.Purpose,
+		TotalSize:   req.TotalSize,
+		PartSize:    partSize,
+		Checksum:    strings.ToLower(req.Checksum),
+		Parts:       make([]*files.UploadPart, 0),
+	}
+	if upload.Purpose == "" {
+		upload.Purpose = string(files.PurposeGeneral)
 	}
-	close(jobsCh)
 
-	numWorkers := 5
-	for i := 0; i < numWorkers; i++ {
-		go u.uploadToStorageWorker(ctx, jobsCh, resultsCh, errsCh)
+	if err := u.repository.InsertUpload(upload); err != nil {
+		return nil, err
 	}
+	upload.TotalParts = totalParts(upload)
+	return upload, nil
+}
 
-	for a := 0; a < len(req); a++ {
-		err := <-errsCh
-		if err != nil {
-			return nil, err
-		}
+func (u *filesUsecase) FindOneUpload(ownerId, uploadId string) (*files.Upload, error) {
+	return u.findOwnUpload(ownerId, uploadId)
+}
 
-		result := <-resultsCh
-		res = append(res, result)
+func (u *filesUsecase) UploadPart(req *files.UploadPartReq) (*files.UploadPart, error) {
+	upload, err := u.findOwnUpload(req.OwnerId, req.UploadId)
+	if err != nil {
+		return nil, err
 	}
-	return res, nil
+	if upload.Status != string(files.UploadPending) {
+		return nil, fmt.Errorf("upload is not pending")
+	}
+	if req.PartNumber < 1 || req.PartNumber > upload.TotalParts {
+		return nil, fmt.Errorf("part number is out of range")
+	}
+
+	expected := upload.PartSize
+	if req.PartNumber == upload.TotalParts {
+		expected = upload.TotalSize - upload.PartSize*int64(upload.TotalParts-1)
+	}
+
+	dest := files.UploadPartPath(upload.Id, req.PartNumber)
+	if err := os.MkdirAll(filepath.Dir(dest), 0777); err != nil {
+		return nil, fmt.Errorf("mkdir \"%s\" failed: %v", filepath.Dir(dest), err)
+	}
+
+	// Write to a temporary name first so a broken transfer never replaces a
+	// part that was already accepted
+	tmp, err := os.CreateTemp(filepath.Dir(dest), "*.tmp")
+	if err != nil {
+		return nil, fmt.Errorf("create part failed: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	hasher := sha256.New()
+	written, err := io.Copy(io.MultiWriter(tmp, hasher), io.LimitReader(req.Body, expected+1))
+	tmp.Close()
+	if err != nil {
+		return nil, fmt.Errorf("write part failed: %v", err)
+	}
+	if written != expected {
+		return nil, fmt.Errorf("part size is invalid")
+	}
+
+	checksum := hex.EncodeToString(hasher.Sum(nil))
+	if checksum != strings.ToLower(req.Checksum) {
+		return nil, fmt.Errorf("part checksum mismatch")
+	}
+
+	if err := os.Rename(tmp.Name(), dest); err != nil {
+		return nil, fmt.Errorf("write part failed: %v", err)
+	}
+
+	part := &files.UploadPart{
+		PartNumber: req.PartNumber,
+		Size:       written,
+		Checksum:   checksum,
+	}
+	if err := u.repository.UpsertUploadPart(upload.Id, part); err != nil {
+		return nil, err
+	}
+	return part, nil
 }
 
-func (u *filesUsecase) deleteFromStorageFileWorkers(ctx context.Context, jobs <-chan *files.DeleteFileReq, errs chan<- error) {
-	for job := range jobs {
-		if err := os.Remove("./assets/images/" + job.Destination); err != nil {
-			errs <- fmt.Errorf("remove file: %s failed: %v", job.Destination, err)
-			return
+func (u *filesUsecase) CompleteUpload(ownerId, uploadId string) (*files.FileRes, error) {
+	upload, err := u.findOwnUpload(ownerId, uploadId)
+	if err != nil {
+		return nil, err
+	}
+	switch upload.Status {
+	case string(files.UploadCompleted):
+		return nil, fmt.Errorf("upload has already been completed")
+	case string(files.UploadAborted):
+		return nil, fmt.Errorf("upload is not pending")
+	}
+	if len(upload.Parts) != upload.TotalParts {
+		return nil, fmt.Errorf("upload parts are incomplete")
+	}
+
+	private := upload.Purpose == string(files.PurposeTransferSlip)
+	dest := files.StorageRoot(private) + upload.Destination
+	if err := os.MkdirAll(filepath.Dir(dest), 0777); err != nil {
+		return nil, fmt.Errorf("mkdir \"%s\" failed: %v", filepath.Dir(dest), err)
+	}
+
+	out, err := os.Create(dest)
+	if err != nil {
+		return nil, fmt.Errorf("create file failed: %v", err)
+	}
+
+	// Stream the parts one by one, the file is never held in memory
+	hasher := sha256.New()
+	var size int64
+	for _, part := range upload.Parts {
+		in, err := os.Open(files.UploadPartPath(upload.Id, part.PartNumber))
+		if err != nil {
+			out.Close()
+			os.Remove(dest)
+			return nil, fmt.Errorf("open part %d failed: %v", part.PartNumber, err)
+		}
+		n, err := io.Copy(io.MultiWriter(out, hasher), in)
+		in.Close()
+		if err != nil {
+			out.Close()
+			os.Remove(dest)
+			return nil, fmt.Errorf("assemble part %d failed: %v", part.PartNumber, err)
 		}
-		errs <- nil
+		size += n
 	}
-}
+	out.Close()
 
-func (u *filesUsecase) DeleteFileOnStorage(req []*files.DeleteFileReq) error {
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*60)
-	defer cancel()
+	if size != upload.TotalSize {
+		os.Remove(dest)
+		return nil, fmt.Errorf("file size is invalid")
+	}
+	if upload.Checksum != "" && hex.EncodeToString(hasher.Sum(nil)) != upload.Checksum {
+		os.Remove(dest)
+		return nil, fmt.Errorf("file checksum mismatch")
+	}
 
-	jobsCh := make(chan *files.DeleteFileReq, len(req))
-	errsCh := make(chan error, len(req))
+	fileUrl := fmt.Sprintf("http://%s:%d/%s", u.cfg.App().Host(), u.cfg.App().Port(), upload.Destination)
+	if private {
+		fileUrl = fmt.Sprintf("http://%s:%d/private/%s", u.cfg.App().Host(), u.cfg.App().Port(), upload.Destination)
+	}
+
+	record := &files.File{
+		FileName:    upload.FileName,
+		Destination: upload.Destination,
+		Url:         fileUrl,
+		OwnerId:     &upload.OwnerId,
+		Purpose:     upload.Purpose,
+		IsPrivate:   private,
+	}
+	if err := u.repository.InsertFile(record); err != nil {
+		os.Remove(dest)
+		return nil, err
+	}
 
-	for _, r := range req {
-		jobsCh <- r
+	if err := u.repository.UpdateUploadStatus(upload.Id, files.UploadCompleted); err != nil {
+		return nil, err
 	}
-	close(jobsCh)
+	os.RemoveAll(filepath.Dir(files.UploadPartPath(upload.Id, 0)))
 
-	numWorkers := 5
-	for i := 0; i < numWorkers; i++ {
-		go u.deleteFromStorageFileWorkers(ctx, jobsCh, errsCh)
+	return &files.FileRes{
+		Id:       record.Id,
+		FileName: record.FileName,
+		Url:      u.SignUrl(record.Url),
+	}, nil
+}
+
+func (u *filesUsecase) AbortUpload(ownerId, uploadId string) error {
+	upload, err := u.findOwnUpload(ownerId, uploadId)
+	if err != nil {
+		return err
+	}
+	if upload.Status == string(files.UploadCompleted) {
+		return fmt.Errorf("upload has already been completed")
 	}
 
-	for a := 0; a < len(req); a++ {
-		err := <-errsCh
+	if err := u.repository.UpdateUploadStatus(upload.Id, files.UploadAborted); err != nil {
 		return err
 	}
+	if err := os.RemoveAll(filepath.Dir(files.UploadPartPath(upload.Id, 0))); err != nil {
+		return fmt.Errorf("remove upload parts failed: %v", err)
+	}
 	return nil
 }
+
+func (u *filesUsecase) DeleteStaleUploads() (int, error) {
+	uploads, err := u.repository.FindStaleUploads(u.cfg.App().FileOrphanAge())
+	if err != nil {
+		return 0, err
+	}
+
+	var deleted int
+	for _, upload := range uploads {
+		if err := os.RemoveAll(filepath.Dir(files.UploadPartPath(upload.Id, 0))); err != nil {
+			log.Printf("remove upload parts: %s failed: %v\n", upload.Id, err)
+			continue
+		}
+		if err := u.repository.DeleteUpload(upload.Id); err != nil {
+			log.Printf("delete upload: %s failed: %v\n", upload.Id, err)
+			continue
+		}
+		deleted++
+	}
+	return deleted, nil
+}
@@ -1,6 +1,14 @@
 package middlewares
 
-type Role struct {
-	Id int `db:"id"`
-	Title string `db:"title"`
-}
\ No newline at end of file
+// Session is the oauth row an access token belongs to, RoleId is the current
+// role of the user and wins over the one in the token claims.
+type Session struct {
+	OauthId string `db:"id"`
+	RoleId  int    `db:"role_id"`
+}
+
+type ApiKey struct {
+	Id         string   `db:"id"`
+	Scopes     []string `db:"-"`
+	ScopesJson string   `db:"scopes"`
+}
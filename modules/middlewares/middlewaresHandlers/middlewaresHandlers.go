@@ -2,11 +2,15 @@ package middlewaresHandlers
 
 import (
 	"net/http"
+	"path/filepath"
+	"strconv"
 	"strings"
 
 	"github.com/codepnw/ecommerce/config"
+	"github.com/codepnw/ecommerce/modules/appinfo"
 	"github.com/codepnw/ecommerce/modules/entities"
 	"github.com/codepnw/ecommerce/modules/middlewares/middlewaresUsecases"
+	"github.com/codepnw/ecommerce/modules/roles"
 	"github.com/codepnw/ecommerce/pkg/auth"
 	"github.com/codepnw/ecommerce/pkg/utils"
 	"github.com/gofiber/fiber/v2"
@@ -23,6 +27,9 @@ const (
 	paramsCheckErr middlewaresErrCode = "middleware-003"
 	authorizeErr   middlewaresErrCode = "middleware-004"
 	apiKeyErr      middlewaresErrCode = "middleware-005"
+	privateFileErr middlewaresErrCode = "middleware-006"
+	verifiedErr    middlewaresErrCode = "middleware-007"
+	impersonateErr middlewaresErrCode = "middleware-008"
 )
 
 type IMiddlewaresHandlers interface {
@@ -30,20 +37,25 @@ type IMiddlewaresHandlers interface {
 	RouterCheck() fiber.Handler
 	Logger() fiber.Handler
 	JwtAuth() fiber.Handler
-	ParamsCheck() fiber.Handler
-	Authorize(expectRoleId ...int) fiber.Handler
-	ApiKeyAuth() fiber.Handler
+	ParamsCheck(bypass ...string) fiber.Handler
+	RequirePermission(permissions ...string) fiber.Handler
+	ApiKeyAuth(scopes ...string) fiber.Handler
 	StreamingFile() fiber.Handler
+	StreamingPrivateFile() fiber.Handler
+	VerifiedEmail() fiber.Handler
+	NotImpersonated() fiber.Handler
 }
 
 type middlewaresHandlers struct {
 	cfg     config.IConfig
+	keys    auth.IKeyStore
 	usecase middlewaresUsecases.IMiddlewaresUsecases
 }
 
-func MiddlewaresHandlers(cfg config.IConfig, usecase middlewaresUsecases.IMiddlewaresUsecases) IMiddlewaresHandlers {
+func MiddlewaresHandlers(cfg config.IConfig, keys auth.IKeyStore, usecase middlewaresUsecases.IMiddlewaresUsecases) IMiddlewaresHandlers {
 	return &middlewaresHandlers{
 		cfg:     cfg,
+		keys:    keys,
 		usecase: usecase,
 	}
 }
@@ -55,7 +67,7 @@ func (h *middlewaresHandlers) Cors() fiber.Handler {
 		AllowMethods:     "GET,POST,HEAD,PUT,DELETE,PATCH",
 		AllowHeaders:     "",
 		AllowCredentials: false,
-		ExposeHeaders:    "",
+		ExposeHeaders:    "X-Impersonated-By",
 		MaxAge:           0,
 	})
 }
@@ -81,7 +93,7 @@ func (h *middlewaresHandlers) Logger() fiber.Handler {
 func (h *middlewaresHandlers) JwtAuth() fiber.Handler {
 	return func(c *fiber.Ctx) error {
 		token := strings.TrimPrefix(c.Get("Authorization"), "Bearer ")
-		result, err := auth.ParseToken(h.cfg.Jwt(), token)
+		result, err := auth.ParseToken(h.cfg.Jwt(), h.keys, token)
 		if err != nil {
 			return entities.NewResponse(c).Error(
 				fiber.ErrUnauthorized.Code,
@@ -90,8 +102,11 @@ func (h *middlewaresHandlers) JwtAuth() fiber.Handler {
 			).Res()
 		}
 
+		// The role comes from the session, a role change must not wait for
+		// the token to expire
 		claims := result.Claims
-		if !h.usecase.FindAccessToken(claims.Id, token) {
+		roleId, ok := h.usecase.FindAccessToken(claims.Id, token)
+		if !ok {
 			return entities.NewResponse(c).Error(
 				fiber.ErrUnauthorized.Code,
 				string(jwtAuthErr),
@@ -99,17 +114,39 @@ func (h *middlewaresHandlers) JwtAuth() fiber.Handler {
 			).Res()
 		}
 
+		permissions, err := h.usecase.FindPermissions(roleId)
+		if err != nil {
+			return entities.NewResponse(c).Error(
+				fiber.ErrInternalServerError.Code,
+				string(jwtAuthErr),
+				err.Error(),
+			).Res()
+		}
+
 		c.Locals("userId", claims.Id)
-		c.Locals("userRoleId", claims.RoleId)
+		c.Locals("userRoleId", roleId)
+		c.Locals("userPermissions", permissions)
+
+		// Every response to an impersonated session says so, clients show
+		// it and the request log records who was acting
+		if claims.Impersonator != "" {
+			c.Locals("impersonator", claims.Impersonator)
+			c.Set("X-Impersonated-By", claims.Impersonator)
+		}
 		return c.Next()
 	}
 }
 
-func (h *middlewaresHandlers) ParamsCheck() fiber.Handler {
+// ParamsCheck lets users act only on their own user_id, unless they hold one
+// of the bypass permissions.
+func (h *middlewaresHandlers) ParamsCheck(bypass ...string) fiber.Handler {
 	return func(c *fiber.Ctx) error {
 		userId := c.Locals("userId")
-		if c.Locals("userRoleId").(int) == 2 {
-			return c.Next()
+		permissions, _ := c.Locals("userPermissions").([]string)
+		for _, p := range bypass {
+			if roles.HasPermission(permissions, p) {
+				return c.Next()
+			}
 		}
 		if c.Params("user_id") != userId {
 			return entities.NewResponse(c).Error(
@@ -122,64 +159,126 @@ func (h *middlewaresHandlers) ParamsCheck() fiber.Handler {
 	}
 }
 
-func (h *middlewaresHandlers) Authorize(expectRoleId ...int) fiber.Handler {
+// RequirePermission must run after JwtAuth, the role of the user has to hold
+// every permission given.
+func (h *middlewaresHandlers) RequirePermission(permissions ...string) fiber.Handler {
 	return func(c *fiber.Ctx) error {
-		userRoleId, ok := c.Locals("userRoleId").(int)
+		granted, ok := c.Locals("userPermissions").([]string)
 		if !ok {
 			return entities.NewResponse(c).Error(
 				fiber.ErrUnauthorized.Code,
 				string(authorizeErr),
-				"user_id is not type int",
+				"permissions are not loaded",
 			).Res()
 		}
 
-		roles, err := h.usecase.FindRole()
-		if err != nil {
-			return entities.NewResponse(c).Error(
-				fiber.ErrInternalServerError.Code,
-				string(authorizeErr),
-				err.Error(),
-			).Res()
-		}
-
-		sum := 0
-		for _, v := range expectRoleId {
-			sum += v
-		}
-
-		expectValue := utils.BinaryConverter(sum, len(roles))
-		userValue := utils.BinaryConverter(userRoleId, len(roles))
-
-		for i := range userValue {
-			if userValue[i]&expectValue[i] == 1 {
-				return c.Next()
+		for _, p := range permissions {
+			if !roles.HasPermission(granted, p) {
+				return entities.NewResponse(c).Error(
+					fiber.ErrUnauthorized.Code,
+					string(authorizeErr),
+					"no permission to access",
+				).Res()
 			}
 		}
-
-		return entities.NewResponse(c).Error(
-			fiber.ErrUnauthorized.Code,
-			string(authorizeErr),
-			"no permission to access",
-		).Res()
+		return c.Next()
 	}
 }
 
-func (h *middlewaresHandlers) ApiKeyAuth() fiber.Handler {
+// ApiKeyAuth accepts a managed key holding every scope given, a key with the
+// "*" scope passes any route.
+func (h *middlewaresHandlers) ApiKeyAuth(scopes ...string) fiber.Handler {
 	return func(c *fiber.Ctx) error {
 		key := c.Get("X-Api-Key")
-		if _, err := auth.ParseApiKey(h.cfg.Jwt(), key); err != nil {
+
+		var granted []string
+		apiKey, err := h.usecase.FindApiKey(key)
+		if err == nil {
+			granted = apiKey.Scopes
+			c.Locals("apiKeyId", apiKey.Id)
+		} else if _, legacyErr := auth.ParseApiKey(h.cfg.Jwt(), key); h.cfg.Auth().LegacyApiKeys() && legacyErr == nil {
+			// Keys signed with the shared secret are kept working only on
+			// request and only for the routes they had before
+			granted = appinfo.LegacyApiKeyScopes
+		} else {
 			return entities.NewResponse(c).Error(
 				fiber.ErrUnauthorized.Code,
 				string(apiKeyErr),
 				"api-key is invalid or required",
 			).Res()
 		}
+
+		for _, scope := range scopes {
+			if !hasScope(granted, scope) {
+				return entities.NewResponse(c).Error(
+					fiber.ErrForbidden.Code,
+					string(apiKeyErr),
+					"api-key is missing scope "+scope,
+				).Res()
+			}
+		}
 		return c.Next()
 	}
 }
 
+func hasScope(granted []string, scope string) bool {
+	for _, g := range granted {
+		if g == scope || (g == appinfo.ScopeAll && scope != appinfo.ScopeMetricsRead) {
+			return true
+		}
+	}
+	return false
+}
+
 func (h *middlewaresHandlers) StreamingFile() fiber.Handler {
 	return filesystem.New(filesystem.Config{
 		Root: http.Dir("./assets/images"),
 	})
 }
+
+func (h *middlewaresHandlers) StreamingPrivateFile() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		expires, err := strconv.ParseInt(c.Query("expires"), 10, 64)
+		if err != nil || !utils.VerifyPath(h.cfg.App().FileSignKey(), c.Path(), expires, c.Query("signature")) {
+			return entities.NewResponse(c).Error(
+				fiber.ErrForbidden.Code,
+				string(privateFileErr),
+				"signature is invalid or has expired",
+			).Res()
+		}
+
+		destination := filepath.Clean("/" + c.Params("*"))
+		return c.SendFile("./assets/private" + destination)
+	}
+}
+
+// VerifiedEmail must run after JwtAuth.
+func (h *middlewaresHandlers) VerifiedEmail() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		userId, ok := c.Locals("userId").(string)
+		if !ok || !h.usecase.FindEmailVerified(userId) {
+			return entities.NewResponse(c).Error(
+				fiber.ErrForbidden.Code,
+				string(verifiedErr),
+				"email is not verified",
+			).Res()
+		}
+		return c.Next()
+	}
+}
+
+// NotImpersonated must run after JwtAuth, it keeps support staff acting as a
+// user away from what only the user may do. Impersonation is for looking, so
+// every write a customer can make on their own account or orders carries it.
+func (h *middlewaresHandlers) NotImpersonated() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if impersonator, _ := c.Locals("impersonator").(string); impersonator != "" {
+			return entities.NewResponse(c).Error(
+				fiber.ErrForbidden.Code,
+				string(impersonateErr),
+				"not allowed while impersonating",
+			).Res()
+		}
+		return c.Next()
+	}
+}
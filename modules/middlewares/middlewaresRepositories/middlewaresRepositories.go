@@ -1,6 +1,7 @@
 package middlewaresRepositories
 
 import (
+	"encoding/json"
 	"fmt"
 
 	"github.com/codepnw/ecommerce/modules/middlewares"
@@ -8,8 +9,10 @@ import (
 )
 
 type IMiddlewaresRepository interface {
-	FindAccessToken(userId, accessToken string) bool
-	FindRole() ([]*middlewares.Role, error)
+	FindAccessToken(userId, tokenHash string) (*middlewares.Session, bool)
+	FindPermissions(roleId int) ([]string, error)
+	FindEmailVerified(userId string) bool
+	FindApiKey(keyHash string) (*middlewares.ApiKey, error)
 }
 
 type middlewaresRepository struct {
@@ -22,33 +25,86 @@ func MiddlewaresRepository(db *sqlx.DB) IMiddlewaresRepository {
 	}
 }
 
-func (r *middlewaresRepository) FindAccessToken(userId, accessToken string) bool {
+// FindAccessToken returns the session the token belongs to, tokens of a
+// disabled account are not found.
+func (r *middlewaresRepository) FindAccessToken(userId, tokenHash string) (*middlewares.Session, bool) {
+	// last_used_at is refreshed at most once a minute to keep writes down
 	query := `
+		WITH "touched" AS (
+			UPDATE "oauth" SET
+				"last_used_at" = NOW()
+			WHERE "user_id" = $1
+			AND "access_token" = $2
+			AND "last_used_at" < NOW() - INTERVAL '1 minute'
+		)
 		SELECT
-			(CASE WHEN COUNT(*) = 1 THEN TRUE ELSE FALSE END)
-		FROM "oauth"
-		WHERE "user_id" = $1
-		AND "access_token" = $2;`
+			"o"."id",
+			"u"."role_id"
+		FROM "oauth" "o"
+		JOIN "users" "u" ON "u"."id" = "o"."user_id"
+		WHERE "o"."user_id" = $1
+		AND "o"."access_token" = $2
+		AND "u"."disabled_at" IS NULL;`
 
-	var check bool
-	if err := r.db.Get(&check, query, userId, accessToken); err != nil {
+	session := new(middlewares.Session)
+	if err := r.db.Get(session, query, userId, tokenHash); err != nil {
+		return nil, false
+	}
+	return session, true
+}
+
+func (r *middlewaresRepository) FindPermissions(roleId int) ([]string, error) {
+	query := `
+		SELECT
+			"permission"
+		FROM "roles_permissions"
+		WHERE "role_id" = $1;`
+
+	permissions := make([]string, 0)
+	if err := r.db.Select(&permissions, query, roleId); err != nil {
+		return nil, fmt.Errorf("select permissions failed: %v", err)
+	}
+	return permissions, nil
+}
+
+func (r *middlewaresRepository) FindEmailVerified(userId string) bool {
+	query := `
+		SELECT
+			("email_verified_at" IS NOT NULL)
+		FROM "users"
+		WHERE "id" = $1;`
+
+	var verified bool
+	if err := r.db.Get(&verified, query, userId); err != nil {
 		return false
 	}
-	return true
+	return verified
 }
 
-func (r *middlewaresRepository) FindRole() ([]*middlewares.Role, error) {
+// FindApiKey returns a key that is neither revoked nor expired, checked on
+// every request so revoking takes effect right away.
+func (r *middlewaresRepository) FindApiKey(keyHash string) (*middlewares.ApiKey, error) {
 	query := `
+		WITH "touched" AS (
+			UPDATE "api_keys" SET
+				"last_used_at" = NOW()
+			WHERE "key_hash" = $1
+			AND ("last_used_at" IS NULL OR "last_used_at" < NOW() - INTERVAL '1 minute')
+		)
 		SELECT
 			"id",
-			"title"
-		FROM "roles"
-		ORDER BY "id" DESC;`
-	
-	roles := make([]*middlewares.Role, 0)
-	if err := r.db.Select(&roles, query); err != nil {
-		return nil, fmt.Errorf("roles are empty")
-	}
+			"scopes"::TEXT AS "scopes"
+		FROM "api_keys"
+		WHERE "key_hash" = $1
+		AND "revoked_at" IS NULL
+		AND ("expires_at" IS NULL OR "expires_at" > NOW());`
 
-	return roles, nil
-}
\ No newline at end of file
+	key := new(middlewares.ApiKey)
+	if err := r.db.Get(key, query, keyHash); err != nil {
+		return nil, fmt.Errorf("api key not found")
+	}
+	if err := json.Unmarshal([]byte(key.ScopesJson), &key.Scopes); err != nil {
+		return nil, fmt.Errorf("unmarshal scopes failed: %v", err)
+	}
+	return key, nil
+}
@@ -3,31 +3,72 @@ package middlewaresUsecases
 import (
 	"github.com/codepnw/ecommerce/modules/middlewares"
 	"github.com/codepnw/ecommerce/modules/middlewares/middlewaresRepositories"
+	"github.com/codepnw/ecommerce/pkg/cache"
+	"github.com/codepnw/ecommerce/pkg/utils"
 )
 
 type IMiddlewaresUsecases interface {
-	FindAccessToken(userId, accessToken string) bool
-	FindRole() ([]*middlewares.Role, error)
+	FindAccessToken(userId, accessToken string) (int, bool)
+	FindPermissions(roleId int) ([]string, error)
+	FindEmailVerified(userId string) bool
+	FindApiKey(key string) (*middlewares.ApiKey, error)
 }
 
 type middlewaresUsecases struct {
 	repository middlewaresRepositories.IMiddlewaresRepository
+	cache      cache.IAuthCache
 }
 
-func MiddlewaresUsecases(repository middlewaresRepositories.IMiddlewaresRepository) IMiddlewaresUsecases {
+func MiddlewaresUsecases(repository middlewaresRepositories.IMiddlewaresRepository, cache cache.IAuthCache) IMiddlewaresUsecases {
 	return &middlewaresUsecases{
 		repository: repository,
+		cache:      cache,
 	}
 }
 
-func (u *middlewaresUsecases) FindAccessToken(userId, accessToken string) bool {
-	return u.repository.FindAccessToken(userId, accessToken)
+// FindAccessToken returns the current role of the user the token belongs to.
+// It is answered from the cache when it can, anything that ends a session or
+// changes the role or status of a user must invalidate it there.
+func (u *middlewaresUsecases) FindAccessToken(userId, accessToken string) (int, bool) {
+	// Only digests are stored, see usersRepository.InsertOauth
+	tokenHash := utils.HashToken(accessToken)
+	if session, ok := u.cache.Session(tokenHash); ok {
+		return session.RoleId, session.UserId == userId
+	}
+
+	session, ok := u.repository.FindAccessToken(userId, tokenHash)
+	if !ok {
+		return 0, false
+	}
+	u.cache.SetSession(tokenHash, &cache.Session{
+		UserId:  userId,
+		OauthId: session.OauthId,
+		RoleId:  session.RoleId,
+	})
+	return session.RoleId, true
+}
+
+func (u *middlewaresUsecases) FindPermissions(roleId int) ([]string, error) {
+	if permissions, ok := u.cache.Permissions(roleId); ok {
+		return permissions, nil
+	}
+
+	permissions, err := u.repository.FindPermissions(roleId)
+	if err != nil {
+		return nil, err
+	}
+	u.cache.SetPermissions(roleId, permissions)
+	return permissions, nil
+}
+
+func (u *middlewaresUsecases) FindEmailVerified(userId string) bool {
+	return u.repository.FindEmailVerified(userId)
 }
 
-func (u *middlewaresUsecases) FindRole() ([]*middlewares.Role, error) {
-	roles, err := u.repository.FindRole()
+func (u *middlewaresUsecases) FindApiKey(key string) (*middlewares.ApiKey, error) {
+	apiKey, err := u.repository.FindApiKey(utils.HashToken(key))
 	if err != nil {
 		return nil, err
 	}
-	return roles, nil
+	return apiKey, nil
 }
@@ -4,20 +4,28 @@ import (
 	"github.com/codepnw/ecommerce/config"
 	"github.com/codepnw/ecommerce/modules/entities"
 	"github.com/codepnw/ecommerce/modules/monitor"
+	"github.com/codepnw/ecommerce/pkg/auth"
+	"github.com/codepnw/ecommerce/pkg/cache"
 	"github.com/gofiber/fiber/v2"
 )
 
 type IMonitorHandler interface {
 	HealthCheck(c *fiber.Ctx) error
+	Jwks(c *fiber.Ctx) error
+	Metrics(c *fiber.Ctx) error
 }
 
 type monitorHandler struct {
-	cfg config.IConfig
+	cfg   config.IConfig
+	keys  auth.IKeyStore
+	cache cache.IAuthCache
 }
 
-func MonitorHandler(cfg config.IConfig) IMonitorHandler {
+func MonitorHandler(cfg config.IConfig, keys auth.IKeyStore, cache cache.IAuthCache) IMonitorHandler {
 	return &monitorHandler{
-		cfg: cfg,
+		cfg:   cfg,
+		keys:  keys,
+		cache: cache,
 	}
 }
 
@@ -29,3 +37,22 @@ func (m *monitorHandler) HealthCheck(c *fiber.Ctx) error {
 	return entities.NewResponse(c).Success(fiber.StatusOK, res).Res()
 	// return c.Status(fiber.StatusOK).JSON(res)
 }
+
+// Jwks publishes the public keys so other services can verify our access
+// tokens, it is a plain key set as verifiers expect, not a response envelope.
+func (m *monitorHandler) Jwks(c *fiber.Ctx) error {
+	c.Set(fiber.HeaderCacheControl, "public, max-age=300")
+	return c.Status(fiber.StatusOK).JSON(m.keys.JWKS())
+}
+
+// Metrics reports the hit ratio of the auth caches, every miss is a query.
+func (m *monitorHandler) Metrics(c *fiber.Ctx) error {
+	return entities.NewResponse(c).Success(
+		fiber.StatusOK,
+		&struct {
+			Cache map[string]*cache.Stats `json:"cache"`
+		}{
+			Cache: m.cache.Stats(),
+		},
+	).Res()
+}
@@ -1,12 +1,17 @@
 package orders
 
 import (
+	"mime/multipart"
+	"regexp"
+	"strings"
+	"time"
+
 	"github.com/codepnw/ecommerce/modules/entities"
 	"github.com/codepnw/ecommerce/modules/products"
 )
 
 type OrderFilter struct {
-	Search    string `query:"search"` // user_id, address, contact
+	Search    string `query:"search"` // user_id, address, contact, guest_email
 	Status    string `query:"status"`
 	StartDate string `query:"start_date"`
 	EndDate   string `query:"end_date"`
@@ -15,16 +20,21 @@ type OrderFilter struct {
 }
 
 type Order struct {
-	Id           string           `db:"id" json:"id"`
-	UserId       string           `db:"user_id" json:"user_id"`
-	TransferSlip *TransferSlip    `db:"transfer_slip" json:"transfer_slip"`
-	Products     []*ProductsOrder `json:"products"`
-	Address      string           `db:"address" json:"address"`
-	Contact      string           `db:"contact" json:"contact"`
-	Status       string           `db:"status" json:"status"`
-	TotalPaid    float64          `db:"total_paid" json:"total_paid"`
-	CreatedAt    string           `db:"created_at" json:"created_at"`
-	UpdatedAt    string           `db:"updated_at" json:"updated_at"`
+	Id              string           `db:"id" json:"id"`
+	UserId          string           `db:"user_id" json:"user_id"`
+	TransferSlip    *TransferSlip    `db:"transfer_slip" json:"transfer_slip"`
+	Products        []*ProductsOrder `json:"products"`
+	Address         string           `db:"address" json:"address"`
+	Contact         string           `db:"contact" json:"contact"`
+	AddressId       *string          `db:"address_id" json:"address_id"`
+	ShippingAddress *ShippingAddress `db:"shipping_address" json:"shipping_address"`
+	GuestEmail      *string          `db:"guest_email" json:"guest_email"`
+	TokenHash       string           `db:"-" json:"-"`
+	TokenExpires    time.Duration    `db:"-" json:"-"`
+	Status          string           `db:"status" json:"status"`
+	TotalPaid       float64          `db:"total_paid" json:"total_paid"`
+	CreatedAt       string           `db:"created_at" json:"created_at"`
+	UpdatedAt       string           `db:"updated_at" json:"updated_at"`
 }
 
 type TransferSlip struct {
@@ -34,8 +44,59 @@ type TransferSlip struct {
 	CreatedAt string `json:"created_at"`
 }
 
+// ShippingAddress is the copy of an address book entry taken when the order
+// is placed.
+type ShippingAddress struct {
+	Name       string `json:"name"`
+	Phone      string `json:"phone"`
+	Line1      string `json:"line1"`
+	Line2      string `json:"line2"`
+	District   string `json:"district"`
+	Province   string `json:"province"`
+	PostalCode string `json:"postal_code"`
+	Country    string `json:"country"`
+}
+
 type ProductsOrder struct {
 	Id      string            `db:"id" json:"id"`
 	Qty     int               `db:"qty" json:"qty"`
 	Product *products.Product `db:"product" json:"product"`
 }
+
+type TransferSlipReq struct {
+	OrderId   string
+	UserId    string
+	File      *multipart.FileHeader
+	Extension string
+}
+
+// GuestOrderReq places an order without an account, the access token for it
+// is mailed to Email.
+type GuestOrderReq struct {
+	Email    string           `json:"email"`
+	Contact  string           `json:"contact"`
+	Address  string           `json:"address"`
+	Products []*ProductsOrder `json:"products"`
+}
+
+func (obj *GuestOrderReq) Trim() {
+	obj.Email = strings.ToLower(strings.TrimSpace(obj.Email))
+	obj.Contact = strings.TrimSpace(obj.Contact)
+	obj.Address = strings.TrimSpace(obj.Address)
+}
+
+func (obj *GuestOrderReq) IsEmail() bool {
+	match, err := regexp.MatchString(`^[\w-\.]+@([\w-]+\.)+[\w-]{2,4}$`, obj.Email)
+	if err != nil {
+		return false
+	}
+	return match
+}
+
+type GuestOrderLookupReq struct {
+	Token string `json:"token"`
+}
+
+type GuestOrderClaimRes struct {
+	Claimed []string `json:"claimed"`
+}
@@ -1,6 +1,10 @@
 package ordersHandlers
 
 import (
+	"context"
+	"fmt"
+	"math"
+	"path/filepath"
 	"strings"
 	"time"
 
@@ -8,8 +12,8 @@ import (
 	"github.com/codepnw/ecommerce/modules/entities"
 	"github.com/codepnw/ecommerce/modules/orders"
 	"github.com/codepnw/ecommerce/modules/orders/ordersUsecases"
+	"github.com/codepnw/ecommerce/modules/roles"
 	"github.com/gofiber/fiber/v2"
-	"github.com/google/uuid"
 )
 
 type ordersHandlersErrCode string
@@ -19,6 +23,10 @@ const (
 	findOrderErr    ordersHandlersErrCode = "orders-002"
 	insertOrderErr  ordersHandlersErrCode = "orders-003"
 	updateOrderErr  ordersHandlersErrCode = "orders-004"
+	uploadSlipErr   ordersHandlersErrCode = "orders-005"
+	insertGuestErr  ordersHandlersErrCode = "orders-006"
+	findGuestErr    ordersHandlersErrCode = "orders-007"
+	claimGuestErr   ordersHandlersErrCode = "orders-008"
 )
 
 type IOrdersHandler interface {
@@ -26,6 +34,10 @@ type IOrdersHandler interface {
 	FindOrder(c *fiber.Ctx) error
 	InsertOrder(c *fiber.Ctx) error
 	UpdateOrder(c *fiber.Ctx) error
+	UploadTransferSlip(c *fiber.Ctx) error
+	InsertGuestOrder(c *fiber.Ctx) error
+	FindGuestOrder(c *fiber.Ctx) error
+	ClaimGuestOrders(c *fiber.Ctx) error
 }
 
 type ordersHandler struct {
@@ -41,6 +53,7 @@ func OrdersHandler(cfg config.IConfig, usecase ordersUsecases.IOrdersUsecase) IO
 }
 
 func (h *ordersHandler) FindOneOrder(c *fiber.Ctx) error {
+	userId := strings.Trim(c.Params("user_id"), " ")
 	orderId := strings.Trim(c.Params("order_id"), " ")
 
 	order, err := h.usecase.FindOneOrder(orderId)
@@ -52,6 +65,16 @@ func (h *ordersHandler) FindOneOrder(c *fiber.Ctx) error {
 		).Res()
 	}
 
+	// The transfer slip link is signed, only hand it to the order owner
+	permissions, _ := c.Locals("userPermissions").([]string)
+	if !roles.HasPermission(permissions, roles.OrdersReadAll) && order.UserId != userId {
+		return entities.NewResponse(c).Error(
+			fiber.ErrUnauthorized.Code,
+			string(findOneOrderErr),
+			"no permission to access",
+		).Res()
+	}
+
 	return entities.NewResponse(c).Success(fiber.StatusOK, order).Res()
 }
 
@@ -147,7 +170,8 @@ func (h *ordersHandler) InsertOrder(c *fiber.Ctx) error {
 		).Res()
 	}
 
-	if c.Locals("userRoleId").(int) != 2 {
+	permissions, _ := c.Locals("userPermissions").([]string)
+	if !roles.HasPermission(permissions, roles.OrdersWriteAll) {
 		req.UserId = userId
 	}
 
@@ -156,11 +180,20 @@ func (h *ordersHandler) InsertOrder(c *fiber.Ctx) error {
 
 	order, err := h.usecase.InsertOrder(req)
 	if err != nil {
-		return entities.NewResponse(c).Error(
-			fiber.ErrInternalServerError.Code,
-			string(insertOrderErr),
-			err.Error(),
-		).Res()
+		switch err.Error() {
+		case "address not found", "address is required":
+			return entities.NewResponse(c).Error(
+				fiber.ErrBadRequest.Code,
+				string(insertOrderErr),
+				err.Error(),
+			).Res()
+		default:
+			return entities.NewResponse(c).Error(
+				fiber.ErrInternalServerError.Code,
+				string(insertOrderErr),
+				err.Error(),
+			).Res()
+		}
 	}
 	return entities.NewResponse(c).Success(fiber.StatusCreated, order).Res()
 }
@@ -183,31 +216,21 @@ func (h *ordersHandler) UpdateOrder(c *fiber.Ctx) error {
 		"completed": "completed",
 		"canceled":  "canceled",
 	}
-	if c.Locals("userRoleId").(int) == 2 {
+	permissions, _ := c.Locals("userPermissions").([]string)
+	if roles.HasPermission(permissions, roles.OrdersWriteAll) {
 		req.Status = statusMap[strings.ToLower(req.Status)]
 	} else if strings.ToLower(req.Status) == statusMap["canceled"] {
 		req.Status = statusMap["canceled"]
 	}
 
+	// Slips only come in through the slip upload, a url sent here would be
+	// signed for whoever reads the order
 	if req.TransferSlip != nil {
-		if req.TransferSlip.Id == "" {
-			req.TransferSlip.Id = uuid.NewString()
-		}
-		if req.TransferSlip.CreatedAt == "" {
-			loc, err := time.LoadLocation("Asia/Bangkok")
-			if err != nil {
-				return entities.NewResponse(c).Error(
-					fiber.ErrInternalServerError.Code,
-					string(updateOrderErr),
-					err.Error(),
-				).Res()
-			}
-			now := time.Now().In(loc)
-
-			// YYYY-MM-DD HH:MM:SS
-			// 2006-01-02 15:04:05
-			req.TransferSlip.CreatedAt = now.Format("2006-01-02 15:04:05")
-		}
+		return entities.NewResponse(c).Error(
+			fiber.ErrBadRequest.Code,
+			string(updateOrderErr),
+			"transfer slip must be uploaded through the slip endpoint",
+		).Res()
 	}
 
 	order, err := h.usecase.UpdateOrder(req)
@@ -220,3 +243,174 @@ func (h *ordersHandler) UpdateOrder(c *fiber.Ctx) error {
 	}
 	return entities.NewResponse(c).Success(fiber.StatusCreated, order).Res()
 }
+
+func (h *ordersHandler) UploadTransferSlip(c *fiber.Ctx) error {
+	userId := strings.Trim(c.Params("user_id"), " ")
+	orderId := strings.Trim(c.Params("order_id"), " ")
+
+	file, err := c.FormFile("file")
+	if err != nil {
+		return entities.NewResponse(c).Error(
+			fiber.ErrBadRequest.Code,
+			string(uploadSlipErr),
+			err.Error(),
+		).Res()
+	}
+
+	extMap := map[string]string{
+		"png":  "png",
+		"jpg":  "jpg",
+		"jpeg": "jpeg",
+	}
+
+	ext := strings.ToLower(strings.TrimPrefix(filepath.Ext(file.Filename), "."))
+	if extMap[ext] == "" {
+		return entities.NewResponse(c).Error(
+			fiber.ErrBadRequest.Code,
+			string(uploadSlipErr),
+			"extension is not acceptable",
+		).Res()
+	}
+
+	if file.Size > int64(h.cfg.App().FileLimit()) {
+		return entities.NewResponse(c).Error(
+			fiber.ErrBadRequest.Code,
+			string(uploadSlipErr),
+			fmt.Sprintf("file size must less than %d MiB", int(math.Ceil(float64(h.cfg.App().FileLimit())/math.Pow(1024, 2)))),
+		).Res()
+	}
+
+	ctx, cancel := context.WithTimeout(c.Context(), h.cfg.App().WriteTimeout())
+	defer cancel()
+
+	order, err := h.usecase.UploadTransferSlip(ctx, &orders.TransferSlipReq{
+		OrderId:   orderId,
+		UserId:    userId,
+		File:      file,
+		Extension: ext,
+	})
+	if err != nil {
+		switch err.Error() {
+		case "no permission to access":
+			return entities.NewResponse(c).Error(
+				fiber.ErrUnauthorized.Code,
+				string(uploadSlipErr),
+				err.Error(),
+			).Res()
+		case "order is not waiting for payment":
+			return entities.NewResponse(c).Error(
+				fiber.ErrBadRequest.Code,
+				string(uploadSlipErr),
+				err.Error(),
+			).Res()
+		default:
+			return entities.NewResponse(c).Error(
+				fiber.ErrInternalServerError.Code,
+				string(uploadSlipErr),
+				err.Error(),
+			).Res()
+		}
+	}
+	return entities.NewResponse(c).Success(fiber.StatusCreated, order).Res()
+}
+
+func (h *ordersHandler) InsertGuestOrder(c *fiber.Ctx) error {
+	req := &orders.GuestOrderReq{
+		Products: make([]*orders.ProductsOrder, 0),
+	}
+
+	if err := c.BodyParser(req); err != nil {
+		return entities.NewResponse(c).Error(
+			fiber.ErrBadRequest.Code,
+			string(insertGuestErr),
+			err.Error(),
+		).Res()
+	}
+	req.Trim()
+
+	if !req.IsEmail() {
+		return entities.NewResponse(c).Error(
+			fiber.ErrBadRequest.Code,
+			string(insertGuestErr),
+			"email pattern is invalid",
+		).Res()
+	}
+
+	if req.Contact == "" || req.Address == "" {
+		return entities.NewResponse(c).Error(
+			fiber.ErrBadRequest.Code,
+			string(insertGuestErr),
+			"contact and address are required",
+		).Res()
+	}
+
+	if len(req.Products) == 0 {
+		return entities.NewResponse(c).Error(
+			fiber.ErrBadRequest.Code,
+			string(insertGuestErr),
+			"products are empty",
+		).Res()
+	}
+
+	order, err := h.usecase.InsertGuestOrder(req)
+	if err != nil {
+		return entities.NewResponse(c).Error(
+			fiber.ErrInternalServerError.Code,
+			string(insertGuestErr),
+			err.Error(),
+		).Res()
+	}
+	return entities.NewResponse(c).Success(fiber.StatusCreated, order).Res()
+}
+
+func (h *ordersHandler) FindGuestOrder(c *fiber.Ctx) error {
+	req := new(orders.GuestOrderLookupReq)
+	if err := c.BodyParser(req); err != nil {
+		return entities.NewResponse(c).Error(
+			fiber.ErrBadRequest.Code,
+			string(findGuestErr),
+			err.Error(),
+		).Res()
+	}
+
+	if req.Token == "" {
+		return entities.NewResponse(c).Error(
+			fiber.ErrBadRequest.Code,
+			string(findGuestErr),
+			"token is required",
+		).Res()
+	}
+
+	order, err := h.usecase.FindGuestOrder(req.Token)
+	if err != nil {
+		switch err.Error() {
+		case "order not found":
+			return entities.NewResponse(c).Error(
+				fiber.ErrBadRequest.Code,
+				string(findGuestErr),
+				err.Error(),
+			).Res()
+		default:
+			return entities.NewResponse(c).Error(
+				fiber.ErrInternalServerError.Code,
+				string(findGuestErr),
+				err.Error(),
+			).Res()
+		}
+	}
+	return entities.NewResponse(c).Success(fiber.StatusOK, order).Res()
+}
+
+func (h *ordersHandler) ClaimGuestOrders(c *fiber.Ctx) error {
+	userId := c.Locals("userId").(string)
+
+	res, err := h.usecase.ClaimGuestOrders(userId)
+	if err != nil {
+		return entities.NewResponse(c).Error(
+			fiber.ErrInternalServerError.Code,
+			string(claimGuestErr),
+			err.Error(),
+		).Res()
+	}
+	return entities.NewResponse(c).Success(fiber.StatusOK, res).Res()
+}
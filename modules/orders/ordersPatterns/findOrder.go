@@ -78,6 +78,9 @@ func (b *findOrderBuilder) initQuery() {
 				) AS "products",
 				"o"."address",
 				"o"."contact",
+				"o"."address_id",
+				"o"."shipping_address",
+				"o"."guest_email",
 				(
 					SELECT
 						SUM(COALESCE(("po"."product"->>'price')::FLOAT*("po"."qty")::FLOAT, 0))
@@ -105,17 +108,20 @@ func (b *findOrderBuilder) buildWhereSearch() {
 			"%"+strings.ToLower(b.req.Search)+"%",
 			"%"+strings.ToLower(b.req.Search)+"%",
 			"%"+strings.ToLower(b.req.Search)+"%",
+			"%"+strings.ToLower(b.req.Search)+"%",
 		)
 
 		query := fmt.Sprintf(`
 			AND (
 				LOWER("o"."user_id") LIKE $%d OR
 				LOWER("o"."address") LIKE $%d OR
-				LOWER("o"."contact") LIKE $%d
+				LOWER("o"."contact") LIKE $%d OR
+				LOWER("o"."guest_email") LIKE $%d
 			)`,
 			b.lastIndex+1,
 			b.lastIndex+2,
 			b.lastIndex+3,
+			b.lastIndex+4,
 		)
 		temp := b.getQuery()
 		temp += query
@@ -134,8 +140,8 @@ func (b *findOrderBuilder) buildWhereStatus() {
 
 		query := fmt.Sprintf(`
 			AND "o"."status" = $%d`,
-				b.lastIndex+1,
-			)
+			b.lastIndex+1,
+		)
 		temp := b.getQuery()
 		temp += query
 		b.setQuery(temp)
@@ -154,9 +160,9 @@ func (b *findOrderBuilder) buildWhereDate() {
 
 		query := fmt.Sprintf(`
 			AND "o"."created_at" BETWEEN DATE($%d) AND ($%d)::DATE + 1`,
-				b.lastIndex+1,
-				b.lastIndex+2,
-			)
+			b.lastIndex+1,
+			b.lastIndex+2,
+		)
 		temp := b.getQuery()
 		temp += query
 		b.setQuery(temp)
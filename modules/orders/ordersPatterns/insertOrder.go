@@ -50,10 +50,15 @@ func (b *insertOrderBuilder) insertOrder() error {
 			"contact",
 			"address",
 			"transfer_slip",
-			"status"
+			"status",
+			"address_id",
+			"shipping_address",
+			"guest_email",
+			"token_hash",
+			"token_expires_at"
 		)
 		VALUES
-		($1, $2, $3, $4, $5)
+		(NULLIF($1, ''), $2, $3, $4, $5, $6, $7, $8, NULLIF($9, ''), CASE WHEN $9 <> '' THEN NOW() + ($10 * INTERVAL '1 second') END)
 			RETURNING "id";`
 
 	if err := b.tx.QueryRowxContext(
@@ -64,6 +69,11 @@ func (b *insertOrderBuilder) insertOrder() error {
 		b.req.Address,
 		b.req.TransferSlip,
 		b.req.Status,
+		b.req.AddressId,
+		b.req.ShippingAddress,
+		b.req.GuestEmail,
+		b.req.TokenHash,
+		int64(b.req.TokenExpires.Seconds()),
 	).Scan(&b.req.Id); err != nil {
 		b.tx.Rollback()
 		return fmt.Errorf("insert order failed: %v", err)
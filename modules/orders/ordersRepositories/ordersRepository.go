@@ -2,9 +2,12 @@ package ordersRepositories
 
 import (
 	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/codepnw/ecommerce/modules/orders"
 	"github.com/codepnw/ecommerce/modules/orders/ordersPatterns"
@@ -16,6 +19,9 @@ type IOrdersRepository interface {
 	FindOrder(req *orders.OrderFilter) ([]*orders.Order, int)
 	InsertOrder(req *orders.Order) (string, error)
 	UpdateOrder(req *orders.Order) error
+	UpdateTransferSlip(orderId, userId string, slip *orders.TransferSlip) error
+	FindGuestOrderId(tokenHash string) (string, error)
+	ClaimGuestOrders(userId string) ([]string, error)
 }
 
 type ordersRepository struct {
@@ -50,6 +56,9 @@ func (r *ordersRepository) FindOneOrder(orderId string) (*orders.Order, error) {
 				) AS "products",
 				"o"."address",
 				"o"."contact",
+				"o"."address_id",
+				"o"."shipping_address",
+				"o"."guest_email",
 				(
 					SELECT
 						SUM(COALESCE(("po"."product"->>'price')::FLOAT*("po"."qty")::FLOAT, 0))
@@ -110,15 +119,6 @@ func (r *ordersRepository) UpdateOrder(req *orders.Order) error {
 		lastIndex++
 	}
 
-	if req.TransferSlip != nil {
-		values = append(values, req.TransferSlip)
-
-		queryWhereStack = append(queryWhereStack, fmt.Sprintf(`
-		"transfer_slip" = $%d?`, lastIndex))
-
-		lastIndex++
-	}
-
 	values = append(values, req.Id)
 
 	queryClose := fmt.Sprintf(`
@@ -138,3 +138,72 @@ func (r *ordersRepository) UpdateOrder(req *orders.Order) error {
 	}
 	return nil
 }
+
+func (r *ordersRepository) UpdateTransferSlip(orderId, userId string, slip *orders.TransferSlip) error {
+	query := `
+		UPDATE "orders" SET
+			"transfer_slip" = $1
+		WHERE "id" = $2
+		AND "user_id" = $3
+		AND "status" = 'waiting'
+		RETURNING "id";`
+
+	var id string
+	if err := r.db.QueryRowContext(context.Background(), query, slip, orderId, userId).Scan(&id); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("order is not waiting for payment")
+		}
+		return fmt.Errorf("update transfer slip failed: %v", err)
+	}
+	return nil
+}
+
+// FindGuestOrderId resolves the access token of a guest order, the token stops
+// working once it expires or the order has been claimed.
+func (r *ordersRepository) FindGuestOrderId(tokenHash string) (string, error) {
+	query := `
+		SELECT
+			"id"
+		FROM "orders"
+		WHERE "token_hash" = $1
+		AND "token_expires_at" > NOW()
+		AND "user_id" IS NULL
+		AND "anonymized_at" IS NULL;`
+
+	var orderId string
+	if err := r.db.Get(&orderId, query, tokenHash); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", fmt.Errorf("order not found")
+		}
+		return "", fmt.Errorf("get guest order failed: %v", err)
+	}
+	return orderId, nil
+}
+
+// ClaimGuestOrders moves the guest orders placed with the email of the user
+// onto the account. Only a verified email can claim, otherwise anyone could
+// sign up with someone else's address and read their orders.
+func (r *ordersRepository) ClaimGuestOrders(userId string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	query := `
+		UPDATE "orders" "o" SET
+			"user_id" = "u"."id",
+			"token_hash" = NULL,
+			"token_expires_at" = NULL,
+			"claimed_at" = NOW()
+		FROM "users" "u"
+		WHERE "u"."id" = $1
+		AND "u"."email_verified_at" IS NOT NULL
+		AND "o"."user_id" IS NULL
+		AND "o"."anonymized_at" IS NULL
+		AND LOWER("o"."guest_email") = LOWER("u"."email")
+		RETURNING "o"."id";`
+
+	claimed := make([]string, 0)
+	if err := r.db.SelectContext(ctx, &claimed, query, userId); err != nil {
+		return nil, fmt.Errorf("claim guest orders failed: %v", err)
+	}
+	return claimed, nil
+}
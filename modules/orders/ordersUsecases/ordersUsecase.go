@@ -1,32 +1,61 @@
 package ordersUsecases
 
 import (
+	"context"
 	"fmt"
+	"log"
 	"math"
+	"strings"
+	"time"
 
+	"github.com/codepnw/ecommerce/config"
+	"github.com/codepnw/ecommerce/modules/addresses"
+	"github.com/codepnw/ecommerce/modules/addresses/addressesRepositories"
 	"github.com/codepnw/ecommerce/modules/entities"
+	"github.com/codepnw/ecommerce/modules/files"
+	"github.com/codepnw/ecommerce/modules/files/filesUsecases"
 	"github.com/codepnw/ecommerce/modules/orders"
 	"github.com/codepnw/ecommerce/modules/orders/ordersRepositories"
 	"github.com/codepnw/ecommerce/modules/products/productsRepositories"
+	"github.com/codepnw/ecommerce/pkg/mailer"
 	"github.com/codepnw/ecommerce/pkg/utils"
+	"github.com/google/uuid"
 )
 
 type IOrdersUsecase interface {
 	FindOneOrder(orderId string) (*orders.Order, error)
 	FindOrder(req *orders.OrderFilter) *entities.PaginateRes
-	InsertOrder(req *orders.Order) (*orders.Order, error) 
+	InsertOrder(req *orders.Order) (*orders.Order, error)
 	UpdateOrder(req *orders.Order) (*orders.Order, error)
+	UploadTransferSlip(ctx context.Context, req *orders.TransferSlipReq) (*orders.Order, error)
+	InsertGuestOrder(req *orders.GuestOrderReq) (*orders.Order, error)
+	FindGuestOrder(token string) (*orders.Order, error)
+	ClaimGuestOrders(userId string) (*orders.GuestOrderClaimRes, error)
 }
 
 type ordersUsecase struct {
-	ordersRepository   ordersRepositories.IOrdersRepository
-	productsRepository productsRepositories.IProductsRepository
+	cfg                 config.IConfig
+	ordersRepository    ordersRepositories.IOrdersRepository
+	productsRepository  productsRepositories.IProductsRepository
+	addressesRepository addressesRepositories.IAddressesRepository
+	filesUsecase        filesUsecases.IFilesUsecase
+	mailer              mailer.IMailer
 }
 
-func OrdersUsecase(ordersRepository ordersRepositories.IOrdersRepository, productsRepository productsRepositories.IProductsRepository) IOrdersUsecase {
+func OrdersUsecase(cfg config.IConfig, ordersRepository ordersRepositories.IOrdersRepository, productsRepository productsRepositories.IProductsRepository, addressesRepository addressesRepositories.IAddressesRepository, filesUsecase filesUsecases.IFilesUsecase, mailer mailer.IMailer) IOrdersUsecase {
 	return &ordersUsecase{
-		ordersRepository:   ordersRepository,
-		productsRepository: productsRepository,
+		cfg:                 cfg,
+		ordersRepository:    ordersRepository,
+		productsRepository:  productsRepository,
+		addressesRepository: addressesRepository,
+		filesUsecase:        filesUsecase,
+		mailer:              mailer,
+	}
+}
+
+func (u *ordersUsecase) signTransferSlip(order *orders.Order) {
+	if order.TransferSlip != nil {
+		order.TransferSlip.Url = u.filesUsecase.SignUrl(order.TransferSlip.Url)
 	}
 }
 
@@ -35,11 +64,15 @@ func (u *ordersUsecase) FindOneOrder(orderId string) (*orders.Order, error) {
 	if err != nil {
 		return nil, err
 	}
+	u.signTransferSlip(order)
 	return order, nil
 }
 
 func (u *ordersUsecase) FindOrder(req *orders.OrderFilter) *entities.PaginateRes {
 	orders, count := u.ordersRepository.FindOrder(req)
+	for i := range orders {
+		u.signTransferSlip(orders[i])
+	}
 
 	return &entities.PaginateRes{
 		Data:      orders,
@@ -51,42 +84,228 @@ func (u *ordersUsecase) FindOrder(req *orders.OrderFilter) *entities.PaginateRes
 }
 
 func (u *ordersUsecase) InsertOrder(req *orders.Order) (*orders.Order, error) {
+	if err := u.shipTo(req); err != nil {
+		return nil, err
+	}
+
+	if err := u.fillProducts(req); err != nil {
+		return nil, err
+	}
+
+	orderId, err := u.ordersRepository.InsertOrder(req)
+	if err != nil {
+		return nil, err
+	}
+
+	order, err := u.FindOneOrder(orderId)
+	if err != nil {
+		return nil, err
+	}
+
+	return order, nil
+}
+
+func (u *ordersUsecase) fillProducts(req *orders.Order) error {
 	for i := range req.Products {
 		if req.Products[i].Product == nil {
-			return nil, fmt.Errorf("product is nil")
+			return fmt.Errorf("product is nil")
 		}
 
 		prod, err := u.productsRepository.FindOneProduct(req.Products[i].Product.Id)
 		if err != nil {
-			return nil, err
+			return err
 		}
-		utils.Debug(prod)
 
 		req.TotalPaid += req.Products[i].Product.Price * float64(req.Products[i].Qty)
 		req.Products[i].Product = prod
 	}
+	return nil
+}
 
-	orderId, err := u.ordersRepository.InsertOrder(req)
+// shipTo snapshots the address given by address_id onto the order. Without an
+// id the free text address is kept, and when that is empty too the default
+// address of the user is used.
+func (u *ordersUsecase) shipTo(req *orders.Order) error {
+	req.ShippingAddress = nil
+
+	var address *addresses.Address
+	if req.AddressId != nil && *req.AddressId != "" {
+		if _, err := uuid.Parse(*req.AddressId); err != nil {
+			return fmt.Errorf("address not found")
+		}
+		found, err := u.addressesRepository.FindOneAddress(req.UserId, *req.AddressId)
+		if err != nil {
+			return err
+		}
+		address = found
+	} else {
+		req.AddressId = nil
+		if strings.TrimSpace(req.Address) != "" {
+			return nil
+		}
+		found, err := u.addressesRepository.FindDefaultAddress(req.UserId)
+		if err != nil {
+			if err.Error() == "address not found" {
+				return fmt.Errorf("address is required")
+			}
+			return err
+		}
+		address = found
+		req.AddressId = &found.Id
+	}
+
+	req.ShippingAddress = &orders.ShippingAddress{
+		Name:       address.Name,
+		Phone:      address.Phone,
+		Line1:      address.Line1,
+		Line2:      address.Line2,
+		District:   address.District,
+		Province:   address.Province,
+		PostalCode: address.PostalCode,
+		Country:    address.Country,
+	}
+
+	// The text columns are still filled for clients that only read those
+	lines := make([]string, 0, 6)
+	for _, line := range []string{address.Line1, address.Line2, address.District, address.Province, address.PostalCode, address.Country} {
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	req.Address = strings.Join(lines, ", ")
+	req.Contact = address.Name + " " + address.Phone
+	return nil
+}
+
+// UpdateOrder only changes the status. Slips are set by UploadTransferSlip,
+// a url from the client would be signed for whoever reads the order.
+func (u *ordersUsecase) UpdateOrder(req *orders.Order) (*orders.Order, error) {
+	req.TransferSlip = nil
+
+	if err := u.ordersRepository.UpdateOrder(req); err != nil {
+		return nil, err
+	}
+
+	order, err := u.FindOneOrder(req.Id)
 	if err != nil {
 		return nil, err
 	}
+	return order, nil
+}
 
-	order, err := u.ordersRepository.FindOneOrder(orderId)
+func (u *ordersUsecase) UploadTransferSlip(ctx context.Context, req *orders.TransferSlipReq) (*orders.Order, error) {
+	order, err := u.ordersRepository.FindOneOrder(req.OrderId)
 	if err != nil {
 		return nil, err
 	}
+	if order.UserId != req.UserId {
+		return nil, fmt.Errorf("no permission to access")
+	}
+	if order.Status != "waiting" {
+		return nil, fmt.Errorf("order is not waiting for payment")
+	}
 
-	return order, nil
+	filename := utils.RandFileName(req.Extension)
+	destination := fmt.Sprintf("slips/%s/%s", req.OrderId, filename)
+	res, err := u.filesUsecase.UploadToStorage(ctx, []*files.FileReq{
+		{
+			File:        req.File,
+			Destination: destination,
+			FileName:    filename,
+			Extension:   req.Extension,
+			OwnerId:     req.UserId,
+			Purpose:     string(files.PurposeTransferSlip),
+			Private:     true,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	loc, err := time.LoadLocation("Asia/Bangkok")
+	if err != nil {
+		return nil, err
+	}
+
+	slip := &orders.TransferSlip{
+		Id:        uuid.NewString(),
+		FileName:  res[0].FileName,
+		Url:       u.filesUsecase.UnsignUrl(res[0].Url),
+		CreatedAt: time.Now().In(loc).Format("2006-01-02 15:04:05"),
+	}
+
+	// The status is checked again inside the update so a concurrent status
+	// change can't slip through between the read above and the write
+	if err := u.ordersRepository.UpdateTransferSlip(req.OrderId, req.UserId, slip); err != nil {
+		// A file left behind has no references, the orphan sweep removes it
+		if delErr := u.filesUsecase.DeleteFileOnStorage(context.Background(), []*files.DeleteFileReq{
+			{
+				Destination: destination,
+				Private:     true,
+			},
+		}); delErr != nil {
+			log.Printf("delete transfer slip: %s failed: %v\n", destination, delErr)
+		}
+		return nil, err
+	}
+
+	return u.FindOneOrder(req.OrderId)
 }
 
-func (u *ordersUsecase) UpdateOrder(req *orders.Order) (*orders.Order, error) {
-	if err := u.ordersRepository.UpdateOrder(req); err != nil {
+// InsertGuestOrder places an order without an account. The access token is
+// only ever sent by mail, the response can't be used to look the order up.
+func (u *ordersUsecase) InsertGuestOrder(req *orders.GuestOrderReq) (*orders.Order, error) {
+	token, err := utils.RandToken(32)
+	if err != nil {
+		return nil, err
+	}
+
+	order := &orders.Order{
+		Products:     req.Products,
+		Address:      req.Address,
+		Contact:      req.Contact,
+		GuestEmail:   &req.Email,
+		TokenHash:    utils.HashToken(token),
+		TokenExpires: u.cfg.App().GuestTokenExpires(),
+		Status:       "waiting",
+	}
+	if err := u.fillProducts(order); err != nil {
 		return nil, err
 	}
 
-	order, err := u.ordersRepository.FindOneOrder(req.Id)
+	orderId, err := u.ordersRepository.InsertOrder(order)
 	if err != nil {
 		return nil, err
 	}
-	return order, nil
-}
\ No newline at end of file
+
+	if err := u.mailer.Send(&mailer.Message{
+		To:      req.Email,
+		Subject: fmt.Sprintf("Your order %s", orderId),
+		Body: fmt.Sprintf(
+			"Thank you for your order %s.\n\nUse this token to look it up for the next %d days: %s\n\nSign up with this email and verify it to move the order onto your account.",
+			orderId,
+			int(u.cfg.App().GuestTokenExpires().Hours()/24),
+			token,
+		),
+	}); err != nil {
+		log.Printf("send guest order mail failed: %v\n", err)
+	}
+
+	return u.FindOneOrder(orderId)
+}
+
+func (u *ordersUsecase) FindGuestOrder(token string) (*orders.Order, error) {
+	orderId, err := u.ordersRepository.FindGuestOrderId(utils.HashToken(token))
+	if err != nil {
+		return nil, err
+	}
+	return u.FindOneOrder(orderId)
+}
+
+func (u *ordersUsecase) ClaimGuestOrders(userId string) (*orders.GuestOrderClaimRes, error) {
+	claimed, err := u.ordersRepository.ClaimGuestOrders(userId)
+	if err != nil {
+		return nil, err
+	}
+	return &orders.GuestOrderClaimRes{Claimed: claimed}, nil
+}
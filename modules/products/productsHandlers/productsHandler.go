@@ -1,6 +1,7 @@
 package productsHandlers
 
 import (
+	"context"
 	"fmt"
 	"strings"
 
@@ -148,7 +149,10 @@ func (h *productsHandler) DeleteProduct(c *fiber.Ctx) error {
 		})
 	}
 
-	if err := h.filesUsecase.DeleteFileOnStorage(deleteFileReq); err != nil {
+	ctx, cancel := context.WithTimeout(c.Context(), h.cfg.App().WriteTimeout())
+	defer cancel()
+
+	if err := h.filesUsecase.DeleteFileOnStorage(ctx, deleteFileReq); err != nil {
 		return entities.NewResponse(c).Error(
 			fiber.ErrInternalServerError.Code,
 			string(deleteProductErr),
@@ -196,7 +196,7 @@ func (b *updateProductBuilder) deleteOldImages() error {
 				Destination: fmt.Sprintf("images/products/%s", img.FileName),
 			})
 		}
-		b.filesUsecases.DeleteFileOnStorage(deleteFileReq)
+		b.filesUsecases.DeleteFileOnStorage(context.Background(), deleteFileReq)
 	}
 
 	if _, err := b.tx.ExecContext(
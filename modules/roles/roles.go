@@ -0,0 +1,52 @@
+package roles
+
+// Permissions seeded by the migrations, routes ask for them with
+// RequirePermission.
+const (
+	ProductsWrite    = "products:write"
+	ProductsDelete   = "products:delete"
+	CategoriesWrite  = "categories:write"
+	CategoriesDelete = "categories:delete"
+	OrdersReadAll    = "orders:read_all"
+	OrdersWriteAll   = "orders:write_all"
+	FilesWrite       = "files:write"
+	UsersManage      = "users:manage"
+	UsersImpersonate = "users:impersonate"
+	AdminsInvite     = "admins:invite"
+	ApiKeysManage    = "apikeys:manage"
+	RolesManage      = "roles:manage"
+)
+
+// Roles every install starts with, they can be granted other permissions but
+// never deleted.
+const (
+	CustomerRoleId = 1
+	AdminRoleId    = 2
+)
+
+type Permission struct {
+	Name        string `db:"name" json:"name"`
+	Description string `db:"description" json:"description"`
+}
+
+type Role struct {
+	Id              int      `db:"id" json:"id"`
+	Title           string   `db:"title" json:"title"`
+	Permissions     []string `db:"-" json:"permissions"`
+	PermissionsJson string   `db:"permissions" json:"-"`
+}
+
+type RoleReq struct {
+	Id          int      `json:"-"`
+	Title       string   `json:"title" form:"title"`
+	Permissions []string `json:"permissions" form:"permissions"`
+}
+
+func HasPermission(granted []string, permission string) bool {
+	for _, g := range granted {
+		if g == permission {
+			return true
+		}
+	}
+	return false
+}
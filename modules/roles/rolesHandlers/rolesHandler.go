@@ -0,0 +1,179 @@
+package rolesHandlers
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/codepnw/ecommerce/config"
+	"github.com/codepnw/ecommerce/modules/entities"
+	"github.com/codepnw/ecommerce/modules/roles"
+	"github.com/codepnw/ecommerce/modules/roles/rolesUsecases"
+	"github.com/gofiber/fiber/v2"
+)
+
+type rolesHandlerErrCode string
+
+const (
+	findPermissionsErr rolesHandlerErrCode = "roles-001"
+	findRolesErr       rolesHandlerErrCode = "roles-002"
+	insertRoleErr      rolesHandlerErrCode = "roles-003"
+	updateRoleErr      rolesHandlerErrCode = "roles-004"
+	deleteRoleErr      rolesHandlerErrCode = "roles-005"
+)
+
+type IRolesHandler interface {
+	FindPermissions(c *fiber.Ctx) error
+	FindRoles(c *fiber.Ctx) error
+	InsertRole(c *fiber.Ctx) error
+	UpdateRole(c *fiber.Ctx) error
+	DeleteRole(c *fiber.Ctx) error
+}
+
+type rolesHandler struct {
+	cfg     config.IConfig
+	usecase rolesUsecases.IRolesUsecase
+}
+
+func RolesHandler(cfg config.IConfig, usecase rolesUsecases.IRolesUsecase) IRolesHandler {
+	return &rolesHandler{
+		cfg:     cfg,
+		usecase: usecase,
+	}
+}
+
+func (h *rolesHandler) FindPermissions(c *fiber.Ctx) error {
+	permissions, err := h.usecase.FindPermissions()
+	if err != nil {
+		return entities.NewResponse(c).Error(
+			fiber.ErrInternalServerError.Code,
+			string(findPermissionsErr),
+			err.Error(),
+		).Res()
+	}
+
+	return entities.NewResponse(c).Success(fiber.StatusOK, permissions).Res()
+}
+
+func (h *rolesHandler) FindRoles(c *fiber.Ctx) error {
+	result, err := h.usecase.FindRoles()
+	if err != nil {
+		return entities.NewResponse(c).Error(
+			fiber.ErrInternalServerError.Code,
+			string(findRolesErr),
+			err.Error(),
+		).Res()
+	}
+
+	return entities.NewResponse(c).Success(fiber.StatusOK, result).Res()
+}
+
+func (h *rolesHandler) InsertRole(c *fiber.Ctx) error {
+	req := new(roles.RoleReq)
+	if err := c.BodyParser(req); err != nil {
+		return entities.NewResponse(c).Error(
+			fiber.ErrBadRequest.Code,
+			string(insertRoleErr),
+			err.Error(),
+		).Res()
+	}
+	req.Title = strings.TrimSpace(req.Title)
+
+	if req.Title == "" {
+		return entities.NewResponse(c).Error(
+			fiber.ErrBadRequest.Code,
+			string(insertRoleErr),
+			"title is required",
+		).Res()
+	}
+
+	result, err := h.usecase.InsertRole(req)
+	if err != nil {
+		if err.Error() == "title has been used" || strings.HasPrefix(err.Error(), "permission ") {
+			return entities.NewResponse(c).Error(
+				fiber.ErrBadRequest.Code,
+				string(insertRoleErr),
+				err.Error(),
+			).Res()
+		}
+		return entities.NewResponse(c).Error(
+			fiber.ErrInternalServerError.Code,
+			string(insertRoleErr),
+			err.Error(),
+		).Res()
+	}
+
+	return entities.NewResponse(c).Success(fiber.StatusCreated, result).Res()
+}
+
+func (h *rolesHandler) UpdateRole(c *fiber.Ctx) error {
+	roleId, err := strconv.Atoi(strings.Trim(c.Params("role_id"), " "))
+	if err != nil || roleId <= 0 {
+		return entities.NewResponse(c).Error(
+			fiber.ErrBadRequest.Code,
+			string(updateRoleErr),
+			"id type is invalid",
+		).Res()
+	}
+
+	req := new(roles.RoleReq)
+	if err := c.BodyParser(req); err != nil {
+		return entities.NewResponse(c).Error(
+			fiber.ErrBadRequest.Code,
+			string(updateRoleErr),
+			err.Error(),
+		).Res()
+	}
+	req.Id = roleId
+	req.Title = strings.TrimSpace(req.Title)
+
+	result, err := h.usecase.UpdateRole(req)
+	if err != nil {
+		if err.Error() == "role not found" ||
+			err.Error() == "title has been used" ||
+			strings.HasPrefix(err.Error(), "permission ") ||
+			strings.HasPrefix(err.Error(), "admin role ") {
+			return entities.NewResponse(c).Error(
+				fiber.ErrBadRequest.Code,
+				string(updateRoleErr),
+				err.Error(),
+			).Res()
+		}
+		return entities.NewResponse(c).Error(
+			fiber.ErrInternalServerError.Code,
+			string(updateRoleErr),
+			err.Error(),
+		).Res()
+	}
+
+	return entities.NewResponse(c).Success(fiber.StatusOK, result).Res()
+}
+
+func (h *rolesHandler) DeleteRole(c *fiber.Ctx) error {
+	roleId, err := strconv.Atoi(strings.Trim(c.Params("role_id"), " "))
+	if err != nil || roleId <= 0 {
+		return entities.NewResponse(c).Error(
+			fiber.ErrBadRequest.Code,
+			string(deleteRoleErr),
+			"id type is invalid",
+		).Res()
+	}
+
+	if err := h.usecase.DeleteRole(roleId); err != nil {
+		switch err.Error() {
+		case "role not found", "role is in use", "built-in roles can't be deleted":
+			return entities.NewResponse(c).Error(
+				fiber.ErrBadRequest.Code,
+				string(deleteRoleErr),
+				err.Error(),
+			).Res()
+		default:
+			return entities.NewResponse(c).Error(
+				fiber.ErrInternalServerError.Code,
+				string(deleteRoleErr),
+				err.Error(),
+			).Res()
+		}
+	}
+
+	return entities.NewResponse(c).Success(fiber.StatusOK, nil).Res()
+}
@@ -0,0 +1,220 @@
+package rolesRepositories
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/codepnw/ecommerce/modules/roles"
+	"github.com/jmoiron/sqlx"
+)
+
+type IRolesRepository interface {
+	FindPermissions() ([]*roles.Permission, error)
+	FindRoles() ([]*roles.Role, error)
+	FindOneRole(roleId int) (*roles.Role, error)
+	InsertRole(req *roles.RoleReq) (int, error)
+	UpdateRole(req *roles.RoleReq) error
+	DeleteRole(roleId int) error
+}
+
+type rolesRepository struct {
+	db *sqlx.DB
+}
+
+func RolesRepository(db *sqlx.DB) IRolesRepository {
+	return &rolesRepository{db: db}
+}
+
+const selectRoles = `
+	SELECT
+		"r"."id",
+		"r"."title",
+		COALESCE((
+			SELECT
+				json_agg("rp"."permission" ORDER BY "rp"."permission")
+			FROM "roles_permissions" "rp"
+			WHERE "rp"."role_id" = "r"."id"
+		), '[]')::TEXT AS "permissions"
+	FROM "roles" "r"`
+
+func (r *rolesRepository) FindPermissions() ([]*roles.Permission, error) {
+	query := `
+		SELECT
+			"name",
+			"description"
+		FROM "permissions"
+		ORDER BY "name";`
+
+	permissions := make([]*roles.Permission, 0)
+	if err := r.db.Select(&permissions, query); err != nil {
+		return nil, fmt.Errorf("select permissions failed: %v", err)
+	}
+	return permissions, nil
+}
+
+func (r *rolesRepository) FindRoles() ([]*roles.Role, error) {
+	query := selectRoles + `
+		ORDER BY "r"."id";`
+
+	result := make([]*roles.Role, 0)
+	if err := r.db.Select(&result, query); err != nil {
+		return nil, fmt.Errorf("select roles failed: %v", err)
+	}
+	for _, role := range result {
+		if err := json.Unmarshal([]byte(role.PermissionsJson), &role.Permissions); err != nil {
+			return nil, fmt.Errorf("unmarshal permissions failed: %v", err)
+		}
+	}
+	return result, nil
+}
+
+func (r *rolesRepository) FindOneRole(roleId int) (*roles.Role, error) {
+	query := selectRoles + `
+		WHERE "r"."id" = $1;`
+
+	role := new(roles.Role)
+	if err := r.db.Get(role, query, roleId); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("role not found")
+		}
+		return nil, fmt.Errorf("get role failed: %v", err)
+	}
+	if err := json.Unmarshal([]byte(role.PermissionsJson), &role.Permissions); err != nil {
+		return nil, fmt.Errorf("unmarshal permissions failed: %v", err)
+	}
+	return role, nil
+}
+
+func (r *rolesRepository) InsertRole(req *roles.RoleReq) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	query := `
+		INSERT INTO "roles" (
+			"title"
+		)
+		VALUES ($1)
+		RETURNING "id";`
+
+	var roleId int
+	if err := tx.QueryRowxContext(ctx, query, req.Title).Scan(&roleId); err != nil {
+		tx.Rollback()
+		switch err.Error() {
+		case "ERROR: duplicate key value violates unique constraint \"roles_title_key\" (SQLSTATE 23505)":
+			return 0, fmt.Errorf("title has been used")
+		default:
+			return 0, fmt.Errorf("insert role failed: %v", err)
+		}
+	}
+
+	if err := replacePermissions(ctx, tx, roleId, req.Permissions); err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return roleId, nil
+}
+
+// UpdateRole renames the role when a title is given and replaces its
+// permissions when the list is given, even an empty one.
+func (r *rolesRepository) UpdateRole(req *roles.RoleReq) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		UPDATE "roles" SET
+			"title" = COALESCE(NULLIF($1, ''), "title")
+		WHERE "id" = $2;`
+
+	result, err := tx.ExecContext(ctx, query, req.Title, req.Id)
+	if err != nil {
+		tx.Rollback()
+		switch err.Error() {
+		case "ERROR: duplicate key value violates unique constraint \"roles_title_key\" (SQLSTATE 23505)":
+			return fmt.Errorf("title has been used")
+		default:
+			return fmt.Errorf("update role failed: %v", err)
+		}
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		tx.Rollback()
+		return fmt.Errorf("role not found")
+	}
+
+	if req.Permissions != nil {
+		if err := replacePermissions(ctx, tx, req.Id, req.Permissions); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	return nil
+}
+
+func replacePermissions(ctx context.Context, tx *sqlx.Tx, roleId int, permissions []string) error {
+	if _, err := tx.ExecContext(ctx, `DELETE FROM "roles_permissions" WHERE "role_id" = $1;`, roleId); err != nil {
+		return fmt.Errorf("delete permissions failed: %v", err)
+	}
+
+	query := `
+		INSERT INTO "roles_permissions" (
+			"role_id",
+			"permission"
+		)
+		VALUES ($1, $2)
+		ON CONFLICT DO NOTHING;`
+
+	for _, permission := range permissions {
+		if _, err := tx.ExecContext(ctx, query, roleId, permission); err != nil {
+			return fmt.Errorf("insert permission failed: %v", err)
+		}
+	}
+	return nil
+}
+
+func (r *rolesRepository) DeleteRole(roleId int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// users.role_id cascades, a role still held by someone must not go
+	query := `
+		DELETE FROM "roles"
+		WHERE "id" = $1
+		AND NOT EXISTS (
+			SELECT 1
+			FROM "users"
+			WHERE "role_id" = $1
+		);`
+
+	result, err := r.db.ExecContext(ctx, query, roleId)
+	if err != nil {
+		return fmt.Errorf("delete role failed: %v", err)
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		if _, err := r.FindOneRole(roleId); err != nil {
+			return err
+		}
+		return fmt.Errorf("role is in use")
+	}
+	return nil
+}
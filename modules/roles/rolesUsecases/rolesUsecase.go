@@ -0,0 +1,106 @@
+package rolesUsecases
+
+import (
+	"fmt"
+
+	"github.com/codepnw/ecommerce/modules/roles"
+	"github.com/codepnw/ecommerce/modules/roles/rolesRepositories"
+	"github.com/codepnw/ecommerce/pkg/cache"
+)
+
+type IRolesUsecase interface {
+	FindPermissions() ([]*roles.Permission, error)
+	FindRoles() ([]*roles.Role, error)
+	InsertRole(req *roles.RoleReq) (*roles.Role, error)
+	UpdateRole(req *roles.RoleReq) (*roles.Role, error)
+	DeleteRole(roleId int) error
+}
+
+type rolesUsecase struct {
+	repository rolesRepositories.IRolesRepository
+	cache      cache.IAuthCache
+}
+
+func RolesUsecase(repository rolesRepositories.IRolesRepository, cache cache.IAuthCache) IRolesUsecase {
+	return &rolesUsecase{
+		repository: repository,
+		cache:      cache,
+	}
+}
+
+func (u *rolesUsecase) FindPermissions() ([]*roles.Permission, error) {
+	permissions, err := u.repository.FindPermissions()
+	if err != nil {
+		return nil, err
+	}
+	return permissions, nil
+}
+
+func (u *rolesUsecase) FindRoles() ([]*roles.Role, error) {
+	result, err := u.repository.FindRoles()
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func (u *rolesUsecase) InsertRole(req *roles.RoleReq) (*roles.Role, error) {
+	if err := u.validPermissions(req.Permissions); err != nil {
+		return nil, err
+	}
+
+	roleId, err := u.repository.InsertRole(req)
+	if err != nil {
+		return nil, err
+	}
+	// An empty permission list may be cached for an id that was unused
+	u.cache.InvalidateRole(roleId)
+	return u.repository.FindOneRole(roleId)
+}
+
+func (u *rolesUsecase) UpdateRole(req *roles.RoleReq) (*roles.Role, error) {
+	if err := u.validPermissions(req.Permissions); err != nil {
+		return nil, err
+	}
+
+	// Otherwise nobody could ever manage roles again
+	if req.Id == roles.AdminRoleId && req.Permissions != nil && !roles.HasPermission(req.Permissions, roles.RolesManage) {
+		return nil, fmt.Errorf("admin role must keep %s", roles.RolesManage)
+	}
+
+	if err := u.repository.UpdateRole(req); err != nil {
+		return nil, err
+	}
+	u.cache.InvalidateRole(req.Id)
+	return u.repository.FindOneRole(req.Id)
+}
+
+func (u *rolesUsecase) DeleteRole(roleId int) error {
+	if roleId == roles.CustomerRoleId || roleId == roles.AdminRoleId {
+		return fmt.Errorf("built-in roles can't be deleted")
+	}
+
+	if err := u.repository.DeleteRole(roleId); err != nil {
+		return err
+	}
+	u.cache.InvalidateRole(roleId)
+	return nil
+}
+
+func (u *rolesUsecase) validPermissions(permissions []string) error {
+	known, err := u.repository.FindPermissions()
+	if err != nil {
+		return err
+	}
+
+	names := make(map[string]bool, len(known))
+	for _, p := range known {
+		names[p.Name] = true
+	}
+	for _, p := range permissions {
+		if !names[p] {
+			return fmt.Errorf("permission %s is invalid", p)
+		}
+	}
+	return nil
+}
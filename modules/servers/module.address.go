@@ -0,0 +1,53 @@
+package servers
+
+import (
+	"github.com/codepnw/ecommerce/modules/addresses/addressesHandlers"
+	"github.com/codepnw/ecommerce/modules/addresses/addressesRepositories"
+	"github.com/codepnw/ecommerce/modules/addresses/addressesUsecases"
+	"github.com/codepnw/ecommerce/modules/roles"
+)
+
+type IAddressesModule interface {
+	Init()
+	Repository() addressesRepositories.IAddressesRepository
+	Usecase() addressesUsecases.IAddressesUsecase
+	Handler() addressesHandlers.IAddressesHandler
+}
+
+type addressesModule struct {
+	*moduleFactory
+	repository addressesRepositories.IAddressesRepository
+	usecase    addressesUsecases.IAddressesUsecase
+	handler    addressesHandlers.IAddressesHandler
+}
+
+func (m *moduleFactory) AddressesModule() IAddressesModule {
+	repository := addressesRepositories.AddressesRepository(m.s.db)
+	usecase := addressesUsecases.AddressesUsecase(repository)
+	handler := addressesHandlers.AddressesHandler(m.s.cfg, usecase)
+
+	return &addressesModule{
+		moduleFactory: m,
+		repository:    repository,
+		usecase:       usecase,
+		handler:       handler,
+	}
+}
+
+func (a *addressesModule) Init() {
+	router := a.r.Group("/addresses")
+	router.Get("/:user_id", a.m.JwtAuth(), a.m.ParamsCheck(roles.UsersManage), a.handler.FindAddresses)
+	router.Get("/:user_id/:address_id", a.m.JwtAuth(), a.m.ParamsCheck(roles.UsersManage), a.handler.FindOneAddress)
+
+	router.Post("/:user_id", a.m.JwtAuth(), a.m.NotImpersonated(), a.m.ParamsCheck(roles.UsersManage), a.handler.InsertAddress)
+
+	router.Patch("/:user_id/:address_id", a.m.JwtAuth(), a.m.NotImpersonated(), a.m.ParamsCheck(roles.UsersManage), a.handler.UpdateAddress)
+
+	router.Delete("/:user_id/:address_id", a.m.JwtAuth(), a.m.NotImpersonated(), a.m.ParamsCheck(roles.UsersManage), a.handler.DeleteAddress)
+}
+
+func (a *addressesModule) Repository() addressesRepositories.IAddressesRepository {
+	return a.repository
+}
+func (a *addressesModule) Usecase() addressesUsecases.IAddressesUsecase { return a.usecase }
+func (a *addressesModule) Handler() addressesHandlers.IAddressesHandler { return a.handler }
@@ -1,9 +1,11 @@
 package servers
 
 import (
+	"github.com/codepnw/ecommerce/modules/appinfo"
 	"github.com/codepnw/ecommerce/modules/appinfo/appinfoHandlers"
 	"github.com/codepnw/ecommerce/modules/appinfo/appinfoRepositories"
 	"github.com/codepnw/ecommerce/modules/appinfo/appinfoUsecases"
+	"github.com/codepnw/ecommerce/modules/roles"
 )
 
 type IAppinfoModule interface {
@@ -35,12 +37,14 @@ func (m *moduleFactory) AppinfoModule() IAppinfoModule {
 
 func (a *appinfoModule) Init() {
 	router := a.r.Group("/appinfo")
-	router.Post("/categories", a.m.JwtAuth(), a.m.Authorize(2), a.handler.InsertCategory)
+	router.Post("/categories", a.m.JwtAuth(), a.m.RequirePermission(roles.CategoriesWrite), a.handler.InsertCategory)
+	router.Post("/apikeys", a.m.JwtAuth(), a.m.RequirePermission(roles.ApiKeysManage), a.handler.InsertApiKey)
 
-	router.Get("/apikey", a.m.JwtAuth(), a.m.Authorize(2), a.handler.GenerateApiKey)
-	router.Get("/categories", a.m.ApiKeyAuth(), a.handler.FindCategory)
+	router.Get("/apikeys", a.m.JwtAuth(), a.m.RequirePermission(roles.ApiKeysManage), a.handler.FindApiKeys)
+	router.Get("/categories", a.m.ApiKeyAuth(appinfo.ScopeCatalogRead), a.handler.FindCategory)
 
-	router.Delete("/:category_id/categories", a.m.JwtAuth(), a.m.Authorize(2), a.handler.DeleteCategory)
+	router.Delete("/:category_id/categories", a.m.JwtAuth(), a.m.RequirePermission(roles.CategoriesDelete), a.handler.DeleteCategory)
+	router.Delete("/apikeys/:apikey_id", a.m.JwtAuth(), a.m.RequirePermission(roles.ApiKeysManage), a.handler.RevokeApiKey)
 }
 
 func (a *appinfoModule) Repository() appinfoRepositories.IAppinfoRepository { return a.repository }
@@ -2,27 +2,33 @@ package servers
 
 import (
 	"github.com/codepnw/ecommerce/modules/files/filesHandlers"
+	"github.com/codepnw/ecommerce/modules/files/filesRepositories"
 	"github.com/codepnw/ecommerce/modules/files/filesUsecases"
+	"github.com/codepnw/ecommerce/modules/roles"
 )
 
 type IFilesModule interface {
 	Init()
+	Repository() filesRepositories.IFilesRepository
 	Usecase() filesUsecases.IFilesUsecase
 	Handler() filesHandlers.IFilesHandler
 }
 
 type filesModule struct {
 	*moduleFactory
-	usecase filesUsecases.IFilesUsecase
-	handler filesHandlers.IFilesHandler
+	repository filesRepositories.IFilesRepository
+	usecase    filesUsecases.IFilesUsecase
+	handler    filesHandlers.IFilesHandler
 }
 
 func (m *moduleFactory) FilesModule() IFilesModule {
-	usecase := filesUsecases.FilesUsecase(m.s.cfg)
+	repository := filesRepositories.FilesRepository(m.s.db)
+	usecase := filesUsecases.FilesUsecase(m.s.cfg, repository, m.s.pool)
 	handler := filesHandlers.FilesHandler(m.s.cfg, usecase)
 
 	return &filesModule{
 		moduleFactory: m,
+		repository:    repository,
 		usecase:       usecase,
 		handler:       handler,
 	}
@@ -30,9 +36,16 @@ func (m *moduleFactory) FilesModule() IFilesModule {
 
 func (f *filesModule) Init() {
 	router := f.r.Group("/files")
-	router.Post("/upload", f.m.JwtAuth(), f.m.Authorize(2), f.handler.UploadFiles)
-	router.Patch("/delete", f.m.JwtAuth(), f.m.Authorize(2), f.handler.DeleteFile)
+	router.Post("/upload", f.m.JwtAuth(), f.m.RequirePermission(roles.FilesWrite), f.handler.UploadFiles)
+	router.Patch("/delete", f.m.JwtAuth(), f.m.RequirePermission(roles.FilesWrite), f.handler.DeleteFile)
+
+	router.Post("/uploads", f.m.JwtAuth(), f.m.RequirePermission(roles.FilesWrite), f.handler.InitUpload)
+	router.Get("/uploads/:upload_id", f.m.JwtAuth(), f.m.RequirePermission(roles.FilesWrite), f.handler.FindOneUpload)
+	router.Put("/uploads/:upload_id/parts/:part_number", f.m.JwtAuth(), f.m.RequirePermission(roles.FilesWrite), f.handler.UploadPart)
+	router.Post("/uploads/:upload_id/complete", f.m.JwtAuth(), f.m.RequirePermission(roles.FilesWrite), f.handler.CompleteUpload)
+	router.Delete("/uploads/:upload_id", f.m.JwtAuth(), f.m.RequirePermission(roles.FilesWrite), f.handler.AbortUpload)
 }
 
-func (f *filesModule) Usecase() filesUsecases.IFilesUsecase { return f.usecase }
-func (f *filesModule) Handler() filesHandlers.IFilesHandler { return f.handler }
+func (f *filesModule) Repository() filesRepositories.IFilesRepository { return f.repository }
+func (f *filesModule) Usecase() filesUsecases.IFilesUsecase           { return f.usecase }
+func (f *filesModule) Handler() filesHandlers.IFilesHandler           { return f.handler }
@@ -1,6 +1,7 @@
 package servers
 
 import (
+	"github.com/codepnw/ecommerce/modules/appinfo"
 	"github.com/codepnw/ecommerce/modules/middlewares/middlewaresHandlers"
 	"github.com/codepnw/ecommerce/modules/middlewares/middlewaresRepositories"
 	"github.com/codepnw/ecommerce/modules/middlewares/middlewaresUsecases"
@@ -15,6 +16,8 @@ type IModuleFactory interface {
 	FilesModule() IFilesModule
 	ProductsModule() IProductsModule
 	OrdersModule() IOrdersModule
+	RolesModule() IRolesModule
+	AddressesModule() IAddressesModule
 }
 
 type moduleFactory struct {
@@ -33,12 +36,13 @@ func InitModule(r fiber.Router, s *server, m middlewaresHandlers.IMiddlewaresHan
 
 func InitMiddlewares(s *server) middlewaresHandlers.IMiddlewaresHandlers {
 	repository := middlewaresRepositories.MiddlewaresRepository(s.db)
-	usecase := middlewaresUsecases.MiddlewaresUsecases(repository)
-	return middlewaresHandlers.MiddlewaresHandlers(s.cfg, usecase)
+	usecase := middlewaresUsecases.MiddlewaresUsecases(repository, s.cache)
+	return middlewaresHandlers.MiddlewaresHandlers(s.cfg, s.keys, usecase)
 }
 
 func (m *moduleFactory) MonitorModule() {
-	handler := monitorHandlers.MonitorHandler(m.s.cfg)
+	handler := monitorHandlers.MonitorHandler(m.s.cfg, m.s.keys, m.s.cache)
 	m.r.Get("/", handler.HealthCheck)
+	m.r.Get("/metrics", m.m.ApiKeyAuth(appinfo.ScopeMetricsRead), handler.Metrics)
+	m.s.app.Get("/.well-known/jwks.json", handler.Jwks)
 }
-
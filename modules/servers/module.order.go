@@ -1,9 +1,11 @@
 package servers
 
 import (
+	"github.com/codepnw/ecommerce/modules/appinfo"
 	"github.com/codepnw/ecommerce/modules/orders/ordersHandlers"
 	"github.com/codepnw/ecommerce/modules/orders/ordersRepositories"
 	"github.com/codepnw/ecommerce/modules/orders/ordersUsecases"
+	"github.com/codepnw/ecommerce/modules/roles"
 )
 
 type IOrdersModule interface {
@@ -22,7 +24,7 @@ type ordersModule struct {
 
 func (m *moduleFactory) OrdersModule() IOrdersModule {
 	repository := ordersRepositories.OrdersRepository(m.s.db)
-	usecase := ordersUsecases.OrdersUsecase(repository, m.ProductsModule().Repository())
+	usecase := ordersUsecases.OrdersUsecase(m.s.cfg, repository, m.ProductsModule().Repository(), m.AddressesModule().Repository(), m.FilesModule().Usecase(), m.s.mailer)
 	handler := ordersHandlers.OrdersHandler(m.s.cfg, usecase)
 
 	return &ordersModule{
@@ -35,12 +37,17 @@ func (m *moduleFactory) OrdersModule() IOrdersModule {
 
 func (o *ordersModule) Init() {
 	router := o.r.Group("/orders")
-	router.Post("/", o.m.JwtAuth(), o.handler.InsertOrder)
+	router.Post("/", o.m.JwtAuth(), o.m.NotImpersonated(), o.m.VerifiedEmail(), o.handler.InsertOrder)
+	router.Post("/guest", o.m.ApiKeyAuth(appinfo.ScopeOrdersGuest), o.handler.InsertGuestOrder)
+	router.Post("/guest/lookup", o.m.ApiKeyAuth(appinfo.ScopeOrdersGuest), o.handler.FindGuestOrder)
+	router.Post("/guest/claim", o.m.JwtAuth(), o.m.NotImpersonated(), o.m.VerifiedEmail(), o.handler.ClaimGuestOrders)
 
-	router.Get("/", o.m.JwtAuth(), o.m.Authorize(2), o.handler.FindOrder)
-	router.Get("/:user_id/:order_id", o.m.JwtAuth(), o.m.ParamsCheck(), o.handler.FindOneOrder)
+	router.Get("/", o.m.JwtAuth(), o.m.RequirePermission(roles.OrdersReadAll), o.handler.FindOrder)
+	router.Get("/:user_id/:order_id", o.m.JwtAuth(), o.m.ParamsCheck(roles.OrdersReadAll), o.handler.FindOneOrder)
 
-	router.Patch("/:user_id/:order_id", o.m.JwtAuth(), o.m.ParamsCheck(), o.handler.UpdateOrder)
+	router.Post("/:user_id/:order_id/slip", o.m.JwtAuth(), o.m.NotImpersonated(), o.m.ParamsCheck(roles.OrdersWriteAll), o.handler.UploadTransferSlip)
+
+	router.Patch("/:user_id/:order_id", o.m.JwtAuth(), o.m.NotImpersonated(), o.m.ParamsCheck(roles.OrdersWriteAll), o.handler.UpdateOrder)
 }
 
 func (o *ordersModule) Repository() ordersRepositories.IOrdersRepository { return o.repository }
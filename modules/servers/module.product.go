@@ -1,9 +1,11 @@
 package servers
 
 import (
+	"github.com/codepnw/ecommerce/modules/appinfo"
 	"github.com/codepnw/ecommerce/modules/products/productsHandlers"
 	"github.com/codepnw/ecommerce/modules/products/productsRepositories"
 	"github.com/codepnw/ecommerce/modules/products/productsUsecases"
+	"github.com/codepnw/ecommerce/modules/roles"
 )
 
 type IProductsModule interface {
@@ -35,13 +37,13 @@ func (m *moduleFactory) ProductsModule() IProductsModule {
 
 func (p *productsModule) Init() {
 	router := p.r.Group("/products")
-	router.Post("/", p.m.JwtAuth(), p.m.Authorize(2), p.handler.InsertProduct)
-	router.Patch("/:product_id", p.m.JwtAuth(), p.m.Authorize(2), p.handler.UpdateProduct)
+	router.Post("/", p.m.JwtAuth(), p.m.RequirePermission(roles.ProductsWrite), p.handler.InsertProduct)
+	router.Patch("/:product_id", p.m.JwtAuth(), p.m.RequirePermission(roles.ProductsWrite), p.handler.UpdateProduct)
 
-	router.Get("/", p.m.ApiKeyAuth(), p.handler.FindProduct)
-	router.Get("/:product_id", p.m.ApiKeyAuth(), p.handler.FindOneProduct)
+	router.Get("/", p.m.ApiKeyAuth(appinfo.ScopeCatalogRead), p.handler.FindProduct)
+	router.Get("/:product_id", p.m.ApiKeyAuth(appinfo.ScopeCatalogRead), p.handler.FindOneProduct)
 
-	router.Delete("/:product_id", p.m.JwtAuth(), p.m.Authorize(2), p.handler.DeleteProduct)
+	router.Delete("/:product_id", p.m.JwtAuth(), p.m.RequirePermission(roles.ProductsDelete), p.handler.DeleteProduct)
 }
 
 func (p *productsModule) Repository() productsRepositories.IProductsRepository { return p.repository }
@@ -0,0 +1,51 @@
+package servers
+
+import (
+	"github.com/codepnw/ecommerce/modules/roles"
+	"github.com/codepnw/ecommerce/modules/roles/rolesHandlers"
+	"github.com/codepnw/ecommerce/modules/roles/rolesRepositories"
+	"github.com/codepnw/ecommerce/modules/roles/rolesUsecases"
+)
+
+type IRolesModule interface {
+	Init()
+	Repository() rolesRepositories.IRolesRepository
+	Usecase() rolesUsecases.IRolesUsecase
+	Handler() rolesHandlers.IRolesHandler
+}
+
+type rolesModule struct {
+	*moduleFactory
+	repository rolesRepositories.IRolesRepository
+	usecase    rolesUsecases.IRolesUsecase
+	handler    rolesHandlers.IRolesHandler
+}
+
+func (m *moduleFactory) RolesModule() IRolesModule {
+	repository := rolesRepositories.RolesRepository(m.s.db)
+	usecase := rolesUsecases.RolesUsecase(repository, m.s.cache)
+	handler := rolesHandlers.RolesHandler(m.s.cfg, usecase)
+
+	return &rolesModule{
+		moduleFactory: m,
+		repository:    repository,
+		usecase:       usecase,
+		handler:       handler,
+	}
+}
+
+func (r *rolesModule) Init() {
+	router := r.r.Group("/roles")
+	router.Get("/", r.m.JwtAuth(), r.m.RequirePermission(roles.RolesManage), r.handler.FindRoles)
+	router.Get("/permissions", r.m.JwtAuth(), r.m.RequirePermission(roles.RolesManage), r.handler.FindPermissions)
+
+	router.Post("/", r.m.JwtAuth(), r.m.RequirePermission(roles.RolesManage), r.handler.InsertRole)
+
+	router.Patch("/:role_id", r.m.JwtAuth(), r.m.RequirePermission(roles.RolesManage), r.handler.UpdateRole)
+
+	router.Delete("/:role_id", r.m.JwtAuth(), r.m.RequirePermission(roles.RolesManage), r.handler.DeleteRole)
+}
+
+func (r *rolesModule) Repository() rolesRepositories.IRolesRepository { return r.repository }
+func (r *rolesModule) Usecase() rolesUsecases.IRolesUsecase           { return r.usecase }
+func (r *rolesModule) Handler() rolesHandlers.IRolesHandler           { return r.handler }
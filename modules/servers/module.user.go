@@ -1,6 +1,8 @@
 package servers
 
 import (
+	"github.com/codepnw/ecommerce/modules/appinfo"
+	"github.com/codepnw/ecommerce/modules/roles"
 	"github.com/codepnw/ecommerce/modules/users/usersHandlers"
 	"github.com/codepnw/ecommerce/modules/users/usersRepositories"
 	"github.com/codepnw/ecommerce/modules/users/usersUsecases"
@@ -22,7 +24,7 @@ type usersModule struct {
 
 func (m *moduleFactory) UsersModule() IUsersModule {
 	repository := usersRepositories.UsersRepository(m.s.db)
-	usecase := usersUsecases.UsersUsecase(m.s.cfg, repository)
+	usecase := usersUsecases.UsersUsecase(m.s.cfg, repository, m.s.mailer, m.s.policy, m.s.cache, m.s.oidc, m.FilesModule().Usecase(), m.s.keys)
 	handler := usersHandlers.UsersHandler(m.s.cfg, usecase)
 
 	return &usersModule{
@@ -35,14 +37,46 @@ func (m *moduleFactory) UsersModule() IUsersModule {
 
 func (u *usersModule) Init() {
 	router := u.r.Group("/users")
-	router.Get("/:user_id", u.m.JwtAuth(), u.m.ParamsCheck(), u.handler.GetUserProfile)
-	router.Get("/admin/secret", u.m.JwtAuth(), u.m.Authorize(2), u.handler.GenerateAdminToken)
-
-	router.Post("/signup", u.m.ApiKeyAuth(), u.handler.SignUpCustomer)
-	router.Post("/signin", u.m.ApiKeyAuth(), u.handler.SignIn)
-	router.Post("/refresh", u.m.ApiKeyAuth(), u.handler.RefreshPassport)
-	router.Post("/signout", u.m.ApiKeyAuth(), u.handler.SignOut)
-	router.Post("/signup-admin", u.m.JwtAuth(), u.m.Authorize(2), u.handler.SignOut)
+	router.Get("/", u.m.JwtAuth(), u.m.RequirePermission(roles.UsersManage), u.handler.FindUsers)
+	router.Get("/invitations", u.m.JwtAuth(), u.m.RequirePermission(roles.AdminsInvite), u.handler.FindInvitations)
+	router.Get("/oauth/:provider/authorize", u.m.ApiKeyAuth(appinfo.ScopeUsersAuth), u.handler.OidcAuthorize)
+	router.Get("/:user_id", u.m.JwtAuth(), u.m.ParamsCheck(roles.UsersManage), u.handler.GetUserProfile)
+	router.Get("/:user_id/export", u.m.JwtAuth(), u.m.NotImpersonated(), u.m.ParamsCheck(roles.UsersManage), u.handler.ExportUser)
+	router.Get("/:user_id/sessions", u.m.JwtAuth(), u.m.ParamsCheck(roles.UsersManage), u.handler.FindSessions)
+
+	router.Post("/signup", u.m.ApiKeyAuth(appinfo.ScopeUsersAuth), u.handler.SignUpCustomer)
+	router.Post("/signin", u.m.ApiKeyAuth(appinfo.ScopeUsersAuth), u.handler.SignIn)
+	router.Post("/refresh", u.m.ApiKeyAuth(appinfo.ScopeUsersAuth), u.handler.RefreshPassport)
+	router.Post("/signout", u.m.ApiKeyAuth(appinfo.ScopeUsersAuth), u.handler.SignOut)
+	router.Post("/password/forgot", u.m.ApiKeyAuth(appinfo.ScopeUsersAuth), u.handler.ForgotPassword)
+	router.Post("/password/reset", u.m.ApiKeyAuth(appinfo.ScopeUsersAuth), u.handler.ResetPassword)
+	router.Post("/verify-email", u.m.ApiKeyAuth(appinfo.ScopeUsersAuth), u.handler.VerifyEmail)
+	router.Post("/verify-email/resend", u.m.ApiKeyAuth(appinfo.ScopeUsersAuth), u.handler.ResendVerification)
+	router.Post("/2fa/verify", u.m.ApiKeyAuth(appinfo.ScopeUsersAuth), u.handler.VerifyTwoFactor)
+	router.Post("/2fa/setup", u.m.ApiKeyAuth(appinfo.ScopeUsersAuth), u.handler.SetupTwoFactor)
+	router.Post("/oauth/:provider/callback", u.m.ApiKeyAuth(appinfo.ScopeUsersAuth), u.handler.OidcCallback)
+	router.Post("/signup-admin", u.m.ApiKeyAuth(appinfo.ScopeUsersAuth), u.handler.SignUpAdmin)
+	router.Post("/deletion/confirm", u.m.ApiKeyAuth(appinfo.ScopeUsersAuth), u.handler.ConfirmDeletion)
+	router.Post("/invitations", u.m.JwtAuth(), u.m.RequirePermission(roles.AdminsInvite), u.handler.InviteAdmin)
+	router.Post("/:user_id/password", u.m.JwtAuth(), u.m.NotImpersonated(), u.m.ParamsCheck(roles.UsersManage), u.handler.ChangePassword)
+	router.Post("/:user_id/unlock", u.m.JwtAuth(), u.m.RequirePermission(roles.UsersManage), u.handler.UnlockUser)
+	router.Post("/:user_id/2fa/enroll", u.m.JwtAuth(), u.m.NotImpersonated(), u.m.ParamsCheck(roles.UsersManage), u.handler.EnrollTwoFactor)
+	router.Post("/:user_id/2fa/confirm", u.m.JwtAuth(), u.m.NotImpersonated(), u.m.ParamsCheck(roles.UsersManage), u.handler.ConfirmTwoFactor)
+	router.Post("/:user_id/2fa/recovery-codes", u.m.JwtAuth(), u.m.NotImpersonated(), u.m.ParamsCheck(roles.UsersManage), u.handler.RegenerateRecoveryCodes)
+	router.Post("/:user_id/force-logout", u.m.JwtAuth(), u.m.RequirePermission(roles.UsersManage), u.handler.ForceLogout)
+	router.Post("/:user_id/deletion", u.m.JwtAuth(), u.m.NotImpersonated(), u.m.ParamsCheck(), u.handler.RequestDeletion)
+	router.Post("/:user_id/disable", u.m.JwtAuth(), u.m.RequirePermission(roles.UsersManage), u.handler.DisableUser)
+	router.Post("/:user_id/enable", u.m.JwtAuth(), u.m.RequirePermission(roles.UsersManage), u.handler.EnableUser)
+	router.Post("/:user_id/impersonate", u.m.JwtAuth(), u.m.NotImpersonated(), u.m.RequirePermission(roles.UsersImpersonate), u.handler.Impersonate)
+
+	router.Patch("/:user_id", u.m.JwtAuth(), u.m.NotImpersonated(), u.m.ParamsCheck(roles.UsersManage), u.handler.UpdateProfile)
+	router.Patch("/:user_id/role", u.m.JwtAuth(), u.m.RequirePermission(roles.UsersManage, roles.RolesManage), u.handler.UpdateUserRole)
+
+	router.Delete("/invitations/:invitation_id", u.m.JwtAuth(), u.m.RequirePermission(roles.AdminsInvite), u.handler.RevokeInvitation)
+	router.Delete("/:user_id", u.m.JwtAuth(), u.m.RequirePermission(roles.UsersManage), u.handler.DeleteUser)
+	router.Delete("/:user_id/2fa", u.m.JwtAuth(), u.m.NotImpersonated(), u.m.ParamsCheck(roles.UsersManage), u.handler.DisableTwoFactor)
+	router.Delete("/:user_id/sessions", u.m.JwtAuth(), u.m.NotImpersonated(), u.m.ParamsCheck(roles.UsersManage), u.handler.DeleteOtherSessions)
+	router.Delete("/:user_id/sessions/:session_id", u.m.JwtAuth(), u.m.NotImpersonated(), u.m.ParamsCheck(roles.UsersManage), u.handler.DeleteSession)
 }
 
 func (u *usersModule) Repository() usersRepositories.IUsersRepository { return u.repository }
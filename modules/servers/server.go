@@ -1,12 +1,19 @@
 package servers
 
 import (
+	"context"
 	"encoding/json"
 	"log"
 	"os"
 	"os/signal"
 
 	"github.com/codepnw/ecommerce/config"
+	"github.com/codepnw/ecommerce/pkg/auth"
+	"github.com/codepnw/ecommerce/pkg/cache"
+	"github.com/codepnw/ecommerce/pkg/mailer"
+	"github.com/codepnw/ecommerce/pkg/oidc"
+	"github.com/codepnw/ecommerce/pkg/password"
+	"github.com/codepnw/ecommerce/pkg/workers"
 	"github.com/gofiber/fiber/v2"
 	"github.com/jmoiron/sqlx"
 )
@@ -17,22 +24,39 @@ type IServer interface {
 }
 
 type server struct {
-	app *fiber.App
-	cfg config.IConfig
-	db *sqlx.DB
+	app    *fiber.App
+	cfg    config.IConfig
+	db     *sqlx.DB
+	pool   workers.IPool
+	mailer mailer.IMailer
+	policy password.IPolicy
+	keys   auth.IKeyStore
+	cache  cache.IAuthCache
+	oidc   oidc.IRegistry
 }
 
 func NewServer(cfg config.IConfig, db *sqlx.DB) IServer {
+	keys, err := auth.NewKeyStore(cfg.Jwt())
+	if err != nil {
+		log.Fatalf("load signing keys failed: %v", err)
+	}
+
 	return &server{
-		cfg: cfg,
-		db: db,
+		cfg:    cfg,
+		db:     db,
+		pool:   workers.NewPool(cfg.App().FileWorkers()),
+		mailer: mailer.NewMailer(cfg.Mail()),
+		policy: password.NewPolicy(cfg.Auth()),
+		keys:   keys,
+		cache:  cache.NewAuthCache(cfg.Cache()),
+		oidc:   oidc.NewRegistry(cfg.Oidc()),
 		app: fiber.New(fiber.Config{
-			AppName: cfg.App().Name(),
-			BodyLimit: cfg.App().BodyLimit(),
-			ReadTimeout: cfg.App().ReadTimeout(),
+			AppName:      cfg.App().Name(),
+			BodyLimit:    cfg.App().BodyLimit(),
+			ReadTimeout:  cfg.App().ReadTimeout(),
 			WriteTimeout: cfg.App().WriteTimeout(),
-			JSONEncoder: json.Marshal,
-			JSONDecoder: json.Unmarshal,
+			JSONEncoder:  json.Marshal,
+			JSONDecoder:  json.Unmarshal,
 		}),
 	}
 }
@@ -46,6 +70,7 @@ func (s *server) Start() {
 	s.app.Use(middlewares.Logger())
 	s.app.Use(middlewares.Cors())
 	s.app.Use(middlewares.StreamingFile())
+	s.app.Get("/private/*", middlewares.StreamingPrivateFile())
 
 	v1 := s.app.Group("v1")
 	modules := InitModule(v1, s, middlewares)
@@ -56,18 +81,27 @@ func (s *server) Start() {
 	modules.FilesModule().Init()
 	modules.ProductsModule().Init()
 	modules.OrdersModule().Init()
+	modules.RolesModule().Init()
+	modules.AddressesModule().Init()
 
 	s.app.Use(middlewares.RouterCheck())
 
+	// Background Jobs
+	ctx, cancel := context.WithCancel(context.Background())
+	go modules.FilesModule().Usecase().SweepOrphanFiles(ctx)
+	go s.keys.Run(ctx)
+
 	// Graceful Shutdown
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt)
-	go func ()  {
-		_ = <-c	
+	go func() {
+		_ = <-c
 		log.Println("server is shutting down....")
+		cancel()
 		_ = s.app.Shutdown()
+		s.pool.Close()
 	}()
- 
+
 	log.Printf("server is starting on %v", s.cfg.App().Url())
 	s.app.Listen(s.cfg.App().Url())
-}
\ No newline at end of file
+}
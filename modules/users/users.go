@@ -3,16 +3,98 @@ package users
 import (
 	"fmt"
 	"regexp"
+	"strings"
 
+	"github.com/codepnw/ecommerce/modules/addresses"
+	"github.com/codepnw/ecommerce/modules/entities"
+	"github.com/codepnw/ecommerce/modules/orders"
 	"golang.org/x/crypto/bcrypt"
 )
 
 type User struct {
-	Id       string `db:"id" json:"id"`
-	Email    string `db:"email" json:"email"`
-	Username string `db:"username" json:"username"`
-	RoleId   int    `db:"role_id" json:"role_id"`
+	Id            string `db:"id" json:"id"`
+	Email         string `db:"email" json:"email"`
+	Username      string `db:"username" json:"username"`
+	RoleId        int    `db:"role_id" json:"role_id"`
+	EmailVerified bool   `db:"email_verified" json:"email_verified"`
+}
+
+// UserFilter is the query of the admin user listing, Status is one of
+// active, disabled or locked.
+type UserFilter struct {
+	Search string `query:"search"` // id, email, username
+	RoleId int    `query:"role_id"`
+	Status string `query:"status"`
+	*entities.PaginationReq
+	*entities.SortReq
+}
+
+// UserAccount is a user as admins see it in the listing.
+type UserAccount struct {
+	Id            string  `db:"id" json:"id"`
+	Email         string  `db:"email" json:"email"`
+	Username      string  `db:"username" json:"username"`
+	RoleId        int     `db:"role_id" json:"role_id"`
+	EmailVerified bool    `db:"email_verified" json:"email_verified"`
+	TotpEnabled   bool    `db:"totp_enabled" json:"totp_enabled"`
+	Locked        bool    `db:"locked" json:"locked"`
+	DisabledAt    *string `db:"disabled_at" json:"disabled_at"`
+	CreatedAt     string  `db:"created_at" json:"created_at"`
+}
+
+// UserExport is the archive of the personal data held about a user, private
+// file urls in it are signed.
+type UserExport struct {
+	ExportedAt string                `json:"exported_at"`
+	Profile    *UserAccount          `json:"profile"`
+	Identities []*UserExportIdentity `json:"identities"`
+	Sessions   []*UserSession        `json:"sessions"`
+	Addresses  []*addresses.Address  `json:"addresses"`
+	Orders     []*orders.Order       `json:"orders"`
+	Files      []*UserExportFile     `json:"files"`
+}
+
+type UserExportIdentity struct {
+	Provider    string `db:"provider" json:"provider"`
+	Subject     string `db:"subject" json:"subject"`
+	Email       string `db:"email" json:"email"`
+	CreatedAt   string `db:"created_at" json:"created_at"`
+	LastLoginAt string `db:"last_login_at" json:"last_login_at"`
+}
+
+type UserExportFile struct {
+	Id        string `db:"id" json:"id"`
+	FileName  string `db:"filename" json:"filename"`
+	Url       string `db:"url" json:"url"`
+	Purpose   string `db:"purpose" json:"purpose"`
+	CreatedAt string `db:"created_at" json:"created_at"`
+}
+
+type UserDeleteReq struct {
+	Token string `json:"token" form:"token"`
+	Ip    string `json:"-" form:"-"`
 }
+
+// UserImpersonateReq opens a session as UserId for support staff, the reason
+// is kept in the audit log.
+type UserImpersonateReq struct {
+	Reason                  string   `json:"reason" form:"reason"`
+	UserId                  string   `json:"-" form:"-"`
+	ImpersonatorId          string   `json:"-" form:"-"`
+	ImpersonatorPermissions []string `json:"-" form:"-"`
+	Ip                      string   `json:"-" form:"-"`
+	UserAgent               string   `json:"-" form:"-"`
+}
+
+type UserImpersonation struct {
+	ImpersonatorId string `json:"impersonator_id"`
+	ExpiresAt      string `json:"expires_at"`
+}
+
+type UserRoleReq struct {
+	RoleId int `json:"role_id" form:"role_id"`
+}
+
 type UserRegisterReq struct {
 	Email    string `db:"email" json:"email" form:"email"`
 	Password string `db:"password" json:"password" form:"password"`
@@ -20,16 +102,24 @@ type UserRegisterReq struct {
 }
 
 type UserCredential struct {
-	Email    string `db:"email" json:"email" form:"email"`
-	Password string `db:"password" json:"password" form:"password"`
+	Email     string `db:"email" json:"email" form:"email"`
+	Password  string `db:"password" json:"password" form:"password"`
+	Ip        string `db:"ip" json:"-" form:"-"`
+	UserAgent string `db:"user_agent" json:"-" form:"-"`
 }
 
 type UserCredentialCheck struct {
-	Id       string `db:"id"`
-	Email    string `db:"email"`
-	Password string `db:"password"`
-	Username string `db:"username"`
-	RoleId   int    `db:"role_id"`
+	Id               string  `db:"id"`
+	Email            string  `db:"email"`
+	Password         string  `db:"password"`
+	Username         string  `db:"username"`
+	RoleId           int     `db:"role_id"`
+	EmailVerified    bool    `db:"email_verified"`
+	TotpEnabled      bool    `db:"totp_enabled"`
+	Disabled         bool    `db:"disabled"`
+	FailedAttempts   int     `db:"failed_attempts"`
+	SinceLastFailure float64 `db:"since_last_failure"` // seconds, 0 when there is none
+	LockedFor        float64 `db:"locked_for"`         // seconds left of a lockout
 }
 
 func (obj *UserRegisterReq) BcryptHashing() error {
@@ -42,7 +132,11 @@ func (obj *UserRegisterReq) BcryptHashing() error {
 }
 
 func (obj *UserRegisterReq) IsEmail() bool {
-	match, err := regexp.MatchString(`^[\w-\.]+@([\w-]+\.)+[\w-]{2,4}$`, obj.Email)
+	return isEmail(obj.Email)
+}
+
+func isEmail(email string) bool {
+	match, err := regexp.MatchString(`^[\w-\.]+@([\w-]+\.)+[\w-]{2,4}$`, email)
 	if err != nil {
 		return false
 	}
@@ -50,8 +144,18 @@ func (obj *UserRegisterReq) IsEmail() bool {
 }
 
 type UserPassport struct {
-	User  *User      `json:"user"`
-	Token *UserToken `json:"token"`
+	User          *User              `json:"user"`
+	Token         *UserToken         `json:"token"`
+	Challenge     *UserChallenge     `json:"challenge,omitempty"`
+	RecoveryCodes []string           `json:"recovery_codes,omitempty"`
+	Impersonation *UserImpersonation `json:"impersonation,omitempty"`
+}
+
+// UserChallenge is returned by sign in instead of a token when a second
+// factor is needed, SetupRequired is set for admins who must enroll first.
+type UserChallenge struct {
+	Token         string `json:"token"`
+	SetupRequired bool   `json:"setup_required"`
 }
 
 type UserToken struct {
@@ -63,6 +167,9 @@ type UserToken struct {
 type UserClaims struct {
 	Id     string `db:"id" json:"id"`
 	RoleId int    `db:"role" json:"role"`
+	// Impersonator is the admin acting as this user, empty for the user's
+	// own sessions
+	Impersonator string `db:"-" json:"impersonator,omitempty"`
 }
 
 type UserRefreshCredential struct {
@@ -70,10 +177,227 @@ type UserRefreshCredential struct {
 }
 
 type Oauth struct {
-	Id     string `db:"id" json:"id"`
-	UserId string `db:"user_id" json:"user_id"`
+	Id       string `db:"id" json:"id"`
+	UserId   string `db:"user_id" json:"user_id"`
+	FamilyId string `db:"family_id" json:"family_id"`
+	Rotated  bool   `db:"rotated" json:"-"`
 }
 
 type UserRemoveCredential struct {
 	OauthId string `json:"oauth_id" form:"oauth_id"`
 }
+
+type UserForgotPasswordReq struct {
+	Email string `json:"email" form:"email"`
+}
+
+type UserVerifyEmailReq struct {
+	Token string `json:"token" form:"token"`
+}
+
+type UserResendVerificationReq struct {
+	Email string `json:"email" form:"email"`
+}
+
+type UserResetPasswordReq struct {
+	Token    string `json:"token" form:"token"`
+	Password string `json:"password" form:"password"`
+}
+
+func (obj *UserResetPasswordReq) BcryptHashing() error {
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(obj.Password), 10)
+	if err != nil {
+		return fmt.Errorf("hashed password failed: %v", err)
+	}
+	obj.Password = string(hashedPassword)
+	return nil
+}
+
+type UserUpdateReq struct {
+	Id       string `db:"id" json:"-"`
+	Email    string `db:"email" json:"email" form:"email"`
+	Username string `db:"username" json:"username" form:"username"`
+}
+
+func (obj *UserUpdateReq) IsEmail() bool {
+	return isEmail(obj.Email)
+}
+
+type UserChangePasswordReq struct {
+	CurrentPassword string `json:"current_password" form:"current_password"`
+	NewPassword     string `json:"new_password" form:"new_password"`
+}
+
+type AuditAction string
+
+const (
+	AuditUserLocked   AuditAction = "user.locked"
+	AuditUserUnlocked AuditAction = "user.unlocked"
+	AuditTotpEnabled  AuditAction = "totp.enabled"
+	AuditTotpDisabled AuditAction = "totp.disabled"
+	AuditRefreshReuse AuditAction = "session.refresh_reused"
+	AuditForceLogout  AuditAction = "session.force_logout"
+	AuditAdminInvited AuditAction = "admin.invited"
+	AuditInviteRevoke AuditAction = "admin.invitation_revoked"
+	AuditInviteAccept AuditAction = "admin.invitation_accepted"
+	AuditInviteReject AuditAction = "admin.invitation_rejected"
+	AuditIdentityLink AuditAction = "identity.linked"
+	AuditRoleChanged  AuditAction = "user.role_changed"
+	AuditUserDisabled AuditAction = "user.disabled"
+	AuditUserEnabled  AuditAction = "user.enabled"
+	AuditUserDeleted  AuditAction = "user.deleted"
+	AuditUserExported AuditAction = "user.exported"
+	AuditImpersonate  AuditAction = "user.impersonated"
+)
+
+// AuditLog is an entry of the "audit_logs" trail, ActorId is empty for
+// actions taken by the system itself.
+type AuditLog struct {
+	Id        string         `db:"id" json:"id"`
+	ActorId   string         `db:"actor_id" json:"actor_id"`
+	Action    AuditAction    `db:"action" json:"action"`
+	TargetId  string         `db:"target_id" json:"target_id"`
+	Ip        string         `db:"ip" json:"ip"`
+	Detail    map[string]any `db:"detail" json:"detail"`
+	CreatedAt string         `db:"created_at" json:"created_at"`
+}
+
+type UserInvitationReq struct {
+	Email string `json:"email" form:"email"`
+}
+
+func (obj *UserInvitationReq) IsEmail() bool {
+	return isEmail(obj.Email)
+}
+
+// UserInvitation lets the holder of its token create one admin account for
+// Email, the token itself is only ever sent by mail.
+type UserInvitation struct {
+	Id         string  `db:"id" json:"id"`
+	Email      string  `db:"email" json:"email"`
+	InvitedBy  *string `db:"invited_by" json:"invited_by"`
+	AcceptedBy *string `db:"accepted_by" json:"accepted_by"`
+	ExpiresAt  string  `db:"expires_at" json:"expires_at"`
+	AcceptedAt *string `db:"accepted_at" json:"accepted_at"`
+	RevokedAt  *string `db:"revoked_at" json:"revoked_at"`
+	CreatedAt  string  `db:"created_at" json:"created_at"`
+}
+
+// UserInvitationToken is the invitation a token points at, Status is one of
+// pending, accepted, revoked or expired.
+type UserInvitationToken struct {
+	Id     string `db:"id"`
+	Email  string `db:"email"`
+	Status string `db:"status"`
+}
+
+type UserAcceptInvitationReq struct {
+	Token    string `json:"token" form:"token"`
+	Username string `json:"username" form:"username"`
+	Password string `json:"password" form:"password"`
+	Ip       string `json:"-" form:"-"`
+}
+
+func (obj *UserAcceptInvitationReq) BcryptHashing() error {
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(obj.Password), 10)
+	if err != nil {
+		return fmt.Errorf("hashed password failed: %v", err)
+	}
+	obj.Password = string(hashedPassword)
+	return nil
+}
+
+type UserOidcAuthorizeRes struct {
+	Url   string `json:"url"`
+	State string `json:"state"`
+}
+
+// UserOidcCallbackReq carries what the provider redirected back with, the
+// client forwards it unchanged.
+type UserOidcCallbackReq struct {
+	Provider  string `json:"-" form:"-"`
+	Code      string `json:"code" form:"code"`
+	State     string `json:"state" form:"state"`
+	Ip        string `json:"-" form:"-"`
+	UserAgent string `json:"-" form:"-"`
+}
+
+type UserIdentity struct {
+	Provider      string
+	Subject       string
+	Email         string
+	EmailVerified bool
+}
+
+type UserTotp struct {
+	Secret  string `db:"totp_secret"`
+	Enabled bool   `db:"totp_enabled"`
+}
+
+type UserTotpEnrollment struct {
+	Secret string `json:"secret"`
+	Uri    string `json:"uri"`
+}
+
+type UserRecoveryCodes struct {
+	Codes []string `json:"recovery_codes"`
+}
+
+// UserTwoFactorCodeReq carries either a code from the authenticator app or
+// one of the recovery codes.
+type UserTwoFactorCodeReq struct {
+	Code         string `json:"code" form:"code"`
+	RecoveryCode string `json:"recovery_code" form:"recovery_code"`
+}
+
+type UserTwoFactorReq struct {
+	ChallengeToken string `json:"challenge_token" form:"challenge_token"`
+	UserTwoFactorCodeReq
+	Ip        string `json:"-" form:"-"`
+	UserAgent string `json:"-" form:"-"`
+}
+
+// UserSessionMeta describes the client a session is created for.
+type UserSessionMeta struct {
+	Ip        string
+	UserAgent string
+}
+
+type UserSession struct {
+	Id         string `db:"id" json:"id"`
+	Device     string `db:"device" json:"device"`
+	Ip         string `db:"ip" json:"ip"`
+	UserAgent  string `db:"user_agent" json:"user_agent"`
+	CreatedAt  string `db:"created_at" json:"created_at"`
+	LastUsedAt string `db:"last_used_at" json:"last_used_at"`
+	Current    bool   `db:"current" json:"current"`
+
+	// ImpersonatorId is set on sessions an admin opened as the user
+	ImpersonatorId *string `db:"impersonator_id" json:"impersonator_id"`
+}
+
+// Device gives a session a readable name from its user agent, it is only a
+// hint for the user and never used for security decisions.
+func (obj *UserSessionMeta) Device() string {
+	ua := strings.ToLower(obj.UserAgent)
+	switch {
+	case ua == "":
+		return "unknown"
+	case strings.Contains(ua, "iphone"):
+		return "iPhone"
+	case strings.Contains(ua, "ipad"):
+		return "iPad"
+	case strings.Contains(ua, "android"):
+		return "Android"
+	case strings.Contains(ua, "windows"):
+		return "Windows"
+	case strings.Contains(ua, "mac os"), strings.Contains(ua, "macintosh"):
+		return "macOS"
+	case strings.Contains(ua, "linux"):
+		return "Linux"
+	case strings.Contains(ua, "postman"), strings.Contains(ua, "curl"), strings.Contains(ua, "httpie"):
+		return "API client"
+	default:
+		return "other"
+	}
+}
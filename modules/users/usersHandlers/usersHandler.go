@@ -1,13 +1,14 @@
 package usersHandlers
 
 import (
+	"fmt"
 	"strings"
 
 	"github.com/codepnw/ecommerce/config"
 	"github.com/codepnw/ecommerce/modules/entities"
 	"github.com/codepnw/ecommerce/modules/users"
 	"github.com/codepnw/ecommerce/modules/users/usersUsecases"
-	"github.com/codepnw/ecommerce/pkg/auth"
+	"github.com/codepnw/ecommerce/pkg/password"
 	"github.com/gofiber/fiber/v2"
 )
 
@@ -19,8 +20,38 @@ const (
 	refreshPassportErr    usersHandlersErrCode = "users-003"
 	signOutErr            usersHandlersErrCode = "users-004"
 	signUpAdminErr        usersHandlersErrCode = "users-005"
-	generateAdminTokenErr usersHandlersErrCode = "users-006"
 	getUserProfileErr     usersHandlersErrCode = "users-007"
+	forgotPasswordErr     usersHandlersErrCode = "users-008"
+	resetPasswordErr      usersHandlersErrCode = "users-009"
+	verifyEmailErr        usersHandlersErrCode = "users-010"
+	resendVerificationErr usersHandlersErrCode = "users-011"
+	updateProfileErr      usersHandlersErrCode = "users-012"
+	changePasswordErr     usersHandlersErrCode = "users-013"
+	unlockUserErr         usersHandlersErrCode = "users-014"
+	verifyTwoFactorErr    usersHandlersErrCode = "users-015"
+	setupTwoFactorErr     usersHandlersErrCode = "users-016"
+	enrollTwoFactorErr    usersHandlersErrCode = "users-017"
+	confirmTwoFactorErr   usersHandlersErrCode = "users-018"
+	disableTwoFactorErr   usersHandlersErrCode = "users-019"
+	recoveryCodesErr      usersHandlersErrCode = "users-020"
+	findSessionsErr       usersHandlersErrCode = "users-021"
+	deleteSessionErr      usersHandlersErrCode = "users-022"
+	deleteSessionsErr     usersHandlersErrCode = "users-023"
+	forceLogoutErr        usersHandlersErrCode = "users-024"
+	inviteAdminErr        usersHandlersErrCode = "users-025"
+	findInvitationsErr    usersHandlersErrCode = "users-026"
+	revokeInvitationErr   usersHandlersErrCode = "users-027"
+	oidcAuthorizeErr      usersHandlersErrCode = "users-028"
+	oidcCallbackErr       usersHandlersErrCode = "users-029"
+	findUsersErr          usersHandlersErrCode = "users-030"
+	updateUserRoleErr     usersHandlersErrCode = "users-031"
+	disableUserErr        usersHandlersErrCode = "users-032"
+	enableUserErr         usersHandlersErrCode = "users-033"
+	deleteUserErr         usersHandlersErrCode = "users-034"
+	exportUserErr         usersHandlersErrCode = "users-035"
+	requestDeletionErr    usersHandlersErrCode = "users-036"
+	confirmDeletionErr    usersHandlersErrCode = "users-037"
+	impersonateErr        usersHandlersErrCode = "users-038"
 )
 
 type IUsersHandler interface {
@@ -28,8 +59,39 @@ type IUsersHandler interface {
 	SignIn(c *fiber.Ctx) error
 	RefreshPassport(c *fiber.Ctx) error
 	SignOut(c *fiber.Ctx) error
-	GenerateAdminToken(c *fiber.Ctx) error
+	SignUpAdmin(c *fiber.Ctx) error
 	GetUserProfile(c *fiber.Ctx) error
+	ForgotPassword(c *fiber.Ctx) error
+	ResetPassword(c *fiber.Ctx) error
+	VerifyEmail(c *fiber.Ctx) error
+	ResendVerification(c *fiber.Ctx) error
+	UpdateProfile(c *fiber.Ctx) error
+	ChangePassword(c *fiber.Ctx) error
+	UnlockUser(c *fiber.Ctx) error
+	VerifyTwoFactor(c *fiber.Ctx) error
+	SetupTwoFactor(c *fiber.Ctx) error
+	EnrollTwoFactor(c *fiber.Ctx) error
+	ConfirmTwoFactor(c *fiber.Ctx) error
+	DisableTwoFactor(c *fiber.Ctx) error
+	RegenerateRecoveryCodes(c *fiber.Ctx) error
+	FindSessions(c *fiber.Ctx) error
+	DeleteSession(c *fiber.Ctx) error
+	DeleteOtherSessions(c *fiber.Ctx) error
+	ForceLogout(c *fiber.Ctx) error
+	InviteAdmin(c *fiber.Ctx) error
+	FindInvitations(c *fiber.Ctx) error
+	RevokeInvitation(c *fiber.Ctx) error
+	OidcAuthorize(c *fiber.Ctx) error
+	OidcCallback(c *fiber.Ctx) error
+	FindUsers(c *fiber.Ctx) error
+	UpdateUserRole(c *fiber.Ctx) error
+	DisableUser(c *fiber.Ctx) error
+	EnableUser(c *fiber.Ctx) error
+	DeleteUser(c *fiber.Ctx) error
+	ExportUser(c *fiber.Ctx) error
+	RequestDeletion(c *fiber.Ctx) error
+	ConfirmDeletion(c *fiber.Ctx) error
+	Impersonate(c *fiber.Ctx) error
 }
 
 type usersHandler struct {
@@ -64,6 +126,13 @@ func (h *usersHandler) SignUpCustomer(c *fiber.Ctx) error {
 
 	result, err := h.usecase.InsertCustomer(req)
 	if err != nil {
+		if _, ok := err.(*password.PolicyError); ok {
+			return entities.NewResponse(c).Error(
+				fiber.ErrBadRequest.Code,
+				string(signUpCustomerErr),
+				err.Error(),
+			).Res()
+		}
 		switch err.Error() {
 		case "username has been used":
 			return entities.NewResponse(c).Error(
@@ -89,43 +158,47 @@ func (h *usersHandler) SignUpCustomer(c *fiber.Ctx) error {
 	return entities.NewResponse(c).Success(fiber.StatusCreated, result).Res()
 }
 
+// SignUpAdmin redeems an admin invitation, the account is created for the
+// email the invitation was sent to.
 func (h *usersHandler) SignUpAdmin(c *fiber.Ctx) error {
-	req := new(users.UserRegisterReq)
+	req := new(users.UserAcceptInvitationReq)
 	if err := c.BodyParser(req); err != nil {
 		return entities.NewResponse(c).Error(
 			fiber.ErrBadRequest.Code,
-			string(signUpCustomerErr),
+			string(signUpAdminErr),
 			err.Error(),
 		).Res()
 	}
+	req.Ip = c.IP()
 
-	if !req.IsEmail() {
+	if req.Token == "" || strings.TrimSpace(req.Username) == "" {
 		return entities.NewResponse(c).Error(
 			fiber.ErrBadRequest.Code,
-			string(signUpCustomerErr),
-			"email pattern is invalid",
+			string(signUpAdminErr),
+			"token and username are required",
 		).Res()
 	}
 
-	result, err := h.usecase.InsertCustomer(req)
+	result, err := h.usecase.AcceptInvitation(req)
 	if err != nil {
-		switch err.Error() {
-		case "username has been used":
+		if _, ok := err.(*password.PolicyError); ok {
 			return entities.NewResponse(c).Error(
 				fiber.ErrBadRequest.Code,
-				string(signUpCustomerErr),
+				string(signUpAdminErr),
 				err.Error(),
 			).Res()
-		case "email has been used":
+		}
+		switch err.Error() {
+		case "token is invalid or has expired", "username has been used", "email has been used":
 			return entities.NewResponse(c).Error(
 				fiber.ErrBadRequest.Code,
-				string(signUpCustomerErr),
+				string(signUpAdminErr),
 				err.Error(),
 			).Res()
 		default:
 			return entities.NewResponse(c).Error(
 				fiber.ErrInternalServerError.Code,
-				string(signUpCustomerErr),
+				string(signUpAdminErr),
 				err.Error(),
 			).Res()
 		}
@@ -134,30 +207,6 @@ func (h *usersHandler) SignUpAdmin(c *fiber.Ctx) error {
 	return entities.NewResponse(c).Success(fiber.StatusCreated, result).Res()
 }
 
-func (h *usersHandler) GenerateAdminToken(c *fiber.Ctx) error {
-	adminToken, err := auth.NewEcomAuth(
-		auth.Admin,
-		h.cfg.Jwt(),
-		nil,
-	)
-	if err != nil {
-		return entities.NewResponse(c).Error(
-			fiber.ErrInternalServerError.Code,
-			string(generateAdminTokenErr),
-			err.Error(),
-		).Res()
-	}
-
-	return entities.NewResponse(c).Success(
-		fiber.StatusOK,
-		&struct {
-			Token string `json:"token"`
-		}{
-			Token: adminToken.SignToken(),
-		},
-	).Res()
-}
-
 func (h *usersHandler) SignIn(c *fiber.Ctx) error {
 	req := new(users.UserCredential)
 	if err := c.BodyParser(req); err != nil {
@@ -168,13 +217,25 @@ func (h *usersHandler) SignIn(c *fiber.Ctx) error {
 		).Res()
 	}
 
+	req.Ip = c.IP()
+	req.UserAgent = c.Get(fiber.HeaderUserAgent)
+
 	passport, err := h.usecase.GetPassport(req)
 	if err != nil {
-		return entities.NewResponse(c).Error(
-			fiber.ErrBadRequest.Code,
-			string(signInErr),
-			err.Error(),
-		).Res()
+		switch err.Error() {
+		case "too many sign in attempts, try again later", "account is locked, try again later":
+			return entities.NewResponse(c).Error(
+				fiber.ErrTooManyRequests.Code,
+				string(signInErr),
+				err.Error(),
+			).Res()
+		default:
+			return entities.NewResponse(c).Error(
+				fiber.ErrBadRequest.Code,
+				string(signInErr),
+				err.Error(),
+			).Res()
+		}
 	}
 
 	return entities.NewResponse(c).Success(fiber.StatusOK, passport).Res()
@@ -246,3 +307,1049 @@ func (h *usersHandler) GetUserProfile(c *fiber.Ctx) error {
 
 	return entities.NewResponse(c).Success(fiber.StatusOK, result).Res()
 }
+
+func (h *usersHandler) ForgotPassword(c *fiber.Ctx) error {
+	req := new(users.UserForgotPasswordReq)
+	if err := c.BodyParser(req); err != nil {
+		return entities.NewResponse(c).Error(
+			fiber.ErrBadRequest.Code,
+			string(forgotPasswordErr),
+			err.Error(),
+		).Res()
+	}
+
+	if req.Email == "" {
+		return entities.NewResponse(c).Error(
+			fiber.ErrBadRequest.Code,
+			string(forgotPasswordErr),
+			"email is required",
+		).Res()
+	}
+
+	if err := h.usecase.ForgotPassword(req); err != nil {
+		return entities.NewResponse(c).Error(
+			fiber.ErrInternalServerError.Code,
+			string(forgotPasswordErr),
+			err.Error(),
+		).Res()
+	}
+
+	return entities.NewResponse(c).Success(fiber.StatusOK, nil).Res()
+}
+
+func (h *usersHandler) ResetPassword(c *fiber.Ctx) error {
+	req := new(users.UserResetPasswordReq)
+	if err := c.BodyParser(req); err != nil {
+		return entities.NewResponse(c).Error(
+			fiber.ErrBadRequest.Code,
+			string(resetPasswordErr),
+			err.Error(),
+		).Res()
+	}
+
+	if req.Token == "" || req.Password == "" {
+		return entities.NewResponse(c).Error(
+			fiber.ErrBadRequest.Code,
+			string(resetPasswordErr),
+			"token and password are required",
+		).Res()
+	}
+
+	if err := h.usecase.ResetPassword(req); err != nil {
+		if _, ok := err.(*password.PolicyError); ok {
+			return entities.NewResponse(c).Error(
+				fiber.ErrBadRequest.Code,
+				string(resetPasswordErr),
+				err.Error(),
+			).Res()
+		}
+		switch err.Error() {
+		case "token is invalid or has expired":
+			return entities.NewResponse(c).Error(
+				fiber.ErrBadRequest.Code,
+				string(resetPasswordErr),
+				err.Error(),
+			).Res()
+		default:
+			return entities.NewResponse(c).Error(
+				fiber.ErrInternalServerError.Code,
+				string(resetPasswordErr),
+				err.Error(),
+			).Res()
+		}
+	}
+
+	return entities.NewResponse(c).Success(fiber.StatusOK, nil).Res()
+}
+
+func (h *usersHandler) VerifyEmail(c *fiber.Ctx) error {
+	req := new(users.UserVerifyEmailReq)
+	if err := c.BodyParser(req); err != nil {
+		return entities.NewResponse(c).Error(
+			fiber.ErrBadRequest.Code,
+			string(verifyEmailErr),
+			err.Error(),
+		).Res()
+	}
+
+	if req.Token == "" {
+		return entities.NewResponse(c).Error(
+			fiber.ErrBadRequest.Code,
+			string(verifyEmailErr),
+			"token is required",
+		).Res()
+	}
+
+	if err := h.usecase.VerifyEmail(req); err != nil {
+		switch err.Error() {
+		case "token is invalid or has expired":
+			return entities.NewResponse(c).Error(
+				fiber.ErrBadRequest.Code,
+				string(verifyEmailErr),
+				err.Error(),
+			).Res()
+		default:
+			return entities.NewResponse(c).Error(
+				fiber.ErrInternalServerError.Code,
+				string(verifyEmailErr),
+				err.Error(),
+			).Res()
+		}
+	}
+
+	return entities.NewResponse(c).Success(fiber.StatusOK, nil).Res()
+}
+
+func (h *usersHandler) ResendVerification(c *fiber.Ctx) error {
+	req := new(users.UserResendVerificationReq)
+	if err := c.BodyParser(req); err != nil {
+		return entities.NewResponse(c).Error(
+			fiber.ErrBadRequest.Code,
+			string(resendVerificationErr),
+			err.Error(),
+		).Res()
+	}
+
+	if req.Email == "" {
+		return entities.NewResponse(c).Error(
+			fiber.ErrBadRequest.Code,
+			string(resendVerificationErr),
+			"email is required",
+		).Res()
+	}
+
+	if err := h.usecase.ResendVerification(req); err != nil {
+		return entities.NewResponse(c).Error(
+			fiber.ErrInternalServerError.Code,
+			string(resendVerificationErr),
+			err.Error(),
+		).Res()
+	}
+
+	return entities.NewResponse(c).Success(fiber.StatusOK, nil).Res()
+}
+
+func (h *usersHandler) UpdateProfile(c *fiber.Ctx) error {
+	req := new(users.UserUpdateReq)
+	if err := c.BodyParser(req); err != nil {
+		return entities.NewResponse(c).Error(
+			fiber.ErrBadRequest.Code,
+			string(updateProfileErr),
+			err.Error(),
+		).Res()
+	}
+	req.Id = strings.Trim(c.Params("user_id"), " ")
+	req.Username = strings.TrimSpace(req.Username)
+	req.Email = strings.TrimSpace(req.Email)
+
+	if req.Email != "" && !req.IsEmail() {
+		return entities.NewResponse(c).Error(
+			fiber.ErrBadRequest.Code,
+			string(updateProfileErr),
+			"email pattern is invalid",
+		).Res()
+	}
+
+	result, err := h.usecase.UpdateProfile(req)
+	if err != nil {
+		switch err.Error() {
+		case "username has been used", "email has been used":
+			return entities.NewResponse(c).Error(
+				fiber.ErrBadRequest.Code,
+				string(updateProfileErr),
+				err.Error(),
+			).Res()
+		default:
+			return entities.NewResponse(c).Error(
+				fiber.ErrInternalServerError.Code,
+				string(updateProfileErr),
+				err.Error(),
+			).Res()
+		}
+	}
+
+	return entities.NewResponse(c).Success(fiber.StatusOK, result).Res()
+}
+
+func (h *usersHandler) ChangePassword(c *fiber.Ctx) error {
+	userId := strings.Trim(c.Params("user_id"), " ")
+	accessToken := strings.TrimPrefix(c.Get("Authorization"), "Bearer ")
+
+	req := new(users.UserChangePasswordReq)
+	if err := c.BodyParser(req); err != nil {
+		return entities.NewResponse(c).Error(
+			fiber.ErrBadRequest.Code,
+			string(changePasswordErr),
+			err.Error(),
+		).Res()
+	}
+
+	if req.CurrentPassword == "" || req.NewPassword == "" {
+		return entities.NewResponse(c).Error(
+			fiber.ErrBadRequest.Code,
+			string(changePasswordErr),
+			"current password and new password are required",
+		).Res()
+	}
+
+	if err := h.usecase.ChangePassword(userId, accessToken, req); err != nil {
+		if _, ok := err.(*password.PolicyError); ok {
+			return entities.NewResponse(c).Error(
+				fiber.ErrBadRequest.Code,
+				string(changePasswordErr),
+				err.Error(),
+			).Res()
+		}
+		switch err.Error() {
+		case "password is invalid":
+			return entities.NewResponse(c).Error(
+				fiber.ErrBadRequest.Code,
+				string(changePasswordErr),
+				err.Error(),
+			).Res()
+		default:
+			return entities.NewResponse(c).Error(
+				fiber.ErrInternalServerError.Code,
+				string(changePasswordErr),
+				err.Error(),
+			).Res()
+		}
+	}
+
+	return entities.NewResponse(c).Success(fiber.StatusOK, nil).Res()
+}
+
+func (h *usersHandler) UnlockUser(c *fiber.Ctx) error {
+	userId := strings.Trim(c.Params("user_id"), " ")
+	adminId, _ := c.Locals("userId").(string)
+
+	if err := h.usecase.UnlockUser(userId, adminId, c.IP()); err != nil {
+		switch err.Error() {
+		case "user not found":
+			return entities.NewResponse(c).Error(
+				fiber.ErrBadRequest.Code,
+				string(unlockUserErr),
+				err.Error(),
+			).Res()
+		default:
+			return entities.NewResponse(c).Error(
+				fiber.ErrInternalServerError.Code,
+				string(unlockUserErr),
+				err.Error(),
+			).Res()
+		}
+	}
+
+	return entities.NewResponse(c).Success(fiber.StatusOK, nil).Res()
+}
+
+func (h *usersHandler) VerifyTwoFactor(c *fiber.Ctx) error {
+	req := new(users.UserTwoFactorReq)
+	if err := c.BodyParser(req); err != nil {
+		return entities.NewResponse(c).Error(
+			fiber.ErrBadRequest.Code,
+			string(verifyTwoFactorErr),
+			err.Error(),
+		).Res()
+	}
+	req.Ip = c.IP()
+	req.UserAgent = c.Get(fiber.HeaderUserAgent)
+
+	passport, err := h.usecase.VerifyTwoFactor(req)
+	if err != nil {
+		switch err.Error() {
+		case "account is locked, try again later":
+			return entities.NewResponse(c).Error(
+				fiber.ErrTooManyRequests.Code,
+				string(verifyTwoFactorErr),
+				err.Error(),
+			).Res()
+		default:
+			return entities.NewResponse(c).Error(
+				fiber.ErrBadRequest.Code,
+				string(verifyTwoFactorErr),
+				err.Error(),
+			).Res()
+		}
+	}
+
+	return entities.NewResponse(c).Success(fiber.StatusOK, passport).Res()
+}
+
+func (h *usersHandler) SetupTwoFactor(c *fiber.Ctx) error {
+	req := new(users.UserTwoFactorReq)
+	if err := c.BodyParser(req); err != nil {
+		return entities.NewResponse(c).Error(
+			fiber.ErrBadRequest.Code,
+			string(setupTwoFactorErr),
+			err.Error(),
+		).Res()
+	}
+
+	result, err := h.usecase.SetupTwoFactor(req.ChallengeToken)
+	if err != nil {
+		return entities.NewResponse(c).Error(
+			fiber.ErrBadRequest.Code,
+			string(setupTwoFactorErr),
+			err.Error(),
+		).Res()
+	}
+
+	return entities.NewResponse(c).Success(fiber.StatusOK, result).Res()
+}
+
+func (h *usersHandler) EnrollTwoFactor(c *fiber.Ctx) error {
+	userId := strings.Trim(c.Params("user_id"), " ")
+	if userId != c.Locals("userId") {
+		return entities.NewResponse(c).Error(
+			fiber.ErrForbidden.Code,
+			string(enrollTwoFactorErr),
+			"two-factor can only be managed by the account owner",
+		).Res()
+	}
+
+	result, err := h.usecase.EnrollTwoFactor(userId)
+	if err != nil {
+		switch err.Error() {
+		case "two-factor is already enabled":
+			return entities.NewResponse(c).Error(
+				fiber.ErrBadRequest.Code,
+				string(enrollTwoFactorErr),
+				err.Error(),
+			).Res()
+		default:
+			return entities.NewResponse(c).Error(
+				fiber.ErrInternalServerError.Code,
+				string(enrollTwoFactorErr),
+				err.Error(),
+			).Res()
+		}
+	}
+
+	return entities.NewResponse(c).Success(fiber.StatusOK, result).Res()
+}
+
+func (h *usersHandler) ConfirmTwoFactor(c *fiber.Ctx) error {
+	userId := strings.Trim(c.Params("user_id"), " ")
+	if userId != c.Locals("userId") {
+		return entities.NewResponse(c).Error(
+			fiber.ErrForbidden.Code,
+			string(confirmTwoFactorErr),
+			"two-factor can only be managed by the account owner",
+		).Res()
+	}
+
+	req := new(users.UserTwoFactorCodeReq)
+	if err := c.BodyParser(req); err != nil {
+		return entities.NewResponse(c).Error(
+			fiber.ErrBadRequest.Code,
+			string(confirmTwoFactorErr),
+			err.Error(),
+		).Res()
+	}
+
+	result, err := h.usecase.ConfirmTwoFactor(userId, req.Code)
+	if err != nil {
+		switch err.Error() {
+		case "code is invalid", "two-factor is already enabled", "two-factor enrollment has not started":
+			return entities.NewResponse(c).Error(
+				fiber.ErrBadRequest.Code,
+				string(confirmTwoFactorErr),
+				err.Error(),
+			).Res()
+		default:
+			return entities.NewResponse(c).Error(
+				fiber.ErrInternalServerError.Code,
+				string(confirmTwoFactorErr),
+				err.Error(),
+			).Res()
+		}
+	}
+
+	return entities.NewResponse(c).Success(fiber.StatusOK, result).Res()
+}
+
+func (h *usersHandler) DisableTwoFactor(c *fiber.Ctx) error {
+	userId := strings.Trim(c.Params("user_id"), " ")
+	if userId != c.Locals("userId") {
+		return entities.NewResponse(c).Error(
+			fiber.ErrForbidden.Code,
+			string(disableTwoFactorErr),
+			"two-factor can only be managed by the account owner",
+		).Res()
+	}
+
+	req := new(users.UserTwoFactorCodeReq)
+	if err := c.BodyParser(req); err != nil {
+		return entities.NewResponse(c).Error(
+			fiber.ErrBadRequest.Code,
+			string(disableTwoFactorErr),
+			err.Error(),
+		).Res()
+	}
+
+	if err := h.usecase.DisableTwoFactor(userId, req); err != nil {
+		switch err.Error() {
+		case "code is invalid", "two-factor is not enabled", "two-factor is required for admins":
+			return entities.NewResponse(c).Error(
+				fiber.ErrBadRequest.Code,
+				string(disableTwoFactorErr),
+				err.Error(),
+			).Res()
+		default:
+			return entities.NewResponse(c).Error(
+				fiber.ErrInternalServerError.Code,
+				string(disableTwoFactorErr),
+				err.Error(),
+			).Res()
+		}
+	}
+
+	return entities.NewResponse(c).Success(fiber.StatusOK, nil).Res()
+}
+
+func (h *usersHandler) RegenerateRecoveryCodes(c *fiber.Ctx) error {
+	userId := strings.Trim(c.Params("user_id"), " ")
+	if userId != c.Locals("userId") {
+		return entities.NewResponse(c).Error(
+			fiber.ErrForbidden.Code,
+			string(recoveryCodesErr),
+			"two-factor can only be managed by the account owner",
+		).Res()
+	}
+
+	req := new(users.UserTwoFactorCodeReq)
+	if err := c.BodyParser(req); err != nil {
+		return entities.NewResponse(c).Error(
+			fiber.ErrBadRequest.Code,
+			string(recoveryCodesErr),
+			err.Error(),
+		).Res()
+	}
+
+	result, err := h.usecase.RegenerateRecoveryCodes(userId, req)
+	if err != nil {
+		switch err.Error() {
+		case "code is invalid", "two-factor is not enabled":
+			return entities.NewResponse(c).Error(
+				fiber.ErrBadRequest.Code,
+				string(recoveryCodesErr),
+				err.Error(),
+			).Res()
+		default:
+			return entities.NewResponse(c).Error(
+				fiber.ErrInternalServerError.Code,
+				string(recoveryCodesErr),
+				err.Error(),
+			).Res()
+		}
+	}
+
+	return entities.NewResponse(c).Success(fiber.StatusOK, result).Res()
+}
+
+func (h *usersHandler) FindSessions(c *fiber.Ctx) error {
+	userId := strings.Trim(c.Params("user_id"), " ")
+	accessToken := strings.TrimPrefix(c.Get("Authorization"), "Bearer ")
+
+	result, err := h.usecase.FindSessions(userId, accessToken)
+	if err != nil {
+		return entities.NewResponse(c).Error(
+			fiber.ErrInternalServerError.Code,
+			string(findSessionsErr),
+			err.Error(),
+		).Res()
+	}
+
+	return entities.NewResponse(c).Success(fiber.StatusOK, result).Res()
+}
+
+func (h *usersHandler) DeleteSession(c *fiber.Ctx) error {
+	userId := strings.Trim(c.Params("user_id"), " ")
+	sessionId := strings.Trim(c.Params("session_id"), " ")
+
+	if err := h.usecase.DeleteSession(userId, sessionId); err != nil {
+		switch err.Error() {
+		case "session not found":
+			return entities.NewResponse(c).Error(
+				fiber.ErrBadRequest.Code,
+				string(deleteSessionErr),
+				err.Error(),
+			).Res()
+		default:
+			return entities.NewResponse(c).Error(
+				fiber.ErrInternalServerError.Code,
+				string(deleteSessionErr),
+				err.Error(),
+			).Res()
+		}
+	}
+
+	return entities.NewResponse(c).Success(fiber.StatusOK, nil).Res()
+}
+
+func (h *usersHandler) DeleteOtherSessions(c *fiber.Ctx) error {
+	userId := strings.Trim(c.Params("user_id"), " ")
+	accessToken := strings.TrimPrefix(c.Get("Authorization"), "Bearer ")
+
+	rows, err := h.usecase.DeleteOtherSessions(userId, accessToken)
+	if err != nil {
+		return entities.NewResponse(c).Error(
+			fiber.ErrInternalServerError.Code,
+			string(deleteSessionsErr),
+			err.Error(),
+		).Res()
+	}
+
+	return entities.NewResponse(c).Success(
+		fiber.StatusOK,
+		&struct {
+			Revoked int64 `json:"revoked"`
+		}{
+			Revoked: rows,
+		},
+	).Res()
+}
+
+func (h *usersHandler) ForceLogout(c *fiber.Ctx) error {
+	userId := strings.Trim(c.Params("user_id"), " ")
+	adminId, _ := c.Locals("userId").(string)
+
+	rows, err := h.usecase.ForceLogout(userId, adminId, c.IP())
+	if err != nil {
+		return entities.NewResponse(c).Error(
+			fiber.ErrInternalServerError.Code,
+			string(forceLogoutErr),
+			err.Error(),
+		).Res()
+	}
+
+	return entities.NewResponse(c).Success(
+		fiber.StatusOK,
+		&struct {
+			Revoked int64 `json:"revoked"`
+		}{
+			Revoked: rows,
+		},
+	).Res()
+}
+
+func (h *usersHandler) InviteAdmin(c *fiber.Ctx) error {
+	req := new(users.UserInvitationReq)
+	if err := c.BodyParser(req); err != nil {
+		return entities.NewResponse(c).Error(
+			fiber.ErrBadRequest.Code,
+			string(inviteAdminErr),
+			err.Error(),
+		).Res()
+	}
+
+	if !req.IsEmail() {
+		return entities.NewResponse(c).Error(
+			fiber.ErrBadRequest.Code,
+			string(inviteAdminErr),
+			"email pattern is invalid",
+		).Res()
+	}
+
+	adminId, _ := c.Locals("userId").(string)
+
+	result, err := h.usecase.InviteAdmin(req, adminId, c.IP())
+	if err != nil {
+		switch err.Error() {
+		case "email has been used":
+			return entities.NewResponse(c).Error(
+				fiber.ErrBadRequest.Code,
+				string(inviteAdminErr),
+				err.Error(),
+			).Res()
+		default:
+			return entities.NewResponse(c).Error(
+				fiber.ErrInternalServerError.Code,
+				string(inviteAdminErr),
+				err.Error(),
+			).Res()
+		}
+	}
+
+	return entities.NewResponse(c).Success(fiber.StatusCreated, result).Res()
+}
+
+func (h *usersHandler) FindInvitations(c *fiber.Ctx) error {
+	result, err := h.usecase.FindInvitations()
+	if err != nil {
+		return entities.NewResponse(c).Error(
+			fiber.ErrInternalServerError.Code,
+			string(findInvitationsErr),
+			err.Error(),
+		).Res()
+	}
+
+	return entities.NewResponse(c).Success(fiber.StatusOK, result).Res()
+}
+
+func (h *usersHandler) RevokeInvitation(c *fiber.Ctx) error {
+	invitationId := strings.Trim(c.Params("invitation_id"), " ")
+	adminId, _ := c.Locals("userId").(string)
+
+	if err := h.usecase.RevokeInvitation(invitationId, adminId, c.IP()); err != nil {
+		switch err.Error() {
+		case "invitation not found":
+			return entities.NewResponse(c).Error(
+				fiber.ErrBadRequest.Code,
+				string(revokeInvitationErr),
+				err.Error(),
+			).Res()
+		default:
+			return entities.NewResponse(c).Error(
+				fiber.ErrInternalServerError.Code,
+				string(revokeInvitationErr),
+				err.Error(),
+			).Res()
+		}
+	}
+
+	return entities.NewResponse(c).Success(fiber.StatusOK, nil).Res()
+}
+
+func (h *usersHandler) OidcAuthorize(c *fiber.Ctx) error {
+	provider := strings.ToLower(strings.Trim(c.Params("provider"), " "))
+
+	result, err := h.usecase.OidcAuthorize(provider)
+	if err != nil {
+		if strings.HasSuffix(err.Error(), "is not supported") {
+			return entities.NewResponse(c).Error(
+				fiber.ErrBadRequest.Code,
+				string(oidcAuthorizeErr),
+				err.Error(),
+			).Res()
+		}
+		return entities.NewResponse(c).Error(
+			fiber.ErrInternalServerError.Code,
+			string(oidcAuthorizeErr),
+			err.Error(),
+		).Res()
+	}
+
+	return entities.NewResponse(c).Success(fiber.StatusOK, result).Res()
+}
+
+func (h *usersHandler) OidcCallback(c *fiber.Ctx) error {
+	req := new(users.UserOidcCallbackReq)
+	if err := c.BodyParser(req); err != nil {
+		return entities.NewResponse(c).Error(
+			fiber.ErrBadRequest.Code,
+			string(oidcCallbackErr),
+			err.Error(),
+		).Res()
+	}
+
+	req.Provider = strings.ToLower(strings.Trim(c.Params("provider"), " "))
+	req.Ip = c.IP()
+	req.UserAgent = c.Get(fiber.HeaderUserAgent)
+
+	if req.Code == "" || req.State == "" {
+		return entities.NewResponse(c).Error(
+			fiber.ErrBadRequest.Code,
+			string(oidcCallbackErr),
+			"code and state are required",
+		).Res()
+	}
+
+	passport, err := h.usecase.OidcCallback(req)
+	if err != nil {
+		msg := err.Error()
+		switch {
+		case msg == "account is locked, try again later":
+			return entities.NewResponse(c).Error(
+				fiber.ErrTooManyRequests.Code,
+				string(oidcCallbackErr),
+				msg,
+			).Res()
+		case strings.HasSuffix(msg, "is not supported"),
+			strings.HasPrefix(msg, "state is invalid"),
+			strings.HasPrefix(msg, "code is invalid"),
+			strings.HasPrefix(msg, "id token is"),
+			msg == "provider did not share an email",
+			msg == "provider did not verify the email",
+			msg == "account is disabled",
+			msg == "email has been used":
+			return entities.NewResponse(c).Error(
+				fiber.ErrBadRequest.Code,
+				string(oidcCallbackErr),
+				msg,
+			).Res()
+		default:
+			return entities.NewResponse(c).Error(
+				fiber.ErrInternalServerError.Code,
+				string(oidcCallbackErr),
+				msg,
+			).Res()
+		}
+	}
+
+	return entities.NewResponse(c).Success(fiber.StatusOK, passport).Res()
+}
+
+func (h *usersHandler) FindUsers(c *fiber.Ctx) error {
+	req := &users.UserFilter{
+		SortReq:       &entities.SortReq{},
+		PaginationReq: &entities.PaginationReq{},
+	}
+
+	if err := c.QueryParser(req); err != nil {
+		return entities.NewResponse(c).Error(
+			fiber.ErrBadRequest.Code,
+			string(findUsersErr),
+			err.Error(),
+		).Res()
+	}
+
+	if req.Page < 1 {
+		req.Page = 1
+	}
+	if req.Limit < 5 {
+		req.Limit = 5
+	}
+	if req.Limit > 100 {
+		req.Limit = 100
+	}
+
+	orderByMap := map[string]string{
+		"id":         `"u"."id"`,
+		"email":      `"u"."email"`,
+		"username":   `"u"."username"`,
+		"created_at": `"u"."created_at"`,
+	}
+	if orderByMap[req.OrderBy] == "" {
+		req.OrderBy = orderByMap["created_at"]
+	} else {
+		req.OrderBy = orderByMap[req.OrderBy]
+	}
+
+	req.Sort = strings.ToUpper(req.Sort)
+	sortMap := map[string]string{
+		"DESC": "DESC",
+		"ASC":  "ASC",
+	}
+	if sortMap[req.Sort] == "" {
+		req.Sort = sortMap["DESC"]
+	}
+
+	req.Status = strings.ToLower(req.Status)
+	statusMap := map[string]string{
+		"active":   "active",
+		"disabled": "disabled",
+		"locked":   "locked",
+	}
+	if req.Status != "" && statusMap[req.Status] == "" {
+		return entities.NewResponse(c).Error(
+			fiber.ErrBadRequest.Code,
+			string(findUsersErr),
+			"status is invalid",
+		).Res()
+	}
+
+	result, err := h.usecase.FindUsers(req)
+	if err != nil {
+		return entities.NewResponse(c).Error(
+			fiber.ErrInternalServerError.Code,
+			string(findUsersErr),
+			err.Error(),
+		).Res()
+	}
+
+	return entities.NewResponse(c).Success(fiber.StatusOK, result).Res()
+}
+
+func (h *usersHandler) UpdateUserRole(c *fiber.Ctx) error {
+	userId := strings.Trim(c.Params("user_id"), " ")
+	adminId, _ := c.Locals("userId").(string)
+	adminPermissions, _ := c.Locals("userPermissions").([]string)
+
+	req := new(users.UserRoleReq)
+	if err := c.BodyParser(req); err != nil {
+		return entities.NewResponse(c).Error(
+			fiber.ErrBadRequest.Code,
+			string(updateUserRoleErr),
+			err.Error(),
+		).Res()
+	}
+	if req.RoleId <= 0 {
+		return entities.NewResponse(c).Error(
+			fiber.ErrBadRequest.Code,
+			string(updateUserRoleErr),
+			"role id is required",
+		).Res()
+	}
+
+	result, err := h.usecase.UpdateUserRole(userId, req.RoleId, adminId, adminPermissions, c.IP())
+	if err != nil {
+		switch err.Error() {
+		case "user not found", "role not found", "you can't change your own role":
+			return entities.NewResponse(c).Error(
+				fiber.ErrBadRequest.Code,
+				string(updateUserRoleErr),
+				err.Error(),
+			).Res()
+		case "user has permissions you don't have", "role has permissions you don't have":
+			return entities.NewResponse(c).Error(
+				fiber.ErrForbidden.Code,
+				string(updateUserRoleErr),
+				err.Error(),
+			).Res()
+		default:
+			return entities.NewResponse(c).Error(
+				fiber.ErrInternalServerError.Code,
+				string(updateUserRoleErr),
+				err.Error(),
+			).Res()
+		}
+	}
+
+	return entities.NewResponse(c).Success(fiber.StatusOK, result).Res()
+}
+
+func (h *usersHandler) DisableUser(c *fiber.Ctx) error {
+	userId := strings.Trim(c.Params("user_id"), " ")
+	adminId, _ := c.Locals("userId").(string)
+	adminPermissions, _ := c.Locals("userPermissions").([]string)
+
+	if err := h.usecase.DisableUser(userId, adminId, adminPermissions, c.IP()); err != nil {
+		switch err.Error() {
+		case "user not found", "you can't disable your own account":
+			return entities.NewResponse(c).Error(
+				fiber.ErrBadRequest.Code,
+				string(disableUserErr),
+				err.Error(),
+			).Res()
+		case "user has permissions you don't have":
+			return entities.NewResponse(c).Error(
+				fiber.ErrForbidden.Code,
+				string(disableUserErr),
+				err.Error(),
+			).Res()
+		default:
+			return entities.NewResponse(c).Error(
+				fiber.ErrInternalServerError.Code,
+				string(disableUserErr),
+				err.Error(),
+			).Res()
+		}
+	}
+
+	return entities.NewResponse(c).Success(fiber.StatusOK, nil).Res()
+}
+
+func (h *usersHandler) EnableUser(c *fiber.Ctx) error {
+	userId := strings.Trim(c.Params("user_id"), " ")
+	adminId, _ := c.Locals("userId").(string)
+
+	if err := h.usecase.EnableUser(userId, adminId, c.IP()); err != nil {
+		switch err.Error() {
+		case "user not found":
+			return entities.NewResponse(c).Error(
+				fiber.ErrBadRequest.Code,
+				string(enableUserErr),
+				err.Error(),
+			).Res()
+		default:
+			return entities.NewResponse(c).Error(
+				fiber.ErrInternalServerError.Code,
+				string(enableUserErr),
+				err.Error(),
+			).Res()
+		}
+	}
+
+	return entities.NewResponse(c).Success(fiber.StatusOK, nil).Res()
+}
+
+func (h *usersHandler) DeleteUser(c *fiber.Ctx) error {
+	userId := strings.Trim(c.Params("user_id"), " ")
+	adminId, _ := c.Locals("userId").(string)
+	adminPermissions, _ := c.Locals("userPermissions").([]string)
+
+	if err := h.usecase.DeleteUser(userId, adminId, adminPermissions, c.IP()); err != nil {
+		switch err.Error() {
+		case "user not found", "you can't delete your own account":
+			return entities.NewResponse(c).Error(
+				fiber.ErrBadRequest.Code,
+				string(deleteUserErr),
+				err.Error(),
+			).Res()
+		case "user has permissions you don't have":
+			return entities.NewResponse(c).Error(
+				fiber.ErrForbidden.Code,
+				string(deleteUserErr),
+				err.Error(),
+			).Res()
+		default:
+			return entities.NewResponse(c).Error(
+				fiber.ErrInternalServerError.Code,
+				string(deleteUserErr),
+				err.Error(),
+			).Res()
+		}
+	}
+
+	return entities.NewResponse(c).Success(fiber.StatusOK, nil).Res()
+}
+
+func (h *usersHandler) ExportUser(c *fiber.Ctx) error {
+	userId := strings.Trim(c.Params("user_id"), " ")
+	actorId, _ := c.Locals("userId").(string)
+
+	result, err := h.usecase.ExportUser(userId, actorId, c.IP())
+	if err != nil {
+		switch err.Error() {
+		case "user not found":
+			return entities.NewResponse(c).Error(
+				fiber.ErrBadRequest.Code,
+				string(exportUserErr),
+				err.Error(),
+			).Res()
+		default:
+			return entities.NewResponse(c).Error(
+				fiber.ErrInternalServerError.Code,
+				string(exportUserErr),
+				err.Error(),
+			).Res()
+		}
+	}
+
+	c.Attachment(fmt.Sprintf("user-%s-export.json", userId))
+	return entities.NewResponse(c).Success(fiber.StatusOK, result).Res()
+}
+
+func (h *usersHandler) RequestDeletion(c *fiber.Ctx) error {
+	userId := strings.Trim(c.Params("user_id"), " ")
+
+	if err := h.usecase.RequestDeletion(userId); err != nil {
+		switch err.Error() {
+		case "user not found":
+			return entities.NewResponse(c).Error(
+				fiber.ErrBadRequest.Code,
+				string(requestDeletionErr),
+				err.Error(),
+			).Res()
+		default:
+			return entities.NewResponse(c).Error(
+				fiber.ErrInternalServerError.Code,
+				string(requestDeletionErr),
+				err.Error(),
+			).Res()
+		}
+	}
+
+	return entities.NewResponse(c).Success(fiber.StatusAccepted, nil).Res()
+}
+
+func (h *usersHandler) ConfirmDeletion(c *fiber.Ctx) error {
+	req := new(users.UserDeleteReq)
+	if err := c.BodyParser(req); err != nil {
+		return entities.NewResponse(c).Error(
+			fiber.ErrBadRequest.Code,
+			string(confirmDeletionErr),
+			err.Error(),
+		).Res()
+	}
+	req.Ip = c.IP()
+
+	if req.Token == "" {
+		return entities.NewResponse(c).Error(
+			fiber.ErrBadRequest.Code,
+			string(confirmDeletionErr),
+			"token is required",
+		).Res()
+	}
+
+	if err := h.usecase.ConfirmDeletion(req); err != nil {
+		switch err.Error() {
+		case "token is invalid or has expired", "user not found":
+			return entities.NewResponse(c).Error(
+				fiber.ErrBadRequest.Code,
+				string(confirmDeletionErr),
+				err.Error(),
+			).Res()
+		default:
+			return entities.NewResponse(c).Error(
+				fiber.ErrInternalServerError.Code,
+				string(confirmDeletionErr),
+				err.Error(),
+			).Res()
+		}
+	}
+
+	return entities.NewResponse(c).Success(fiber.StatusOK, nil).Res()
+}
+
+func (h *usersHandler) Impersonate(c *fiber.Ctx) error {
+	req := new(users.UserImpersonateReq)
+	if err := c.BodyParser(req); err != nil {
+		return entities.NewResponse(c).Error(
+			fiber.ErrBadRequest.Code,
+			string(impersonateErr),
+			err.Error(),
+		).Res()
+	}
+	req.Reason = strings.TrimSpace(req.Reason)
+	req.UserId = strings.Trim(c.Params("user_id"), " ")
+	req.ImpersonatorId, _ = c.Locals("userId").(string)
+	req.ImpersonatorPermissions, _ = c.Locals("userPermissions").([]string)
+	req.Ip = c.IP()
+	req.UserAgent = c.Get(fiber.HeaderUserAgent)
+
+	if req.Reason == "" {
+		return entities.NewResponse(c).Error(
+			fiber.ErrBadRequest.Code,
+			string(impersonateErr),
+			"reason is required",
+		).Res()
+	}
+
+	result, err := h.usecase.Impersonate(req)
+	if err != nil {
+		switch err.Error() {
+		case "user not found", "account is disabled", "you can't impersonate yourself", "admins can't be impersonated":
+			return entities.NewResponse(c).Error(
+				fiber.ErrBadRequest.Code,
+				string(impersonateErr),
+				err.Error(),
+			).Res()
+		case "user has permissions you don't have":
+			return entities.NewResponse(c).Error(
+				fiber.ErrForbidden.Code,
+				string(impersonateErr),
+				err.Error(),
+			).Res()
+		default:
+			return entities.NewResponse(c).Error(
+				fiber.ErrInternalServerError.Code,
+				string(impersonateErr),
+				err.Error(),
+			).Res()
+		}
+	}
+	return entities.NewResponse(c).Success(fiber.StatusCreated, result).Res()
+}
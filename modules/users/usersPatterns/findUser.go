@@ -0,0 +1,211 @@
+package usersPatterns
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/codepnw/ecommerce/modules/users"
+	"github.com/jmoiron/sqlx"
+)
+
+type IFindUserBuilder interface {
+	initQuery()
+	initCountQuery()
+	buildWhereSearch()
+	buildWhereRole()
+	buildWhereStatus()
+	buildSort()
+	buildPaginate()
+	closeQuery()
+	getQuery() string
+	getValues() []any
+	getDb() *sqlx.DB
+	reset()
+}
+
+type findUserBuilder struct {
+	db        *sqlx.DB
+	req       *users.UserFilter
+	query     string
+	values    []any
+	lastIndex int
+}
+
+func FindUserBuilder(db *sqlx.DB, req *users.UserFilter) IFindUserBuilder {
+	return &findUserBuilder{
+		db:     db,
+		req:    req,
+		values: make([]any, 0),
+	}
+}
+
+type findUserEngineer struct {
+	builder IFindUserBuilder
+}
+
+func FindUserEngineer(b IFindUserBuilder) *findUserEngineer {
+	return &findUserEngineer{builder: b}
+}
+
+func (b *findUserBuilder) initQuery() {
+	b.query += `
+		SELECT
+			COALESCE(array_to_json(array_agg("at")), '[]')
+		FROM (
+			SELECT
+				"u"."id",
+				"u"."email",
+				"u"."username",
+				"u"."role_id",
+				("u"."email_verified_at" IS NOT NULL) AS "email_verified",
+				("u"."totp_enabled_at" IS NOT NULL) AS "totp_enabled",
+				COALESCE("u"."locked_until" > NOW(), FALSE) AS "locked",
+				"u"."disabled_at",
+				"u"."created_at"
+			FROM "users" "u"
+			WHERE 1 = 1`
+}
+
+func (b *findUserBuilder) initCountQuery() {
+	b.query += `
+		SELECT
+			COUNT(*) AS "count"
+		FROM "users" "u"
+		WHERE 1 = 1`
+}
+
+func (b *findUserBuilder) buildWhereSearch() {
+	if b.req.Search != "" {
+		b.values = append(
+			b.values,
+			"%"+strings.ToLower(b.req.Search)+"%",
+			"%"+strings.ToLower(b.req.Search)+"%",
+			"%"+strings.ToLower(b.req.Search)+"%",
+		)
+
+		b.query += fmt.Sprintf(`
+			AND (
+				LOWER("u"."id") LIKE $%d OR
+				LOWER("u"."email") LIKE $%d OR
+				LOWER("u"."username") LIKE $%d
+			)`,
+			b.lastIndex+1,
+			b.lastIndex+2,
+			b.lastIndex+3,
+		)
+
+		b.lastIndex = len(b.values)
+	}
+}
+
+func (b *findUserBuilder) buildWhereRole() {
+	if b.req.RoleId > 0 {
+		b.values = append(b.values, b.req.RoleId)
+
+		b.query += fmt.Sprintf(`
+			AND "u"."role_id" = $%d`,
+			b.lastIndex+1,
+		)
+
+		b.lastIndex = len(b.values)
+	}
+}
+
+func (b *findUserBuilder) buildWhereStatus() {
+	switch b.req.Status {
+	case "active":
+		b.query += `
+			AND "u"."disabled_at" IS NULL
+			AND COALESCE("u"."locked_until" <= NOW(), TRUE)`
+	case "disabled":
+		b.query += `
+			AND "u"."disabled_at" IS NOT NULL`
+	case "locked":
+		b.query += `
+			AND "u"."locked_until" > NOW()`
+	}
+}
+
+// buildSort writes the column in the query, OrderBy and Sort are only ever
+// taken from the maps in the handler.
+func (b *findUserBuilder) buildSort() {
+	b.query += fmt.Sprintf(`
+			ORDER BY %s %s`, b.req.OrderBy, b.req.Sort)
+}
+
+func (b *findUserBuilder) buildPaginate() {
+	b.values = append(
+		b.values,
+		(b.req.Page-1)*b.req.Limit,
+		b.req.Limit,
+	)
+
+	b.query += fmt.Sprintf(`
+			OFFSET $%d LIMIT $%d`, b.lastIndex+1, b.lastIndex+2)
+
+	b.lastIndex = len(b.values)
+}
+
+func (b *findUserBuilder) closeQuery() {
+	b.query += `
+		) AS "at"`
+}
+
+func (b *findUserBuilder) getQuery() string { return b.query }
+
+func (b *findUserBuilder) getValues() []any { return b.values }
+
+func (b *findUserBuilder) getDb() *sqlx.DB { return b.db }
+
+func (b *findUserBuilder) reset() {
+	b.query = ""
+	b.values = make([]any, 0)
+	b.lastIndex = 0
+}
+
+func (en *findUserEngineer) FindUser() ([]*users.UserAccount, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+	defer en.builder.reset()
+
+	en.builder.initQuery()
+	en.builder.buildWhereSearch()
+	en.builder.buildWhereRole()
+	en.builder.buildWhereStatus()
+	en.builder.buildSort()
+	en.builder.buildPaginate()
+	en.builder.closeQuery()
+
+	raw := make([]byte, 0)
+	if err := en.builder.getDb().GetContext(ctx, &raw, en.builder.getQuery(), en.builder.getValues()...); err != nil {
+		return nil, fmt.Errorf("get users failed: %v", err)
+	}
+
+	result := make([]*users.UserAccount, 0)
+	if err := json.Unmarshal(raw, &result); err != nil {
+		return nil, fmt.Errorf("unmarshal users failed: %v", err)
+	}
+	return result, nil
+}
+
+func (en *findUserEngineer) CountUser() int {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*30)
+	defer cancel()
+	defer en.builder.reset()
+
+	en.builder.initCountQuery()
+	en.builder.buildWhereSearch()
+	en.builder.buildWhereRole()
+	en.builder.buildWhereStatus()
+
+	var count int
+	if err := en.builder.getDb().GetContext(ctx, &count, en.builder.getQuery(), en.builder.getValues()...); err != nil {
+		log.Printf("count users failed: %v\n", err)
+		return 0
+	}
+	return count
+}
@@ -99,10 +99,11 @@ func (f *userReq) Admin() (IInsertUser, error) {
 		"email",
 		"password",
 		"username",
-		"role_id"
+		"role_id",
+		"email_verified_at"
 	)
 	VALUES
-		($1, $2, $3, 2)
+		($1, $2, $3, 2, NOW())
 	RETURNING "id";`
 
 	if err := f.db.QueryRowContext(
@@ -137,7 +138,8 @@ func (f *userReq) Result() (*users.UserPassport, error) {
 			"u"."id",
 			"u"."email",
 			"u"."username",
-			"u"."role_id"
+			"u"."role_id",
+			("u"."email_verified_at" IS NOT NULL) AS "email_verified"
 		FROM "users" "u"
 		WHERE "u"."id" = $1
 	) AS "t"`
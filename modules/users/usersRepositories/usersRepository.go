@@ -2,22 +2,75 @@ package usersRepositories
 
 import (
 	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"strings"
 	"time"
 
+	"github.com/codepnw/ecommerce/modules/addresses"
+	"github.com/codepnw/ecommerce/modules/orders"
 	"github.com/codepnw/ecommerce/modules/users"
 	"github.com/codepnw/ecommerce/modules/users/usersPatterns"
+	"github.com/codepnw/ecommerce/pkg/utils"
 	"github.com/jmoiron/sqlx"
 )
 
 type IUsersRepository interface {
 	InsertUser(req *users.UserRegisterReq, isAdmin bool) (*users.UserPassport, error)
 	FindOneUserByEmail(email string) (*users.UserCredentialCheck, error)
-	InsertOauth(req *users.UserPassport) error
+	InsertOauth(req *users.UserPassport, meta *users.UserSessionMeta) error
+	InsertImpersonation(req *users.UserPassport, meta *users.UserSessionMeta, audit *users.AuditLog) error
+	RoleHasPermission(roleId int, permission ...string) (bool, error)
+	RoleExceedsPermissions(roleId int, permissions []string) (bool, error)
 	FindOneOauth(refreshToken string) (*users.Oauth, error)
-	UpdateOauth(req *users.UserToken) error
+	UpdateOauth(oldRefreshToken string, req *users.UserToken) error
 	GetProfile(userId string) (*users.User, error)
 	DeleteOauth(oauthId string) error
+	InsertPasswordReset(userId, tokenHash string, expires time.Duration) error
+	FindPasswordResetUser(tokenHash string) (string, error)
+	ResetPassword(tokenHash, password string) (string, error)
+	InsertEmailVerification(userId, tokenHash string, expires time.Duration) error
+	VerifyEmail(tokenHash string) error
+	FindOneUserById(userId string) (*users.UserCredentialCheck, error)
+	UpdateProfile(req *users.UserUpdateReq) error
+	UpdatePassword(userId, password, accessToken string) error
+	CountIpFailures(ip string, window time.Duration) int
+	InsertLoginAttempt(email, ip string, success bool) error
+	RecordLoginFailure(user *users.UserCredentialCheck, ip string, maxAttempts int, window, lockout time.Duration) (bool, error)
+	RecordLoginSuccess(user *users.UserCredentialCheck, ip string) error
+	UnlockUser(userId string, audit *users.AuditLog) error
+	InsertAudit(audit *users.AuditLog) error
+	FindTotp(userId string) (*users.UserTotp, error)
+	SetTotpSecret(userId, secret string) error
+	EnableTotp(userId string, step int64, codeHashes []string, audit *users.AuditLog) error
+	DisableTotp(userId string, audit *users.AuditLog) error
+	UseTotpStep(userId string, step int64) bool
+	UseRecoveryCode(userId, codeHash string) bool
+	ReplaceRecoveryCodes(userId string, codeHashes []string) error
+	FindSessions(userId, accessToken string) ([]*users.UserSession, error)
+	DeleteSession(userId, sessionId string) error
+	DeleteOtherSessions(userId, accessToken string) (int64, error)
+	DeleteAllSessions(userId string, audit *users.AuditLog) (int64, error)
+	InsertInvitation(req *users.UserInvitationReq, tokenHash string, expires time.Duration, audit *users.AuditLog) (*users.UserInvitation, error)
+	FindInvitations() ([]*users.UserInvitation, error)
+	RevokeInvitation(invitationId string, audit *users.AuditLog) error
+	FindInvitationByToken(tokenHash string) (*users.UserInvitationToken, error)
+	AcceptInvitation(tokenHash string, req *users.UserAcceptInvitationReq) (string, error)
+	InsertOidcState(stateHash, provider, verifier, nonce string, expires time.Duration) error
+	UseOidcState(stateHash, provider string) (string, string, error)
+	FindIdentity(provider, subject string) (string, error)
+	InsertIdentity(userId string, identity *users.UserIdentity, audit *users.AuditLog) error
+	InsertIdentityUser(identity *users.UserIdentity, username, password string) (string, error)
+	FindUser(req *users.UserFilter) ([]*users.UserAccount, int, error)
+	UpdateUserRole(userId string, roleId int, audit *users.AuditLog) error
+	DisableUser(userId string, audit *users.AuditLog) error
+	EnableUser(userId string, audit *users.AuditLog) error
+	DeleteUser(userId string, audit *users.AuditLog) error
+	InsertDeletionRequest(userId, tokenHash string, expires time.Duration) error
+	ConfirmDeletion(tokenHash string, audit *users.AuditLog) (string, error)
+	ExportUser(userId string) (*users.UserExport, error)
 }
 
 type usersRepository struct {
@@ -60,7 +113,13 @@ func (r *usersRepository) FindOneUserByEmail(email string) (*users.UserCredentia
 			"email",
 			"password",
 			"username",
-			"role_id"
+			"role_id",
+			("email_verified_at" IS NOT NULL) AS "email_verified",
+			("totp_enabled_at" IS NOT NULL) AS "totp_enabled",
+			("disabled_at" IS NOT NULL) AS "disabled",
+			"failed_attempts",
+			COALESCE(EXTRACT(EPOCH FROM (NOW() - "last_failed_at")), 0)::FLOAT AS "since_last_failure",
+			GREATEST(COALESCE(EXTRACT(EPOCH FROM ("locked_until" - NOW())), 0), 0)::FLOAT AS "locked_for"
 		FROM "users"
 		WHERE email = $1;`
 
@@ -71,56 +130,283 @@ func (r *usersRepository) FindOneUserByEmail(email string) (*users.UserCredentia
 	return user, nil
 }
 
-func (r *usersRepository) InsertOauth(req *users.UserPassport) error {
+// InsertOauth stores sha256 digests of both tokens, the passport keeps the
+// raw tokens for the client.
+func (r *usersRepository) InsertOauth(req *users.UserPassport, meta *users.UserSessionMeta) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		INSERT INTO "oauth" (
+			"user_id",
+			"refresh_token",
+			"access_token",
+			"device",
+			"ip",
+			"user_agent"
+		)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING "id", "family_id";`
+
+	refreshHash := utils.HashToken(req.Token.RefreshToken)
+
+	var familyId string
+	if err := tx.QueryRowContext(
+		ctx,
+		query,
+		req.User.Id,
+		refreshHash,
+		utils.HashToken(req.Token.AccessToken),
+		meta.Device(),
+		meta.Ip,
+		meta.UserAgent,
+	).Scan(&req.Token.Id, &familyId); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("insert oauth failed: %v", err)
+	}
+
+	if err := insertRefreshToken(ctx, tx, familyId, refreshHash); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// InsertImpersonation stores a session that has no refresh token, the
+// impersonator signs in again once the access token expires. The audit is
+// written in the same transaction so no session exists without one.
+func (r *usersRepository) InsertImpersonation(req *users.UserPassport, meta *users.UserSessionMeta, audit *users.AuditLog) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	// The refresh digest is of a token nobody holds, there is no row in
+	// refresh_tokens for it either
+	unused, err := utils.RandToken(32)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+
 	query := `
 		INSERT INTO "oauth" (
 			"user_id",
 			"refresh_token",
-			"access_token"
+			"access_token",
+			"device",
+			"ip",
+			"user_agent",
+			"impersonator_id"
 		)
-		VALUES ($1, $2, $3)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
 		RETURNING "id";`
 
-	if err := r.db.QueryRowContext(
+	if err := tx.QueryRowContext(
 		ctx,
 		query,
 		req.User.Id,
-		req.Token.RefreshToken,
-		req.Token.AccessToken,
+		utils.HashToken(unused),
+		utils.HashToken(req.Token.AccessToken),
+		meta.Device(),
+		meta.Ip,
+		meta.UserAgent,
+		req.Impersonation.ImpersonatorId,
 	).Scan(&req.Token.Id); err != nil {
+		tx.Rollback()
 		return fmt.Errorf("insert oauth failed: %v", err)
 	}
+
+	if audit.Detail == nil {
+		audit.Detail = make(map[string]any)
+	}
+	audit.Detail["oauth_id"] = req.Token.Id
+	if err := insertAudit(ctx, tx, audit); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
 	return nil
 }
 
+// RoleHasPermission reports whether the role holds any of the permissions.
+func (r *usersRepository) RoleHasPermission(roleId int, permission ...string) (bool, error) {
+	query := `
+		SELECT EXISTS (
+			SELECT 1
+			FROM "roles_permissions"
+			WHERE "role_id" = $1
+			AND "permission" = ANY($2)
+		);`
+
+	var has bool
+	if err := r.db.Get(&has, query, roleId, permission); err != nil {
+		return false, fmt.Errorf("get role permissions failed: %v", err)
+	}
+	return has, nil
+}
+
+// RoleExceedsPermissions reports whether the role holds a permission that is
+// not in the given set.
+func (r *usersRepository) RoleExceedsPermissions(roleId int, permissions []string) (bool, error) {
+	query := `
+		SELECT EXISTS (
+			SELECT 1
+			FROM "roles_permissions"
+			WHERE "role_id" = $1
+			AND NOT ("permission" = ANY($2))
+		);`
+
+	// A nil slice is sent as NULL and would match nothing
+	if permissions == nil {
+		permissions = make([]string, 0)
+	}
+
+	var exceeds bool
+	if err := r.db.Get(&exceeds, query, roleId, permissions); err != nil {
+		return false, fmt.Errorf("get role permissions failed: %v", err)
+	}
+	return exceeds, nil
+}
+
+// FindOneOauth looks a refresh token up in the history of every family, a
+// rotated token is still found and reported with Rotated set.
 func (r *usersRepository) FindOneOauth(refreshToken string) (*users.Oauth, error) {
 	query := `
 		SELECT
-			"id",
-			"user_id"
-		FROM "oauth"
-		WHERE "refresh_token" = $1;`
+			"o"."id",
+			"o"."user_id",
+			"o"."family_id",
+			("rt"."rotated_at" IS NOT NULL) AS "rotated"
+		FROM "refresh_tokens" "rt"
+		JOIN "oauth" "o" ON "o"."family_id" = "rt"."family_id"
+		WHERE "rt"."token_hash" = $1;`
 
 	oauth := new(users.Oauth)
-	if err := r.db.Get(oauth, query, refreshToken); err != nil {
+	if err := r.db.Get(oauth, query, utils.HashToken(refreshToken)); err != nil {
 		return nil, fmt.Errorf("oauth not found")
 	}
 	return oauth, nil
 }
 
-func (r *usersRepository) UpdateOauth(req *users.UserToken) error {
-	query := `
+// UpdateOauth rotates the refresh token of a session. The presented token is
+// locked and marked rotated, presenting it again revokes the whole family
+// since either the client or an attacker holds a stolen copy.
+func (r *usersRepository) UpdateOauth(oldRefreshToken string, req *users.UserToken) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	findQuery := `
+		SELECT
+			"o"."id",
+			"o"."user_id",
+			"o"."family_id",
+			("rt"."rotated_at" IS NOT NULL) AS "rotated"
+		FROM "refresh_tokens" "rt"
+		JOIN "oauth" "o" ON "o"."family_id" = "rt"."family_id"
+		WHERE "rt"."token_hash" = $1
+		FOR UPDATE OF "rt";`
+
+	oldHash := utils.HashToken(oldRefreshToken)
+
+	oauth := new(users.Oauth)
+	if err := tx.GetContext(ctx, oauth, findQuery, oldHash); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("oauth not found")
+	}
+
+	if oauth.Rotated {
+		revokeQuery := `DELETE FROM "oauth" WHERE "family_id" = $1;`
+
+		if _, err := tx.ExecContext(ctx, revokeQuery, oauth.FamilyId); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("revoke oauth failed: %v", err)
+		}
+
+		if err := insertAudit(ctx, tx, &users.AuditLog{
+			Action:   users.AuditRefreshReuse,
+			TargetId: oauth.UserId,
+			Detail: map[string]any{
+				"oauth_id":  oauth.Id,
+				"family_id": oauth.FamilyId,
+			},
+		}); err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		return fmt.Errorf("refresh token has been reused, session revoked")
+	}
+
+	rotateQuery := `
+		UPDATE "refresh_tokens" SET
+			"rotated_at" = NOW()
+		WHERE "token_hash" = $1;`
+
+	if _, err := tx.ExecContext(ctx, rotateQuery, oldHash); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("rotate refresh token failed: %v", err)
+	}
+
+	newHash := utils.HashToken(req.RefreshToken)
+	if err := insertRefreshToken(ctx, tx, oauth.FamilyId, newHash); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	updateQuery := `
 		UPDATE "oauth" SET
-			"access_token" = :access_token,
-			"refresh_token" = :refresh_token
-		WHERE "id" = :id;`
+			"access_token" = $2,
+			"refresh_token" = $3,
+			"last_used_at" = NOW()
+		WHERE "id" = $1;`
 
-	if _, err := r.db.NamedExecContext(context.Background(), query, req); err != nil {
+	if _, err := tx.ExecContext(ctx, updateQuery, oauth.Id, utils.HashToken(req.AccessToken), newHash); err != nil {
+		tx.Rollback()
 		return fmt.Errorf("update oauth failed: %v", err)
 	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	req.Id = oauth.Id
+	return nil
+}
+
+func insertRefreshToken(ctx context.Context, tx *sqlx.Tx, familyId, tokenHash string) error {
+	query := `
+		INSERT INTO "refresh_tokens" (
+			"family_id",
+			"token_hash"
+		)
+		VALUES ($1, $2);`
+
+	if _, err := tx.ExecContext(ctx, query, familyId, tokenHash); err != nil {
+		return fmt.Errorf("insert refresh token failed: %v", err)
+	}
 	return nil
 }
 
@@ -130,7 +416,8 @@ func (r *usersRepository) GetProfile(userId string) (*users.User, error) {
 			"id",
 			"email",
 			"username",
-			"role_id"
+			"role_id",
+			("email_verified_at" IS NOT NULL) AS "email_verified"
 		FROM "users"
 		WHERE "id" = $1;`
 
@@ -149,3 +436,1683 @@ func (r *usersRepository) DeleteOauth(oauthId string) error {
 	}
 	return nil
 }
+
+func (r *usersRepository) InsertPasswordReset(userId, tokenHash string, expires time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	// Only the latest token of a user stays usable
+	revokeQuery := `
+		UPDATE "password_resets" SET
+			"used_at" = NOW()
+		WHERE "user_id" = $1
+		AND "used_at" IS NULL;`
+
+	if _, err := tx.ExecContext(ctx, revokeQuery, userId); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("revoke password resets failed: %v", err)
+	}
+
+	query := `
+		INSERT INTO "password_resets" (
+			"user_id",
+			"token_hash",
+			"expires_at"
+		)
+		VALUES ($1, $2, NOW() + ($3 * INTERVAL '1 second'));`
+
+	if _, err := tx.ExecContext(ctx, query, userId, tokenHash, int64(expires.Seconds())); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("insert password reset failed: %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// FindPasswordResetUser resolves a reset token without using it up.
+func (r *usersRepository) FindPasswordResetUser(tokenHash string) (string, error) {
+	query := `
+		SELECT
+			"user_id"
+		FROM "password_resets"
+		WHERE "token_hash" = $1
+		AND "used_at" IS NULL
+		AND "expires_at" > NOW();`
+
+	var userId string
+	if err := r.db.Get(&userId, query, tokenHash); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", fmt.Errorf("token is invalid or has expired")
+		}
+		return "", fmt.Errorf("get password reset failed: %v", err)
+	}
+	return userId, nil
+}
+
+// ResetPassword returns the id of the user whose password was reset.
+func (r *usersRepository) ResetPassword(tokenHash, password string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+
+	tokenQuery := `
+		UPDATE "password_resets" SET
+			"used_at" = NOW()
+		WHERE "token_hash" = $1
+		AND "used_at" IS NULL
+		AND "expires_at" > NOW()
+		RETURNING "user_id";`
+
+	var userId string
+	if err := tx.QueryRowxContext(ctx, tokenQuery, tokenHash).Scan(&userId); err != nil {
+		tx.Rollback()
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", fmt.Errorf("token is invalid or has expired")
+		}
+		return "", fmt.Errorf("use password reset failed: %v", err)
+	}
+
+	passwordQuery := `
+		UPDATE "users" SET
+			"password" = $1
+		WHERE "id" = $2;`
+
+	if _, err := tx.ExecContext(ctx, passwordQuery, password, userId); err != nil {
+		tx.Rollback()
+		return "", fmt.Errorf("update password failed: %v", err)
+	}
+
+	// Sign the user out everywhere
+	oauthQuery := `DELETE FROM "oauth" WHERE "user_id" = $1;`
+
+	if _, err := tx.ExecContext(ctx, oauthQuery, userId); err != nil {
+		tx.Rollback()
+		return "", fmt.Errorf("delete oauth failed: %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return "", err
+	}
+	return userId, nil
+}
+
+func (r *usersRepository) InsertEmailVerification(userId, tokenHash string, expires time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	revokeQuery := `
+		UPDATE "email_verifications" SET
+			"used_at" = NOW()
+		WHERE "user_id" = $1
+		AND "used_at" IS NULL;`
+
+	if _, err := tx.ExecContext(ctx, revokeQuery, userId); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("revoke email verifications failed: %v", err)
+	}
+
+	query := `
+		INSERT INTO "email_verifications" (
+			"user_id",
+			"token_hash",
+			"expires_at"
+		)
+		VALUES ($1, $2, NOW() + ($3 * INTERVAL '1 second'));`
+
+	if _, err := tx.ExecContext(ctx, query, userId, tokenHash, int64(expires.Seconds())); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("insert email verification failed: %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (r *usersRepository) VerifyEmail(tokenHash string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	tokenQuery := `
+		UPDATE "email_verifications" SET
+			"used_at" = NOW()
+		WHERE "token_hash" = $1
+		AND "used_at" IS NULL
+		AND "expires_at" > NOW()
+		RETURNING "user_id";`
+
+	var userId string
+	if err := tx.QueryRowxContext(ctx, tokenQuery, tokenHash).Scan(&userId); err != nil {
+		tx.Rollback()
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("token is invalid or has expired")
+		}
+		return fmt.Errorf("use email verification failed: %v", err)
+	}
+
+	userQuery := `
+		UPDATE "users" SET
+			"email_verified_at" = NOW()
+		WHERE "id" = $1
+		AND "email_verified_at" IS NULL;`
+
+	if _, err := tx.ExecContext(ctx, userQuery, userId); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("verify email failed: %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (r *usersRepository) FindOneUserById(userId string) (*users.UserCredentialCheck, error) {
+	query := `
+		SELECT
+			"id",
+			"email",
+			"password",
+			"username",
+			"role_id",
+			("email_verified_at" IS NOT NULL) AS "email_verified",
+			("totp_enabled_at" IS NOT NULL) AS "totp_enabled",
+			("disabled_at" IS NOT NULL) AS "disabled",
+			GREATEST(COALESCE(EXTRACT(EPOCH FROM ("locked_until" - NOW())), 0), 0)::FLOAT AS "locked_for"
+		FROM "users"
+		WHERE "id" = $1;`
+
+	user := new(users.UserCredentialCheck)
+	if err := r.db.Get(user, query, userId); err != nil {
+		return nil, fmt.Errorf("user not found")
+	}
+	return user, nil
+}
+
+func (r *usersRepository) UpdateProfile(req *users.UserUpdateReq) error {
+	query := `
+		UPDATE "users" SET`
+
+	queryWhereStack := make([]string, 0)
+	values := make([]any, 0)
+	lastIndex := 1
+
+	if req.Username != "" {
+		values = append(values, req.Username)
+
+		queryWhereStack = append(queryWhereStack, fmt.Sprintf(`
+		"username" = $%d?`, lastIndex))
+
+		lastIndex++
+	}
+
+	if req.Email != "" {
+		values = append(values, req.Email)
+
+		// A new address has to be verified again
+		queryWhereStack = append(queryWhereStack, fmt.Sprintf(`
+		"email_verified_at" = (CASE WHEN "email" = $%d THEN "email_verified_at" ELSE NULL END),
+		"email" = $%d?`, lastIndex, lastIndex))
+
+		lastIndex++
+	}
+
+	if len(queryWhereStack) == 0 {
+		return nil
+	}
+
+	values = append(values, req.Id)
+
+	queryClose := fmt.Sprintf(`
+	WHERE "id" = $%d;`, lastIndex)
+
+	for i := range queryWhereStack {
+		if i != len(queryWhereStack)-1 {
+			query += strings.Replace(queryWhereStack[i], "?", ",", 1)
+		} else {
+			query += strings.Replace(queryWhereStack[i], "?", "", 1)
+		}
+	}
+	query += queryClose
+
+	if _, err := r.db.ExecContext(context.Background(), query, values...); err != nil {
+		switch err.Error() {
+		case "ERROR: duplicate key value violates unique constraint \"users_username_key\" (SQLSTATE 23505)":
+			return fmt.Errorf("username has been used")
+		case "ERROR: duplicate key value violates unique constraint \"users_email_key\" (SQLSTATE 23505)":
+			return fmt.Errorf("email has been used")
+		default:
+			return fmt.Errorf("update user failed: %v", err)
+		}
+	}
+	return nil
+}
+
+func (r *usersRepository) UpdatePassword(userId, password, accessToken string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	passwordQuery := `
+		UPDATE "users" SET
+			"password" = $1
+		WHERE "id" = $2;`
+
+	if _, err := tx.ExecContext(ctx, passwordQuery, password, userId); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("update password failed: %v", err)
+	}
+
+	// Keep the session that made the change, sign out the others
+	oauthQuery := `
+		DELETE FROM "oauth"
+		WHERE "user_id" = $1
+		AND "access_token" <> $2;`
+
+	if _, err := tx.ExecContext(ctx, oauthQuery, userId, utils.HashToken(accessToken)); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("delete oauth failed: %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (r *usersRepository) CountIpFailures(ip string, window time.Duration) int {
+	query := `
+		SELECT
+			COUNT(*)
+		FROM "login_attempts"
+		WHERE "ip" = $1
+		AND "success" = FALSE
+		AND "created_at" > NOW() - ($2 * INTERVAL '1 second');`
+
+	var count int
+	if err := r.db.Get(&count, query, ip, int64(window.Seconds())); err != nil {
+		return 0
+	}
+	return count
+}
+
+func (r *usersRepository) InsertLoginAttempt(email, ip string, success bool) error {
+	query := `
+		INSERT INTO "login_attempts" (
+			"email",
+			"ip",
+			"success"
+		)
+		VALUES ($1, $2, $3);`
+
+	if _, err := r.db.ExecContext(context.Background(), query, email, ip, success); err != nil {
+		return fmt.Errorf("insert login attempt failed: %v", err)
+	}
+	return nil
+}
+
+// RecordLoginFailure counts the failure against the account and locks it once
+// maxAttempts failures happened within the window, it reports whether this
+// failure locked the account.
+func (r *usersRepository) RecordLoginFailure(user *users.UserCredentialCheck, ip string, maxAttempts int, window, lockout time.Duration) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+
+	attemptQuery := `
+		INSERT INTO "login_attempts" (
+			"email",
+			"ip",
+			"success"
+		)
+		VALUES ($1, $2, FALSE);`
+
+	if _, err := tx.ExecContext(ctx, attemptQuery, user.Email, ip); err != nil {
+		tx.Rollback()
+		return false, fmt.Errorf("insert login attempt failed: %v", err)
+	}
+
+	userQuery := `
+		UPDATE "users" SET
+			"failed_attempts" = "next"."count",
+			"last_failed_at" = NOW(),
+			"locked_until" = (CASE WHEN "next"."count" >= $2 THEN NOW() + ($4 * INTERVAL '1 second') ELSE NULL END)
+		FROM (
+			SELECT
+				(CASE WHEN "last_failed_at" > NOW() - ($3 * INTERVAL '1 second') THEN "failed_attempts" + 1 ELSE 1 END) AS "count"
+			FROM "users"
+			WHERE "id" = $1
+		) AS "next"
+		WHERE "users"."id" = $1
+		RETURNING ("locked_until" IS NOT NULL);`
+
+	var locked bool
+	if err := tx.QueryRowxContext(
+		ctx,
+		userQuery,
+		user.Id,
+		maxAttempts,
+		int64(window.Seconds()),
+		int64(lockout.Seconds()),
+	).Scan(&locked); err != nil {
+		tx.Rollback()
+		return false, fmt.Errorf("update failed attempts failed: %v", err)
+	}
+
+	if locked {
+		if err := insertAudit(ctx, tx, &users.AuditLog{
+			Action:   users.AuditUserLocked,
+			TargetId: user.Id,
+			Ip:       ip,
+			Detail: map[string]any{
+				"failed_attempts": maxAttempts,
+				"lockout_seconds": int64(lockout.Seconds()),
+			},
+		}); err != nil {
+			tx.Rollback()
+			return false, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+	return locked, nil
+}
+
+func (r *usersRepository) RecordLoginSuccess(user *users.UserCredentialCheck, ip string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	attemptQuery := `
+		INSERT INTO "login_attempts" (
+			"email",
+			"ip",
+			"success"
+		)
+		VALUES ($1, $2, TRUE);`
+
+	if _, err := tx.ExecContext(ctx, attemptQuery, user.Email, ip); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("insert login attempt failed: %v", err)
+	}
+
+	userQuery := `
+		UPDATE "users" SET
+			"failed_attempts" = 0,
+			"last_failed_at" = NULL,
+			"locked_until" = NULL
+		WHERE "id" = $1;`
+
+	if _, err := tx.ExecContext(ctx, userQuery, user.Id); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("reset failed attempts failed: %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (r *usersRepository) UnlockUser(userId string, audit *users.AuditLog) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		UPDATE "users" SET
+			"failed_attempts" = 0,
+			"last_failed_at" = NULL,
+			"locked_until" = NULL
+		WHERE "id" = $1;`
+
+	result, err := tx.ExecContext(ctx, query, userId)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("unlock user failed: %v", err)
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		tx.Rollback()
+		return fmt.Errorf("user not found")
+	}
+
+	if err := insertAudit(ctx, tx, audit); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (r *usersRepository) InsertAudit(audit *users.AuditLog) error {
+	return insertAudit(context.Background(), r.db, audit)
+}
+
+func insertAudit(ctx context.Context, db sqlx.ExecerContext, audit *users.AuditLog) error {
+	query := `
+		INSERT INTO "audit_logs" (
+			"actor_id",
+			"action",
+			"target_id",
+			"ip",
+			"detail"
+		)
+		VALUES (NULLIF($1, ''), $2, NULLIF($3, ''), NULLIF($4, ''), $5);`
+
+	detail := audit.Detail
+	if detail == nil {
+		detail = make(map[string]any)
+	}
+	detailBytes, err := json.Marshal(detail)
+	if err != nil {
+		return fmt.Errorf("marshal audit detail failed: %v", err)
+	}
+
+	if _, err := db.ExecContext(
+		ctx,
+		query,
+		audit.ActorId,
+		string(audit.Action),
+		audit.TargetId,
+		audit.Ip,
+		string(detailBytes),
+	); err != nil {
+		return fmt.Errorf("insert audit failed: %v", err)
+	}
+	return nil
+}
+
+func (r *usersRepository) FindTotp(userId string) (*users.UserTotp, error) {
+	query := `
+		SELECT
+			COALESCE("totp_secret", '') AS "totp_secret",
+			("totp_enabled_at" IS NOT NULL) AS "totp_enabled"
+		FROM "users"
+		WHERE "id" = $1;`
+
+	totp := new(users.UserTotp)
+	if err := r.db.Get(totp, query, userId); err != nil {
+		return nil, fmt.Errorf("user not found")
+	}
+	return totp, nil
+}
+
+// SetTotpSecret keeps a pending secret until the enrollment is confirmed, an
+// enabled secret is never replaced this way.
+func (r *usersRepository) SetTotpSecret(userId, secret string) error {
+	query := `
+		UPDATE "users" SET
+			"totp_secret" = $2,
+			"totp_last_step" = NULL
+		WHERE "id" = $1
+		AND "totp_enabled_at" IS NULL;`
+
+	result, err := r.db.ExecContext(context.Background(), query, userId, secret)
+	if err != nil {
+		return fmt.Errorf("set totp secret failed: %v", err)
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return fmt.Errorf("two-factor is already enabled")
+	}
+	return nil
+}
+
+func (r *usersRepository) EnableTotp(userId string, step int64, codeHashes []string, audit *users.AuditLog) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		UPDATE "users" SET
+			"totp_enabled_at" = NOW(),
+			"totp_last_step" = $2
+		WHERE "id" = $1
+		AND "totp_secret" IS NOT NULL
+		AND "totp_enabled_at" IS NULL;`
+
+	result, err := tx.ExecContext(ctx, query, userId, step)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("enable totp failed: %v", err)
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		tx.Rollback()
+		return fmt.Errorf("two-factor is already enabled")
+	}
+
+	if err := replaceRecoveryCodes(ctx, tx, userId, codeHashes); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err := insertAudit(ctx, tx, audit); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (r *usersRepository) DisableTotp(userId string, audit *users.AuditLog) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		UPDATE "users" SET
+			"totp_secret" = NULL,
+			"totp_enabled_at" = NULL,
+			"totp_last_step" = NULL
+		WHERE "id" = $1;`
+
+	if _, err := tx.ExecContext(ctx, query, userId); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("disable totp failed: %v", err)
+	}
+
+	if err := replaceRecoveryCodes(ctx, tx, userId, nil); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err := insertAudit(ctx, tx, audit); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// UseTotpStep records the step of an accepted code, it fails for a step that
+// was already used so a code cannot be replayed within its window.
+func (r *usersRepository) UseTotpStep(userId string, step int64) bool {
+	query := `
+		UPDATE "users" SET
+			"totp_last_step" = $2
+		WHERE "id" = $1
+		AND COALESCE("totp_last_step", 0) < $2;`
+
+	result, err := r.db.ExecContext(context.Background(), query, userId, step)
+	if err != nil {
+		return false
+	}
+	rows, _ := result.RowsAffected()
+	return rows == 1
+}
+
+func (r *usersRepository) UseRecoveryCode(userId, codeHash string) bool {
+	query := `
+		UPDATE "recovery_codes" SET
+			"used_at" = NOW()
+		WHERE "user_id" = $1
+		AND "code_hash" = $2
+		AND "used_at" IS NULL;`
+
+	result, err := r.db.ExecContext(context.Background(), query, userId, codeHash)
+	if err != nil {
+		return false
+	}
+	rows, _ := result.RowsAffected()
+	return rows == 1
+}
+
+func (r *usersRepository) ReplaceRecoveryCodes(userId string, codeHashes []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	if err := replaceRecoveryCodes(ctx, tx, userId, codeHashes); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	return nil
+}
+
+func replaceRecoveryCodes(ctx context.Context, tx *sqlx.Tx, userId string, codeHashes []string) error {
+	deleteQuery := `
+		DELETE FROM "recovery_codes"
+		WHERE "user_id" = $1;`
+
+	if _, err := tx.ExecContext(ctx, deleteQuery, userId); err != nil {
+		return fmt.Errorf("delete recovery codes failed: %v", err)
+	}
+
+	insertQuery := `
+		INSERT INTO "recovery_codes" (
+			"user_id",
+			"code_hash"
+		)
+		VALUES ($1, $2);`
+
+	for _, hash := range codeHashes {
+		if _, err := tx.ExecContext(ctx, insertQuery, userId, hash); err != nil {
+			return fmt.Errorf("insert recovery code failed: %v", err)
+		}
+	}
+	return nil
+}
+
+func (r *usersRepository) FindSessions(userId, accessToken string) ([]*users.UserSession, error) {
+	query := `
+		SELECT
+			"id",
+			"device",
+			"ip",
+			"user_agent",
+			"created_at",
+			"last_used_at",
+			("access_token" = $2) AS "current",
+			"impersonator_id"
+		FROM "oauth"
+		WHERE "user_id" = $1
+		ORDER BY "last_used_at" DESC;`
+
+	sessions := make([]*users.UserSession, 0)
+	if err := r.db.Select(&sessions, query, userId, utils.HashToken(accessToken)); err != nil {
+		return nil, fmt.Errorf("get sessions failed: %v", err)
+	}
+	return sessions, nil
+}
+
+func (r *usersRepository) DeleteSession(userId, sessionId string) error {
+	query := `
+		DELETE FROM "oauth"
+		WHERE "user_id" = $1
+		AND "id" = $2;`
+
+	result, err := r.db.ExecContext(context.Background(), query, userId, sessionId)
+	if err != nil {
+		return fmt.Errorf("delete session failed: %v", err)
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return fmt.Errorf("session not found")
+	}
+	return nil
+}
+
+func (r *usersRepository) DeleteOtherSessions(userId, accessToken string) (int64, error) {
+	query := `
+		DELETE FROM "oauth"
+		WHERE "user_id" = $1
+		AND "access_token" <> $2;`
+
+	result, err := r.db.ExecContext(context.Background(), query, userId, utils.HashToken(accessToken))
+	if err != nil {
+		return 0, fmt.Errorf("delete sessions failed: %v", err)
+	}
+	rows, _ := result.RowsAffected()
+	return rows, nil
+}
+
+func (r *usersRepository) DeleteAllSessions(userId string, audit *users.AuditLog) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	query := `
+		DELETE FROM "oauth"
+		WHERE "user_id" = $1;`
+
+	result, err := tx.ExecContext(ctx, query, userId)
+	if err != nil {
+		tx.Rollback()
+		return 0, fmt.Errorf("delete sessions failed: %v", err)
+	}
+	rows, _ := result.RowsAffected()
+
+	if audit.Detail == nil {
+		audit.Detail = make(map[string]any)
+	}
+	audit.Detail["sessions"] = rows
+	if err := insertAudit(ctx, tx, audit); err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return rows, nil
+}
+
+func (r *usersRepository) InsertInvitation(req *users.UserInvitationReq, tokenHash string, expires time.Duration, audit *users.AuditLog) (*users.UserInvitation, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// Only the latest invitation of an email stays usable
+	revokeQuery := `
+		UPDATE "admin_invitations" SET
+			"revoked_at" = NOW()
+		WHERE "email" = $1
+		AND "accepted_at" IS NULL
+		AND "revoked_at" IS NULL;`
+
+	if _, err := tx.ExecContext(ctx, revokeQuery, req.Email); err != nil {
+		tx.Rollback()
+		return nil, fmt.Errorf("revoke invitations failed: %v", err)
+	}
+
+	query := `
+		INSERT INTO "admin_invitations" (
+			"email",
+			"token_hash",
+			"invited_by",
+			"expires_at"
+		)
+		VALUES ($1, $2, NULLIF($3, ''), NOW() + ($4 * INTERVAL '1 second'))
+		RETURNING "id";`
+
+	var invitationId string
+	if err := tx.QueryRowxContext(
+		ctx,
+		query,
+		req.Email,
+		tokenHash,
+		audit.ActorId,
+		int64(expires.Seconds()),
+	).Scan(&invitationId); err != nil {
+		tx.Rollback()
+		return nil, fmt.Errorf("insert invitation failed: %v", err)
+	}
+
+	audit.TargetId = invitationId
+	if err := insertAudit(ctx, tx, audit); err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return r.findOneInvitation(invitationId)
+}
+
+func (r *usersRepository) findOneInvitation(invitationId string) (*users.UserInvitation, error) {
+	query := `
+		SELECT
+			"id",
+			"email",
+			"invited_by",
+			"accepted_by",
+			"expires_at",
+			"accepted_at",
+			"revoked_at",
+			"created_at"
+		FROM "admin_invitations"
+		WHERE "id" = $1;`
+
+	invitation := new(users.UserInvitation)
+	if err := r.db.Get(invitation, query, invitationId); err != nil {
+		return nil, fmt.Errorf("invitation not found")
+	}
+	return invitation, nil
+}
+
+func (r *usersRepository) FindInvitations() ([]*users.UserInvitation, error) {
+	query := `
+		SELECT
+			"id",
+			"email",
+			"invited_by",
+			"accepted_by",
+			"expires_at",
+			"accepted_at",
+			"revoked_at",
+			"created_at"
+		FROM "admin_invitations"
+		ORDER BY "created_at" DESC;`
+
+	invitations := make([]*users.UserInvitation, 0)
+	if err := r.db.Select(&invitations, query); err != nil {
+		return nil, fmt.Errorf("select invitations failed: %v", err)
+	}
+	return invitations, nil
+}
+
+func (r *usersRepository) RevokeInvitation(invitationId string, audit *users.AuditLog) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		UPDATE "admin_invitations" SET
+			"revoked_at" = NOW()
+		WHERE "id"::TEXT = $1
+		AND "accepted_at" IS NULL
+		AND "revoked_at" IS NULL
+		RETURNING "email";`
+
+	var email string
+	if err := tx.QueryRowxContext(ctx, query, invitationId).Scan(&email); err != nil {
+		tx.Rollback()
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("invitation not found")
+		}
+		return fmt.Errorf("revoke invitation failed: %v", err)
+	}
+
+	audit.TargetId = invitationId
+	audit.Detail = map[string]any{"email": email}
+	if err := insertAudit(ctx, tx, audit); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (r *usersRepository) FindInvitationByToken(tokenHash string) (*users.UserInvitationToken, error) {
+	query := `
+		SELECT
+			"id",
+			"email",
+			CASE
+				WHEN "accepted_at" IS NOT NULL THEN 'accepted'
+				WHEN "revoked_at" IS NOT NULL THEN 'revoked'
+				WHEN "expires_at" <= NOW() THEN 'expired'
+				ELSE 'pending'
+			END AS "status"
+		FROM "admin_invitations"
+		WHERE "token_hash" = $1;`
+
+	invitation := new(users.UserInvitationToken)
+	if err := r.db.Get(invitation, query, tokenHash); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("token is invalid or has expired")
+		}
+		return nil, fmt.Errorf("get invitation failed: %v", err)
+	}
+	return invitation, nil
+}
+
+// AcceptInvitation consumes the invitation and creates the admin account for
+// its email in one transaction, it returns the id of the new user.
+func (r *usersRepository) AcceptInvitation(tokenHash string, req *users.UserAcceptInvitationReq) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+
+	tokenQuery := `
+		UPDATE "admin_invitations" SET
+			"accepted_at" = NOW()
+		WHERE "token_hash" = $1
+		AND "accepted_at" IS NULL
+		AND "revoked_at" IS NULL
+		AND "expires_at" > NOW()
+		RETURNING "id", "email", COALESCE("invited_by", '');`
+
+	var invitationId, email, invitedBy string
+	if err := tx.QueryRowxContext(ctx, tokenQuery, tokenHash).Scan(&invitationId, &email, &invitedBy); err != nil {
+		tx.Rollback()
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", fmt.Errorf("token is invalid or has expired")
+		}
+		return "", fmt.Errorf("use invitation failed: %v", err)
+	}
+
+	// The email is trusted as verified, the token could only be read from it
+	userQuery := `
+		INSERT INTO "users" (
+			"email",
+			"password",
+			"username",
+			"role_id",
+			"email_verified_at"
+		)
+		VALUES ($1, $2, $3, 2, NOW())
+		RETURNING "id";`
+
+	var userId string
+	if err := tx.QueryRowxContext(ctx, userQuery, email, req.Password, req.Username).Scan(&userId); err != nil {
+		tx.Rollback()
+		switch err.Error() {
+		case "ERROR: duplicate key value violates unique constraint \"users_username_key\" (SQLSTATE 23505)":
+			return "", fmt.Errorf("username has been used")
+		case "ERROR: duplicate key value violates unique constraint \"users_email_key\" (SQLSTATE 23505)":
+			return "", fmt.Errorf("email has been used")
+		default:
+			return "", fmt.Errorf("insert user failed: %v", err)
+		}
+	}
+
+	acceptQuery := `
+		UPDATE "admin_invitations" SET
+			"accepted_by" = $1
+		WHERE "id" = $2;`
+
+	if _, err := tx.ExecContext(ctx, acceptQuery, userId, invitationId); err != nil {
+		tx.Rollback()
+		return "", fmt.Errorf("accept invitation failed: %v", err)
+	}
+
+	if err := insertAudit(ctx, tx, &users.AuditLog{
+		ActorId:  userId,
+		Action:   users.AuditInviteAccept,
+		TargetId: invitationId,
+		Ip:       req.Ip,
+		Detail: map[string]any{
+			"email":      email,
+			"invited_by": invitedBy,
+		},
+	}); err != nil {
+		tx.Rollback()
+		return "", err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return "", err
+	}
+	return userId, nil
+}
+
+func (r *usersRepository) InsertOidcState(stateHash, provider, verifier, nonce string, expires time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// Abandoned logins never come back, clear them on the way
+	cleanQuery := `DELETE FROM "oidc_states" WHERE "expires_at" < NOW();`
+
+	if _, err := r.db.ExecContext(ctx, cleanQuery); err != nil {
+		return fmt.Errorf("delete oidc states failed: %v", err)
+	}
+
+	query := `
+		INSERT INTO "oidc_states" (
+			"state_hash",
+			"provider",
+			"code_verifier",
+			"nonce",
+			"expires_at"
+		)
+		VALUES ($1, $2, $3, $4, NOW() + ($5 * INTERVAL '1 second'));`
+
+	if _, err := r.db.ExecContext(ctx, query, stateHash, provider, verifier, nonce, int64(expires.Seconds())); err != nil {
+		return fmt.Errorf("insert oidc state failed: %v", err)
+	}
+	return nil
+}
+
+// UseOidcState consumes the state and returns its pkce verifier and nonce.
+func (r *usersRepository) UseOidcState(stateHash, provider string) (string, string, error) {
+	query := `
+		DELETE FROM "oidc_states"
+		WHERE "state_hash" = $1
+		AND "provider" = $2
+		AND "expires_at" > NOW()
+		RETURNING "code_verifier", "nonce";`
+
+	var verifier, nonce string
+	if err := r.db.QueryRowxContext(context.Background(), query, stateHash, provider).Scan(&verifier, &nonce); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", "", fmt.Errorf("state is invalid or has expired")
+		}
+		return "", "", fmt.Errorf("use oidc state failed: %v", err)
+	}
+	return verifier, nonce, nil
+}
+
+// FindIdentity returns the user linked to the external identity and records
+// the login on it.
+func (r *usersRepository) FindIdentity(provider, subject string) (string, error) {
+	query := `
+		UPDATE "user_identities" SET
+			"last_login_at" = NOW()
+		WHERE "provider" = $1
+		AND "subject" = $2
+		RETURNING "user_id";`
+
+	var userId string
+	if err := r.db.QueryRowxContext(context.Background(), query, provider, subject).Scan(&userId); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", fmt.Errorf("identity not found")
+		}
+		return "", fmt.Errorf("find identity failed: %v", err)
+	}
+	return userId, nil
+}
+
+func (r *usersRepository) InsertIdentity(userId string, identity *users.UserIdentity, audit *users.AuditLog) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	if err := insertIdentity(ctx, tx, userId, identity); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err := insertAudit(ctx, tx, audit); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// InsertIdentityUser creates a customer for a first login through a provider,
+// the password is one nobody knows so only the provider or a reset signs in.
+// The caller only gets here with an email the provider has verified.
+func (r *usersRepository) InsertIdentityUser(identity *users.UserIdentity, username, password string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+
+	query := `
+		INSERT INTO "users" (
+			"email",
+			"password",
+			"username",
+			"role_id",
+			"email_verified_at"
+		)
+		VALUES ($1, $2, $3, 1, NOW())
+		RETURNING "id";`
+
+	var userId string
+	if err := tx.QueryRowxContext(ctx, query, identity.Email, password, username).Scan(&userId); err != nil {
+		tx.Rollback()
+		switch err.Error() {
+		case "ERROR: duplicate key value violates unique constraint \"users_username_key\" (SQLSTATE 23505)":
+			return "", fmt.Errorf("username has been used")
+		case "ERROR: duplicate key value violates unique constraint \"users_email_key\" (SQLSTATE 23505)":
+			return "", fmt.Errorf("email has been used")
+		default:
+			return "", fmt.Errorf("insert user failed: %v", err)
+		}
+	}
+
+	if err := insertIdentity(ctx, tx, userId, identity); err != nil {
+		tx.Rollback()
+		return "", err
+	}
+
+	if err := insertAudit(ctx, tx, &users.AuditLog{
+		ActorId:  userId,
+		Action:   users.AuditIdentityLink,
+		TargetId: userId,
+		Detail: map[string]any{
+			"provider": identity.Provider,
+			"created":  true,
+		},
+	}); err != nil {
+		tx.Rollback()
+		return "", err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return "", err
+	}
+	return userId, nil
+}
+
+func insertIdentity(ctx context.Context, tx *sqlx.Tx, userId string, identity *users.UserIdentity) error {
+	query := `
+		INSERT INTO "user_identities" (
+			"user_id",
+			"provider",
+			"subject",
+			"email"
+		)
+		VALUES ($1, $2, $3, $4);`
+
+	if _, err := tx.ExecContext(ctx, query, userId, identity.Provider, identity.Subject, identity.Email); err != nil {
+		return fmt.Errorf("insert identity failed: %v", err)
+	}
+	return nil
+}
+
+func (r *usersRepository) FindUser(req *users.UserFilter) ([]*users.UserAccount, int, error) {
+	builder := usersPatterns.FindUserBuilder(r.db, req)
+	engineer := usersPatterns.FindUserEngineer(builder)
+
+	result, err := engineer.FindUser()
+	if err != nil {
+		return nil, 0, err
+	}
+	return result, engineer.CountUser(), nil
+}
+
+func (r *usersRepository) UpdateUserRole(userId string, roleId int, audit *users.AuditLog) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	var previous int
+	if err := tx.GetContext(ctx, &previous, `SELECT "role_id" FROM "users" WHERE "id" = $1 FOR UPDATE;`, userId); err != nil {
+		tx.Rollback()
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("user not found")
+		}
+		return fmt.Errorf("get user role failed: %v", err)
+	}
+
+	query := `
+		UPDATE "users" SET
+			"role_id" = $1
+		WHERE "id" = $2;`
+
+	if _, err := tx.ExecContext(ctx, query, roleId, userId); err != nil {
+		tx.Rollback()
+		if strings.Contains(err.Error(), "SQLSTATE 23503") {
+			return fmt.Errorf("role not found")
+		}
+		return fmt.Errorf("update user role failed: %v", err)
+	}
+
+	if audit.Detail == nil {
+		audit.Detail = make(map[string]any)
+	}
+	audit.Detail["from"] = previous
+	audit.Detail["to"] = roleId
+	if err := insertAudit(ctx, tx, audit); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// DisableUser also ends every session of the user, a disabled account can't
+// refresh its way back in.
+func (r *usersRepository) DisableUser(userId string, audit *users.AuditLog) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		UPDATE "users" SET
+			"disabled_at" = COALESCE("disabled_at", NOW()),
+			"disabled_by" = COALESCE("disabled_by", NULLIF($2, ''))
+		WHERE "id" = $1;`
+
+	result, err := tx.ExecContext(ctx, query, userId, audit.ActorId)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("disable user failed: %v", err)
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		tx.Rollback()
+		return fmt.Errorf("user not found")
+	}
+
+	// Sessions the user opened as someone else end as well
+	sessions, err := tx.ExecContext(ctx, `DELETE FROM "oauth" WHERE "user_id" = $1 OR "impersonator_id" = $1;`, userId)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("delete sessions failed: %v", err)
+	}
+	rows, _ := sessions.RowsAffected()
+
+	if audit.Detail == nil {
+		audit.Detail = make(map[string]any)
+	}
+	audit.Detail["sessions"] = rows
+	if err := insertAudit(ctx, tx, audit); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (r *usersRepository) EnableUser(userId string, audit *users.AuditLog) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		UPDATE "users" SET
+			"disabled_at" = NULL,
+			"disabled_by" = NULL
+		WHERE "id" = $1;`
+
+	result, err := tx.ExecContext(ctx, query, userId)
+	if err != nil {
+		tx.Rollback()
+		return fmt.Errorf("enable user failed: %v", err)
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		tx.Rollback()
+		return fmt.Errorf("user not found")
+	}
+
+	if err := insertAudit(ctx, tx, audit); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (r *usersRepository) DeleteUser(userId string, audit *users.AuditLog) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	if err := deleteUser(ctx, tx, userId, audit); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// deleteUser strips the personal data from the orders of the user before the
+// account goes, the orders stay as financial records with a null user_id.
+// Everything else personal cascades with the users row.
+func deleteUser(ctx context.Context, tx *sqlx.Tx, userId string, audit *users.AuditLog) error {
+	var email string
+	if err := tx.GetContext(ctx, &email, `SELECT "email" FROM "users" WHERE "id" = $1 FOR UPDATE;`, userId); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return fmt.Errorf("user not found")
+		}
+		return fmt.Errorf("get user failed: %v", err)
+	}
+
+	query := `
+		UPDATE "orders" SET
+			"contact" = '',
+			"address" = '',
+			"address_id" = NULL,
+			"shipping_address" = NULL,
+			"guest_email" = NULL,
+			"anonymized_at" = NOW()
+		WHERE "user_id" = $1;`
+
+	result, err := tx.ExecContext(ctx, query, userId)
+	if err != nil {
+		return fmt.Errorf("anonymize orders failed: %v", err)
+	}
+	orders, _ := result.RowsAffected()
+
+	// Attempts are kept by email, not by user
+	if _, err := tx.ExecContext(ctx, `DELETE FROM "login_attempts" WHERE "email" = $1;`, email); err != nil {
+		return fmt.Errorf("delete login attempts failed: %v", err)
+	}
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM "users" WHERE "id" = $1;`, userId); err != nil {
+		return fmt.Errorf("delete user failed: %v", err)
+	}
+
+	if audit.Detail == nil {
+		audit.Detail = make(map[string]any)
+	}
+	audit.Detail["orders"] = orders
+	return insertAudit(ctx, tx, audit)
+}
+
+func (r *usersRepository) InsertDeletionRequest(userId, tokenHash string, expires time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	// Only the latest token of a user stays usable
+	revokeQuery := `
+		UPDATE "account_deletions" SET
+			"used_at" = NOW()
+		WHERE "user_id" = $1
+		AND "used_at" IS NULL;`
+
+	if _, err := tx.ExecContext(ctx, revokeQuery, userId); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("revoke deletion requests failed: %v", err)
+	}
+
+	query := `
+		INSERT INTO "account_deletions" (
+			"user_id",
+			"token_hash",
+			"expires_at"
+		)
+		VALUES ($1, $2, NOW() + ($3 * INTERVAL '1 second'));`
+
+	if _, err := tx.ExecContext(ctx, query, userId, tokenHash, int64(expires.Seconds())); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("insert deletion request failed: %v", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// ConfirmDeletion consumes the token and deletes its user in one
+// transaction, it returns the id of the deleted user.
+func (r *usersRepository) ConfirmDeletion(tokenHash string, audit *users.AuditLog) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	tx, err := r.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+
+	query := `
+		UPDATE "account_deletions" SET
+			"used_at" = NOW()
+		WHERE "token_hash" = $1
+		AND "used_at" IS NULL
+		AND "expires_at" > NOW()
+		RETURNING "user_id";`
+
+	var userId string
+	if err := tx.QueryRowxContext(ctx, query, tokenHash).Scan(&userId); err != nil {
+		tx.Rollback()
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", fmt.Errorf("token is invalid or has expired")
+		}
+		return "", fmt.Errorf("use deletion token failed: %v", err)
+	}
+
+	// The actor can't reference the account that is being deleted
+	audit.ActorId = ""
+	audit.TargetId = userId
+	if audit.Detail == nil {
+		audit.Detail = make(map[string]any)
+	}
+	audit.Detail["requested_by"] = "user"
+	if err := deleteUser(ctx, tx, userId, audit); err != nil {
+		tx.Rollback()
+		return "", err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return "", err
+	}
+	return userId, nil
+}
+
+// ExportUser reads everything in one snapshot so the parts of the archive
+// agree with each other.
+func (r *usersRepository) ExportUser(userId string) (*users.UserExport, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	tx, err := r.db.BeginTxx(ctx, &sql.TxOptions{
+		Isolation: sql.LevelRepeatableRead,
+		ReadOnly:  true,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	export := &users.UserExport{
+		ExportedAt: time.Now().UTC().Format(time.RFC3339),
+		Profile:    new(users.UserAccount),
+		Identities: make([]*users.UserExportIdentity, 0),
+		Sessions:   make([]*users.UserSession, 0),
+		Addresses:  make([]*addresses.Address, 0),
+		Orders:     make([]*orders.Order, 0),
+		Files:      make([]*users.UserExportFile, 0),
+	}
+
+	profileQuery := `
+		SELECT
+			"id",
+			"email",
+			"username",
+			"role_id",
+			("email_verified_at" IS NOT NULL) AS "email_verified",
+			("totp_enabled_at" IS NOT NULL) AS "totp_enabled",
+			COALESCE("locked_until" > NOW(), FALSE) AS "locked",
+			"disabled_at",
+			"created_at"
+		FROM "users"
+		WHERE "id" = $1;`
+
+	if err := tx.GetContext(ctx, export.Profile, profileQuery, userId); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("user not found")
+		}
+		return nil, fmt.Errorf("get profile failed: %v", err)
+	}
+
+	identitiesQuery := `
+		SELECT
+			"provider",
+			"subject",
+			"email",
+			"created_at",
+			"last_login_at"
+		FROM "user_identities"
+		WHERE "user_id" = $1
+		ORDER BY "created_at";`
+
+	if err := tx.SelectContext(ctx, &export.Identities, identitiesQuery, userId); err != nil {
+		return nil, fmt.Errorf("select identities failed: %v", err)
+	}
+
+	sessionsQuery := `
+		SELECT
+			"id",
+			"device",
+			"ip",
+			"user_agent",
+			"created_at",
+			"last_used_at",
+			FALSE AS "current"
+		FROM "oauth"
+		WHERE "user_id" = $1
+		ORDER BY "last_used_at" DESC;`
+
+	if err := tx.SelectContext(ctx, &export.Sessions, sessionsQuery, userId); err != nil {
+		return nil, fmt.Errorf("select sessions failed: %v", err)
+	}
+
+	addressesQuery := `
+		SELECT
+			"id",
+			"user_id",
+			"name",
+			"phone",
+			"line1",
+			"line2",
+			"district",
+			"province",
+			"postal_code",
+			"country",
+			"is_default",
+			"created_at",
+			"updated_at"
+		FROM "addresses"
+		WHERE "user_id" = $1
+		ORDER BY "created_at";`
+
+	if err := tx.SelectContext(ctx, &export.Addresses, addressesQuery, userId); err != nil {
+		return nil, fmt.Errorf("select addresses failed: %v", err)
+	}
+
+	ordersQuery := `
+		SELECT
+			COALESCE(array_to_json(array_agg("at")), '[]')
+		FROM (
+			SELECT
+				"o"."id",
+				"o"."user_id",
+				"o"."transfer_slip",
+				"o"."status",
+				(
+					SELECT
+						array_to_json(array_agg("pt"))
+					FROM (
+						SELECT
+							"spo"."id",
+							"spo"."qty",
+							"spo"."product"
+						FROM "products_orders" "spo"
+						WHERE "spo"."order_id" = "o"."id"
+					) AS "pt"
+				) AS "products",
+				"o"."address",
+				"o"."contact",
+				"o"."address_id",
+				"o"."shipping_address",
+				(
+					SELECT
+						SUM(COALESCE(("po"."product"->>'price')::FLOAT*("po"."qty")::FLOAT, 0))
+					FROM "products_orders" "po"
+					WHERE "po"."order_id" = "o"."id"
+				) AS "total_paid",
+				"o"."created_at",
+				"o"."updated_at"
+			FROM "orders" "o"
+			WHERE "o"."user_id" = $1
+			ORDER BY "o"."created_at"
+		) AS "at";`
+
+	raw := make([]byte, 0)
+	if err := tx.GetContext(ctx, &raw, ordersQuery, userId); err != nil {
+		return nil, fmt.Errorf("get orders failed: %v", err)
+	}
+	if err := json.Unmarshal(raw, &export.Orders); err != nil {
+		return nil, fmt.Errorf("unmarshal orders failed: %v", err)
+	}
+
+	filesQuery := `
+		SELECT
+			"id",
+			"filename",
+			"url",
+			"purpose",
+			"created_at"
+		FROM "files"
+		WHERE "owner_id" = $1
+		ORDER BY "created_at";`
+
+	if err := tx.SelectContext(ctx, &export.Files, filesQuery, userId); err != nil {
+		return nil, fmt.Errorf("select files failed: %v", err)
+	}
+
+	return export, nil
+}
@@ -1,101 +1,220 @@
 package usersUsecases
 
 import (
+	"context"
 	"fmt"
+	"log"
+	"math"
+	"strings"
+	"time"
 
 	"github.com/codepnw/ecommerce/config"
+	"github.com/codepnw/ecommerce/modules/entities"
+	"github.com/codepnw/ecommerce/modules/files/filesUsecases"
+	"github.com/codepnw/ecommerce/modules/roles"
 	"github.com/codepnw/ecommerce/modules/users"
 	"github.com/codepnw/ecommerce/modules/users/usersRepositories"
 	"github.com/codepnw/ecommerce/pkg/auth"
+	"github.com/codepnw/ecommerce/pkg/cache"
+	"github.com/codepnw/ecommerce/pkg/mailer"
+	"github.com/codepnw/ecommerce/pkg/oidc"
+	"github.com/codepnw/ecommerce/pkg/password"
+	"github.com/codepnw/ecommerce/pkg/totp"
+	"github.com/codepnw/ecommerce/pkg/utils"
 	"golang.org/x/crypto/bcrypt"
 )
 
 type IUsersUsecase interface {
 	InsertCustomer(req *users.UserRegisterReq) (*users.UserPassport, error)
-	InsertAdmin(req *users.UserRegisterReq) (*users.UserPassport, error)
 	GetPassport(req *users.UserCredential) (*users.UserPassport, error)
 	RefreshPassport(req *users.UserRefreshCredential) (*users.UserPassport, error)
 	DeleteOauth(oauthId string) error
 	GetUserProfile(userId string) (*users.User, error)
+	ForgotPassword(req *users.UserForgotPasswordReq) error
+	ResetPassword(req *users.UserResetPasswordReq) error
+	VerifyEmail(req *users.UserVerifyEmailReq) error
+	ResendVerification(req *users.UserResendVerificationReq) error
+	UpdateProfile(req *users.UserUpdateReq) (*users.User, error)
+	ChangePassword(userId, accessToken string, req *users.UserChangePasswordReq) error
+	VerifyTwoFactor(req *users.UserTwoFactorReq) (*users.UserPassport, error)
+	SetupTwoFactor(challengeToken string) (*users.UserTotpEnrollment, error)
+	EnrollTwoFactor(userId string) (*users.UserTotpEnrollment, error)
+	ConfirmTwoFactor(userId, code string) (*users.UserRecoveryCodes, error)
+	DisableTwoFactor(userId string, req *users.UserTwoFactorCodeReq) error
+	RegenerateRecoveryCodes(userId string, req *users.UserTwoFactorCodeReq) (*users.UserRecoveryCodes, error)
+	FindSessions(userId, accessToken string) ([]*users.UserSession, error)
+	DeleteSession(userId, sessionId string) error
+	DeleteOtherSessions(userId, accessToken string) (int64, error)
+	ForceLogout(userId, adminId, ip string) (int64, error)
+	UnlockUser(userId, adminId, ip string) error
+	InviteAdmin(req *users.UserInvitationReq, adminId, ip string) (*users.UserInvitation, error)
+	FindInvitations() ([]*users.UserInvitation, error)
+	RevokeInvitation(invitationId, adminId, ip string) error
+	AcceptInvitation(req *users.UserAcceptInvitationReq) (*users.UserPassport, error)
+	OidcAuthorize(provider string) (*users.UserOidcAuthorizeRes, error)
+	OidcCallback(req *users.UserOidcCallbackReq) (*users.UserPassport, error)
+	FindUsers(req *users.UserFilter) (*entities.PaginateRes, error)
+	UpdateUserRole(userId string, roleId int, adminId string, adminPermissions []string, ip string) (*users.User, error)
+	DisableUser(userId, adminId string, adminPermissions []string, ip string) error
+	EnableUser(userId, adminId, ip string) error
+	DeleteUser(userId, adminId string, adminPermissions []string, ip string) error
+	ExportUser(userId, actorId, ip string) (*users.UserExport, error)
+	RequestDeletion(userId string) error
+	ConfirmDeletion(req *users.UserDeleteReq) error
+	Impersonate(req *users.UserImpersonateReq) (*users.UserPassport, error)
 }
 
 type usersUsecase struct {
-	cfg config.IConfig
+	cfg        config.IConfig
 	repository usersRepositories.IUsersRepository
+	mailer     mailer.IMailer
+	policy     password.IPolicy
+	cache      cache.IAuthCache
+	oidc       oidc.IRegistry
+	files      filesUsecases.IFilesUsecase
+	keys       auth.IKeyStore
 }
 
-func UsersUsecase(cfg config.IConfig, repository usersRepositories.IUsersRepository) IUsersUsecase {
+func UsersUsecase(cfg config.IConfig, repository usersRepositories.IUsersRepository, mailer mailer.IMailer, policy password.IPolicy, cache cache.IAuthCache, oidc oidc.IRegistry, files filesUsecases.IFilesUsecase, keys auth.IKeyStore) IUsersUsecase {
 	return &usersUsecase{
-		cfg: cfg,
+		cfg:        cfg,
 		repository: repository,
+		mailer:     mailer,
+		policy:     policy,
+		cache:      cache,
+		oidc:       oidc,
+		files:      files,
+		keys:       keys,
 	}
 }
 
-func (u *usersUsecase) InsertCustomer(req *users.UserRegisterReq) (*users.UserPassport, error) {
-	if err := req.BcryptHashing(); err != nil {
-		return nil, err
+// signToken builds and signs a token with the session keys, a token that
+// failed to sign must never reach the client.
+func (u *usersUsecase) signToken(tokenType auth.TokenType, claims *users.UserClaims) (string, error) {
+	token, err := auth.NewEcomAuth(tokenType, u.cfg.Jwt(), u.keys, claims)
+	if err != nil {
+		return "", err
 	}
+	return token.SignToken()
+}
 
-	result, err := u.repository.InsertUser(req, false)
-	if err != nil {
+func (u *usersUsecase) InsertCustomer(req *users.UserRegisterReq) (*users.UserPassport, error) {
+	if err := u.policy.Validate(req.Password, req.Username, req.Email); err != nil {
 		return nil, err
 	}
-	return result, nil
-}
 
-func (u *usersUsecase) InsertAdmin(req *users.UserRegisterReq) (*users.UserPassport, error) {
 	if err := req.BcryptHashing(); err != nil {
 		return nil, err
 	}
 
-	result, err := u.repository.InsertUser(req, true)
+	result, err := u.repository.InsertUser(req, false)
 	if err != nil {
 		return nil, err
 	}
+
+	// The account exists already, a failed mail can be retried with resend
+	if err := u.sendVerification(result.User.Id, result.User.Email, result.User.Username); err != nil {
+		log.Printf("send verification failed: %v\n", err)
+	}
 	return result, nil
 }
 
 func (u *usersUsecase) GetPassport(req *users.UserCredential) (*users.UserPassport, error) {
+	if u.repository.CountIpFailures(req.Ip, u.cfg.Auth().LoginWindow()) >= u.cfg.Auth().LoginIpMaxAttempts() {
+		return nil, fmt.Errorf("too many sign in attempts, try again later")
+	}
+
 	user, err := u.repository.FindOneUserByEmail(req.Email)
 	if err != nil {
+		// Unknown emails still count against the ip
+		if err := u.repository.InsertLoginAttempt(req.Email, req.Ip, false); err != nil {
+			log.Printf("insert login attempt failed: %v\n", err)
+		}
 		return nil, err
 	}
 
+	if user.LockedFor > 0 {
+		return nil, fmt.Errorf("account is locked, try again later")
+	}
+	if !u.loginAllowed(user) {
+		return nil, fmt.Errorf("too many sign in attempts, try again later")
+	}
+
 	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(req.Password)); err != nil {
+		locked, err := u.repository.RecordLoginFailure(
+			user,
+			req.Ip,
+			u.cfg.Auth().LoginMaxAttempts(),
+			u.cfg.Auth().LoginWindow(),
+			u.cfg.Auth().LockoutDuration(),
+		)
+		if err != nil {
+			log.Printf("record login failure failed: %v\n", err)
+		}
+		if locked {
+			return nil, fmt.Errorf("account is locked, try again later")
+		}
 		return nil, fmt.Errorf("password is invalid")
 	}
 
-	accessToken, err := auth.NewEcomAuth(auth.Access, u.cfg.Jwt(), &users.UserClaims{
-		Id: user.Id,
+	if err := u.repository.RecordLoginSuccess(user, req.Ip); err != nil {
+		return nil, err
+	}
+
+	if user.TotpEnabled || (user.RoleId == 2 && u.cfg.Auth().TotpRequiredAdmin()) {
+		return u.challengePassport(user)
+	}
+	return u.newPassport(user, &users.UserSessionMeta{
+		Ip:        req.Ip,
+		UserAgent: req.UserAgent,
+	})
+}
+
+// newPassport signs a new session for a user whose credentials are verified.
+// Every way of signing in ends here, so a disabled account is refused here.
+func (u *usersUsecase) newPassport(user *users.UserCredentialCheck, meta *users.UserSessionMeta) (*users.UserPassport, error) {
+	if user.Disabled {
+		return nil, fmt.Errorf("account is disabled")
+	}
+
+	accessToken, err := u.signToken(auth.Access, &users.UserClaims{
+		Id:     user.Id,
 		RoleId: user.RoleId,
 	})
+	if err != nil {
+		return nil, err
+	}
 
-	refreshToken, err := auth.NewEcomAuth(auth.Refresh, u.cfg.Jwt(), &users.UserClaims{
-		Id: user.Id,
+	refreshToken, err := u.signToken(auth.Refresh, &users.UserClaims{
+		Id:     user.Id,
 		RoleId: user.RoleId,
 	})
+	if err != nil {
+		return nil, err
+	}
 
 	passport := &users.UserPassport{
 		User: &users.User{
-			Id: user.Id,
-			Email: user.Email,
-			Username: user.Username,
-			RoleId: user.RoleId,
+			Id:            user.Id,
+			Email:         user.Email,
+			Username:      user.Username,
+			RoleId:        user.RoleId,
+			EmailVerified: user.EmailVerified,
 		},
 		Token: &users.UserToken{
-			AccessToken: accessToken.SignToken(),
-			RefreshToken: refreshToken.SignToken(),
+			AccessToken:  accessToken,
+			RefreshToken: refreshToken,
 		},
 	}
 
-	if err := u.repository.InsertOauth(passport); err != nil {
+	if err := u.repository.InsertOauth(passport, meta); err != nil {
 		return nil, err
 	}
 	return passport, nil
 }
 
 func (u *usersUsecase) RefreshPassport(req *users.UserRefreshCredential) (*users.UserPassport, error) {
-	claims, err := auth.ParseToken(u.cfg.Jwt(), req.RefreshToken)
+	claims, err := auth.ParseToken(u.cfg.Jwt(), u.keys, req.RefreshToken)
 	if err != nil {
 		return nil, err
 	}
@@ -111,35 +230,39 @@ func (u *usersUsecase) RefreshPassport(req *users.UserRefreshCredential) (*users
 	}
 
 	newClaims := &users.UserClaims{
-		Id: profile.Id,
+		Id:     profile.Id,
 		RoleId: profile.RoleId,
 	}
 
-	accessToken, err := auth.NewEcomAuth(
-		auth.Access,
-		u.cfg.Jwt(),
-		newClaims,
-	)
+	accessToken, err := u.signToken(auth.Access, newClaims)
 	if err != nil {
 		return nil, err
 	}
 
-	refreshToken := auth.RepeatToken(
+	refreshToken, err := auth.RepeatToken(
 		u.cfg.Jwt(),
+		u.keys,
 		newClaims,
 		claims.ExpiresAt.Unix(),
 	)
-	
+	if err != nil {
+		return nil, err
+	}
+
 	passport := &users.UserPassport{
 		User: profile,
 		Token: &users.UserToken{
-			Id: oauth.Id,
-			AccessToken: accessToken.SignToken(),
+			Id:           oauth.Id,
+			AccessToken:  accessToken,
 			RefreshToken: refreshToken,
 		},
 	}
 
-	if err := u.repository.UpdateOauth(passport.Token); err != nil {
+	// A rotated token is caught here and revokes its family, either way the
+	// previous access token of the session is no longer valid
+	err = u.repository.UpdateOauth(req.RefreshToken, passport.Token)
+	u.cache.InvalidateSession(oauth.Id)
+	if err != nil {
 		return nil, err
 	}
 	return passport, nil
@@ -149,6 +272,7 @@ func (u *usersUsecase) DeleteOauth(oauthId string) error {
 	if err := u.repository.DeleteOauth(oauthId); err != nil {
 		return err
 	}
+	u.cache.InvalidateSession(oauthId)
 	return nil
 }
 
@@ -158,4 +282,980 @@ func (u *usersUsecase) GetUserProfile(userId string) (*users.User, error) {
 		return nil, err
 	}
 	return profile, nil
-}
\ No newline at end of file
+}
+
+func (u *usersUsecase) ForgotPassword(req *users.UserForgotPasswordReq) error {
+	// Unknown emails are ignored so the endpoint can't be used to find accounts
+	user, err := u.repository.FindOneUserByEmail(req.Email)
+	if err != nil {
+		log.Printf("forgot password: %v\n", err)
+		return nil
+	}
+
+	token, err := utils.RandToken(32)
+	if err != nil {
+		return err
+	}
+
+	if err := u.repository.InsertPasswordReset(user.Id, utils.HashToken(token), u.cfg.Auth().ResetTokenExpires()); err != nil {
+		return err
+	}
+
+	return u.mailer.Send(&mailer.Message{
+		To:      user.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf(
+			"Hi %s,\n\nUse this token to reset your password: %s\n\nThe token expires in %v and can be used only once.",
+			user.Username,
+			token,
+			u.cfg.Auth().ResetTokenExpires(),
+		),
+	})
+}
+
+func (u *usersUsecase) ResetPassword(req *users.UserResetPasswordReq) error {
+	// Checked before the token is consumed so a rejected password can be retried
+	userId, err := u.repository.FindPasswordResetUser(utils.HashToken(req.Token))
+	if err != nil {
+		return err
+	}
+	user, err := u.repository.FindOneUserById(userId)
+	if err != nil {
+		return err
+	}
+	if err := u.policy.Validate(req.Password, user.Username, user.Email); err != nil {
+		return err
+	}
+
+	if err := req.BcryptHashing(); err != nil {
+		return err
+	}
+
+	userId, err = u.repository.ResetPassword(utils.HashToken(req.Token), req.Password)
+	if err != nil {
+		return err
+	}
+	u.cache.InvalidateUser(userId)
+	return nil
+}
+
+func (u *usersUsecase) sendVerification(userId, email, username string) error {
+	token, err := utils.RandToken(32)
+	if err != nil {
+		return err
+	}
+
+	if err := u.repository.InsertEmailVerification(userId, utils.HashToken(token), u.cfg.Auth().VerifyTokenExpires()); err != nil {
+		return err
+	}
+
+	return u.mailer.Send(&mailer.Message{
+		To:      email,
+		Subject: "Verify your email",
+		Body: fmt.Sprintf(
+			"Hi %s,\n\nUse this token to verify your email: %s\n\nThe token expires in %v.",
+			username,
+			token,
+			u.cfg.Auth().VerifyTokenExpires(),
+		),
+	})
+}
+
+func (u *usersUsecase) VerifyEmail(req *users.UserVerifyEmailReq) error {
+	if err := u.repository.VerifyEmail(utils.HashToken(req.Token)); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (u *usersUsecase) ResendVerification(req *users.UserResendVerificationReq) error {
+	user, err := u.repository.FindOneUserByEmail(req.Email)
+	if err != nil {
+		log.Printf("resend verification: %v\n", err)
+		return nil
+	}
+	if user.EmailVerified {
+		return nil
+	}
+	return u.sendVerification(user.Id, user.Email, user.Username)
+}
+
+func (u *usersUsecase) UpdateProfile(req *users.UserUpdateReq) (*users.User, error) {
+	before, err := u.repository.GetProfile(req.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := u.repository.UpdateProfile(req); err != nil {
+		return nil, err
+	}
+
+	profile, err := u.repository.GetProfile(req.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	if profile.Email != before.Email {
+		if err := u.sendVerification(profile.Id, profile.Email, profile.Username); err != nil {
+			log.Printf("send verification failed: %v\n", err)
+		}
+	}
+	return profile, nil
+}
+
+func (u *usersUsecase) ChangePassword(userId, accessToken string, req *users.UserChangePasswordReq) error {
+	user, err := u.repository.FindOneUserById(userId)
+	if err != nil {
+		return err
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(req.CurrentPassword)); err != nil {
+		return fmt.Errorf("password is invalid")
+	}
+
+	if err := u.policy.Validate(req.NewPassword, user.Username, user.Email); err != nil {
+		return err
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.NewPassword), 10)
+	if err != nil {
+		return fmt.Errorf("hashed password failed: %v", err)
+	}
+
+	if err := u.repository.UpdatePassword(userId, string(hashedPassword), accessToken); err != nil {
+		return err
+	}
+	u.cache.InvalidateUser(userId)
+	return nil
+}
+
+// loginAllowed applies the progressive delay, every failure within the window
+// doubles the time the account has to wait before the next attempt.
+func (u *usersUsecase) loginAllowed(user *users.UserCredentialCheck) bool {
+	if user.FailedAttempts == 0 || user.SinceLastFailure > u.cfg.Auth().LoginWindow().Seconds() {
+		return true
+	}
+
+	wait := u.cfg.Auth().LoginDelay() << (user.FailedAttempts - 1)
+	if wait <= 0 || wait > u.cfg.Auth().LockoutDuration() {
+		wait = u.cfg.Auth().LockoutDuration()
+	}
+	return user.SinceLastFailure >= wait.Seconds()
+}
+
+func (u *usersUsecase) UnlockUser(userId, adminId, ip string) error {
+	if err := u.repository.UnlockUser(userId, &users.AuditLog{
+		ActorId:  adminId,
+		Action:   users.AuditUserUnlocked,
+		TargetId: userId,
+		Ip:       ip,
+	}); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (u *usersUsecase) challengePassport(user *users.UserCredentialCheck) (*users.UserPassport, error) {
+	if user.Disabled {
+		return nil, fmt.Errorf("account is disabled")
+	}
+
+	challenge, err := u.signToken(auth.Challenge, &users.UserClaims{
+		Id:     user.Id,
+		RoleId: user.RoleId,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &users.UserPassport{
+		User: &users.User{
+			Id:            user.Id,
+			Email:         user.Email,
+			Username:      user.Username,
+			RoleId:        user.RoleId,
+			EmailVerified: user.EmailVerified,
+		},
+		Challenge: &users.UserChallenge{
+			Token:         challenge,
+			SetupRequired: !user.TotpEnabled,
+		},
+	}, nil
+}
+
+// VerifyTwoFactor exchanges a sign in challenge for a passport. For an
+// account that had to enroll, the first valid code also confirms the
+// enrollment and the recovery codes are returned once.
+func (u *usersUsecase) VerifyTwoFactor(req *users.UserTwoFactorReq) (*users.UserPassport, error) {
+	claims, err := auth.ParseChallengeToken(u.cfg.Jwt(), u.keys, req.ChallengeToken)
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := u.repository.FindOneUserById(claims.Claims.Id)
+	if err != nil {
+		return nil, err
+	}
+	if user.LockedFor > 0 {
+		return nil, fmt.Errorf("account is locked, try again later")
+	}
+
+	var recoveryCodes *users.UserRecoveryCodes
+	if user.TotpEnabled {
+		err = u.checkTwoFactor(user.Id, &req.UserTwoFactorCodeReq)
+	} else {
+		recoveryCodes, err = u.ConfirmTwoFactor(user.Id, req.Code)
+	}
+	if err != nil {
+		if err.Error() != "code is invalid" {
+			return nil, err
+		}
+		locked, err := u.repository.RecordLoginFailure(
+			user,
+			req.Ip,
+			u.cfg.Auth().LoginMaxAttempts(),
+			u.cfg.Auth().LoginWindow(),
+			u.cfg.Auth().LockoutDuration(),
+		)
+		if err != nil {
+			log.Printf("record login failure failed: %v\n", err)
+		}
+		if locked {
+			return nil, fmt.Errorf("account is locked, try again later")
+		}
+		return nil, fmt.Errorf("code is invalid")
+	}
+
+	passport, err := u.newPassport(user, &users.UserSessionMeta{
+		Ip:        req.Ip,
+		UserAgent: req.UserAgent,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if recoveryCodes != nil {
+		passport.RecoveryCodes = recoveryCodes.Codes
+	}
+	return passport, nil
+}
+
+// SetupTwoFactor lets an account that must use two-factor enroll with its
+// sign in challenge, before it has a session.
+func (u *usersUsecase) SetupTwoFactor(challengeToken string) (*users.UserTotpEnrollment, error) {
+	claims, err := auth.ParseChallengeToken(u.cfg.Jwt(), u.keys, challengeToken)
+	if err != nil {
+		return nil, err
+	}
+	return u.EnrollTwoFactor(claims.Claims.Id)
+}
+
+func (u *usersUsecase) EnrollTwoFactor(userId string) (*users.UserTotpEnrollment, error) {
+	user, err := u.repository.FindOneUserById(userId)
+	if err != nil {
+		return nil, err
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := u.repository.SetTotpSecret(user.Id, secret); err != nil {
+		return nil, err
+	}
+
+	return &users.UserTotpEnrollment{
+		Secret: secret,
+		Uri:    totp.ProvisioningURI(u.cfg.Auth().TotpIssuer(), user.Email, secret),
+	}, nil
+}
+
+func (u *usersUsecase) ConfirmTwoFactor(userId, code string) (*users.UserRecoveryCodes, error) {
+	secret, err := u.repository.FindTotp(userId)
+	if err != nil {
+		return nil, err
+	}
+	if secret.Enabled {
+		return nil, fmt.Errorf("two-factor is already enabled")
+	}
+	if secret.Secret == "" {
+		return nil, fmt.Errorf("two-factor enrollment has not started")
+	}
+
+	step, ok := totp.Validate(secret.Secret, code, time.Now(), 1)
+	if !ok {
+		return nil, fmt.Errorf("code is invalid")
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := u.repository.EnableTotp(userId, step, hashes, &users.AuditLog{
+		ActorId:  userId,
+		Action:   users.AuditTotpEnabled,
+		TargetId: userId,
+	}); err != nil {
+		return nil, err
+	}
+	return &users.UserRecoveryCodes{Codes: codes}, nil
+}
+
+func (u *usersUsecase) DisableTwoFactor(userId string, req *users.UserTwoFactorCodeReq) error {
+	user, err := u.repository.FindOneUserById(userId)
+	if err != nil {
+		return err
+	}
+	if user.RoleId == 2 && u.cfg.Auth().TotpRequiredAdmin() {
+		return fmt.Errorf("two-factor is required for admins")
+	}
+	if !user.TotpEnabled {
+		return fmt.Errorf("two-factor is not enabled")
+	}
+
+	if err := u.checkTwoFactor(userId, req); err != nil {
+		return err
+	}
+
+	if err := u.repository.DisableTotp(userId, &users.AuditLog{
+		ActorId:  userId,
+		Action:   users.AuditTotpDisabled,
+		TargetId: userId,
+	}); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (u *usersUsecase) RegenerateRecoveryCodes(userId string, req *users.UserTwoFactorCodeReq) (*users.UserRecoveryCodes, error) {
+	if err := u.checkTwoFactor(userId, req); err != nil {
+		return nil, err
+	}
+
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := u.repository.ReplaceRecoveryCodes(userId, hashes); err != nil {
+		return nil, err
+	}
+	return &users.UserRecoveryCodes{Codes: codes}, nil
+}
+
+// checkTwoFactor accepts a code from the authenticator app or an unused
+// recovery code, each of them works only once.
+func (u *usersUsecase) checkTwoFactor(userId string, req *users.UserTwoFactorCodeReq) error {
+	if req.RecoveryCode != "" {
+		if !u.repository.UseRecoveryCode(userId, utils.HashToken(normalizeRecoveryCode(req.RecoveryCode))) {
+			return fmt.Errorf("code is invalid")
+		}
+		return nil
+	}
+
+	secret, err := u.repository.FindTotp(userId)
+	if err != nil {
+		return err
+	}
+	if !secret.Enabled {
+		return fmt.Errorf("two-factor is not enabled")
+	}
+
+	step, ok := totp.Validate(secret.Secret, req.Code, time.Now(), 1)
+	if !ok || !u.repository.UseTotpStep(userId, step) {
+		return fmt.Errorf("code is invalid")
+	}
+	return nil
+}
+
+func newRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, 0, 10)
+	hashes := make([]string, 0, 10)
+	for i := 0; i < 10; i++ {
+		token, err := utils.RandToken(5)
+		if err != nil {
+			return nil, nil, err
+		}
+		code := token[:5] + "-" + token[5:]
+		codes = append(codes, code)
+		hashes = append(hashes, utils.HashToken(normalizeRecoveryCode(code)))
+	}
+	return codes, hashes, nil
+}
+
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+}
+
+func (u *usersUsecase) FindSessions(userId, accessToken string) ([]*users.UserSession, error) {
+	sessions, err := u.repository.FindSessions(userId, accessToken)
+	if err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+func (u *usersUsecase) DeleteSession(userId, sessionId string) error {
+	if err := u.repository.DeleteSession(userId, sessionId); err != nil {
+		return err
+	}
+	u.cache.InvalidateSession(sessionId)
+	return nil
+}
+
+func (u *usersUsecase) DeleteOtherSessions(userId, accessToken string) (int64, error) {
+	rows, err := u.repository.DeleteOtherSessions(userId, accessToken)
+	if err != nil {
+		return 0, err
+	}
+	u.cache.InvalidateUser(userId)
+	return rows, nil
+}
+
+func (u *usersUsecase) ForceLogout(userId, adminId, ip string) (int64, error) {
+	rows, err := u.repository.DeleteAllSessions(userId, &users.AuditLog{
+		ActorId:  adminId,
+		Action:   users.AuditForceLogout,
+		TargetId: userId,
+		Ip:       ip,
+	})
+	if err != nil {
+		return 0, err
+	}
+	u.cache.InvalidateUser(userId)
+	return rows, nil
+}
+
+// InviteAdmin mails a single use token that lets its holder create an admin
+// account for req.Email, a newer invitation replaces a pending one.
+func (u *usersUsecase) InviteAdmin(req *users.UserInvitationReq, adminId, ip string) (*users.UserInvitation, error) {
+	if _, err := u.repository.FindOneUserByEmail(req.Email); err == nil {
+		return nil, fmt.Errorf("email has been used")
+	}
+
+	token, err := utils.RandToken(32)
+	if err != nil {
+		return nil, err
+	}
+
+	invitation, err := u.repository.InsertInvitation(req, utils.HashToken(token), u.cfg.Auth().InviteTokenExpires(), &users.AuditLog{
+		ActorId: adminId,
+		Action:  users.AuditAdminInvited,
+		Ip:      ip,
+		Detail: map[string]any{
+			"email": req.Email,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := u.mailer.Send(&mailer.Message{
+		To:      req.Email,
+		Subject: "You are invited as an admin",
+		Body: fmt.Sprintf(
+			"Hi,\n\nYou have been invited to become an admin of %s. Use this token to create your account: %s\n\nThe token expires in %v and can be used only once.",
+			u.cfg.App().Name(),
+			token,
+			u.cfg.Auth().InviteTokenExpires(),
+		),
+	}); err != nil {
+		return nil, err
+	}
+	return invitation, nil
+}
+
+func (u *usersUsecase) FindInvitations() ([]*users.UserInvitation, error) {
+	invitations, err := u.repository.FindInvitations()
+	if err != nil {
+		return nil, err
+	}
+	return invitations, nil
+}
+
+func (u *usersUsecase) RevokeInvitation(invitationId, adminId, ip string) error {
+	if err := u.repository.RevokeInvitation(invitationId, &users.AuditLog{
+		ActorId: adminId,
+		Action:  users.AuditInviteRevoke,
+		Ip:      ip,
+	}); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (u *usersUsecase) AcceptInvitation(req *users.UserAcceptInvitationReq) (*users.UserPassport, error) {
+	tokenHash := utils.HashToken(req.Token)
+	invitation, err := u.repository.FindInvitationByToken(tokenHash)
+	if err != nil {
+		return nil, err
+	}
+	if invitation.Status != "pending" {
+		// Someone holds a token that no longer works, leave a trail for the admins
+		if err := u.repository.InsertAudit(&users.AuditLog{
+			Action:   users.AuditInviteReject,
+			TargetId: invitation.Id,
+			Ip:       req.Ip,
+			Detail: map[string]any{
+				"email":  invitation.Email,
+				"reason": invitation.Status,
+			},
+		}); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("token is invalid or has expired")
+	}
+
+	// Checked before the token is consumed so a rejected password can be retried
+	if err := u.policy.Validate(req.Password, req.Username, invitation.Email); err != nil {
+		return nil, err
+	}
+
+	if err := req.BcryptHashing(); err != nil {
+		return nil, err
+	}
+
+	userId, err := u.repository.AcceptInvitation(tokenHash, req)
+	if err != nil {
+		return nil, err
+	}
+
+	profile, err := u.repository.GetProfile(userId)
+	if err != nil {
+		return nil, err
+	}
+	return &users.UserPassport{
+		User: profile,
+	}, nil
+}
+
+// OidcAuthorize starts a sign in through an external provider, the client
+// sends the user to the returned url and posts the code it gets back to
+// OidcCallback together with the state.
+func (u *usersUsecase) OidcAuthorize(provider string) (*users.UserOidcAuthorizeRes, error) {
+	p, err := u.oidc.Provider(provider)
+	if err != nil {
+		return nil, err
+	}
+
+	state, err := utils.RandToken(32)
+	if err != nil {
+		return nil, err
+	}
+	verifier, err := oidc.NewVerifier()
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := oidc.NewNonce()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	url, err := p.AuthCodeURL(ctx, state, nonce, verifier)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := u.repository.InsertOidcState(utils.HashToken(state), provider, verifier, nonce, u.cfg.Oidc().StateExpires()); err != nil {
+		return nil, err
+	}
+	return &users.UserOidcAuthorizeRes{
+		Url:   url,
+		State: state,
+	}, nil
+}
+
+func (u *usersUsecase) OidcCallback(req *users.UserOidcCallbackReq) (*users.UserPassport, error) {
+	p, err := u.oidc.Provider(req.Provider)
+	if err != nil {
+		return nil, err
+	}
+
+	verifier, nonce, err := u.repository.UseOidcState(utils.HashToken(req.State), req.Provider)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	external, err := p.Exchange(ctx, req.Code, verifier, nonce)
+	if err != nil {
+		return nil, err
+	}
+	identity := &users.UserIdentity{
+		Provider:      external.Provider,
+		Subject:       external.Subject,
+		Email:         external.Email,
+		EmailVerified: external.EmailVerified,
+	}
+
+	userId, err := u.repository.FindIdentity(identity.Provider, identity.Subject)
+	if err != nil {
+		if err.Error() != "identity not found" {
+			return nil, err
+		}
+		if userId, err = u.linkIdentity(identity, external.Name, req.Ip); err != nil {
+			return nil, err
+		}
+	}
+
+	user, err := u.repository.FindOneUserById(userId)
+	if err != nil {
+		return nil, err
+	}
+	if user.LockedFor > 0 {
+		return nil, fmt.Errorf("account is locked, try again later")
+	}
+
+	if err := u.repository.RecordLoginSuccess(user, req.Ip); err != nil {
+		return nil, err
+	}
+
+	if user.TotpEnabled || (user.RoleId == 2 && u.cfg.Auth().TotpRequiredAdmin()) {
+		return u.challengePassport(user)
+	}
+	return u.newPassport(user, &users.UserSessionMeta{
+		Ip:        req.Ip,
+		UserAgent: req.UserAgent,
+	})
+}
+
+// linkIdentity attaches a first time identity to the account with the same
+// email when both sides have verified it, otherwise a new customer is made.
+// Only provider verified emails are taken, an unverified one would let anyone
+// claim an account or an address by adding its email at some provider.
+func (u *usersUsecase) linkIdentity(identity *users.UserIdentity, name, ip string) (string, error) {
+	if identity.Email == "" {
+		return "", fmt.Errorf("provider did not share an email")
+	}
+	if !identity.EmailVerified {
+		return "", fmt.Errorf("provider did not verify the email")
+	}
+
+	if existing, err := u.repository.FindOneUserByEmail(identity.Email); err == nil {
+		if !existing.EmailVerified {
+			return "", fmt.Errorf("email has been used")
+		}
+		if err := u.repository.InsertIdentity(existing.Id, identity, &users.AuditLog{
+			ActorId:  existing.Id,
+			Action:   users.AuditIdentityLink,
+			TargetId: existing.Id,
+			Ip:       ip,
+			Detail: map[string]any{
+				"provider": identity.Provider,
+			},
+		}); err != nil {
+			return "", err
+		}
+		return existing.Id, nil
+	}
+
+	secret, err := utils.RandToken(32)
+	if err != nil {
+		return "", err
+	}
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(secret), 10)
+	if err != nil {
+		return "", fmt.Errorf("hashed password failed: %v", err)
+	}
+
+	base := usernameOf(identity.Email, name)
+	username := base
+	for i := 0; ; i++ {
+		userId, err := u.repository.InsertIdentityUser(identity, username, string(hashedPassword))
+		if err == nil {
+			return userId, nil
+		}
+		if err.Error() != "username has been used" || i == 4 {
+			return "", err
+		}
+		suffix, err := utils.RandToken(2)
+		if err != nil {
+			return "", err
+		}
+		username = base + "-" + suffix
+	}
+}
+
+func usernameOf(email, name string) string {
+	source := name
+	if at := strings.Index(email, "@"); at > 0 {
+		source = email[:at]
+	}
+
+	var b strings.Builder
+	for _, r := range strings.ToLower(source) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') || r == '.' || r == '_' || r == '-' {
+			b.WriteRune(r)
+		}
+	}
+	if b.Len() == 0 {
+		return "user"
+	}
+	return b.String()
+}
+
+func (u *usersUsecase) FindUsers(req *users.UserFilter) (*entities.PaginateRes, error) {
+	result, count, err := u.repository.FindUser(req)
+	if err != nil {
+		return nil, err
+	}
+
+	return &entities.PaginateRes{
+		Data:      result,
+		Page:      req.Page,
+		Limit:     req.Limit,
+		TotalItem: count,
+		TotalPage: int(math.Ceil(float64(count) / float64(req.Limit))),
+	}, nil
+}
+
+// UpdateUserRole takes effect on the next request of the user, JwtAuth reads
+// the role through the session cache rather than from the token.
+func (u *usersUsecase) UpdateUserRole(userId string, roleId int, adminId string, adminPermissions []string, ip string) (*users.User, error) {
+	if userId == adminId {
+		return nil, fmt.Errorf("you can't change your own role")
+	}
+	if err := u.checkOutranked(userId, adminPermissions); err != nil {
+		return nil, err
+	}
+	exceeds, err := u.repository.RoleExceedsPermissions(roleId, adminPermissions)
+	if err != nil {
+		return nil, err
+	}
+	if exceeds {
+		return nil, fmt.Errorf("role has permissions you don't have")
+	}
+
+	if err := u.repository.UpdateUserRole(userId, roleId, &users.AuditLog{
+		ActorId:  adminId,
+		Action:   users.AuditRoleChanged,
+		TargetId: userId,
+		Ip:       ip,
+	}); err != nil {
+		return nil, err
+	}
+	u.cache.InvalidateUser(userId)
+	return u.repository.GetProfile(userId)
+}
+
+func (u *usersUsecase) DisableUser(userId, adminId string, adminPermissions []string, ip string) error {
+	if userId == adminId {
+		return fmt.Errorf("you can't disable your own account")
+	}
+	if err := u.checkOutranked(userId, adminPermissions); err != nil {
+		return err
+	}
+
+	if err := u.repository.DisableUser(userId, &users.AuditLog{
+		ActorId:  adminId,
+		Action:   users.AuditUserDisabled,
+		TargetId: userId,
+		Ip:       ip,
+	}); err != nil {
+		return err
+	}
+	u.cache.InvalidateUser(userId)
+	return nil
+}
+
+func (u *usersUsecase) EnableUser(userId, adminId, ip string) error {
+	if err := u.repository.EnableUser(userId, &users.AuditLog{
+		ActorId:  adminId,
+		Action:   users.AuditUserEnabled,
+		TargetId: userId,
+		Ip:       ip,
+	}); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (u *usersUsecase) DeleteUser(userId, adminId string, adminPermissions []string, ip string) error {
+	if userId == adminId {
+		return fmt.Errorf("you can't delete your own account")
+	}
+	if err := u.checkOutranked(userId, adminPermissions); err != nil {
+		return err
+	}
+
+	if err := u.repository.DeleteUser(userId, &users.AuditLog{
+		ActorId:  adminId,
+		Action:   users.AuditUserDeleted,
+		TargetId: userId,
+		Ip:       ip,
+	}); err != nil {
+		return err
+	}
+	u.cache.InvalidateUser(userId)
+	return nil
+}
+
+// checkOutranked refuses to act on a user whose role holds a permission the
+// admin lacks, otherwise any user manager could remove a super admin.
+func (u *usersUsecase) checkOutranked(userId string, adminPermissions []string) error {
+	user, err := u.repository.FindOneUserById(userId)
+	if err != nil {
+		return err
+	}
+	exceeds, err := u.repository.RoleExceedsPermissions(user.RoleId, adminPermissions)
+	if err != nil {
+		return err
+	}
+	if exceeds {
+		return fmt.Errorf("user has permissions you don't have")
+	}
+	return nil
+}
+
+// ExportUser gathers the personal data held about a user, the links to
+// private files in it expire like any other signed link.
+func (u *usersUsecase) ExportUser(userId, actorId, ip string) (*users.UserExport, error) {
+	export, err := u.repository.ExportUser(userId)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, order := range export.Orders {
+		if order.TransferSlip != nil {
+			order.TransferSlip.Url = u.files.SignUrl(order.TransferSlip.Url)
+		}
+	}
+	for _, file := range export.Files {
+		file.Url = u.files.SignUrl(file.Url)
+	}
+
+	if err := u.repository.InsertAudit(&users.AuditLog{
+		ActorId:  actorId,
+		Action:   users.AuditUserExported,
+		TargetId: userId,
+		Ip:       ip,
+	}); err != nil {
+		log.Printf("insert audit failed: %v\n", err)
+	}
+	return export, nil
+}
+
+// RequestDeletion mails the user a token that confirms the deletion, a stolen
+// access token alone can't delete an account.
+func (u *usersUsecase) RequestDeletion(userId string) error {
+	user, err := u.repository.FindOneUserById(userId)
+	if err != nil {
+		return err
+	}
+
+	token, err := utils.RandToken(32)
+	if err != nil {
+		return err
+	}
+
+	if err := u.repository.InsertDeletionRequest(user.Id, utils.HashToken(token), u.cfg.Auth().DeleteTokenExpires()); err != nil {
+		return err
+	}
+
+	return u.mailer.Send(&mailer.Message{
+		To:      user.Email,
+		Subject: "Confirm your account deletion",
+		Body: fmt.Sprintf(
+			"Hi %s,\n\nUse this token to confirm the deletion of your account: %s\n\nThe token expires in %v. Your personal data will be erased, orders are kept without it for our financial records. Ignore this mail if you did not ask for it.",
+			user.Username,
+			token,
+			u.cfg.Auth().DeleteTokenExpires(),
+		),
+	})
+}
+
+func (u *usersUsecase) ConfirmDeletion(req *users.UserDeleteReq) error {
+	userId, err := u.repository.ConfirmDeletion(utils.HashToken(req.Token), &users.AuditLog{
+		Action: users.AuditUserDeleted,
+		Ip:     req.Ip,
+	})
+	if err != nil {
+		return err
+	}
+	u.cache.InvalidateUser(userId)
+	return nil
+}
+
+// Impersonate gives support staff an access token of another user. Admins
+// can't be impersonated, that would hand out permissions the impersonator
+// may not hold.
+func (u *usersUsecase) Impersonate(req *users.UserImpersonateReq) (*users.UserPassport, error) {
+	if req.UserId == req.ImpersonatorId {
+		return nil, fmt.Errorf("you can't impersonate yourself")
+	}
+
+	user, err := u.repository.FindOneUserById(req.UserId)
+	if err != nil {
+		return nil, err
+	}
+	if user.Disabled {
+		return nil, fmt.Errorf("account is disabled")
+	}
+
+	privileged, err := u.repository.RoleHasPermission(user.RoleId, roles.UsersManage, roles.UsersImpersonate)
+	if err != nil {
+		return nil, err
+	}
+	if privileged {
+		return nil, fmt.Errorf("admins can't be impersonated")
+	}
+
+	// Acting as the user must not grant anything the impersonator lacks
+	exceeds, err := u.repository.RoleExceedsPermissions(user.RoleId, req.ImpersonatorPermissions)
+	if err != nil {
+		return nil, err
+	}
+	if exceeds {
+		return nil, fmt.Errorf("user has permissions you don't have")
+	}
+
+	accessToken, err := u.signToken(auth.Impersonation, &users.UserClaims{
+		Id:           user.Id,
+		RoleId:       user.RoleId,
+		Impersonator: req.ImpersonatorId,
+	})
+	if err != nil {
+		return nil, err
+	}
+	expiresAt := time.Now().Add(u.cfg.Jwt().ImpersonationExpires())
+
+	passport := &users.UserPassport{
+		User: &users.User{
+			Id:            user.Id,
+			Email:         user.Email,
+			Username:      user.Username,
+			RoleId:        user.RoleId,
+			EmailVerified: user.EmailVerified,
+		},
+		Token: &users.UserToken{
+			AccessToken: accessToken,
+		},
+		Impersonation: &users.UserImpersonation{
+			ImpersonatorId: req.ImpersonatorId,
+			ExpiresAt:      expiresAt.Format(time.RFC3339),
+		},
+	}
+
+	if err := u.repository.InsertImpersonation(passport, &users.UserSessionMeta{
+		Ip:        req.Ip,
+		UserAgent: req.UserAgent,
+	}, &users.AuditLog{
+		ActorId:  req.ImpersonatorId,
+		Action:   users.AuditImpersonate,
+		TargetId: user.Id,
+		Ip:       req.Ip,
+		Detail: map[string]any{
+			"reason":     req.Reason,
+			"expires_at": passport.Impersonation.ExpiresAt,
+		},
+	}); err != nil {
+		return nil, err
+	}
+	return passport, nil
+}
@@ -1,6 +1,8 @@
 package auth
 
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"math"
@@ -14,15 +16,19 @@ import (
 type TokenType string
 
 const (
-	Access  TokenType = "access"
-	Refresh TokenType = "refresh"
-	Admin   TokenType = "admin"
-	ApiKey  TokenType = "apikey"
+	Access    TokenType = "access"
+	Refresh   TokenType = "refresh"
+	Admin     TokenType = "admin"
+	ApiKey    TokenType = "apikey"
+	Challenge TokenType = "challenge"
+	// Impersonation is an access token an admin holds for another user
+	Impersonation TokenType = "impersonation"
 )
 
 type ecomAuth struct {
 	mapClaims *ecomMapClaims
 	cfg       config.IJwtConfig
+	keys      IKeyStore
 }
 
 type ecomAdmin struct {
@@ -39,15 +45,15 @@ type ecomMapClaims struct {
 }
 
 type IEcomAuth interface {
-	SignToken() string
+	SignToken() (string, error)
 }
 
 type IEcomAdmin interface {
-	SignToken() string
+	SignToken() (string, error)
 }
 
 type IEcomApiKey interface {
-	SignToken() string
+	SignToken() (string, error)
 }
 
 func jwtTimeDurationCal(t int) *jwt.NumericDate {
@@ -58,30 +64,66 @@ func jwtTimeRepeatAdapter(t int64) *jwt.NumericDate {
 	return jwt.NewNumericDate(time.Unix(t, 0))
 }
 
-func (a *ecomAuth) SignToken() string {
+// newTokenId makes every refresh token unique, two rotations within the same
+// second would otherwise sign identical tokens.
+func newTokenId() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func (a *ecomAuth) SignToken() (string, error) {
+	if a.keys != nil && a.keys.asymmetric() {
+		ss, err := a.keys.sign(a.mapClaims)
+		if err != nil {
+			return "", fmt.Errorf("sign token failed: %v", err)
+		}
+		return ss, nil
+	}
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, a.mapClaims)
-	ss, _ := token.SignedString(a.cfg.SecretKey())
-	return ss
+	ss, err := token.SignedString(a.cfg.SecretKey())
+	if err != nil {
+		return "", fmt.Errorf("sign token failed: %v", err)
+	}
+	return ss, nil
+}
+
+// sessionKey resolves the key of access, refresh and challenge tokens, the
+// admin and api key tokens keep their own secrets.
+func sessionKey(cfg config.IJwtConfig, keys IKeyStore, t *jwt.Token) (interface{}, error) {
+	if cfg.SigningMethod() != "HS256" {
+		if keys == nil || !keys.asymmetric() {
+			return nil, fmt.Errorf("signing keys are not loaded")
+		}
+		return keys.verifyKey(t)
+	}
+	if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
+		return nil, fmt.Errorf("signing method is invalid")
+	}
+	return cfg.SecretKey(), nil
 }
 
-func (a *ecomAdmin) SignToken() string {
+func (a *ecomAdmin) SignToken() (string, error) {
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, a.mapClaims)
-	ss, _ := token.SignedString(a.cfg.AdminKey())
-	return ss
+	ss, err := token.SignedString(a.cfg.AdminKey())
+	if err != nil {
+		return "", fmt.Errorf("sign token failed: %v", err)
+	}
+	return ss, nil
 }
 
-func (a *ecomApiKey) SignToken() string {
+func (a *ecomApiKey) SignToken() (string, error) {
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, a.mapClaims)
-	ss, _ := token.SignedString(a.cfg.ApiKey())
-	return ss
+	ss, err := token.SignedString(a.cfg.ApiKey())
+	if err != nil {
+		return "", fmt.Errorf("sign token failed: %v", err)
+	}
+	return ss, nil
 }
 
-func ParseToken(cfg config.IJwtConfig, tokenString string) (*ecomMapClaims, error) {
+func ParseToken(cfg config.IJwtConfig, keys IKeyStore, tokenString string) (*ecomMapClaims, error) {
 	token, err := jwt.ParseWithClaims(tokenString, &ecomMapClaims{}, func(t *jwt.Token) (interface{}, error) {
-		if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("signing method is invalid")
-		}
-		return cfg.SecretKey(), nil
+		return sessionKey(cfg, keys, t)
 	})
 	if err != nil {
 		if errors.Is(err, jwt.ErrTokenMalformed) {
@@ -94,6 +136,31 @@ func ParseToken(cfg config.IJwtConfig, tokenString string) (*ecomMapClaims, erro
 	}
 
 	if claims, ok := token.Claims.(*ecomMapClaims); ok {
+		// A challenge is signed with the same secret but must never pass as a session
+		if claims.Subject == "challenge-token" {
+			return nil, fmt.Errorf("token type is invalid")
+		}
+		return claims, nil
+	} else {
+		return nil, fmt.Errorf("claims type is invalid")
+	}
+}
+
+func ParseChallengeToken(cfg config.IJwtConfig, keys IKeyStore, tokenString string) (*ecomMapClaims, error) {
+	token, err := jwt.ParseWithClaims(tokenString, &ecomMapClaims{}, func(t *jwt.Token) (interface{}, error) {
+		return sessionKey(cfg, keys, t)
+	})
+	if err != nil {
+		if errors.Is(err, jwt.ErrTokenMalformed) {
+			return nil, fmt.Errorf("token format is invalid")
+		} else if errors.Is(err, jwt.ErrTokenExpired) {
+			return nil, fmt.Errorf("token has expired")
+		} else {
+			return nil, fmt.Errorf("parse token failed: %v", err)
+		}
+	}
+
+	if claims, ok := token.Claims.(*ecomMapClaims); ok && claims.Subject == "challenge-token" {
 		return claims, nil
 	} else {
 		return nil, fmt.Errorf("claims type is invalid")
@@ -148,15 +215,17 @@ func ParseApiKey(cfg config.IJwtConfig, tokenString string) (*ecomMapClaims, err
 	}
 }
 
-func RepeatToken(cfg config.IJwtConfig, claims *users.UserClaims, exp int64) string {
+func RepeatToken(cfg config.IJwtConfig, keys IKeyStore, claims *users.UserClaims, exp int64) (string, error) {
 	obj := &ecomAuth{
-		cfg: cfg,
+		cfg:  cfg,
+		keys: keys,
 		mapClaims: &ecomMapClaims{
 			Claims: claims,
 			RegisteredClaims: jwt.RegisteredClaims{
 				Issuer:    "ecommerce-api",
 				Subject:   "refresh-token",
 				Audience:  []string{"customer", "admin"},
+				ID:        newTokenId(),
 				ExpiresAt: jwtTimeRepeatAdapter(exp),
 				NotBefore: jwt.NewNumericDate(time.Now()),
 				IssuedAt:  jwt.NewNumericDate(time.Now()),
@@ -166,24 +235,31 @@ func RepeatToken(cfg config.IJwtConfig, claims *users.UserClaims, exp int64) str
 	return obj.SignToken()
 }
 
-func NewEcomAuth(tokenType TokenType, cfg config.IJwtConfig, claims *users.UserClaims) (IEcomAuth, error) {
+// NewEcomAuth builds a token of tokenType, keys signs the session tokens when
+// an asymmetric method is configured.
+func NewEcomAuth(tokenType TokenType, cfg config.IJwtConfig, keys IKeyStore, claims *users.UserClaims) (IEcomAuth, error) {
 	switch tokenType {
 	case Access:
-		return newAccessToken(cfg, claims), nil
+		return newAccessToken(cfg, keys, claims), nil
 	case Refresh:
-		return newRefreshToken(cfg, claims), nil
+		return newRefreshToken(cfg, keys, claims), nil
 	case Admin:
 		return newAdminToken(cfg), nil
 	case ApiKey:
 		return newApiKey(cfg), nil
+	case Challenge:
+		return newChallengeToken(cfg, keys, claims), nil
+	case Impersonation:
+		return newImpersonationToken(cfg, keys, claims), nil
 	default:
 		return nil, fmt.Errorf("unknown token type")
 	}
 }
 
-func newAccessToken(cfg config.IJwtConfig, claims *users.UserClaims) IEcomAuth {
+func newAccessToken(cfg config.IJwtConfig, keys IKeyStore, claims *users.UserClaims) IEcomAuth {
 	return &ecomAuth{
-		cfg: cfg,
+		cfg:  cfg,
+		keys: keys,
 		mapClaims: &ecomMapClaims{
 			Claims: claims,
 			RegisteredClaims: jwt.RegisteredClaims{
@@ -198,15 +274,17 @@ func newAccessToken(cfg config.IJwtConfig, claims *users.UserClaims) IEcomAuth {
 	}
 }
 
-func newRefreshToken(cfg config.IJwtConfig, claims *users.UserClaims) IEcomAuth {
+func newRefreshToken(cfg config.IJwtConfig, keys IKeyStore, claims *users.UserClaims) IEcomAuth {
 	return &ecomAuth{
-		cfg: cfg,
+		cfg:  cfg,
+		keys: keys,
 		mapClaims: &ecomMapClaims{
 			Claims: claims,
 			RegisteredClaims: jwt.RegisteredClaims{
 				Issuer:    "ecommerce-api",
 				Subject:   "refresh-token",
 				Audience:  []string{"customer", "admin"},
+				ID:        newTokenId(),
 				ExpiresAt: jwtTimeDurationCal(cfg.RefreshExpiresAt()),
 				NotBefore: jwt.NewNumericDate(time.Now()),
 				IssuedAt:  jwt.NewNumericDate(time.Now()),
@@ -252,3 +330,43 @@ func newApiKey(cfg config.IJwtConfig) IEcomAuth {
 		},
 	}
 }
+
+// newChallengeToken proves the password step of a two-factor sign in, it is
+// exchanged for a passport once the second factor is verified.
+func newChallengeToken(cfg config.IJwtConfig, keys IKeyStore, claims *users.UserClaims) IEcomAuth {
+	return &ecomAuth{
+		cfg:  cfg,
+		keys: keys,
+		mapClaims: &ecomMapClaims{
+			Claims: claims,
+			RegisteredClaims: jwt.RegisteredClaims{
+				Issuer:    "ecommerce-api",
+				Subject:   "challenge-token",
+				Audience:  []string{"customer", "admin"},
+				ExpiresAt: jwtTimeDurationCal(300), // 5 min
+				NotBefore: jwt.NewNumericDate(time.Now()),
+				IssuedAt:  jwt.NewNumericDate(time.Now()),
+			},
+		},
+	}
+}
+
+// newImpersonationToken passes as an access token of the user in claims, the
+// impersonator claim tells it apart and it expires much sooner.
+func newImpersonationToken(cfg config.IJwtConfig, keys IKeyStore, claims *users.UserClaims) IEcomAuth {
+	return &ecomAuth{
+		cfg:  cfg,
+		keys: keys,
+		mapClaims: &ecomMapClaims{
+			Claims: claims,
+			RegisteredClaims: jwt.RegisteredClaims{
+				Issuer:    "ecommerce-api",
+				Subject:   "access-token",
+				Audience:  []string{"customer", "admin"},
+				ExpiresAt: jwt.NewNumericDate(time.Now().Add(cfg.ImpersonationExpires())),
+				NotBefore: jwt.NewNumericDate(time.Now()),
+				IssuedAt:  jwt.NewNumericDate(time.Now()),
+			},
+		},
+	}
+}
@@ -0,0 +1,353 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"log"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/codepnw/ecommerce/config"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+type IKeyStore interface {
+	Rotate() error
+	JWKS() *JWKSet
+	Run(ctx context.Context)
+	asymmetric() bool
+	sign(claims jwt.Claims) (string, error)
+	verifyKey(t *jwt.Token) (interface{}, error)
+}
+
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+type JWKSet struct {
+	Keys []*JWK `json:"keys"`
+}
+
+type signingKey struct {
+	kid       string
+	private   crypto.Signer
+	createdAt time.Time
+}
+
+// keyStore keeps the signing keys as pem files in the keys directory so every
+// instance sharing it signs with the same active key. The newest key signs,
+// older keys only verify until the grace period after their replacement ends.
+type keyStore struct {
+	cfg        config.IJwtConfig
+	method     jwt.SigningMethod
+	mu         sync.RWMutex
+	keys       []*signingKey // newest first
+	lastReload time.Time
+}
+
+// NewKeyStore loads the keys for the configured signing method, the store is
+// handed to NewEcomAuth and ParseToken. HS256 needs no keys, the store then
+// serves an empty key set.
+func NewKeyStore(cfg config.IJwtConfig) (IKeyStore, error) {
+	ks := &keyStore{cfg: cfg}
+	switch cfg.SigningMethod() {
+	case "HS256":
+		return ks, nil
+	case "RS256":
+		ks.method = jwt.SigningMethodRS256
+	case "EdDSA":
+		ks.method = jwt.SigningMethodEdDSA
+	default:
+		return nil, fmt.Errorf("signing method %s is not supported", cfg.SigningMethod())
+	}
+
+	if err := os.MkdirAll(cfg.KeysDir(), 0700); err != nil {
+		return nil, fmt.Errorf("create keys dir failed: %v", err)
+	}
+	if err := ks.reload(); err != nil {
+		return nil, err
+	}
+	if err := ks.ensureActive(); err != nil {
+		return nil, err
+	}
+	return ks, nil
+}
+
+func (ks *keyStore) asymmetric() bool {
+	return ks.method != nil
+}
+
+// Run rotates the active key on schedule and picks up keys created by other
+// instances until ctx is cancelled.
+func (ks *keyStore) Run(ctx context.Context) {
+	if !ks.asymmetric() {
+		return
+	}
+
+	interval := ks.cfg.KeyRotation() / 4
+	if interval > time.Hour || interval <= 0 {
+		interval = time.Hour
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := ks.reload(); err != nil {
+				log.Printf("reload signing keys failed: %v\n", err)
+				continue
+			}
+			if err := ks.ensureActive(); err != nil {
+				log.Printf("rotate signing key failed: %v\n", err)
+			}
+		}
+	}
+}
+
+// Rotate makes a new key active right away, the previous key keeps verifying
+// for the grace period.
+func (ks *keyStore) Rotate() error {
+	if !ks.asymmetric() {
+		return fmt.Errorf("signing method %s has no keys to rotate", ks.cfg.SigningMethod())
+	}
+	return ks.generate()
+}
+
+func (ks *keyStore) JWKS() *JWKSet {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	set := &JWKSet{Keys: make([]*JWK, 0, len(ks.keys))}
+	for _, k := range ks.keys {
+		switch pub := k.private.Public().(type) {
+		case *rsa.PublicKey:
+			set.Keys = append(set.Keys, &JWK{
+				Kty: "RSA",
+				Kid: k.kid,
+				Use: "sig",
+				Alg: ks.method.Alg(),
+				N:   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+				E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+			})
+		case ed25519.PublicKey:
+			set.Keys = append(set.Keys, &JWK{
+				Kty: "OKP",
+				Kid: k.kid,
+				Use: "sig",
+				Alg: ks.method.Alg(),
+				Crv: "Ed25519",
+				X:   base64.RawURLEncoding.EncodeToString(pub),
+			})
+		}
+	}
+	return set
+}
+
+func (ks *keyStore) sign(claims jwt.Claims) (string, error) {
+	ks.mu.RLock()
+	if len(ks.keys) == 0 {
+		ks.mu.RUnlock()
+		return "", fmt.Errorf("no signing key")
+	}
+	active := ks.keys[0]
+	ks.mu.RUnlock()
+
+	token := jwt.NewWithClaims(ks.method, claims)
+	token.Header["kid"] = active.kid
+	return token.SignedString(active.private)
+}
+
+func (ks *keyStore) verifyKey(t *jwt.Token) (interface{}, error) {
+	if t.Method.Alg() != ks.method.Alg() {
+		return nil, fmt.Errorf("signing method is invalid")
+	}
+	kid, _ := t.Header["kid"].(string)
+	if kid == "" {
+		return nil, fmt.Errorf("kid is required")
+	}
+
+	if key := ks.find(kid); key != nil {
+		return key.private.Public(), nil
+	}
+
+	// Another instance may have rotated, look at the directory again but not
+	// more than once every few seconds
+	ks.mu.RLock()
+	recent := time.Since(ks.lastReload) < 10*time.Second
+	ks.mu.RUnlock()
+	if !recent {
+		if err := ks.reload(); err == nil {
+			if key := ks.find(kid); key != nil {
+				return key.private.Public(), nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("kid is unknown")
+}
+
+func (ks *keyStore) find(kid string) *signingKey {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	for _, k := range ks.keys {
+		if k.kid == kid {
+			return k
+		}
+	}
+	return nil
+}
+
+// reload reads every key of the configured method from the keys directory
+// and deletes the ones whose grace period is over.
+func (ks *keyStore) reload() error {
+	paths, err := filepath.Glob(filepath.Join(ks.cfg.KeysDir(), "*.pem"))
+	if err != nil {
+		return fmt.Errorf("list keys failed: %v", err)
+	}
+
+	loaded := make([]*signingKey, 0, len(paths))
+	for _, path := range paths {
+		key, err := ks.readKey(path)
+		if err != nil {
+			log.Printf("skip signing key %s: %v\n", path, err)
+			continue
+		}
+		loaded = append(loaded, key)
+	}
+	sort.Slice(loaded, func(i, j int) bool {
+		return loaded[i].createdAt.After(loaded[j].createdAt)
+	})
+
+	valid := make([]*signingKey, 0, len(loaded))
+	for i, key := range loaded {
+		if i > 0 && time.Since(loaded[i-1].createdAt) > ks.cfg.KeyGrace() {
+			if err := os.Remove(filepath.Join(ks.cfg.KeysDir(), key.kid+".pem")); err != nil && !os.IsNotExist(err) {
+				log.Printf("remove retired key %s failed: %v\n", key.kid, err)
+			}
+			continue
+		}
+		valid = append(valid, key)
+	}
+
+	ks.mu.Lock()
+	ks.keys = valid
+	ks.lastReload = time.Now()
+	ks.mu.Unlock()
+	return nil
+}
+
+func (ks *keyStore) readKey(path string) (*signingKey, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(raw)
+	if block == nil {
+		return nil, fmt.Errorf("pem is invalid")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	var private crypto.Signer
+	switch k := parsed.(type) {
+	case *rsa.PrivateKey:
+		if ks.method != jwt.SigningMethodRS256 {
+			return nil, fmt.Errorf("rsa key does not match %s", ks.method.Alg())
+		}
+		private = k
+	case ed25519.PrivateKey:
+		if ks.method != jwt.SigningMethodEdDSA {
+			return nil, fmt.Errorf("ed25519 key does not match %s", ks.method.Alg())
+		}
+		private = k
+	default:
+		return nil, fmt.Errorf("key type is not supported")
+	}
+
+	return &signingKey{
+		kid:       strings.TrimSuffix(filepath.Base(path), ".pem"),
+		private:   private,
+		createdAt: info.ModTime(),
+	}, nil
+}
+
+func (ks *keyStore) ensureActive() error {
+	ks.mu.RLock()
+	expired := len(ks.keys) == 0 || time.Since(ks.keys[0].createdAt) > ks.cfg.KeyRotation()
+	ks.mu.RUnlock()
+
+	if !expired {
+		return nil
+	}
+	return ks.generate()
+}
+
+func (ks *keyStore) generate() error {
+	var private crypto.Signer
+	switch ks.method {
+	case jwt.SigningMethodRS256:
+		k, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return fmt.Errorf("generate rsa key failed: %v", err)
+		}
+		private = k
+	default:
+		_, k, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return fmt.Errorf("generate ed25519 key failed: %v", err)
+		}
+		private = k
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return fmt.Errorf("marshal key failed: %v", err)
+	}
+
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	kid := time.Now().UTC().Format("20060102T150405Z") + "-" + hex.EncodeToString(suffix)
+
+	// Written aside and renamed so other instances never read half a key
+	path := filepath.Join(ks.cfg.KeysDir(), kid+".pem")
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		return fmt.Errorf("write key failed: %v", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("write key failed: %v", err)
+	}
+	log.Printf("signing key %s is active\n", kid)
+
+	return ks.reload()
+}
@@ -0,0 +1,75 @@
+package cache
+
+import (
+	"github.com/codepnw/ecommerce/config"
+)
+
+type Session struct {
+	UserId  string
+	OauthId string
+	RoleId  int
+}
+
+// IAuthCache is shared by the middlewares, which fill it, and by the modules
+// that change sessions or roles, which must invalidate it.
+type IAuthCache interface {
+	Permissions(roleId int) ([]string, bool)
+	SetPermissions(roleId int, permissions []string)
+	InvalidateRole(roleId int)
+	Session(tokenHash string) (*Session, bool)
+	SetSession(tokenHash string, session *Session)
+	InvalidateSession(oauthId string)
+	InvalidateUser(userId string)
+	Stats() map[string]*Stats
+}
+
+type authCache struct {
+	roles    *Cache[int, []string]
+	sessions *Cache[string, *Session] // by access token digest
+}
+
+func NewAuthCache(cfg config.ICacheConfig) IAuthCache {
+	return &authCache{
+		roles:    New[int, []string](cfg.RoleTTL()),
+		sessions: New[string, *Session](cfg.TokenTTL()),
+	}
+}
+
+func (c *authCache) Permissions(roleId int) ([]string, bool) {
+	return c.roles.Get(roleId)
+}
+
+func (c *authCache) SetPermissions(roleId int, permissions []string) {
+	c.roles.Set(roleId, permissions)
+}
+
+func (c *authCache) InvalidateRole(roleId int) {
+	c.roles.Delete(roleId)
+}
+
+func (c *authCache) Session(tokenHash string) (*Session, bool) {
+	return c.sessions.Get(tokenHash)
+}
+
+func (c *authCache) SetSession(tokenHash string, session *Session) {
+	c.sessions.Set(tokenHash, session)
+}
+
+func (c *authCache) InvalidateSession(oauthId string) {
+	c.sessions.DeleteFunc(func(_ string, s *Session) bool {
+		return s.OauthId == oauthId
+	})
+}
+
+func (c *authCache) InvalidateUser(userId string) {
+	c.sessions.DeleteFunc(func(_ string, s *Session) bool {
+		return s.UserId == userId
+	})
+}
+
+func (c *authCache) Stats() map[string]*Stats {
+	return map[string]*Stats{
+		"roles":    c.roles.Stats(),
+		"sessions": c.sessions.Stats(),
+	}
+}
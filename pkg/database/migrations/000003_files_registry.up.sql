@@ -0,0 +1,21 @@
+BEGIN;
+
+CREATE TABLE "files" (
+  "id" uuid NOT NULL UNIQUE PRIMARY KEY DEFAULT uuid_generate_v4(),
+  "filename" VARCHAR NOT NULL,
+  "destination" VARCHAR UNIQUE NOT NULL,
+  "url" VARCHAR NOT NULL,
+  "owner_id" VARCHAR,
+  "purpose" VARCHAR NOT NULL DEFAULT 'general',
+  "ref_count" INT NOT NULL DEFAULT 0,
+  "created_at" TIMESTAMP NOT NULL DEFAULT NOW(),
+  "updated_at" TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX "files_url_idx" ON "files" ("url");
+
+ALTER TABLE "files" ADD FOREIGN KEY ("owner_id") REFERENCES "users" ("id") ON DELETE SET NULL;
+
+CREATE TRIGGER set_updated_at_timestamp_files_table BEFORE UPDATE ON "files" FOR EACH ROW EXECUTE PROCEDURE set_updated_at_column();
+
+COMMIT;
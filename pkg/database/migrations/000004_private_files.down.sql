@@ -0,0 +1,5 @@
+BEGIN;
+
+ALTER TABLE "files" DROP COLUMN IF EXISTS "is_private";
+
+COMMIT;
@@ -0,0 +1,5 @@
+BEGIN;
+
+ALTER TABLE "files" ADD COLUMN "is_private" BOOLEAN NOT NULL DEFAULT FALSE;
+
+COMMIT;
@@ -0,0 +1,10 @@
+BEGIN;
+
+DROP TRIGGER IF EXISTS set_updated_at_timestamp_uploads_table ON "uploads";
+
+DROP TABLE IF EXISTS "upload_parts" CASCADE;
+DROP TABLE IF EXISTS "uploads" CASCADE;
+
+DROP TYPE IF EXISTS "upload_status";
+
+COMMIT;
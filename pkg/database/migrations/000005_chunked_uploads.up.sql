@@ -0,0 +1,37 @@
+BEGIN;
+
+CREATE TYPE "upload_status" AS ENUM (
+    'pending',
+    'completed',
+    'aborted'
+);
+
+CREATE TABLE "uploads" (
+  "id" uuid NOT NULL UNIQUE PRIMARY KEY DEFAULT uuid_generate_v4(),
+  "owner_id" VARCHAR NOT NULL,
+  "filename" VARCHAR NOT NULL,
+  "destination" VARCHAR NOT NULL,
+  "purpose" VARCHAR NOT NULL DEFAULT 'general',
+  "total_size" BIGINT NOT NULL,
+  "part_size" BIGINT NOT NULL,
+  "checksum" VARCHAR NOT NULL DEFAULT '',
+  "status" upload_status NOT NULL DEFAULT 'pending',
+  "created_at" TIMESTAMP NOT NULL DEFAULT NOW(),
+  "updated_at" TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE "upload_parts" (
+  "upload_id" uuid NOT NULL,
+  "part_number" INT NOT NULL,
+  "size" BIGINT NOT NULL,
+  "checksum" VARCHAR NOT NULL,
+  "created_at" TIMESTAMP NOT NULL DEFAULT NOW(),
+  PRIMARY KEY ("upload_id", "part_number")
+);
+
+ALTER TABLE "uploads" ADD FOREIGN KEY ("owner_id") REFERENCES "users" ("id") ON DELETE CASCADE;
+ALTER TABLE "upload_parts" ADD FOREIGN KEY ("upload_id") REFERENCES "uploads" ("id") ON DELETE CASCADE;
+
+CREATE TRIGGER set_updated_at_timestamp_uploads_table BEFORE UPDATE ON "uploads" FOR EACH ROW EXECUTE PROCEDURE set_updated_at_column();
+
+COMMIT;
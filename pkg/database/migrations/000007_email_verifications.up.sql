@@ -0,0 +1,19 @@
+BEGIN;
+
+ALTER TABLE "users" ADD COLUMN "email_verified_at" TIMESTAMP;
+
+-- Accounts created before verification existed are trusted as they are
+UPDATE "users" SET "email_verified_at" = NOW();
+
+CREATE TABLE "email_verifications" (
+  "id" uuid NOT NULL UNIQUE PRIMARY KEY DEFAULT uuid_generate_v4(),
+  "user_id" VARCHAR NOT NULL,
+  "token_hash" VARCHAR UNIQUE NOT NULL,
+  "expires_at" TIMESTAMP NOT NULL,
+  "used_at" TIMESTAMP,
+  "created_at" TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+ALTER TABLE "email_verifications" ADD FOREIGN KEY ("user_id") REFERENCES "users" ("id") ON DELETE CASCADE;
+
+COMMIT;
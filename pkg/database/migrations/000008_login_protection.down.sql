@@ -0,0 +1,11 @@
+BEGIN;
+
+DROP TABLE IF EXISTS "audit_logs" CASCADE;
+DROP TABLE IF EXISTS "login_attempts" CASCADE;
+
+ALTER TABLE "users"
+  DROP COLUMN IF EXISTS "failed_attempts",
+  DROP COLUMN IF EXISTS "last_failed_at",
+  DROP COLUMN IF EXISTS "locked_until";
+
+COMMIT;
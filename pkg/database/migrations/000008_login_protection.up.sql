@@ -0,0 +1,33 @@
+BEGIN;
+
+ALTER TABLE "users"
+  ADD COLUMN "failed_attempts" INT NOT NULL DEFAULT 0,
+  ADD COLUMN "last_failed_at" TIMESTAMP,
+  ADD COLUMN "locked_until" TIMESTAMP;
+
+CREATE TABLE "login_attempts" (
+  "id" uuid NOT NULL UNIQUE PRIMARY KEY DEFAULT uuid_generate_v4(),
+  "email" VARCHAR NOT NULL,
+  "ip" VARCHAR NOT NULL,
+  "success" BOOLEAN NOT NULL,
+  "created_at" TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX ON "login_attempts" ("ip", "created_at");
+
+-- target_id has no foreign key so the trail survives the target being deleted
+CREATE TABLE "audit_logs" (
+  "id" uuid NOT NULL UNIQUE PRIMARY KEY DEFAULT uuid_generate_v4(),
+  "actor_id" VARCHAR,
+  "action" VARCHAR NOT NULL,
+  "target_id" VARCHAR,
+  "ip" VARCHAR,
+  "detail" jsonb NOT NULL DEFAULT '{}',
+  "created_at" TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+ALTER TABLE "audit_logs" ADD FOREIGN KEY ("actor_id") REFERENCES "users" ("id") ON DELETE SET NULL;
+
+CREATE INDEX ON "audit_logs" ("target_id", "created_at");
+
+COMMIT;
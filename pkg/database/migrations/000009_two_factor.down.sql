@@ -0,0 +1,10 @@
+BEGIN;
+
+DROP TABLE IF EXISTS "recovery_codes" CASCADE;
+
+ALTER TABLE "users"
+  DROP COLUMN IF EXISTS "totp_secret",
+  DROP COLUMN IF EXISTS "totp_enabled_at",
+  DROP COLUMN IF EXISTS "totp_last_step";
+
+COMMIT;
@@ -0,0 +1,20 @@
+BEGIN;
+
+ALTER TABLE "users"
+  ADD COLUMN "totp_secret" VARCHAR,
+  ADD COLUMN "totp_enabled_at" TIMESTAMP,
+  ADD COLUMN "totp_last_step" BIGINT;
+
+CREATE TABLE "recovery_codes" (
+  "id" uuid NOT NULL UNIQUE PRIMARY KEY DEFAULT uuid_generate_v4(),
+  "user_id" VARCHAR NOT NULL,
+  "code_hash" VARCHAR NOT NULL,
+  "used_at" TIMESTAMP,
+  "created_at" TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+ALTER TABLE "recovery_codes" ADD FOREIGN KEY ("user_id") REFERENCES "users" ("id") ON DELETE CASCADE;
+
+CREATE UNIQUE INDEX ON "recovery_codes" ("user_id", "code_hash");
+
+COMMIT;
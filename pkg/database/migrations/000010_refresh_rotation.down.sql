@@ -0,0 +1,10 @@
+BEGIN;
+
+DROP TABLE IF EXISTS "refresh_tokens" CASCADE;
+
+-- Digests cannot be turned back into tokens, every session has to sign in again
+DELETE FROM "oauth";
+
+ALTER TABLE "oauth" DROP COLUMN IF EXISTS "family_id";
+
+COMMIT;
@@ -0,0 +1,21 @@
+BEGIN;
+
+ALTER TABLE "oauth" ADD COLUMN "family_id" uuid NOT NULL UNIQUE DEFAULT uuid_generate_v4();
+
+-- Refresh tokens are kept as sha256 digests from now on, existing sessions stay valid
+UPDATE "oauth" SET "refresh_token" = encode(sha256("refresh_token"::bytea), 'hex');
+
+CREATE TABLE "refresh_tokens" (
+  "id" uuid NOT NULL UNIQUE PRIMARY KEY DEFAULT uuid_generate_v4(),
+  "family_id" uuid NOT NULL,
+  "token_hash" VARCHAR UNIQUE NOT NULL,
+  "rotated_at" TIMESTAMP,
+  "created_at" TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+ALTER TABLE "refresh_tokens" ADD FOREIGN KEY ("family_id") REFERENCES "oauth" ("family_id") ON DELETE CASCADE;
+
+INSERT INTO "refresh_tokens" ("family_id", "token_hash")
+SELECT "family_id", "refresh_token" FROM "oauth";
+
+COMMIT;
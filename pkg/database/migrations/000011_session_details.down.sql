@@ -0,0 +1,9 @@
+BEGIN;
+
+ALTER TABLE "oauth"
+  DROP COLUMN IF EXISTS "device",
+  DROP COLUMN IF EXISTS "ip",
+  DROP COLUMN IF EXISTS "user_agent",
+  DROP COLUMN IF EXISTS "last_used_at";
+
+COMMIT;
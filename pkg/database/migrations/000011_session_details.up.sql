@@ -0,0 +1,11 @@
+BEGIN;
+
+ALTER TABLE "oauth"
+  ADD COLUMN "device" VARCHAR NOT NULL DEFAULT 'unknown',
+  ADD COLUMN "ip" VARCHAR NOT NULL DEFAULT '',
+  ADD COLUMN "user_agent" VARCHAR NOT NULL DEFAULT '',
+  ADD COLUMN "last_used_at" TIMESTAMP NOT NULL DEFAULT NOW();
+
+UPDATE "oauth" SET "last_used_at" = "updated_at";
+
+COMMIT;
@@ -0,0 +1,8 @@
+BEGIN;
+
+DROP INDEX IF EXISTS "oauth_user_id_access_token_idx";
+
+ALTER TABLE "oauth" DROP CONSTRAINT IF EXISTS "oauth_access_token_digest";
+ALTER TABLE "oauth" DROP CONSTRAINT IF EXISTS "oauth_refresh_token_digest";
+
+COMMIT;
@@ -0,0 +1,11 @@
+BEGIN;
+
+-- Access tokens were stored as issued, those sessions have to sign in again
+DELETE FROM "oauth" WHERE "access_token" !~ '^[0-9a-f]{64}$';
+
+ALTER TABLE "oauth" ADD CONSTRAINT "oauth_access_token_digest" CHECK ("access_token" ~ '^[0-9a-f]{64}$');
+ALTER TABLE "oauth" ADD CONSTRAINT "oauth_refresh_token_digest" CHECK ("refresh_token" ~ '^[0-9a-f]{64}$');
+
+CREATE INDEX ON "oauth" ("user_id", "access_token");
+
+COMMIT;
@@ -0,0 +1,18 @@
+BEGIN;
+
+CREATE TABLE "api_keys" (
+  "id" uuid NOT NULL UNIQUE PRIMARY KEY DEFAULT uuid_generate_v4(),
+  "name" VARCHAR NOT NULL,
+  "owner_id" VARCHAR,
+  "prefix" VARCHAR NOT NULL,
+  "key_hash" VARCHAR UNIQUE NOT NULL,
+  "scopes" jsonb NOT NULL DEFAULT '["*"]',
+  "created_at" TIMESTAMP NOT NULL DEFAULT NOW(),
+  "last_used_at" TIMESTAMP,
+  "expires_at" TIMESTAMP,
+  "revoked_at" TIMESTAMP
+);
+
+ALTER TABLE "api_keys" ADD FOREIGN KEY ("owner_id") REFERENCES "users" ("id") ON DELETE SET NULL;
+
+COMMIT;
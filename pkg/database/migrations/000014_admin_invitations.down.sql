@@ -0,0 +1,5 @@
+BEGIN;
+
+DROP TABLE IF EXISTS "admin_invitations" CASCADE;
+
+COMMIT;
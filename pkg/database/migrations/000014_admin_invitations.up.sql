@@ -0,0 +1,20 @@
+BEGIN;
+
+CREATE TABLE "admin_invitations" (
+  "id" uuid NOT NULL UNIQUE PRIMARY KEY DEFAULT uuid_generate_v4(),
+  "email" VARCHAR NOT NULL,
+  "token_hash" VARCHAR UNIQUE NOT NULL,
+  "invited_by" VARCHAR,
+  "accepted_by" VARCHAR,
+  "expires_at" TIMESTAMP NOT NULL,
+  "accepted_at" TIMESTAMP,
+  "revoked_at" TIMESTAMP,
+  "created_at" TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+ALTER TABLE "admin_invitations" ADD FOREIGN KEY ("invited_by") REFERENCES "users" ("id") ON DELETE SET NULL;
+ALTER TABLE "admin_invitations" ADD FOREIGN KEY ("accepted_by") REFERENCES "users" ("id") ON DELETE SET NULL;
+
+CREATE INDEX ON "admin_invitations" ("email");
+
+COMMIT;
@@ -0,0 +1,6 @@
+BEGIN;
+
+DROP TABLE IF EXISTS "roles_permissions" CASCADE;
+DROP TABLE IF EXISTS "permissions" CASCADE;
+
+COMMIT;
@@ -0,0 +1,46 @@
+BEGIN;
+
+CREATE TABLE "permissions" (
+  "name" VARCHAR PRIMARY KEY,
+  "description" VARCHAR NOT NULL DEFAULT ''
+);
+
+CREATE TABLE "roles_permissions" (
+  "role_id" INT NOT NULL,
+  "permission" VARCHAR NOT NULL,
+  PRIMARY KEY ("role_id", "permission")
+);
+
+ALTER TABLE "roles_permissions" ADD FOREIGN KEY ("role_id") REFERENCES "roles" ("id") ON DELETE CASCADE;
+ALTER TABLE "roles_permissions" ADD FOREIGN KEY ("permission") REFERENCES "permissions" ("name") ON DELETE CASCADE;
+
+INSERT INTO "permissions" (
+  "name",
+  "description"
+)
+VALUES
+  ('products:write', 'Create and update products'),
+  ('products:delete', 'Delete products'),
+  ('categories:write', 'Create categories'),
+  ('categories:delete', 'Delete categories'),
+  ('orders:read_all', 'Read the orders of every user'),
+  ('orders:write_all', 'Update the orders of every user'),
+  ('files:write', 'Upload and delete files'),
+  ('users:manage', 'Manage the accounts and sessions of every user'),
+  ('admins:invite', 'Invite new admins'),
+  ('apikeys:manage', 'Create, list and revoke api keys'),
+  ('roles:manage', 'Create roles and change their permissions');
+
+-- Admins keep every permission they had through the role id
+INSERT INTO "roles_permissions" (
+  "role_id",
+  "permission"
+)
+SELECT
+  "r"."id",
+  "p"."name"
+FROM "roles" "r"
+CROSS JOIN "permissions" "p"
+WHERE "r"."title" = 'admin';
+
+COMMIT;
@@ -0,0 +1,27 @@
+BEGIN;
+
+CREATE TABLE "user_identities" (
+  "id" uuid NOT NULL UNIQUE PRIMARY KEY DEFAULT uuid_generate_v4(),
+  "user_id" VARCHAR NOT NULL,
+  "provider" VARCHAR NOT NULL,
+  "subject" VARCHAR NOT NULL,
+  "email" VARCHAR NOT NULL DEFAULT '',
+  "created_at" TIMESTAMP NOT NULL DEFAULT NOW(),
+  "last_login_at" TIMESTAMP NOT NULL DEFAULT NOW(),
+  UNIQUE ("provider", "subject")
+);
+
+ALTER TABLE "user_identities" ADD FOREIGN KEY ("user_id") REFERENCES "users" ("id") ON DELETE CASCADE;
+
+-- The pkce verifier and nonce stay on the server between the redirect to the
+-- provider and the callback, looked up by the digest of the state
+CREATE TABLE "oidc_states" (
+  "state_hash" VARCHAR PRIMARY KEY,
+  "provider" VARCHAR NOT NULL,
+  "code_verifier" VARCHAR NOT NULL,
+  "nonce" VARCHAR NOT NULL,
+  "expires_at" TIMESTAMP NOT NULL,
+  "created_at" TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+COMMIT;
@@ -0,0 +1,32 @@
+BEGIN;
+
+CREATE TABLE "addresses" (
+  "id" uuid NOT NULL UNIQUE PRIMARY KEY DEFAULT uuid_generate_v4(),
+  "user_id" VARCHAR NOT NULL,
+  "name" VARCHAR NOT NULL,
+  "phone" VARCHAR NOT NULL,
+  "line1" VARCHAR NOT NULL,
+  "line2" VARCHAR NOT NULL DEFAULT '',
+  "district" VARCHAR NOT NULL,
+  "province" VARCHAR NOT NULL,
+  "postal_code" VARCHAR NOT NULL,
+  "country" VARCHAR NOT NULL,
+  "is_default" BOOLEAN NOT NULL DEFAULT FALSE,
+  "created_at" TIMESTAMP NOT NULL DEFAULT NOW(),
+  "updated_at" TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+ALTER TABLE "addresses" ADD FOREIGN KEY ("user_id") REFERENCES "users" ("id") ON DELETE CASCADE;
+
+CREATE INDEX "addresses_user_id_idx" ON "addresses" ("user_id");
+CREATE UNIQUE INDEX "addresses_user_id_default_key" ON "addresses" ("user_id") WHERE "is_default";
+
+CREATE TRIGGER set_updated_at_timestamp_addresses_table BEFORE UPDATE ON "addresses" FOR EACH ROW EXECUTE PROCEDURE set_updated_at_column();
+
+-- The address is copied onto the order when it is placed, later edits to the
+-- address book never change where an order was shipped
+ALTER TABLE "orders" ADD COLUMN "address_id" uuid;
+ALTER TABLE "orders" ADD COLUMN "shipping_address" jsonb;
+ALTER TABLE "orders" ADD FOREIGN KEY ("address_id") REFERENCES "addresses" ("id") ON DELETE SET NULL;
+
+COMMIT;
@@ -0,0 +1,8 @@
+BEGIN;
+
+DROP INDEX IF EXISTS "users_role_id_idx";
+
+ALTER TABLE "users" DROP COLUMN IF EXISTS "disabled_by";
+ALTER TABLE "users" DROP COLUMN IF EXISTS "disabled_at";
+
+COMMIT;
@@ -0,0 +1,10 @@
+BEGIN;
+
+ALTER TABLE "users" ADD COLUMN "disabled_at" TIMESTAMP;
+ALTER TABLE "users" ADD COLUMN "disabled_by" VARCHAR;
+
+ALTER TABLE "users" ADD FOREIGN KEY ("disabled_by") REFERENCES "users" ("id") ON DELETE SET NULL;
+
+CREATE INDEX "users_role_id_idx" ON "users" ("role_id");
+
+COMMIT;
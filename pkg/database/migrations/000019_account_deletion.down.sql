@@ -0,0 +1,13 @@
+BEGIN;
+
+DROP TABLE IF EXISTS "account_deletions" CASCADE;
+
+-- Orders of deleted accounts can't satisfy the old constraint
+DELETE FROM "orders" WHERE "user_id" IS NULL;
+
+ALTER TABLE "orders" DROP COLUMN IF EXISTS "anonymized_at";
+ALTER TABLE "orders" DROP CONSTRAINT IF EXISTS "orders_user_id_fkey";
+ALTER TABLE "orders" ALTER COLUMN "user_id" SET NOT NULL;
+ALTER TABLE "orders" ADD FOREIGN KEY ("user_id") REFERENCES "users" ("id") ON DELETE CASCADE;
+
+COMMIT;
@@ -0,0 +1,21 @@
+BEGIN;
+
+-- Orders are financial records and outlive the account, deleting a user now
+-- detaches its orders instead of deleting them
+ALTER TABLE "orders" DROP CONSTRAINT IF EXISTS "orders_user_id_fkey";
+ALTER TABLE "orders" ALTER COLUMN "user_id" DROP NOT NULL;
+ALTER TABLE "orders" ADD FOREIGN KEY ("user_id") REFERENCES "users" ("id") ON DELETE SET NULL;
+ALTER TABLE "orders" ADD COLUMN "anonymized_at" TIMESTAMP;
+
+CREATE TABLE "account_deletions" (
+  "id" uuid NOT NULL UNIQUE PRIMARY KEY DEFAULT uuid_generate_v4(),
+  "user_id" VARCHAR NOT NULL,
+  "token_hash" VARCHAR UNIQUE NOT NULL,
+  "expires_at" TIMESTAMP NOT NULL,
+  "used_at" TIMESTAMP,
+  "created_at" TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+ALTER TABLE "account_deletions" ADD FOREIGN KEY ("user_id") REFERENCES "users" ("id") ON DELETE CASCADE;
+
+COMMIT;
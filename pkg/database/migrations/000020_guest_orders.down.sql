@@ -0,0 +1,10 @@
+BEGIN;
+
+DELETE FROM "orders" WHERE "user_id" IS NULL AND "guest_email" IS NOT NULL;
+
+ALTER TABLE "orders" DROP COLUMN IF EXISTS "claimed_at";
+ALTER TABLE "orders" DROP COLUMN IF EXISTS "token_expires_at";
+ALTER TABLE "orders" DROP COLUMN IF EXISTS "token_hash";
+ALTER TABLE "orders" DROP COLUMN IF EXISTS "guest_email";
+
+COMMIT;
@@ -0,0 +1,13 @@
+BEGIN;
+
+-- Guest orders have no user, they are reached with the access token mailed
+-- to guest_email until it expires or a verified account with that email
+-- claims them
+ALTER TABLE "orders" ADD COLUMN "guest_email" VARCHAR;
+ALTER TABLE "orders" ADD COLUMN "token_hash" VARCHAR UNIQUE;
+ALTER TABLE "orders" ADD COLUMN "token_expires_at" TIMESTAMP;
+ALTER TABLE "orders" ADD COLUMN "claimed_at" TIMESTAMP;
+
+CREATE INDEX ON "orders" (LOWER("guest_email")) WHERE "user_id" IS NULL;
+
+COMMIT;
@@ -0,0 +1,8 @@
+BEGIN;
+
+DELETE FROM "oauth" WHERE "impersonator_id" IS NOT NULL;
+ALTER TABLE "oauth" DROP COLUMN IF EXISTS "impersonator_id";
+
+DELETE FROM "permissions" WHERE "name" = 'users:impersonate';
+
+COMMIT;
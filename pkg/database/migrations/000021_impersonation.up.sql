@@ -0,0 +1,24 @@
+BEGIN;
+
+-- Sessions an admin opened as the user, they end with the admin's account
+ALTER TABLE "oauth" ADD COLUMN "impersonator_id" VARCHAR;
+ALTER TABLE "oauth" ADD FOREIGN KEY ("impersonator_id") REFERENCES "users" ("id") ON DELETE CASCADE;
+
+INSERT INTO "permissions" (
+  "name",
+  "description"
+)
+VALUES
+  ('users:impersonate', 'Sign in as another user for support');
+
+INSERT INTO "roles_permissions" (
+  "role_id",
+  "permission"
+)
+SELECT
+  "r"."id",
+  'users:impersonate'
+FROM "roles" "r"
+WHERE "r"."title" = 'admin';
+
+COMMIT;
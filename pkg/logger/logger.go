@@ -28,6 +28,8 @@ type logger struct {
 	Query      any    `json:"query"`
 	Body       any    `json:"body"`
 	Response   any    `json:"response"`
+	// Impersonator is the admin behind an impersonated session
+	Impersonator string `json:"impersonator,omitempty"`
 }
 
 func InitLogger(c *fiber.Ctx, res any) ILogger {
@@ -38,6 +40,7 @@ func InitLogger(c *fiber.Ctx, res any) ILogger {
 		Path:       c.Path(),
 		StatusCode: c.Response().StatusCode(),
 	}
+	log.Impersonator, _ = c.Locals("impersonator").(string)
 	log.SetQuery(c)
 	log.SetBody(c)
 	log.SetResponse(res)
@@ -70,20 +73,70 @@ func (l *logger) SetQuery(c *fiber.Ctx) {
 	l.Query = body
 }
 
+// secretRoutes are the routes whose body or response carries a password, a
+// token or a key, a ":" segment matches any value.
+var secretRoutes = []string{
+	"/v1/users/signup",
+	"/v1/users/signin",
+	"/v1/users/refresh",
+	"/v1/users/signout",
+	"/v1/users/password/reset",
+	"/v1/users/verify-email",
+	"/v1/users/:user_id/password",
+	"/v1/users/2fa/verify",
+	"/v1/users/2fa/setup",
+	"/v1/users/:user_id/2fa",
+	"/v1/users/:user_id/2fa/enroll",
+	"/v1/users/:user_id/2fa/confirm",
+	"/v1/users/:user_id/2fa/recovery-codes",
+	"/v1/appinfo/apikeys",
+	"/v1/users/signup-admin",
+	"/v1/users/invitations",
+	"/v1/users/oauth/:provider/callback",
+	"/v1/users/deletion/confirm",
+	"/v1/orders/guest/lookup",
+	"/v1/users/:user_id/impersonate",
+}
+
+func isSecretRoute(path string) bool {
+	segments := strings.Split(strings.TrimSuffix(path, "/"), "/")
+	for _, route := range secretRoutes {
+		parts := strings.Split(route, "/")
+		if len(parts) != len(segments) {
+			continue
+		}
+		match := true
+		for i := range parts {
+			if !strings.HasPrefix(parts[i], ":") && parts[i] != segments[i] {
+				match = false
+				break
+			}
+		}
+		if match {
+			return true
+		}
+	}
+	return false
+}
+
 func (l *logger) SetBody(c *fiber.Ctx) {
 	var body any
 	if err := c.BodyParser(&body); err != nil {
 		log.Printf("body parser error: %v", err)
 	}
 
-	switch l.Path {
-	case "v1/users/signup":
+	if isSecretRoute(l.Path) {
 		l.Body = "never gonna give you up"
-	default:
-		l.Body = body
+		return
 	}
+	l.Body = body
 }
 
+// SetResponse keeps the errors of secret routes, they only carry a message.
 func (l *logger) SetResponse(res any) {
+	if isSecretRoute(l.Path) && l.StatusCode < fiber.StatusBadRequest {
+		l.Response = "never gonna give you up"
+		return
+	}
 	l.Response = res
 }
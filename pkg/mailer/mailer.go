@@ -0,0 +1,112 @@
+package mailer
+
+import (
+	"fmt"
+	"log"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/codepnw/ecommerce/config"
+	"github.com/codepnw/ecommerce/pkg/utils"
+)
+
+type Message struct {
+	To      string `json:"to"`
+	Subject string `json:"subject"`
+	Body    string `json:"body"`
+}
+
+type IMailer interface {
+	Send(msg *Message) error
+}
+
+type logMailer struct {
+	from string
+}
+
+type fileMailer struct {
+	from string
+	path string
+	mu   sync.Mutex
+}
+
+type smtpMailer struct {
+	cfg config.IMailConfig
+}
+
+func NewMailer(cfg config.IMailConfig) IMailer {
+	switch cfg.Driver() {
+	case "file":
+		path := cfg.FilePath()
+		if path == "" {
+			path = "./assets/mails/outbox.txt"
+		}
+		return &fileMailer{
+			from: cfg.From(),
+			path: path,
+		}
+	case "smtp":
+		return &smtpMailer{cfg: cfg}
+	default:
+		return &logMailer{from: cfg.From()}
+	}
+}
+
+func (m *logMailer) Send(msg *Message) error {
+	log.Printf("mail from: %s to: %s subject: %s\n%s\n", m.from, msg.To, msg.Subject, msg.Body)
+	return nil
+}
+
+// Every message is appended as one json line so tests can read them back.
+func (m *fileMailer) Send(msg *Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(m.path), 0777); err != nil {
+		return fmt.Errorf("mkdir \"%s\" failed: %v", filepath.Dir(m.path), err)
+	}
+
+	file, err := os.OpenFile(m.path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+	if err != nil {
+		return fmt.Errorf("open mail file failed: %v", err)
+	}
+	defer file.Close()
+
+	data := utils.Output(&struct {
+		Time string `json:"time"`
+		From string `json:"from"`
+		*Message
+	}{
+		Time:    time.Now().Format("2006-01-02 15:04:05"),
+		From:    m.from,
+		Message: msg,
+	})
+	if _, err := file.WriteString(string(data) + "\n"); err != nil {
+		return fmt.Errorf("write mail file failed: %v", err)
+	}
+	return nil
+}
+
+func (m *smtpMailer) Send(msg *Message) error {
+	addr := fmt.Sprintf("%s:%d", m.cfg.SmtpHost(), m.cfg.SmtpPort())
+	auth := smtp.PlainAuth("", m.cfg.SmtpUsername(), m.cfg.SmtpPassword(), m.cfg.SmtpHost())
+
+	body := strings.Join([]string{
+		"From: " + m.cfg.From(),
+		"To: " + msg.To,
+		"Subject: " + msg.Subject,
+		"MIME-Version: 1.0",
+		"Content-Type: text/plain; charset=\"utf-8\"",
+		"",
+		msg.Body,
+	}, "\r\n")
+
+	if err := smtp.SendMail(addr, auth, m.cfg.From(), []string{msg.To}, []byte(body)); err != nil {
+		return fmt.Errorf("send mail failed: %v", err)
+	}
+	return nil
+}
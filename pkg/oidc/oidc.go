@@ -0,0 +1,337 @@
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/codepnw/ecommerce/config"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Identity is what a provider asserts about the user in its id token.
+type Identity struct {
+	Provider      string
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+}
+
+type IRegistry interface {
+	Provider(name string) (IProvider, error)
+}
+
+// IProvider runs the authorization code flow with PKCE against one OpenID
+// Connect provider, its endpoints come from the discovery document of the
+// issuer so any compliant server, a local mock included, can be plugged in.
+type IProvider interface {
+	AuthCodeURL(ctx context.Context, state, nonce, verifier string) (string, error)
+	Exchange(ctx context.Context, code, verifier, nonce string) (*Identity, error)
+}
+
+type registry struct {
+	cfg       config.IOidcConfig
+	mu        sync.Mutex
+	providers map[string]*provider
+}
+
+func NewRegistry(cfg config.IOidcConfig) IRegistry {
+	return &registry{
+		cfg:       cfg,
+		providers: make(map[string]*provider),
+	}
+}
+
+func (r *registry) Provider(name string) (IProvider, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if p, ok := r.providers[name]; ok {
+		return p, nil
+	}
+	cfg, ok := r.cfg.Provider(name)
+	if !ok {
+		return nil, fmt.Errorf("provider %s is not supported", name)
+	}
+	p := &provider{
+		cfg:    cfg,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+	r.providers[name] = p
+	return p, nil
+}
+
+type discovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JwksUri               string `json:"jwks_uri"`
+}
+
+type provider struct {
+	cfg    config.IOidcProviderConfig
+	client *http.Client
+
+	mu         sync.Mutex
+	discovery  *discovery
+	keys       map[string]any
+	keysLoaded time.Time
+}
+
+// NewVerifier returns a PKCE code verifier, the client keeps it until the
+// code is exchanged.
+func NewVerifier() (string, error) {
+	return randString(32)
+}
+
+func NewNonce() (string, error) {
+	return randString(16)
+}
+
+func randString(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("generate random failed: %v", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// Challenge is the S256 code challenge of a verifier.
+func Challenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func (p *provider) AuthCodeURL(ctx context.Context, state, nonce, verifier string) (string, error) {
+	d, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	params := url.Values{}
+	params.Set("response_type", "code")
+	params.Set("client_id", p.cfg.ClientId())
+	params.Set("redirect_uri", p.cfg.RedirectUrl())
+	params.Set("scope", strings.Join(p.cfg.Scopes(), " "))
+	params.Set("state", state)
+	params.Set("nonce", nonce)
+	params.Set("code_challenge", Challenge(verifier))
+	params.Set("code_challenge_method", "S256")
+
+	sep := "?"
+	if strings.Contains(d.AuthorizationEndpoint, "?") {
+		sep = "&"
+	}
+	return d.AuthorizationEndpoint + sep + params.Encode(), nil
+}
+
+func (p *provider) Exchange(ctx context.Context, code, verifier, nonce string) (*Identity, error) {
+	d, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.cfg.RedirectUrl())
+	form.Set("client_id", p.cfg.ClientId())
+	form.Set("code_verifier", verifier)
+	if p.cfg.ClientSecret() != "" {
+		form.Set("client_secret", p.cfg.ClientSecret())
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, fmt.Errorf("new token request failed: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	res, err := p.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("exchange code failed: %v", err)
+	}
+	defer res.Body.Close()
+
+	body := &struct {
+		IdToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}{}
+	if err := json.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(body); err != nil {
+		return nil, fmt.Errorf("decode token response failed: %v", err)
+	}
+	if res.StatusCode != http.StatusOK || body.Error != "" {
+		return nil, fmt.Errorf("code is invalid: %s %s", body.Error, body.ErrorDescription)
+	}
+	if body.IdToken == "" {
+		return nil, fmt.Errorf("id token is missing")
+	}
+
+	return p.verify(ctx, body.IdToken, d.Issuer, nonce)
+}
+
+type idClaims struct {
+	jwt.RegisteredClaims
+	Nonce             string `json:"nonce"`
+	Email             string `json:"email"`
+	EmailVerified     any    `json:"email_verified"` // some providers send a string
+	Name              string `json:"name"`
+	PreferredUsername string `json:"preferred_username"`
+}
+
+// verify checks the id token against the issuer exactly as discovered, some
+// providers end it with a slash.
+func (p *provider) verify(ctx context.Context, idToken, issuer, nonce string) (*Identity, error) {
+	claims := new(idClaims)
+	_, err := jwt.ParseWithClaims(
+		idToken,
+		claims,
+		func(t *jwt.Token) (interface{}, error) {
+			kid, _ := t.Header["kid"].(string)
+			return p.key(ctx, kid)
+		},
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "ES256", "ES384", "ES512"}),
+		jwt.WithIssuer(issuer),
+		jwt.WithAudience(p.cfg.ClientId()),
+		jwt.WithLeeway(time.Minute),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("id token is invalid: %v", err)
+	}
+	if claims.ExpiresAt == nil {
+		return nil, fmt.Errorf("id token is invalid: exp is required")
+	}
+	if claims.Nonce != nonce {
+		return nil, fmt.Errorf("id token is invalid: nonce does not match")
+	}
+	if claims.Subject == "" {
+		return nil, fmt.Errorf("id token is invalid: sub is required")
+	}
+
+	identity := &Identity{
+		Provider: p.cfg.Name(),
+		Subject:  claims.Subject,
+		Email:    strings.TrimSpace(claims.Email),
+		Name:     claims.Name,
+	}
+	switch v := claims.EmailVerified.(type) {
+	case bool:
+		identity.EmailVerified = v
+	case string:
+		identity.EmailVerified = v == "true"
+	}
+	if identity.Name == "" {
+		identity.Name = claims.PreferredUsername
+	}
+	return identity, nil
+}
+
+func (p *provider) discover(ctx context.Context) (*discovery, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.discovery != nil {
+		return p.discovery, nil
+	}
+
+	d := new(discovery)
+	if err := p.getJson(ctx, p.cfg.Issuer()+"/.well-known/openid-configuration", d); err != nil {
+		return nil, fmt.Errorf("discover %s failed: %v", p.cfg.Name(), err)
+	}
+	if strings.TrimSuffix(d.Issuer, "/") != p.cfg.Issuer() {
+		return nil, fmt.Errorf("discover %s failed: issuer %s does not match", p.cfg.Name(), d.Issuer)
+	}
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JwksUri == "" {
+		return nil, fmt.Errorf("discover %s failed: endpoints are missing", p.cfg.Name())
+	}
+	p.discovery = d
+	return d, nil
+}
+
+// key finds the verification key by kid, the key set is fetched again when a
+// kid is unknown since providers rotate, but not more than once a minute.
+func (p *provider) key(ctx context.Context, kid string) (any, error) {
+	p.mu.Lock()
+	key, ok := p.keys[kid]
+	fresh := time.Since(p.keysLoaded) < time.Minute
+	p.mu.Unlock()
+
+	if ok {
+		return key, nil
+	}
+	if !fresh {
+		if err := p.loadKeys(ctx); err != nil {
+			return nil, err
+		}
+		p.mu.Lock()
+		key, ok = p.keys[kid]
+		p.mu.Unlock()
+		if ok {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("kid %s is unknown", kid)
+}
+
+func (p *provider) loadKeys(ctx context.Context) error {
+	d, err := p.discover(ctx)
+	if err != nil {
+		return err
+	}
+
+	set := &struct {
+		Keys []*jwk `json:"keys"`
+	}{}
+	if err := p.getJson(ctx, d.JwksUri, set); err != nil {
+		return fmt.Errorf("load %s keys failed: %v", p.cfg.Name(), err)
+	}
+
+	keys := make(map[string]any, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		public, err := k.publicKey()
+		if err != nil {
+			continue
+		}
+		keys[k.Kid] = public
+	}
+
+	p.mu.Lock()
+	p.keys = keys
+	p.keysLoaded = time.Now()
+	p.mu.Unlock()
+	return nil
+}
+
+func (p *provider) getJson(ctx context.Context, url string, dest any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	res, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s responded %d", url, res.StatusCode)
+	}
+	return json.NewDecoder(io.LimitReader(res.Body, 1<<20)).Decode(dest)
+}
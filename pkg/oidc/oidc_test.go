@@ -0,0 +1,136 @@
+package oidc
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/codepnw/ecommerce/config"
+)
+
+// The flow runs against the mock started by `make oidcmock`, the test is
+// skipped when it isn't up.
+const mockIssuer = "http://localhost:8090/default"
+
+type mockOidcConfig struct {
+	issuer string
+}
+
+func (c *mockOidcConfig) StateExpires() time.Duration { return 10 * time.Minute }
+func (c *mockOidcConfig) Provider(name string) (config.IOidcProviderConfig, bool) {
+	if name != "mock" {
+		return nil, false
+	}
+	return c, true
+}
+func (c *mockOidcConfig) Name() string         { return "mock" }
+func (c *mockOidcConfig) Issuer() string       { return c.issuer }
+func (c *mockOidcConfig) ClientId() string     { return "ecommerce" }
+func (c *mockOidcConfig) ClientSecret() string { return "secret" }
+func (c *mockOidcConfig) RedirectUrl() string  { return "http://localhost:3000/oidc/callback" }
+func (c *mockOidcConfig) Scopes() []string     { return []string{"openid", "email", "profile"} }
+
+func mockProvider(t *testing.T) IProvider {
+	t.Helper()
+
+	issuer := os.Getenv("OIDC_MOCK_ISSUER")
+	if issuer == "" {
+		issuer = mockIssuer
+	}
+	client := &http.Client{Timeout: 2 * time.Second}
+	res, err := client.Get(issuer + "/.well-known/openid-configuration")
+	if err != nil {
+		t.Skipf("oidc mock is unreachable: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Skipf("oidc mock responded %d", res.StatusCode)
+	}
+
+	p, err := NewRegistry(&mockOidcConfig{issuer: issuer}).Provider("mock")
+	if err != nil {
+		t.Fatalf("provider: %v", err)
+	}
+	return p
+}
+
+// authorize follows the authorization url the way a browser would and
+// returns the code and state the mock redirects back with.
+func authorize(t *testing.T, p IProvider, state, nonce, verifier string) (string, string) {
+	t.Helper()
+
+	authUrl, err := p.AuthCodeURL(context.Background(), state, nonce, verifier)
+	if err != nil {
+		t.Fatalf("auth code url: %v", err)
+	}
+
+	client := &http.Client{
+		Timeout: 5 * time.Second,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	res, err := client.Get(authUrl)
+	if err != nil {
+		t.Fatalf("authorize: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusFound {
+		t.Fatalf("authorize responded %d, want %d", res.StatusCode, http.StatusFound)
+	}
+
+	location, err := url.Parse(res.Header.Get("Location"))
+	if err != nil {
+		t.Fatalf("parse redirect: %v", err)
+	}
+	return location.Query().Get("code"), location.Query().Get("state")
+}
+
+func TestAuthorizeCallback(t *testing.T) {
+	p := mockProvider(t)
+
+	verifier, err := NewVerifier()
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce, err := NewNonce()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code, state := authorize(t, p, "state-1", nonce, verifier)
+	if state != "state-1" {
+		t.Fatalf("state = %q, want %q", state, "state-1")
+	}
+	if code == "" {
+		t.Fatal("code is missing from the redirect")
+	}
+
+	identity, err := p.Exchange(context.Background(), code, verifier, nonce)
+	if err != nil {
+		t.Fatalf("exchange: %v", err)
+	}
+	if identity.Provider != "mock" {
+		t.Errorf("provider = %q, want %q", identity.Provider, "mock")
+	}
+	if identity.Subject == "" {
+		t.Error("subject is empty")
+	}
+}
+
+func TestCallbackNonceMismatch(t *testing.T) {
+	p := mockProvider(t)
+
+	verifier, err := NewVerifier()
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, _ := authorize(t, p, "state-2", "nonce-sent", verifier)
+
+	if _, err := p.Exchange(context.Background(), code, verifier, "nonce-other"); err == nil {
+		t.Fatal("exchange accepted an id token with another nonce")
+	}
+}
@@ -0,0 +1,117 @@
+package password
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"unicode"
+
+	"github.com/codepnw/ecommerce/config"
+)
+
+// PolicyError is returned when a password is rejected by the policy, the
+// message is safe to show to the user.
+type PolicyError struct {
+	Msg string
+}
+
+func (e *PolicyError) Error() string {
+	return e.Msg
+}
+
+type IPolicy interface {
+	Validate(password string, identities ...string) error
+}
+
+type policy struct {
+	cfg      config.IAuthConfig
+	breached map[string]struct{}
+}
+
+// NewPolicy loads the breached list once, one sha1 hex per line in the
+// "HASH" or "HASH:COUNT" format of the public breach corpora.
+func NewPolicy(cfg config.IAuthConfig) IPolicy {
+	p := &policy{
+		cfg:      cfg,
+		breached: make(map[string]struct{}),
+	}
+	if cfg.PasswordBreachedList() == "" {
+		return p
+	}
+
+	file, err := os.Open(cfg.PasswordBreachedList())
+	if err != nil {
+		log.Fatalf("load breached password list failed: %v", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		hash, _, _ := strings.Cut(line, ":")
+		p.breached[strings.ToUpper(hash)] = struct{}{}
+	}
+	if err := scanner.Err(); err != nil {
+		log.Fatalf("read breached password list failed: %v", err)
+	}
+	log.Printf("breached password list loaded: %d entries", len(p.breached))
+	return p
+}
+
+// Validate checks the password against the policy, identities are the
+// username and email of the account which must not be part of it.
+func (p *policy) Validate(password string, identities ...string) error {
+	if len([]rune(password)) < p.cfg.PasswordMinLength() {
+		return &PolicyError{Msg: fmt.Sprintf("password must be at least %d characters", p.cfg.PasswordMinLength())}
+	}
+
+	var upper, lower, digit, symbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsDigit(r):
+			digit = true
+		case unicode.IsPunct(r) || unicode.IsSymbol(r):
+			symbol = true
+		}
+	}
+	if p.cfg.PasswordRequireUpper() && !upper {
+		return &PolicyError{Msg: "password must contain an uppercase letter"}
+	}
+	if p.cfg.PasswordRequireLower() && !lower {
+		return &PolicyError{Msg: "password must contain a lowercase letter"}
+	}
+	if p.cfg.PasswordRequireDigit() && !digit {
+		return &PolicyError{Msg: "password must contain a digit"}
+	}
+	if p.cfg.PasswordRequireSymbol() && !symbol {
+		return &PolicyError{Msg: "password must contain a symbol"}
+	}
+
+	lowered := strings.ToLower(password)
+	for _, identity := range identities {
+		// The local part is what people reuse, not the domain
+		identity, _, _ = strings.Cut(strings.ToLower(strings.TrimSpace(identity)), "@")
+		if len(identity) >= 3 && strings.Contains(lowered, identity) {
+			return &PolicyError{Msg: "password must not contain your username or email"}
+		}
+	}
+
+	if len(p.breached) > 0 {
+		sum := sha1.Sum([]byte(password))
+		if _, ok := p.breached[strings.ToUpper(hex.EncodeToString(sum[:]))]; ok {
+			return &PolicyError{Msg: "password has appeared in a data breach"}
+		}
+	}
+	return nil
+}
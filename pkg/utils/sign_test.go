@@ -0,0 +1,46 @@
+package utils
+
+import (
+	"testing"
+	"time"
+)
+
+func TestVerifyPath(t *testing.T) {
+	key := []byte("file-sign-key")
+	path := "/v1/files/private/slips/a.png"
+	future := time.Now().Add(time.Minute).Unix()
+	past := time.Now().Add(-time.Minute).Unix()
+	signature := SignPath(key, path, future)
+
+	tampered := []byte(signature)
+	if tampered[0] == 'a' {
+		tampered[0] = 'b'
+	} else {
+		tampered[0] = 'a'
+	}
+
+	tests := []struct {
+		name      string
+		key       []byte
+		path      string
+		expires   int64
+		signature string
+		want      bool
+	}{
+		{"valid", key, path, future, signature, true},
+		{"expired", key, path, past, SignPath(key, path, past), false},
+		{"other path", key, "/v1/files/private/slips/b.png", future, signature, false},
+		{"extended expiry", key, path, future + 3600, signature, false},
+		{"other key", []byte("other-key"), path, future, signature, false},
+		{"tampered signature", key, path, future, string(tampered), false},
+		{"empty signature", key, path, future, "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := VerifyPath(tt.key, tt.path, tt.expires, tt.signature); got != tt.want {
+				t.Errorf("VerifyPath = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,110 @@
+package workers
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// ErrClosed is returned for every job handed to a pool after Close.
+var ErrClosed = errors.New("worker pool is closed")
+
+type Job func(ctx context.Context) error
+
+type IPool interface {
+	Run(ctx context.Context, jobs []Job) []error
+	Close()
+}
+
+type task struct {
+	ctx   context.Context
+	job   Job
+	index int
+	errs  []error
+	done  *sync.WaitGroup
+}
+
+type pool struct {
+	tasks     chan *task
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+	// mu keeps Close from closing tasks while Run is still sending on it
+	mu     sync.RWMutex
+	closed bool
+}
+
+// NewPool starts a fixed number of workers shared by every caller, so the
+// amount of concurrent storage work no longer grows with the request count.
+func NewPool(size int) IPool {
+	if size < 1 {
+		size = 1
+	}
+
+	p := &pool{
+		tasks: make(chan *task),
+	}
+	p.wg.Add(size)
+	for i := 0; i < size; i++ {
+		go p.worker()
+	}
+	return p
+}
+
+func (p *pool) worker() {
+	defer p.wg.Done()
+
+	for t := range p.tasks {
+		if err := t.ctx.Err(); err != nil {
+			t.errs[t.index] = err
+		} else {
+			t.errs[t.index] = t.job(t.ctx)
+		}
+		t.done.Done()
+	}
+}
+
+// Run blocks until every job has finished or been skipped because ctx was
+// cancelled. The returned errors are aligned with jobs, nil means success.
+// After Close every job fails with ErrClosed.
+func (p *pool) Run(ctx context.Context, jobs []Job) []error {
+	errs := make([]error, len(jobs))
+	done := new(sync.WaitGroup)
+
+	p.mu.RLock()
+	if p.closed {
+		p.mu.RUnlock()
+		for i := range errs {
+			errs[i] = ErrClosed
+		}
+		return errs
+	}
+
+	for i := range jobs {
+		done.Add(1)
+		select {
+		case p.tasks <- &task{ctx: ctx, job: jobs[i], index: i, errs: errs, done: done}:
+		case <-ctx.Done():
+			for j := i; j < len(jobs); j++ {
+				errs[j] = ctx.Err()
+			}
+			done.Done()
+			p.mu.RUnlock()
+			done.Wait()
+			return errs
+		}
+	}
+	p.mu.RUnlock()
+
+	done.Wait()
+	return errs
+}
+
+func (p *pool) Close() {
+	p.closeOnce.Do(func() {
+		p.mu.Lock()
+		p.closed = true
+		close(p.tasks)
+		p.mu.Unlock()
+		p.wg.Wait()
+	})
+}
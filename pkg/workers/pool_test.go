@@ -0,0 +1,89 @@
+package workers
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+)
+
+func TestRun(t *testing.T) {
+	failed := errors.New("job failed")
+
+	tests := []struct {
+		name string
+		jobs []Job
+		want []error
+	}{
+		{"no jobs", nil, []error{}},
+		{
+			"errors stay aligned with jobs",
+			[]Job{
+				func(ctx context.Context) error { return nil },
+				func(ctx context.Context) error { return failed },
+				func(ctx context.Context) error { return nil },
+			},
+			[]error{nil, failed, nil},
+		},
+	}
+
+	p := NewPool(2)
+	defer p.Close()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			errs := p.Run(context.Background(), tt.jobs)
+			if len(errs) != len(tt.want) {
+				t.Fatalf("len(errs) = %d, want %d", len(errs), len(tt.want))
+			}
+			for i := range errs {
+				if !errors.Is(errs[i], tt.want[i]) {
+					t.Errorf("errs[%d] = %v, want %v", i, errs[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestRunCancelled(t *testing.T) {
+	p := NewPool(1)
+	defer p.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	var ran int32
+	job := func(ctx context.Context) error {
+		atomic.AddInt32(&ran, 1)
+		return nil
+	}
+	for i, err := range p.Run(ctx, []Job{job, job, job}) {
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("errs[%d] = %v, want %v", i, err, context.Canceled)
+		}
+	}
+	if n := atomic.LoadInt32(&ran); n != 0 {
+		t.Errorf("%d jobs ran after the context was cancelled", n)
+	}
+}
+
+func TestRunAfterClose(t *testing.T) {
+	p := NewPool(2)
+	p.Close()
+	// A second Close must not panic on the closed channel
+	p.Close()
+
+	var ran int32
+	job := func(ctx context.Context) error {
+		atomic.AddInt32(&ran, 1)
+		return nil
+	}
+	for i, err := range p.Run(context.Background(), []Job{job, job}) {
+		if !errors.Is(err, ErrClosed) {
+			t.Errorf("errs[%d] = %v, want %v", i, err, ErrClosed)
+		}
+	}
+	if n := atomic.LoadInt32(&ran); n != 0 {
+		t.Errorf("%d jobs ran on a closed pool", n)
+	}
+}